@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_EVENT_RECEIVED = "received"
+	AUDIT_EVENT_STARTED  = "started"
+	AUDIT_EVENT_FINISHED = "finished"
+)
+
+/**
+Where the audit log is kept, e.g. `{"file": "audit.log"}` - a relative path is in the state directory
+*/
+type AuditConfig struct {
+	File string `json:"file"`
+}
+
+/**
+One line of the audit log. A task gets a line when it's received - with the statement or script it runs, and its
+config with secrets masked - when it starts, and when it finishes, with the outcome and how much was sent back.
+*/
+type AuditEntry struct {
+	Time       time.Time              `json:"time"`
+	Event      string                 `json:"event"`
+	TaskId     string                 `json:"task_id"`
+	Type       uint64                 `json:"type"`
+	Schedule   string                 `json:"schedule,omitempty"`
+	Statement  string                 `json:"statement,omitempty"`
+	Config     map[string]interface{} `json:"config,omitempty"`
+	StartedAt  *time.Time             `json:"started_at,omitempty"`
+	DurationMs *int64                 `json:"duration_ms,omitempty"`
+	Outcome    string                 `json:"outcome,omitempty"`
+	BytesSent  int64                  `json:"bytes_sent,omitempty"`
+}
+
+/**
+Check there's a file to write to
+*/
+func (a *AuditConfig) Validate() error {
+	if a.File == "" {
+		return errors.New("audit.file must be set, e.g. audit.log.")
+	}
+	return nil
+}
+
+var (
+	auditLock  sync.Mutex
+	auditFile  *os.File
+	auditTasks = map[string]*auditTask{} // tasks started and not yet finished
+)
+
+/**
+What's noted about a task between it starting and finishing
+*/
+type auditTask struct {
+	startedAt time.Time
+	uploaded  int64
+}
+
+/**
+Task types whose payload is the statement or script they run
+*/
+var auditStatementTypes = map[uint64]bool{
+	TASK_TYPE_DB_MYSQL_QUERY: true,
+	TASK_TYPE_DB_MYSQL_EXEC:  true,
+	TASK_TYPE_DB_MSSQL_QUERY: true,
+	TASK_TYPE_DB_MSSQL_EXEC:  true,
+	TASK_TYPE_WMI_QUERY:      true,
+	TASK_TYPE_POWERSHELL:     true,
+}
+
+/**
+Append a line to the audit log, if there is one. The file is only ever appended to, and synced after each line so
+the record survives a crash. A line that can't be written is logged instead.
+*/
+func writeAudit(entry AuditEntry) {
+	config := currentConfig()
+	if config.Audit == nil || config.Audit.File == "" {
+		return
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Audit log write failed", "error", err)
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile == nil {
+		path := config.Audit.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(stateDir(), path)
+		}
+		if auditFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			logger.Error("Audit log not opened", "path", path, "error", err)
+			return
+		}
+	}
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		logger.Error("Audit log write failed", "error", err)
+		return
+	}
+	auditFile.Sync()
+}
+
+/**
+Note a task that's been received, with what it will do
+*/
+func auditTaskReceived(task Task) {
+	entry := AuditEntry{Event: AUDIT_EVENT_RECEIVED, TaskId: task.Id, Type: task.Type, Schedule: task.schedule}
+	if auditStatementTypes[task.Type] {
+		entry.Statement = task.Payload
+	}
+	// The config can hold DSNs and passwords, which are masked as they are for `config show`
+	if len(task.RawConfig) > 0 && json.Unmarshal(task.RawConfig, &entry.Config) == nil {
+		redactConfigValues(entry.Config)
+	}
+	writeAudit(entry)
+}
+
+/**
+Note a task that's started running
+*/
+func auditTaskStarted(task Task) {
+	auditLock.Lock()
+	auditTasks[task.Id] = &auditTask{startedAt: time.Now()}
+	auditLock.Unlock()
+	writeAudit(AuditEntry{Event: AUDIT_EVENT_STARTED, TaskId: task.Id, Type: task.Type, Schedule: task.schedule})
+}
+
+/**
+Note bytes a task has uploaded, to count towards what it sent
+*/
+func auditTaskUploaded(task Task, bytes int64) {
+	auditLock.Lock()
+	if started, ok := auditTasks[task.Id]; ok {
+		started.uploaded += bytes
+	}
+	auditLock.Unlock()
+}
+
+/**
+Note a task's result, and how much it sent back in all
+*/
+func auditTaskFinished(task Task, response JsonResponse) {
+	auditLock.Lock()
+	started := auditTasks[task.Id]
+	delete(auditTasks, task.Id)
+	auditLock.Unlock()
+
+	entry := AuditEntry{Event: AUDIT_EVENT_FINISHED, TaskId: task.Id, Type: task.Type, Schedule: task.schedule, Outcome: response.Type}
+	if body, err := json.Marshal(response.Body); err == nil {
+		entry.BytesSent = int64(len(body))
+	}
+	if started != nil {
+		duration := time.Since(started.startedAt).Milliseconds()
+		entry.StartedAt = &started.startedAt
+		entry.DurationMs = &duration
+		entry.BytesSent += started.uploaded
+	}
+	writeAudit(entry)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+/**
+Parse a fetch response - either a single task or an array of them when the server sends a batch
+*/
+func parseTasks(data []byte) ([]Task, error) {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '[' {
+		var tasks []Task
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			return nil, err
+		}
+		if len(tasks) == 0 {
+			return nil, errNoTasks
+		}
+		logger.Info("Batch of tasks found", "count", len(tasks))
+		return tasks, nil
+	}
+
+	var task Task
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return []Task{task}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	CONTROL_CANCEL = "cancel"
+)
+
+// Cancel functions for the tasks being run, IDs of tasks waiting in the queue, and queued tasks the server cancelled
+var (
+	runningTasks     = map[string]context.CancelFunc{}
+	queuedTasks      = map[string]bool{}
+	cancelledTasks   = map[string]bool{}
+	runningTasksLock sync.Mutex
+)
+
+/**
+Note a task is waiting in the queue, so it can be cancelled before it starts
+*/
+func registerQueuedTask(id string) {
+	runningTasksLock.Lock()
+	defer runningTasksLock.Unlock()
+
+	queuedTasks[id] = true
+}
+
+/**
+Note a task is running so the server can cancel it. Returns false if the server already cancelled it while it was
+waiting in the queue.
+*/
+func registerRunningTask(id string, cancel context.CancelFunc) bool {
+	runningTasksLock.Lock()
+	defer runningTasksLock.Unlock()
+
+	delete(queuedTasks, id)
+	if cancelledTasks[id] {
+		delete(cancelledTasks, id)
+		return false
+	}
+	runningTasks[id] = cancel
+	return true
+}
+
+/**
+Forget a task once it's finished
+*/
+func unregisterRunningTask(id string) {
+	runningTasksLock.Lock()
+	defer runningTasksLock.Unlock()
+
+	delete(runningTasks, id)
+}
+
+/**
+Cancel a task by ID - if it's running its context is cancelled, killing its queries and commands, otherwise it's
+skipped when it reaches a worker. Returns whether the task was running.
+*/
+func cancelTask(id string) bool {
+	runningTasksLock.Lock()
+	defer runningTasksLock.Unlock()
+
+	if cancel, ok := runningTasks[id]; ok {
+		cancel()
+		return true
+	}
+	// Only remember IDs for tasks we're holding, so the set can't grow without limit
+	if queuedTasks[id] {
+		cancelledTasks[id] = true
+	}
+	if task, ok := cancelDeferredTask(id); ok {
+		go postStoppedResult(task, "cancelled", "Task was cancelled by the server before it started", nil)
+	}
+	if task, ok := cancelWaitingTask(id); ok {
+		go postStoppedResult(task, "cancelled", "Task was cancelled by the server before it started", nil)
+	}
+	return false
+}
+
+/**
+Cancel every running task, when shutting down
+*/
+func cancelAllTasks() {
+	runningTasksLock.Lock()
+	defer runningTasksLock.Unlock()
+
+	for _, cancel := range runningTasks {
+		cancel()
+	}
+}
+
+/**
+Act on a control message from the server, e.g. `{"control": "cancel", "task_id": "123"}`
+*/
+func handleControlMessage(message Task) {
+	switch message.Control {
+	case CONTROL_CANCEL:
+		logger.Info("Cancelling task", "task_id", message.TargetId)
+		if !cancelTask(message.TargetId) {
+			logger.Info("Task is not running - it will be skipped if it's still queued", "task_id", message.TargetId)
+		}
+	case CONTROL_PAUSE, CONTROL_RESUME:
+		if err := handlePauseControl(message); err != nil {
+			logger.Error("Pause failed", "error", err)
+		}
+	case CONTROL_SCHEDULE, CONTROL_UNSCHEDULE:
+		if err := handleScheduleControl(message); err != nil {
+			logger.Error("Schedule change failed", "error", err)
+		}
+	default:
+		logger.Warn("Unknown control message", "control", message.Control)
+	}
+}
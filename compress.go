@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	GZIP_MIN_SIZE = 1024
+)
+
+/**
+Gzip a request body
+*/
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+/**
+Compress a postback body if it's worth it and compression is on - returns the body to send and its Content-Encoding
+*/
+func compressPayload(payload []byte) ([]byte, string, error) {
+	if !currentConfig().CompressResults || len(payload) < GZIP_MIN_SIZE {
+		return payload, "", nil
+	}
+	compressed, err := gzipBytes(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return compressed, "gzip", nil
+}
+
+/**
+Read a response body, returning it both as sent (for signature checks) and decompressed
+*/
+func readResponseBody(resp *http.Response) ([]byte, []byte, error) {
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return raw, raw, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, decoded, nil
+}
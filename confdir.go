@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	CONFIG_DIR_NAME = "conf.d"
+)
+
+/**
+The drop-in directory next to the config file, whose files are merged over it
+*/
+func configDirPath() string {
+	return filepath.Join(filepath.Dir(configFilePath), CONFIG_DIR_NAME)
+}
+
+/**
+The config files in the drop-in directory, in the order they're merged - by name, so `10-proxy.yaml` comes before
+`20-site.json`. Hidden files and anything that isn't JSON, YAML or TOML are skipped, so editor backups are left alone.
+*/
+func configDirFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(configDirPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json", ".yaml", ".yml", ".toml":
+			files = append(files, filepath.Join(configDirPath(), name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/**
+Merge the drop-in files over the config, each over the ones before it. Settings within a section, and entries in
+maps such as `databases`, are merged one by one, while lists are replaced whole. The files are only ever read -
+changes the connector saves go to the main config file.
+*/
+func applyConfigDir(target *ConfigFile) error {
+	files, err := configDirFiles()
+	if err != nil {
+		return err
+	}
+
+	unknownKeys := target.unknownKeys
+	for _, file := range files {
+		data, err := readConfigFile(file)
+		if err != nil {
+			return err
+		}
+		if err := decodeConfig(data, configFormat(file), target); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for _, problem := range target.unknownKeys {
+			unknownKeys = append(unknownKeys, fmt.Sprintf("%s: %s", filepath.Base(file), problem))
+		}
+	}
+	target.unknownKeys = unknownKeys
+	return nil
+}
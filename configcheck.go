@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/**
+Every problem found with the config, so they can all be fixed in one go
+*/
+type ConfigProblems []string
+
+/**
+Note a problem, if there is one
+*/
+func (p *ConfigProblems) add(err error) {
+	if err != nil {
+		*p = append(*p, err.Error())
+	}
+}
+
+/**
+The problems as an error, or nil if there aren't any
+*/
+func (p ConfigProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p ConfigProblems) Error() string {
+	if len(p) == 1 {
+		return p[0]
+	}
+	return fmt.Sprintf("The config has %d problems:\n  - %s", len(p), strings.Join(p, "\n  - "))
+}
+
+/**
+API URLs must be https, so the key isn't sent in the clear - plain http is only allowed to this machine, e.g. for a
+local test server
+*/
+func checkConfigUrl(name string, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%s %q is not a valid URL - it should look like https://example.com/.", name, value)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if host := u.Hostname(); host == "localhost" || net.ParseIP(host).IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("%s %q must use https:// so the key isn't sent unencrypted.", name, value)
+	default:
+		return fmt.Errorf("%s %q must start with https://.", name, value)
+	}
+}
+
+/**
+Find settings in a decoded config file that don't match anything the connector knows, e.g. a misspelt
+`intervall` - those would otherwise be silently ignored. Each is explained by its path, like `http.connect_timout`,
+along with the setting that was probably meant.
+*/
+func unknownConfigKeys(values map[string]interface{}) []string {
+	var unknown []string
+	collectUnknownConfigKeys(values, reflect.TypeOf(ConfigFile{}), "", &unknown)
+	sort.Strings(unknown)
+	return unknown
+}
+
+/**
+Walk a decoded value alongside the type it's decoded into, noting keys the type has no field for
+*/
+func collectUnknownConfigKeys(value interface{}, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := configFields(t)
+		for key, child := range object {
+			fieldType, ok := fields[key]
+			if !ok {
+				// encoding/json matches names regardless of case
+				for name, candidate := range fields {
+					if strings.EqualFold(name, key) {
+						fieldType, ok = candidate, true
+						break
+					}
+				}
+			}
+			if !ok {
+				*unknown = append(*unknown, unknownConfigKeyProblem(joinConfigPath(path, key), closestConfigKey(key, fields)))
+				continue
+			}
+			collectUnknownConfigKeys(child, fieldType, joinConfigPath(path, key), unknown)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		elem := t.Elem()
+		// Profiles hold the same settings as the config itself
+		if path == "profiles" {
+			elem = reflect.TypeOf(ConfigFile{})
+		}
+		for key, child := range object {
+			collectUnknownConfigKeys(child, elem, joinConfigPath(path, key), unknown)
+		}
+	case reflect.Slice:
+		if t == reflect.TypeOf(json.RawMessage{}) {
+			return
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, child := range items {
+			collectUnknownConfigKeys(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i), unknown)
+		}
+	}
+}
+
+/**
+The JSON names of a struct's fields and their types, with embedded structs' fields included
+*/
+func configFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case tag == "-":
+		case field.Anonymous && tag == "":
+			for name, fieldType := range configFields(field.Type) {
+				fields[name] = fieldType
+			}
+		case field.PkgPath != "":
+			// unexported
+		case tag == "":
+			fields[field.Name] = field.Type
+		default:
+			fields[tag] = field.Type
+		}
+	}
+	return fields
+}
+
+func joinConfigPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+/**
+Explain an unknown setting, suggesting the setting that was probably meant if there is one
+*/
+func unknownConfigKeyProblem(path string, suggestion string) string {
+	if suggestion != "" {
+		return fmt.Sprintf("Unknown setting %q - did you mean %q?", path, suggestion)
+	}
+	return fmt.Sprintf("Unknown setting %q - check the spelling, or remove it.", path)
+}
+
+/**
+The known setting closest in spelling to an unknown one, if any is close enough to be a typo
+*/
+func closestConfigKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if distance := editDistance(strings.ToLower(key), name); distance < bestDistance || (distance == bestDistance && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+/**
+How many single character insertions, deletions or substitutions turn one string into another
+*/
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
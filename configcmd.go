@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Settings given on the command line, which win over everything else for this run
+var commandLineConfig = map[string]interface{}{}
+
+/**
+Lay the settings given on the command line over a config
+*/
+func applyCommandLine(target *ConfigFile) error {
+	if len(commandLineConfig) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(commandLineConfig)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+/**
+Fill in the URL and interval when nothing else has set them
+*/
+func applyConfigDefaults(target *ConfigFile) {
+	if len(target.Url) == 0 {
+		target.Url = UrlList{API_URL}
+	}
+	if target.Interval == 0 {
+		target.Interval = INTERVAL
+	}
+}
+
+/**
+Look at or change the config file from the command line, for `goproxy config show`,
+`goproxy config set <setting> <value>`, `goproxy config unset <setting>` and `goproxy config encrypt`/`decrypt`. Settings inside others are named with
+dots, e.g. `http.connect_timeout`. Values are JSON for anything but text, e.g.
+`goproxy config set allowed_dirs '["D:\\Exports"]'`.
+*/
+func runConfigCommand(args []string) error {
+	switch {
+	case args[0] == "show" && len(args) == 1:
+		loadConfiguration()
+		return showConfiguration()
+	case args[0] == "set" && len(args) == 3:
+		return setConfigSetting(args[1], &args[2])
+	case args[0] == "unset" && len(args) == 2:
+		return setConfigSetting(args[1], nil)
+	case args[0] == "encrypt" && len(args) == 1:
+		return encryptConfigFile(true)
+	case args[0] == "decrypt" && len(args) == 1:
+		return encryptConfigFile(false)
+	}
+	return errors.New("Use goproxy config show, goproxy config set <setting> <value>, goproxy config unset <setting>, or goproxy config encrypt/decrypt.")
+}
+
+/**
+Set a setting in the config file, or remove it if `raw` is nil, leaving everything else as it is
+*/
+func setConfigSetting(path string, raw *string) error {
+	parts := strings.Split(path, ".")
+	settingType, err := configSettingType(parts)
+	if err != nil {
+		return err
+	}
+
+	data, err := readConfigFile(configFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	format := configFormat(configFilePath)
+	values, err := decodeConfigValues(data, format)
+	if err != nil {
+		return err
+	}
+	// The rest of the config decides how the value is written, e.g. whether the key is protected
+	if err := decodeConfig(data, format, &config); err != nil && len(data) > 0 {
+		return err
+	}
+
+	var value interface{}
+	if raw != nil {
+		if value, err = parseConfigValue(path, *raw, settingType); err != nil {
+			return err
+		}
+	}
+
+	// Settings inside others are changed in place, and the top level setting they're in written back
+	if len(parts) > 1 {
+		parent := values
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				if raw == nil {
+					return nil
+				}
+				child = map[string]interface{}{}
+				parent[part] = child
+			}
+			parent = child
+		}
+		if raw == nil {
+			delete(parent, parts[len(parts)-1])
+		} else {
+			parent[parts[len(parts)-1]] = value
+		}
+		value = values[parts[0]]
+	}
+
+	if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+			return err
+		}
+	}
+	if err := updateConfigFile(map[string]interface{}{parts[0]: value}); err != nil {
+		return err
+	}
+	if raw == nil {
+		fmt.Printf("Removed %s from %s\n", path, configFilePath)
+	} else {
+		fmt.Printf("Set %s in %s\n", path, configFilePath)
+	}
+	return nil
+}
+
+/**
+The type of a setting, named by its path - an error suggesting the setting that was probably meant if there's no
+such setting
+*/
+func configSettingType(parts []string) (reflect.Type, error) {
+	t := reflect.TypeOf(ConfigFile{})
+	for i, part := range parts {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		path := strings.Join(parts[:i+1], ".")
+		switch {
+		case t.Kind() == reflect.Struct:
+			fields := configFields(t)
+			fieldType, ok := fields[part]
+			if !ok {
+				return nil, errors.New(unknownConfigKeyProblem(path, closestConfigKey(part, fields)))
+			}
+			t = fieldType
+		case t.Kind() == reflect.Map && i == 1 && parts[0] == "profiles":
+			// Profiles hold the same settings as the config itself
+			t = reflect.TypeOf(ConfigFile{})
+		case t.Kind() == reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("%s has no settings inside it.", strings.Join(parts[:i], "."))
+		}
+	}
+	return t, nil
+}
+
+/**
+Turn a value from the command line into the setting's type - text is taken as it is, anything else must be JSON
+*/
+func parseConfigValue(path string, raw string, settingType reflect.Type) (interface{}, error) {
+	for settingType.Kind() == reflect.Ptr {
+		settingType = settingType.Elem()
+	}
+	if settingType.Kind() == reflect.String {
+		return raw, nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal([]byte(raw), &value)
+	// A single URL is fine where a list is expected
+	if err != nil && settingType == reflect.TypeOf(UrlList{}) {
+		return raw, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s needs a JSON value, e.g. a number, true or [\"a\", \"b\"]: %v", path, err)
+	}
+	if err := json.Unmarshal([]byte(raw), reflect.New(settingType).Interface()); err != nil {
+		return nil, fmt.Errorf("%q isn't a valid %s: %v", raw, path, err)
+	}
+	return value, nil
+}
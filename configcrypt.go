@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CONFIG_ENCRYPTED_HEADER      = "GOPROXY-ENCRYPTED-CONFIG v1\n"
+	CONFIG_PASSPHRASE_ENV        = ENV_CONFIG_PATH + "_PASSPHRASE"
+	CONFIG_PASSPHRASE_FILE_ENV   = ENV_CONFIG_PATH + "_PASSPHRASE_FILE"
+	CONFIG_PASSPHRASE_CREDENTIAL = "goproxy-passphrase"
+	CONFIG_SALT_SIZE             = 16
+	CONFIG_SCRYPT_N              = 1 << 15
+	CONFIG_SCRYPT_R              = 8
+	CONFIG_SCRYPT_P              = 1
+)
+
+/**
+Is this config file encrypted with a passphrase?
+*/
+func isEncryptedConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(CONFIG_ENCRYPTED_HEADER))
+}
+
+/**
+The passphrase for an encrypted config - from `GOPROXY_CONFIG_PASSPHRASE`, a file named by
+`GOPROXY_CONFIG_PASSPHRASE_FILE`, or a systemd credential called `goproxy-passphrase`. A trailing newline in a file
+is ignored.
+*/
+func configPassphrase() (string, error) {
+	if passphrase := os.Getenv(CONFIG_PASSPHRASE_ENV); passphrase != "" {
+		return passphrase, nil
+	}
+	path := os.Getenv(CONFIG_PASSPHRASE_FILE_ENV)
+	if path == "" && os.Getenv("CREDENTIALS_DIRECTORY") != "" {
+		path = filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), CONFIG_PASSPHRASE_CREDENTIAL)
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+	if path == "" {
+		return "", fmt.Errorf("The config file is encrypted - set the passphrase in %s or %s.", CONFIG_PASSPHRASE_ENV, CONFIG_PASSPHRASE_FILE_ENV)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Reading the config passphrase: %v", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("The config passphrase in %s is empty.", path)
+	}
+	return passphrase, nil
+}
+
+/**
+AES-256-GCM with a key derived from the passphrase and salt by scrypt, so guessing passphrases is slow
+*/
+func configCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, CONFIG_SCRYPT_N, CONFIG_SCRYPT_R, CONFIG_SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/**
+Encrypt a whole config file with the passphrase. The file is a header line, then the salt, nonce and sealed config in
+base64 - it keeps its extension, and the config inside stays in that format.
+*/
+func encryptConfigData(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, CONFIG_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := configCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(append(salt, nonce...), aead.Seal(nil, nonce, data, []byte(CONFIG_ENCRYPTED_HEADER))...)
+	return []byte(CONFIG_ENCRYPTED_HEADER + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+/**
+The config in a file as it was before it was encrypted - files that aren't encrypted are returned as they are
+*/
+func decryptConfigData(data []byte) ([]byte, error) {
+	if !isEncryptedConfig(data) {
+		return data, nil
+	}
+	passphrase, err := configPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data[len(CONFIG_ENCRYPTED_HEADER):])))
+	if err != nil || len(sealed) < CONFIG_SALT_SIZE {
+		return nil, errors.New("The encrypted config file is corrupt.")
+	}
+	aead, err := configCipher(passphrase, sealed[:CONFIG_SALT_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[CONFIG_SALT_SIZE:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("The encrypted config file is corrupt.")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(CONFIG_ENCRYPTED_HEADER))
+	if err != nil {
+		return nil, errors.New("The config file could not be decrypted - the passphrase is wrong, or the file is corrupt.")
+	}
+	return plain, nil
+}
+
+/**
+Read a config file, decrypting it if it's encrypted
+*/
+func readConfigFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decryptConfigData(data)
+}
+
+/**
+Encrypt the config file in place with the passphrase, for `goproxy config encrypt`, or decrypt it back to plain text
+for `goproxy config decrypt`. The connector keeps an encrypted file encrypted when it saves settings to it.
+*/
+func encryptConfigFile(encrypt bool) error {
+	data, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return err
+	}
+	if isEncryptedConfig(data) == encrypt {
+		if encrypt {
+			return fmt.Errorf("%s is already encrypted.", configFilePath)
+		}
+		return fmt.Errorf("%s isn't encrypted.", configFilePath)
+	}
+
+	if encrypt {
+		passphrase, err := configPassphrase()
+		if err != nil {
+			return errors.New("Set the passphrase to encrypt the config with in " + CONFIG_PASSPHRASE_ENV + " or " + CONFIG_PASSPHRASE_FILE_ENV + ".")
+		}
+		// Make sure it's a config before locking it away
+		if _, err := decodeConfigValues(data, configFormat(configFilePath)); err != nil {
+			return err
+		}
+		data, err = encryptConfigData(data, passphrase)
+	} else {
+		data, err = decryptConfigData(data)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(data); err != nil {
+		return err
+	}
+
+	if encrypt {
+		fmt.Printf("Encrypted %s - the connector now needs the passphrase to start\n", configFilePath)
+	} else {
+		fmt.Printf("Decrypted %s\n", configFilePath)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CONFIG_FORMAT_JSON = "json"
+	CONFIG_FORMAT_YAML = "yaml"
+	CONFIG_FORMAT_TOML = "toml"
+)
+
+/**
+The format of a config file, from its extension - JSON unless it's `.yaml`, `.yml` or `.toml`
+*/
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return CONFIG_FORMAT_YAML
+	case ".toml":
+		return CONFIG_FORMAT_TOML
+	}
+	return CONFIG_FORMAT_JSON
+}
+
+/**
+Read config of any format into plain values, with the same names as the JSON config
+*/
+func decodeConfigValues(data []byte, format string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	var err error
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		err = yaml.Unmarshal(data, &values)
+	case CONFIG_FORMAT_TOML:
+		err = toml.Unmarshal(data, &values)
+	default:
+		if len(bytes.TrimSpace(data)) > 0 {
+			err = json.Unmarshal(data, &values)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s config: %v", format, err)
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+/**
+Read config of any format into the config struct. YAML and TOML are converted to JSON on the way, so every format
+uses the JSON names and parsing. Settings that match nothing are noted for `Validate` to report.
+*/
+func decodeConfig(data []byte, format string, target *ConfigFile) error {
+	values, err := decodeConfigValues(data, format)
+	if err != nil {
+		return err
+	}
+	if format != CONFIG_FORMAT_JSON {
+		if data, err = json.Marshal(values); err != nil {
+			return err
+		}
+		// Back to plain JSON values - TOML arrays of tables don't decode to []interface{}
+		values = nil
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+	}
+	target.unknownKeys = unknownConfigKeys(values)
+	return json.Unmarshal(data, target)
+}
+
+/**
+Write plain config values out in the given format
+*/
+func encodeConfigValues(values map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		return yaml.Marshal(values)
+	case CONFIG_FORMAT_TOML:
+		var buffer bytes.Buffer
+		err := toml.NewEncoder(&buffer).Encode(values)
+		return buffer.Bytes(), err
+	}
+	return json.MarshalIndent(values, "", "    ")
+}
+
+/**
+Turn a value into plain maps, slices and scalars by way of its JSON encoding, so it's written with its JSON names
+whatever the config format
+*/
+func plainConfigValue(value interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var plain interface{}
+	err = json.Unmarshal(encoded, &plain)
+	return plain, err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	CONFIG_FILE_NAME = "conf.json"
+)
+
+/**
+Find the config file: the `-config` flag or `GOPROXY_CONFIG` if given, otherwise `conf.json` next to the executable
+if there is one (where it was always kept before), otherwise the platform default - ProgramData on Windows, /etc
+elsewhere
+*/
+func findConfigFile(flagPath string) string {
+	if flagPath == "" {
+		flagPath = os.Getenv(ENV_CONFIG_PATH)
+	}
+	if flagPath != "" {
+		if absolute, err := filepath.Abs(flagPath); err == nil {
+			return absolute
+		}
+		return flagPath
+	}
+
+	if executable, err := os.Executable(); err == nil {
+		beside := filepath.Join(filepath.Dir(executable), CONFIG_FILE_NAME)
+		if _, err := os.Stat(beside); err == nil {
+			return beside
+		}
+	}
+
+	return filepath.Join(defaultConfigDir(), CONFIG_FILE_NAME)
+}
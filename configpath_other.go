@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+/**
+Where the config lives when it isn't given with `-config`
+*/
+func defaultConfigDir() string {
+	return "/etc/goproxy"
+}
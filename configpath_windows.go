@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/**
+Where the config lives when it isn't given with `-config` - under ProgramData, so it's shared by the service and
+admins rather than tied to one user
+*/
+func defaultConfigDir() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		programData = `C:\ProgramData`
+	}
+	return filepath.Join(programData, "Digistorm", "Connector")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	REGISTRY_CONFIG_KEY = `Software\Digistorm\Connector`
+)
+
+/**
+Lay settings from the registry over the config, so sites that manage machines with Group Policy can push them
+there. Each value is named after a setting, and each subkey is a section - `Proxy\url` is `proxy.url`. Text values
+are read like `goproxy config set` reads them, so a REG_SZ holding `10` works for `interval`, and DWORDs work for
+numbers and true/false. Lists can be REG_MULTI_SZ. Anything not in the registry comes from the config file as usual.
+*/
+func applyRegistryConfig(target *ConfigFile) error {
+	values, err := readRegistryConfig()
+	if err != nil || values == nil {
+		return err
+	}
+
+	for name, value := range values {
+		if values[name], err = registryConfigValue([]string{name}, value); err != nil {
+			return fmt.Errorf("Registry config: %v", err)
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	for _, problem := range unknownConfigKeys(values) {
+		target.unknownKeys = append(target.unknownKeys, "registry: "+problem)
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("Registry config: %v", err)
+	}
+	return nil
+}
+
+/**
+Are there settings in the registry?
+*/
+func hasRegistryConfig() bool {
+	values, err := readRegistryConfig()
+	return err == nil && values != nil
+}
+
+/**
+Convert a value read from the registry to what the setting at its path expects. Settings the connector doesn't know
+are left as they are, to be reported as unknown.
+*/
+func registryConfigValue(parts []string, value interface{}) (interface{}, error) {
+	settingType, err := configSettingType(parts)
+	if err != nil {
+		return value, nil
+	}
+	for settingType.Kind() == reflect.Ptr {
+		settingType = settingType.Elem()
+	}
+	path := strings.Join(parts, ".")
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if v[name], err = registryConfigValue(append(parts[:len(parts):len(parts)], name), child); err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		return parseConfigValue(path, v, settingType)
+	case uint64:
+		if settingType.Kind() == reflect.Bool {
+			return v != 0, nil
+		}
+	case []string:
+		if settingType.Kind() != reflect.Slice || settingType.Elem().Kind() == reflect.String {
+			return v, nil
+		}
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			if items[i], err = parseConfigValue(path, item, settingType.Elem()); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+/**
+The registry only exists on Windows, so there are never settings in it
+*/
+func readRegistryConfig() (map[string]interface{}, error) {
+	return nil, nil
+}
+
+/**
+Nothing to watch outside Windows
+*/
+func watchRegistryConfig() {}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"time"
+)
+
+/**
+Read the settings under the connector's registry key, or nil if there's no key. The 64-bit view is read even from a
+32-bit build, so settings pushed by Group Policy are found either way.
+*/
+func readRegistryConfig() (map[string]interface{}, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, REGISTRY_CONFIG_KEY, registry.READ|registry.WOW64_64KEY)
+	if err == registry.ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`Registry config HKLM\%s: %v`, REGISTRY_CONFIG_KEY, err)
+	}
+	defer key.Close()
+	return readRegistryConfigKey(key, `HKLM\`+REGISTRY_CONFIG_KEY)
+}
+
+/**
+Read the values in a key, and its subkeys as sections
+*/
+func readRegistryConfigKey(key registry.Key, path string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	names, err := key.ReadValueNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("Registry config %s: %v", path, err)
+	}
+	for _, name := range names {
+		_, valueType, err := key.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf(`Registry config %s\%s: %v`, path, name, err)
+		}
+		switch valueType {
+		case registry.SZ, registry.EXPAND_SZ:
+			var value string
+			value, _, err = key.GetStringValue(name)
+			if err == nil && valueType == registry.EXPAND_SZ {
+				value, err = registry.ExpandString(value)
+			}
+			values[name] = value
+		case registry.DWORD, registry.QWORD:
+			values[name], _, err = key.GetIntegerValue(name)
+		case registry.MULTI_SZ:
+			values[name], _, err = key.GetStringsValue(name)
+		default:
+			err = fmt.Errorf("use a string, DWORD, QWORD or multi-string value")
+		}
+		if err != nil {
+			return nil, fmt.Errorf(`Registry config %s\%s: %v`, path, name, err)
+		}
+	}
+
+	subkeys, err := key.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("Registry config %s: %v", path, err)
+	}
+	for _, name := range subkeys {
+		subkey, err := registry.OpenKey(key, name, registry.READ|registry.WOW64_64KEY)
+		if err != nil {
+			return nil, fmt.Errorf(`Registry config %s\%s: %v`, path, name, err)
+		}
+		values[name], err = readRegistryConfigKey(subkey, path+`\`+name)
+		subkey.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+/**
+Reload the config whenever the connector's registry key or anything under it changes, as Group Policy refreshes it.
+A key created after startup isn't watched until a restart.
+*/
+func watchRegistryConfig() {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, REGISTRY_CONFIG_KEY, registry.NOTIFY|registry.WOW64_64KEY)
+	if err == registry.ErrNotExist {
+		return
+	} else if err != nil {
+		logger.Error("Registry config watcher not started", "error", err)
+		return
+	}
+	defer key.Close()
+
+	for {
+		// Blocks until something changes - the watch has to be asked for again each time
+		filter := uint32(windows.REG_NOTIFY_CHANGE_NAME | windows.REG_NOTIFY_CHANGE_LAST_SET)
+		if err := windows.RegNotifyChangeKeyValue(windows.Handle(key), true, filter, 0, false); err != nil {
+			logger.Error("Registry config watcher failed", "error", err)
+			return
+		}
+		// Group Policy writes values one at a time, so let it finish
+		time.Sleep(CONFIG_RELOAD_SETTLE)
+		reloadConfigurationAndLog()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+/**
+What the connector was doing when it panicked, sent to the `crash_report` endpoint so the bug can be fixed without
+asking for logs. `where` is `task`, `worker`, `poll` or `result`.
+*/
+type CrashReport struct {
+	TaskId    string    `json:"task_id,omitempty"`
+	Type      uint64    `json:"type,omitempty"`
+	Where     string    `json:"where"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	Version   string    `json:"version"`
+	Os        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	CrashedAt time.Time `json:"crashed_at"`
+}
+
+/**
+Recover from a panic in a goroutine the connector can carry on without, e.g. `defer recoverPanic("poll")`. The
+crash is logged and reported, and the goroutine ends as if it had returned.
+*/
+func recoverPanic(where string) {
+	if r := recover(); r != nil {
+		handleCrash(where, nil, r)
+	}
+}
+
+/**
+Recover from a panic while running a task - as `recoverPanic`, and the task gets an error result unless it already
+has one
+*/
+func recoverTaskPanic(task Task) {
+	if r := recover(); r != nil {
+		handleCrash("task", &task, r)
+		if task.responded != nil && atomic.LoadInt32(task.responded) != 0 {
+			return
+		}
+		postJsonResponse(task, JsonResponse{
+			Type: "error",
+			Body: map[string]interface{}{"message": fmt.Sprintf("The connector crashed running the task: %v", r)},
+		})
+	}
+}
+
+/**
+Log a recovered panic with its stack, and report it to Sentry and the `crash_report` endpoint
+*/
+func handleCrash(where string, task *Task, r interface{}) {
+	stack := string(debug.Stack())
+	report := CrashReport{
+		Where:     where,
+		Panic:     fmt.Sprint(r),
+		Stack:     stack,
+		Version:   version,
+		Os:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		CrashedAt: time.Now(),
+	}
+	crashLogger := logger
+	if task != nil {
+		report.TaskId = task.Id
+		report.Type = task.Type
+		crashLogger = taskLogger(*task)
+	}
+	crashLogger.Error("Recovered from a crash", "event_id", EVENT_CRASHED, "where", where, "panic", report.Panic, "stack", stack)
+	crashesTotal.add(1, where)
+
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	captureError(err, "error", 3, map[string]interface{}{"where": where, "stack": stack})
+
+	go func() {
+		if err := sendCrashReport(report); err != nil {
+			logger.Warn("Crash report failed", "error", err)
+		}
+	}()
+}
+
+/**
+POST a crash report to the `crash_report` endpoint
+*/
+func sendCrashReport(report CrashReport) error {
+	payload, err := json.Marshal(JsonResponse{TaskId: report.TaskId, Type: "crash_report", Body: report})
+	if err != nil {
+		return err
+	}
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	task := Task{Id: report.TaskId, Type: report.Type}
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		crashReportUrl, err := apiEndpoint(ENDPOINT_CRASH_REPORT, task)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", crashReportUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, payload); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Crash report failed: %s", resp.Status)
+	}
+	return verifyResponse(req, resp, body)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+A database set up on this connector, so the server can name it with `dsn_alias` instead of sending its credentials
+e.g. `"databases": {"mis_primary": {"type": "mysql", "dsn": "reader:secret@tcp(db:3306)/mis"}}`. With `protect_dsns`
+the DSN is moved to `dsn_protected` on startup - encrypted with DPAPI on Windows, or kept in the system keyring elsewhere.
+*/
+type DatabaseConfig struct {
+	Type         string `json:"type"`
+	Dsn          string `json:"dsn,omitempty"`
+	DsnProtected string `json:"dsn_protected,omitempty"` // the protected DSN, set by the connector
+}
+
+/**
+Check a database has a type the connector can connect to, and a DSN
+*/
+func (d *DatabaseConfig) Validate(alias string) error {
+	if d.Type != "mysql" && d.Type != "mssql" {
+		return fmt.Errorf("databases.%s.type must be mysql or mssql, not %q.", alias, d.Type)
+	}
+	if d.Dsn == "" && d.DsnProtected == "" {
+		return fmt.Errorf("databases.%s needs a dsn.", alias)
+	}
+	return nil
+}
+
+/**
+Fill in the DSN, and the type if it isn't given, for a task that names a database by `dsn_alias`. With
+`require_dsn_alias` on, tasks that send a DSN of their own are refused.
+*/
+func (c *DBTaskConfig) resolveAlias() error {
+	config := currentConfig()
+	if c.Alias == "" {
+		if config.RequireDsnAlias && c.Dsn != "" {
+			return errors.New("This connector only accepts databases by dsn_alias - set the database up in its config.")
+		}
+		return nil
+	}
+	if c.Dsn != "" {
+		return errors.New("Send either a dsn or a dsn_alias, not both.")
+	}
+
+	database, ok := config.Databases[c.Alias]
+	if !ok {
+		return fmt.Errorf("There's no database %q set up on this connector.", c.Alias)
+	}
+	if c.Type != "" && c.Type != database.Type {
+		return fmt.Errorf("Database %q is %s, not %s.", c.Alias, database.Type, c.Type)
+	}
+	c.Type = database.Type
+	c.Dsn = database.Dsn
+	return nil
+}
+
+/**
+The keyring account a database's DSN is kept under
+*/
+func databaseKeyringAccount(alias string) string {
+	return configFilePath + "#databases." + alias
+}
+
+/**
+Protect any DSNs that are still in the config file as they are, noting the change to write back. A DSN that can't be
+protected - e.g. no keyring on a headless Linux server - stays as it is, with a warning.
+*/
+func protectDatabaseDsns(changes map[string]interface{}) {
+	protected := map[string]DatabaseConfig{}
+	changed := false
+	for alias, database := range currentConfig().Databases {
+		if database.Dsn != "" && !isSecretReference(database.Dsn) {
+			value, err := protectSecret(databaseKeyringAccount(alias), database.Dsn)
+			if err != nil {
+				logger.Warn("Couldn't protect the DSN, so it stays in the config file", "dsn_alias", alias, "error", err)
+			} else {
+				database.Dsn = ""
+				database.DsnProtected = value
+				changed = true
+			}
+		}
+		protected[alias] = database
+	}
+	if changed {
+		changes["databases"] = protected
+	}
+}
+
+/**
+Recover the protected DSNs in a config
+*/
+func unprotectDatabaseDsns(target *ConfigFile) error {
+	for alias, database := range target.Databases {
+		if database.Dsn != "" || database.DsnProtected == "" {
+			continue
+		}
+		dsn, err := unprotectSecret(database.DsnProtected)
+		if err != nil {
+			return fmt.Errorf("Database %s: %v", alias, err)
+		}
+		database.Dsn = dsn
+		target.Databases[alias] = database
+	}
+	return nil
+}
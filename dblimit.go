@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Slots for open database connections, shared by every task, and the tasks holding one - by their context
+var (
+	dbConnectionSlots     chan struct{}
+	dbConnectionSlotsOnce sync.Once
+	dbConnectionHolders   = map[context.Context]bool{}
+	dbConnectionLock      sync.Mutex
+)
+
+/**
+Wait for a free database connection slot when `max_db_connections` is set, so a small database server's connection
+limit can't be exhausted by the connector. A task holds its slot until it finishes, however many times it connects
+in between - each task only has one connection open at a time.
+*/
+func acquireDbConnection(task Task) error {
+	config := currentConfig()
+	if config.MaxDbConnections <= 0 {
+		return nil
+	}
+	dbConnectionSlotsOnce.Do(func() {
+		dbConnectionSlots = make(chan struct{}, config.MaxDbConnections)
+	})
+
+	ctx := task.Context()
+	dbConnectionLock.Lock()
+	held := dbConnectionHolders[ctx]
+	dbConnectionLock.Unlock()
+	if held {
+		return nil
+	}
+
+	select {
+	case dbConnectionSlots <- struct{}{}:
+	default:
+		taskLogger(task).Warn("All database connections are in use - waiting for one", "max_db_connections", config.MaxDbConnections)
+		select {
+		case dbConnectionSlots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	dbConnectionLock.Lock()
+	dbConnectionHolders[ctx] = true
+	dbConnectionLock.Unlock()
+
+	// The task's context is cancelled once it has finished
+	go func() {
+		<-ctx.Done()
+		dbConnectionLock.Lock()
+		delete(dbConnectionHolders, ctx)
+		dbConnectionLock.Unlock()
+		<-dbConnectionSlots
+	}()
+	return nil
+}
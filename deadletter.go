@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DEAD_LETTERS_KEPT = 500
+)
+
+/**
+One failed run of a task
+*/
+type TaskFailure struct {
+	Attempt  int       `json:"attempt"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+/**
+A task that failed for good, with every error it hit along the way
+*/
+type DeadLetter struct {
+	TaskId   string        `json:"task_id"`
+	Task     Task          `json:"task"`
+	Failures []TaskFailure `json:"failures"`
+	FailedAt time.Time     `json:"failed_at"`
+	Reported bool          `json:"reported"`
+}
+
+/**
+Note a failed run of a task in its history
+*/
+func recordTaskFailure(task *Task, err error) {
+	task.Failures = append(task.Failures, TaskFailure{Attempt: task.Attempt + 1, Error: err.Error(), FailedAt: time.Now()})
+}
+
+/**
+Key for a dead letter - by time first, so they're kept in the order they failed
+*/
+func deadLetterKey(deadLetter DeadLetter) []byte {
+	return []byte(deadLetter.FailedAt.UTC().Format(time.RFC3339Nano) + " " + deadLetter.TaskId)
+}
+
+/**
+Write a dead letter to the task store, dropping the oldest once there are more than `DEAD_LETTERS_KEPT`
+*/
+func saveDeadLetter(deadLetter DeadLetter) error {
+	db := getTaskStore()
+	if db == nil {
+		return nil
+	}
+	data, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(taskStoreDeadLettersBucket)
+		if err := bucket.Put(deadLetterKey(deadLetter), data); err != nil {
+			return err
+		}
+
+		var keys [][]byte
+		bucket.ForEach(func(key, value []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			return nil
+		})
+		for len(keys) > DEAD_LETTERS_KEPT {
+			if err := bucket.Delete(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+}
+
+/**
+Record a task that failed for good in the dead-letter store and report it to the `dead_letter` endpoint, so
+failures can be audited later rather than only showing up in a single error result
+*/
+func deadLetterTask(task Task, err error) {
+	recordTaskFailure(&task, err)
+	deadLetter := DeadLetter{TaskId: task.Id, Task: task, Failures: task.Failures, FailedAt: time.Now()}
+	deadLetter.Task.Failures = nil
+
+	if err := saveDeadLetter(deadLetter); err != nil {
+		logger.Error("Dead letter failed", "error", err)
+	}
+	go reportDeadLetter(deadLetter)
+}
+
+/**
+POST a dead letter to the API, and mark it reported in the store once it's through
+*/
+func reportDeadLetter(deadLetter DeadLetter) {
+	if err := sendDeadLetter(deadLetter); err != nil {
+		logger.Error("Dead letter failed", "error", err)
+		return
+	}
+	deadLetter.Reported = true
+	if err := saveDeadLetter(deadLetter); err != nil {
+		logger.Error("Dead letter failed", "error", err)
+	}
+}
+
+/**
+POST a dead letter to the `dead_letter` endpoint
+*/
+func sendDeadLetter(deadLetter DeadLetter) error {
+	payload, err := json.Marshal(JsonResponse{TaskId: deadLetter.TaskId, Type: "dead_letter", Body: deadLetter})
+	if err != nil {
+		return err
+	}
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		deadLetterUrl, err := apiEndpoint(ENDPOINT_DEAD_LETTER, deadLetter.Task)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", deadLetterUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, payload); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Dead letter report failed: %s", resp.Status)
+	}
+	return verifyResponse(req, resp, body)
+}
+
+/**
+Report any dead letters that didn't get through before the connector last stopped
+*/
+func reportStoredDeadLetters() {
+	db := getTaskStore()
+	if db == nil {
+		return
+	}
+
+	var unreported []DeadLetter
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(taskStoreDeadLettersBucket).ForEach(func(key, value []byte) error {
+			var deadLetter DeadLetter
+			if err := json.Unmarshal(value, &deadLetter); err != nil {
+				return err
+			}
+			if !deadLetter.Reported {
+				unreported = append(unreported, deadLetter)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		logger.Error("Dead letter failed", "error", err)
+		return
+	}
+
+	for _, deadLetter := range unreported {
+		reportDeadLetter(deadLetter)
+	}
+}
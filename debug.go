@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DEBUG_DUMP_MAX_BODY = 64 * 1024 // bytes of a body shown in a dump - the rest is left off
+)
+
+/**
+Dumps for support sessions, e.g. `{"dump": true, "redact_columns": ["dob", "medicare_number"]}`. With `dump`, every
+request to the API and its response is logged in full, along with each task's payload - with credentials, keys and
+the values of `redact_columns` masked.
+*/
+type DebugConfig struct {
+	Dump          bool     `json:"dump,omitempty"`
+	RedactColumns []string `json:"redact_columns,omitempty"` // result columns holding personal information, matched ignoring case
+}
+
+var debugFlag bool // `-debug` - log at debug level, with dumps of what goes over the wire
+
+// Headers that carry credentials, masked in dumps
+var redactedHeaders = map[string]bool{
+	"Authorization":          true,
+	"Proxy-Authorization":    true,
+	"Cookie":                 true,
+	"Set-Cookie":             true,
+	"X-Digistorm-Key":        true,
+	"X-Rotate-Key":           true,
+	"X-Rotate-Key-Signature": true,
+}
+
+/**
+Are requests, responses and task payloads being dumped?
+*/
+func isDebugDump() bool {
+	config := currentConfig()
+	return debugFlag || (config.Debug != nil && config.Debug.Dump)
+}
+
+/**
+Mask credentials, secrets and personal information in a decoded JSON value, in place - config settings that hold
+secrets as `goproxy config show` masks them, and any field named in `debug.redact_columns`
+*/
+func redactDumpValue(value interface{}) {
+	config := currentConfig()
+	columns := map[string]bool{}
+	if config.Debug != nil {
+		for _, column := range config.Debug.RedactColumns {
+			columns[strings.ToLower(column)] = true
+		}
+	}
+	var redact func(value interface{})
+	redact = func(value interface{}) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for name, child := range value {
+				if columns[strings.ToLower(name)] && child != nil {
+					value[name] = CONFIG_REDACTED
+				}
+			}
+			redactConfigValues(value)
+			for _, child := range value {
+				redact(child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				redact(child)
+			}
+		}
+	}
+	redact(value)
+}
+
+/**
+A body as it's shown in a dump - JSON with its secrets masked, or the text as it is, cut short if it's long. Gzipped
+bodies are unzipped first.
+*/
+func dumpBody(body []byte, encoding string) string {
+	if encoding == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Sprintf("(%d bytes of gzip that can't be read)", len(body))
+		}
+		// A body that was cut short still shows what there is of it
+		decoded, err := ioutil.ReadAll(io.LimitReader(reader, DEBUG_DUMP_MAX_BODY))
+		if err != nil && len(decoded) == 0 {
+			return fmt.Sprintf("(%d bytes of gzip that can't be read)", len(body))
+		}
+		body = decoded
+	}
+	var value interface{}
+	if json.Unmarshal(body, &value) == nil {
+		body = redactedJson(value)
+	}
+	if len(body) > DEBUG_DUMP_MAX_BODY {
+		return fmt.Sprintf("%s... (%d bytes)", body[:DEBUG_DUMP_MAX_BODY], len(body))
+	}
+	return string(body)
+}
+
+/**
+Headers as they're shown in a dump, one per line, with credentials masked
+*/
+func dumpHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = CONFIG_REDACTED
+		}
+		lines = append(lines, name+": "+value)
+	}
+	return strings.Join(lines, "\n")
+}
+
+/**
+Wraps the API client's transport to log requests and responses while dumps are on
+*/
+type dumpingTransport struct {
+	next http.RoundTripper
+}
+
+func (t dumpingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isDebugDump() {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	logger.Debug("HTTP request", "method", req.Method, "url", redactUrlPassword(req.URL.String()),
+		"headers", dumpHeaders(req.Header), "body", dumpBody(body, req.Header.Get("Content-Encoding")))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		logger.Debug("HTTP request failed", "method", req.Method, "url", redactUrlPassword(req.URL.String()), "error", err)
+		return resp, err
+	}
+	// The body is logged once it's been read, so streamed responses aren't held up
+	resp.Body = &dumpingBody{ReadCloser: resp.Body, resp: resp}
+	return resp, nil
+}
+
+/**
+A response body that logs the response once it's been read to the end or closed
+*/
+type dumpingBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	buf    bytes.Buffer
+	size   int
+	logged sync.Once
+}
+
+func (b *dumpingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := DEBUG_DUMP_MAX_BODY - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+	}
+	b.size += n
+	if err == io.EOF {
+		b.log()
+	}
+	return n, err
+}
+
+func (b *dumpingBody) Close() error {
+	b.log()
+	return b.ReadCloser.Close()
+}
+
+func (b *dumpingBody) log() {
+	b.logged.Do(func() {
+		body := dumpBody(b.buf.Bytes(), b.resp.Header.Get("Content-Encoding"))
+		if b.size > b.buf.Len() {
+			body = fmt.Sprintf("%s... (%d bytes)", body, b.size)
+		}
+		logger.Debug("HTTP response", "url", redactUrlPassword(b.resp.Request.URL.String()), "status", b.resp.Status,
+			"headers", dumpHeaders(b.resp.Header), "body", body)
+	})
+}
+
+/**
+Log a task's payload and config while dumps are on, with their secrets masked
+*/
+func dumpTask(task Task) {
+	if !isDebugDump() {
+		return
+	}
+	var taskConfig interface{}
+	json.Unmarshal(task.RawConfig, &taskConfig)
+	taskLogger(task).Debug("Task payload", "payload", task.Payload, "config", string(redactedJson(taskConfig)))
+}
+
+/**
+A decoded JSON value as JSON again, with its secrets masked
+*/
+func redactedJson(value interface{}) []byte {
+	redactDumpValue(value)
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const (
+	DEDUPE_DEFAULT_WINDOW = 86400
+	DEDUPE_PRUNE_INTERVAL = time.Hour
+)
+
+// When finished results were last pruned from the task store
+var (
+	resultsPrunedAt     time.Time
+	resultsPrunedAtLock sync.Mutex
+)
+
+/**
+A finished task's result, kept so a duplicate delivery can be answered without running the task again
+*/
+type storedResult struct {
+	Response   JsonResponse `json:"response"`
+	FinishedAt time.Time    `json:"finished_at"`
+}
+
+/**
+How long finished tasks are remembered for, to catch duplicate deliveries - `dedupe_window` seconds, default a day.
+0 if duplicates aren't checked for.
+*/
+func getDedupeWindow() time.Duration {
+	config := currentConfig()
+	if config.DedupeWindow < 0 {
+		return 0
+	}
+	if config.DedupeWindow == 0 {
+		return DEDUPE_DEFAULT_WINDOW * time.Second
+	}
+	return time.Duration(config.DedupeWindow) * time.Second
+}
+
+/**
+Has this task been delivered before? A task that's still queued or running is ignored, and one that finished within
+`dedupe_window` gets its result sent again rather than being run twice - the server retrying a delivery mustn't
+run a command twice.
+*/
+func isDuplicateTask(task Task) bool {
+	db := getTaskStore()
+	window := getDedupeWindow()
+	if db == nil || window == 0 || task.Id == "" {
+		return false
+	}
+
+	var pending bool
+	var result *storedResult
+	err := db.View(func(tx *bolt.Tx) error {
+		pending = tx.Bucket(taskStoreTasksBucket).Get([]byte(task.Id)) != nil
+		data := tx.Bucket(taskStoreResultsBucket).Get([]byte(task.Id))
+		if data == nil {
+			return nil
+		}
+		result = &storedResult{}
+		return json.Unmarshal(data, result)
+	})
+	if err != nil {
+		logger.Error("Task store failed", "error", err)
+		return false
+	}
+
+	switch {
+	case pending:
+		taskLogger(task).Info("Task is already queued or running - ignoring the duplicate")
+		return true
+	case result != nil && time.Since(result.FinishedAt) < window:
+		taskLogger(task).Info("Task has already run - sending its result again")
+		runAndWait(func() {
+			postJsonResponse(task, result.Response)
+		})
+		return true
+	}
+	return false
+}
+
+/**
+Keep a finished task's result for `dedupe_window`. Interrupted tasks aren't kept, as they can be sent again to
+finish them.
+*/
+func storeTaskResult(id string, response JsonResponse) {
+	if getDedupeWindow() == 0 || id == "" || response.Type == "interrupted" {
+		return
+	}
+	putTaskStore(taskStoreResultsBucket, id, storedResult{Response: response, FinishedAt: time.Now()})
+	pruneTaskResults()
+}
+
+/**
+Drop results older than `dedupe_window` from the task store, at most once an hour
+*/
+func pruneTaskResults() {
+	resultsPrunedAtLock.Lock()
+	if time.Since(resultsPrunedAt) < DEDUPE_PRUNE_INTERVAL {
+		resultsPrunedAtLock.Unlock()
+		return
+	}
+	resultsPrunedAt = time.Now()
+	resultsPrunedAtLock.Unlock()
+
+	db := getTaskStore()
+	if db == nil {
+		return
+	}
+	window := getDedupeWindow()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(taskStoreResultsBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			var result storedResult
+			if json.Unmarshal(value, &result) != nil || time.Since(result.FinishedAt) >= window {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Task store failed", "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+A task held until its `run_at` time, with the timer that will queue it
+*/
+type deferredTask struct {
+	task  Task
+	timer *time.Timer
+}
+
+var (
+	deferredTasks     = map[string]*deferredTask{}
+	deferredTasksLock sync.Mutex
+)
+
+/**
+When a task should run - `run_at` is RFC 3339, or a date and time with no offset meaning the connector's local time
+e.g. "2024-03-02T02:00:00"
+*/
+func parseRunAt(runAt string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, runAt); err == nil {
+		return at, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04:05", runAt, time.Local)
+}
+
+/**
+Hold a task until its `run_at` time, then queue it. Returns false if the time has already come.
+The task is in the task store while it's held, so it's held again after a restart.
+*/
+func deferTask(task Task) bool {
+	runAt, err := parseRunAt(task.RunAt)
+	if err != nil {
+		taskLogger(task).Warn("Task has an invalid run_at - running it now", "run_at", task.RunAt)
+		return false
+	}
+	delay := time.Until(runAt)
+	if delay <= 0 {
+		return false
+	}
+
+	deferredTasksLock.Lock()
+	defer deferredTasksLock.Unlock()
+
+	if existing, ok := deferredTasks[task.Id]; ok {
+		existing.timer.Stop()
+	}
+	deferredTasks[task.Id] = &deferredTask{
+		task:  task,
+		timer: time.AfterFunc(delay, func() { runDeferredTask(task.Id) }),
+	}
+
+	taskLogger(task).Info("Task deferred", "run_at", runAt.Local().Format(time.RFC3339))
+	return true
+}
+
+/**
+Queue a deferred task now its time has come
+*/
+func runDeferredTask(id string) {
+	// Left in the task store, to be picked up when the connector starts again
+	if isShuttingDown() {
+		return
+	}
+
+	deferredTasksLock.Lock()
+	deferred, ok := deferredTasks[id]
+	delete(deferredTasks, id)
+	deferredTasksLock.Unlock()
+	if !ok {
+		return
+	}
+
+	task := deferred.task
+	task.RunAt = ""
+	dispatchTask(task)
+}
+
+/**
+Drop a deferred task the server has cancelled. Returns whether it was being held.
+*/
+func cancelDeferredTask(id string) (Task, bool) {
+	deferredTasksLock.Lock()
+	defer deferredTasksLock.Unlock()
+
+	deferred, ok := deferredTasks[id]
+	if !ok {
+		return Task{}, false
+	}
+	deferred.timer.Stop()
+	delete(deferredTasks, id)
+	return deferred.task, true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const (
+	DEPENDENCY_RESULTS_KEPT = 100
+)
+
+/**
+How a finished task turned out, kept for tasks that depend on it
+*/
+type taskOutcome struct {
+	success bool
+	body    interface{}
+}
+
+// Outcomes of recently finished tasks, oldest first in `taskOutcomeOrder`, and tasks waiting on a prerequisite
+var (
+	taskOutcomes     = map[string]taskOutcome{}
+	taskOutcomeOrder []string
+	waitingTasks     = map[string][]Task{}
+	dependencyLock   sync.Mutex
+)
+
+/**
+Note how a task turned out, and queue any tasks that were waiting on it
+*/
+func recordTaskOutcome(id string, response JsonResponse) {
+	dependencyLock.Lock()
+	var expired string
+	if _, ok := taskOutcomes[id]; !ok {
+		taskOutcomeOrder = append(taskOutcomeOrder, id)
+		if len(taskOutcomeOrder) > DEPENDENCY_RESULTS_KEPT {
+			expired = taskOutcomeOrder[0]
+			delete(taskOutcomes, expired)
+			taskOutcomeOrder = taskOutcomeOrder[1:]
+		}
+	}
+	outcome := taskOutcome{success: response.Type == "success", body: response.Body}
+	taskOutcomes[id] = outcome
+	waiting := waitingTasks[id]
+	delete(waitingTasks, id)
+	dependencyLock.Unlock()
+
+	// Kept on disk too, so a task can still follow on from one that finished before a restart
+	storeTaskOutcome(id, outcome)
+	if expired != "" {
+		forgetTaskOutcome(expired)
+	}
+
+	for _, task := range waiting {
+		go dispatchTask(task)
+	}
+}
+
+/**
+Hold a task until the task it depends on has finished. Returns the task ready to queue, with the prerequisite's
+result as its payload if it asked for it, or false if it's being held or was skipped because the prerequisite failed.
+*/
+func resolveDependency(task Task) (Task, bool) {
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+
+	outcome, ok := taskOutcomes[task.DependsOn]
+	if !ok {
+		taskLogger(task).Info("Task is waiting for the task it depends on to finish", "depends_on", task.DependsOn)
+		waitingTasks[task.DependsOn] = append(waitingTasks[task.DependsOn], task)
+		return task, false
+	}
+	if !outcome.success {
+		taskLogger(task).Info("Task skipped - the task it depends on did not succeed", "depends_on", task.DependsOn)
+		go postStoppedResult(task, "skipped", fmt.Sprintf("Task %s it depends on did not succeed", task.DependsOn), map[string]interface{}{
+			"depends_on": task.DependsOn,
+		})
+		return task, false
+	}
+
+	if task.PassResult {
+		if body, isString := outcome.body.(string); isString {
+			task.Payload = body
+		} else if body, err := json.Marshal(outcome.body); err == nil {
+			task.Payload = string(body)
+		}
+	}
+	task.DependsOn = ""
+	return task, true
+}
+
+/**
+Drop a task that's waiting on a prerequisite, when the server cancels it or the connector shuts down
+*/
+func cancelWaitingTask(id string) (Task, bool) {
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+
+	for prerequisite, tasks := range waitingTasks {
+		for i, task := range tasks {
+			if task.Id != id {
+				continue
+			}
+			waitingTasks[prerequisite] = append(tasks[:i:i], tasks[i+1:]...)
+			if len(waitingTasks[prerequisite]) == 0 {
+				delete(waitingTasks, prerequisite)
+			}
+			return task, true
+		}
+	}
+	return Task{}, false
+}
+
+/**
+Take every task that's waiting on a prerequisite, when shutting down
+*/
+func drainWaitingTasks() []Task {
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+
+	var tasks []Task
+	for _, waiting := range waitingTasks {
+		tasks = append(tasks, waiting...)
+	}
+	waitingTasks = map[string][]Task{}
+	return tasks
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+/**
+Resolve a URL given in a task against the API URL, so the server can send relative paths like `/files/123`
+*/
+func resolveApiUrl(ref string) (string, error) {
+	base, err := url.Parse(apiUrl())
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(target).String(), nil
+}
+
+/**
+Download a server-provided file to a temporary file, decompressing it if it is gzipped.
+The API key is only sent when the file is served by the task API itself.
+The caller is responsible for removing the returned file.
+*/
+func downloadFile(ref string, compressed bool) (string, error) {
+	fileUrl, err := resolveApiUrl(ref)
+	if err != nil {
+		return "", err
+	}
+
+	fromApi := isApiUrl(fileUrl)
+	var client *http.Client
+	if fromApi {
+		client, err = apiHttpClient()
+	} else {
+		client, err = downloadHttpClient()
+	}
+	if err != nil {
+		return "", err
+	}
+	// Files can be big and school links slow - rely on the connect and response header timeouts instead
+	client = withRequestTimeout(client, 0)
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", fileUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if fromApi {
+			if err := authenticateRequest(req, nil); err != nil {
+				return nil, err
+			}
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Download of %s failed: %s", fileUrl, resp.Status)
+	}
+
+	// Hash the body as it streams past so the API's signature can be checked once it's all arrived
+	hash := sha256.New()
+	var body io.Reader = io.TeeReader(resp.Body, hash)
+	if compressed {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	tmpFile, err := ioutil.TempFile("", "goproxy-download-")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, body); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	if fromApi {
+		// Make sure the whole response was hashed, even if gzip stopped short of the end
+		io.Copy(hash, resp.Body)
+		if err := verifyResponseHash(req, resp, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			os.Remove(tmpFile.Name())
+			return "", err
+		}
+	}
+
+	return tmpFile.Name(), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENDPOINT_FETCH        = "fetch"
+	ENDPOINT_RESULT       = "result"
+	ENDPOINT_UPLOAD       = "upload"
+	ENDPOINT_HEARTBEAT    = "heartbeat"
+	ENDPOINT_ENROLL       = "enroll"
+	ENDPOINT_PROGRESS     = "progress"
+	ENDPOINT_DEAD_LETTER  = "dead_letter"
+	ENDPOINT_CONFIG       = "config"
+	ENDPOINT_SLOW_QUERY   = "slow_query"
+	ENDPOINT_CRASH_REPORT = "crash_report"
+	ENDPOINT_SUPPORT_LOGS = "support_logs"
+	FAILOVER_RECHECK      = 5 * time.Minute
+)
+
+/**
+Paths or URLs for each kind of API call, relative to `url`. `{id}` and `{type}` are replaced with the task's ID and
+type. Anything not set uses `url` itself.
+e.g. `{"fetch": "/tasks/pending", "result": "/tasks/{id}/result", "upload": "/tasks/{id}/upload"}`
+*/
+type EndpointsConfig struct {
+	Fetch       string `json:"fetch,omitempty"`
+	Result      string `json:"result,omitempty"`
+	Upload      string `json:"upload,omitempty"`
+	Heartbeat   string `json:"heartbeat,omitempty"`
+	Enroll      string `json:"enroll,omitempty"`
+	Progress    string `json:"progress,omitempty"`
+	DeadLetter  string `json:"dead_letter,omitempty"`
+	Config      string `json:"config,omitempty"`
+	SlowQuery   string `json:"slow_query,omitempty"`
+	CrashReport string `json:"crash_report,omitempty"`
+	SupportLogs string `json:"support_logs,omitempty"`
+}
+
+/**
+The URL for an API call, with the task filled in to its template
+*/
+func apiEndpoint(name string, task Task) (string, error) {
+	config := currentConfig()
+	var template string
+	if config.Endpoints != nil {
+		switch name {
+		case ENDPOINT_FETCH:
+			template = config.Endpoints.Fetch
+		case ENDPOINT_RESULT:
+			template = config.Endpoints.Result
+		case ENDPOINT_UPLOAD:
+			template = config.Endpoints.Upload
+		case ENDPOINT_HEARTBEAT:
+			template = config.Endpoints.Heartbeat
+		case ENDPOINT_ENROLL:
+			template = config.Endpoints.Enroll
+		case ENDPOINT_PROGRESS:
+			template = config.Endpoints.Progress
+		case ENDPOINT_DEAD_LETTER:
+			template = config.Endpoints.DeadLetter
+		case ENDPOINT_CONFIG:
+			template = config.Endpoints.Config
+		case ENDPOINT_SLOW_QUERY:
+			template = config.Endpoints.SlowQuery
+		case ENDPOINT_CRASH_REPORT:
+			template = config.Endpoints.CrashReport
+		case ENDPOINT_SUPPORT_LOGS:
+			template = config.Endpoints.SupportLogs
+		}
+	}
+	if template == "" {
+		return apiUrl(), nil
+	}
+
+	template = strings.NewReplacer(
+		"{id}", url.PathEscape(task.Id),
+		"{type}", strconv.FormatUint(task.Type, 10),
+	).Replace(template)
+
+	return resolveApiUrl(template)
+}
+
+/**
+The URL for an API call with extra query parameters added
+*/
+func apiEndpointWithQuery(name string, task Task, query url.Values) (string, error) {
+	endpoint, err := apiEndpoint(name, task)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	values := u.Query()
+	for name, value := range query {
+		values[name] = value
+	}
+	u.RawQuery = values.Encode()
+
+	return u.String(), nil
+}
+
+/**
+One API URL, or several to fail over between - `"url"` can be a string or a list in the config
+*/
+type UrlList []string
+
+func (u *UrlList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*u = UrlList{}
+		if single != "" {
+			*u = UrlList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*u = UrlList(list)
+	return nil
+}
+
+func (u UrlList) MarshalJSON() ([]byte, error) {
+	if len(u) == 1 {
+		return json.Marshal(u[0])
+	}
+	return json.Marshal([]string(u))
+}
+
+// Which of the API URLs is in use, and when we last failed over from the first
+var (
+	activeUrl     int
+	failedOverAt  time.Time
+	activeUrlLock sync.Mutex
+)
+
+/**
+The API URL currently in use. After failing over we go back to the first URL every `FAILOVER_RECHECK`, in case it
+has recovered.
+*/
+func apiUrl() string {
+	activeUrlLock.Lock()
+	defer activeUrlLock.Unlock()
+	config := currentConfig()
+
+	if len(config.Url) == 0 {
+		return ""
+	}
+	if activeUrl != 0 && time.Since(failedOverAt) > FAILOVER_RECHECK {
+		logger.Info("Trying the primary API URL again", "url", config.Url[0])
+		activeUrl = 0
+	}
+	if activeUrl >= len(config.Url) {
+		activeUrl = 0
+	}
+	return config.Url[activeUrl]
+}
+
+/**
+Move on to the next API URL after `failed` stopped responding - unless another request has already moved us on
+*/
+func failoverApiUrl(failed string) {
+	activeUrlLock.Lock()
+	defer activeUrlLock.Unlock()
+	config := currentConfig()
+
+	if len(config.Url) < 2 || activeUrl >= len(config.Url) || !strings.HasPrefix(failed, config.Url[activeUrl]) {
+		return
+	}
+	activeUrl = (activeUrl + 1) % len(config.Url)
+	failedOverAt = time.Now()
+
+	logger.Warn("Failing over to another API URL", "url", config.Url[activeUrl])
+}
+
+/**
+Is this URL on one of our API servers?
+*/
+func isApiUrl(u string) bool {
+	for _, base := range currentConfig().Url {
+		if strings.HasPrefix(u, base) {
+			return true
+		}
+	}
+	return false
+}
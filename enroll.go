@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+)
+
+/**
+What the API hands back for a valid enrollment token
+*/
+type EnrollmentResponse struct {
+	AgentId string `json:"agent_id"`
+	ApiKey  string `json:"key"`
+}
+
+/**
+Exchange a one-time enrollment token for this connector's own agent ID and key, and save them in place of the token.
+Does nothing once the connector is enrolled.
+*/
+func enroll() error {
+	if config.EnrollmentToken == "" {
+		return nil
+	}
+
+	logger.Info("Enrolling with the API")
+	hostname, _ := os.Hostname()
+	payload, err := json.Marshal(JsonResponse{
+		Type: "enroll",
+		Body: map[string]string{
+			"hostname": hostname,
+			"os":       runtime.GOOS,
+			"arch":     runtime.GOARCH,
+			"version":  version,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	// The token is all we have to authenticate with - it stands in for the key
+	_, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		enrollUrl, err := apiEndpoint(ENDPOINT_ENROLL, Task{})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", enrollUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Digistorm-Enrollment-Token", config.EnrollmentToken)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Enrollment failed: %s", resp.Status)
+	}
+
+	var enrollment EnrollmentResponse
+	if err := json.Unmarshal(body, &enrollment); err != nil {
+		return err
+	}
+	if enrollment.AgentId == "" || !validApiKey.MatchString(enrollment.ApiKey) {
+		return errors.New("Enrollment failed: the API did not send a valid agent ID and key.")
+	}
+
+	err = updateConfigFile(map[string]interface{}{
+		"agent_id":         enrollment.AgentId,
+		"key":              enrollment.ApiKey,
+		"enrollment_token": nil,
+	})
+	if err != nil {
+		return err
+	}
+	// The key is ours alone now - keep other users on the machine from reading it
+	if err := os.Chmod(configFilePath, 0600); err != nil {
+		return err
+	}
+
+	config.AgentId = enrollment.AgentId
+	config.ApiKey = enrollment.ApiKey
+	config.EnrollmentToken = ""
+
+	logger.Info("Enrolled", "agent_id", config.AgentId)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	ENV_PREFIX      = "GOPROXY_"
+	ENV_CONFIG_PATH = ENV_PREFIX + "CONFIG"
+)
+
+/**
+Config that can be set from the environment, as `GOPROXY_` + the name, e.g. `GOPROXY_KEY`
+*/
+var envStringSettings = map[string]func(c *ConfigFile) *string{
+	"KEY":       func(c *ConfigFile) *string { return &c.ApiKey },
+	"AGENT_ID":  func(c *ConfigFile) *string { return &c.AgentId },
+	"TRANSPORT": func(c *ConfigFile) *string { return &c.Transport },
+	"PUSH_URL":  func(c *ConfigFile) *string { return &c.PushUrl },
+}
+
+var envIntSettings = map[string]func(c *ConfigFile) *int{
+	"INTERVAL":           func(c *ConfigFile) *int { return &c.Interval },
+	"MIN_INTERVAL":       func(c *ConfigFile) *int { return &c.MinInterval },
+	"POLL_JITTER":        func(c *ConfigFile) *int { return &c.PollJitter },
+	"BATCH_SIZE":         func(c *ConfigFile) *int { return &c.BatchSize },
+	"HEARTBEAT_INTERVAL": func(c *ConfigFile) *int { return &c.HeartbeatInterval },
+	"PROGRESS_INTERVAL":  func(c *ConfigFile) *int { return &c.ProgressInterval },
+	"SHUTDOWN_GRACE":     func(c *ConfigFile) *int { return &c.ShutdownGrace },
+	"TASK_TIMEOUT":       func(c *ConfigFile) *int { return &c.TaskTimeout },
+	"QUEUE_SIZE":         func(c *ConfigFile) *int { return &c.QueueSize },
+	"CONCURRENCY":        func(c *ConfigFile) *int { return &c.Concurrency },
+	"MAX_DB_CONNECTIONS": func(c *ConfigFile) *int { return &c.MaxDbConnections },
+	"DEDUPE_WINDOW":      func(c *ConfigFile) *int { return &c.DedupeWindow },
+}
+
+/**
+Is any config set in the environment? `GOPROXY_CONFIG` only says where the file is, and `GOPROXY_CONFIG_PASSPHRASE`
+how to read it, so they don't count.
+*/
+func hasEnvironmentConfig() bool {
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, ENV_PREFIX) && !strings.HasPrefix(variable, ENV_CONFIG_PATH) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Override the config file with `GOPROXY_` environment variables, so the connector can be set up in a container or by
+deployment tooling without writing a file. `GOPROXY_URL` may be a comma separated list of URLs to fail over between.
+The overrides are only held in memory - they're never written back to the config file.
+*/
+func applyEnvironment(target *ConfigFile) error {
+	if value, ok := os.LookupEnv(ENV_PREFIX + "URL"); ok {
+		var urls UrlList
+		for _, u := range strings.Split(value, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		target.Url = urls
+	}
+	for name, setting := range envStringSettings {
+		if value, ok := os.LookupEnv(ENV_PREFIX + name); ok {
+			*setting(target) = value
+		}
+	}
+	for name, setting := range envIntSettings {
+		value, ok := os.LookupEnv(ENV_PREFIX + name)
+		if !ok {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s%s must be a whole number, not %q.", ENV_PREFIX, name, value)
+		}
+		*setting(target) = number
+	}
+	return nil
+}
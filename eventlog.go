@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+const (
+	SERVICE_NAME = "DigistormConnector" // also the Windows Event Log source, registered when the service is installed
+
+	// Windows Event Log IDs for the lines worth a sysadmin's attention - a log line carries one as `event_id`
+	EVENT_STARTED               = 100
+	EVENT_STOPPING              = 101
+	EVENT_STOPPED               = 102
+	EVENT_CONFIG_RELOADED       = 200
+	EVENT_CONFIG_RELOAD_FAILED  = 201
+	EVENT_CONFIG_NEEDS_RESTART  = 202
+	EVENT_TASK_FAILED           = 300
+	EVENT_TASK_TIMED_OUT        = 301
+	EVENT_AUTH_FAILED           = 400
+	EVENT_WEBHOOK_AUTH_REJECTED = 401
+	EVENT_CRASHED               = 500
+)
+
+/**
+Passes log lines on to the next handler, and also writes any with an `event_id` to the Windows Event Log, so
+monitoring that watches the Event Log picks them up. The line's level sets the event's severity.
+*/
+type eventLogHandler struct {
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h eventLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	var eventId uint32
+	var fields []string
+	addField := func(attr slog.Attr) bool {
+		if attr.Key == "event_id" {
+			if id, ok := attr.Value.Any().(int); ok {
+				eventId = uint32(id)
+			}
+			return true
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", attr.Key, attr.Value))
+		return true
+	}
+	for _, attr := range h.attrs {
+		addField(attr)
+	}
+	record.Attrs(addField)
+
+	if eventId != 0 {
+		message := record.Message
+		if len(fields) > 0 {
+			message += "\r\n\r\n" + strings.Join(fields, "\r\n")
+		}
+		reportEvent(eventId, record.Level, message)
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return eventLogHandler{next: h.next.WithAttrs(attrs), attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h eventLogHandler) WithGroup(name string) slog.Handler {
+	return eventLogHandler{next: h.next.WithGroup(name), attrs: h.attrs}
+}
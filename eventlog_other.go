@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+)
+
+/**
+The Event Log is only on Windows
+*/
+func reportEvent(id uint32, level slog.Level, message string) {
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/kardianos/service"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"log/slog"
+	"sync"
+)
+
+var (
+	eventLog     *eventlog.Log
+	eventLogOnce sync.Once
+)
+
+/**
+Write an event to the Windows Event Log under the service's source. Only the service - and the connectors it runs
+for profiles - write events, so running the connector by hand doesn't fill the Event Log.
+*/
+func reportEvent(id uint32, level slog.Level, message string) {
+	eventLogOnce.Do(func() {
+		if !service.Interactive() || profileChild {
+			eventLog, _ = eventlog.Open(SERVICE_NAME)
+		}
+	})
+	if eventLog == nil {
+		return
+	}
+	switch {
+	case level >= slog.LevelError:
+		eventLog.Error(id, message)
+	case level >= slog.LevelWarn:
+		eventLog.Warning(id, message)
+	default:
+		eventLog.Info(id, message)
+	}
+}
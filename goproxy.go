@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -11,12 +12,15 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/kardianos/service"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,15 +29,62 @@ const (
 	TASK_TYPE_DB_MYSQL_EXEC  = 2
 	TASK_TYPE_DB_MSSQL_QUERY = 3
 	TASK_TYPE_DB_MSSQL_EXEC  = 4
-	API_URL                  = "http://taskserver:8888/"
+	TASK_TYPE_WMI_QUERY      = 5
+	TASK_TYPE_TCP_CHECK      = 6
+	TASK_TYPE_PING           = 7
+	TASK_TYPE_DNS_LOOKUP     = 8
+	TASK_TYPE_FILE_LIST      = 9
+	TASK_TYPE_LOG_TAIL       = 10
+	TASK_TYPE_DB_SCHEMA      = 11
+	TASK_TYPE_DB_DUMP        = 12
+	TASK_TYPE_DB_RESTORE     = 13
+	TASK_TYPE_CSV_IMPORT     = 14
+	TASK_TYPE_POWERSHELL     = 15
+	TASK_TYPE_REGISTRY_READ  = 16
+	TASK_TYPE_INVENTORY      = 17
+	TASK_TYPE_SERVICE        = 18
+	TASK_TYPE_CERT_CHECK     = 19
+	TASK_TYPE_EMAIL          = 20
+	TASK_TYPE_SNMP           = 21
+	TASK_TYPE_PRINT          = 22
+	TASK_TYPE_SUPPORT_LOGS   = 23
+	API_URL                  = "https://taskserver:8888/"
 	INTERVAL                 = 10
+	TRANSPORT_POLL           = "poll"
+	TRANSPORT_WEBSOCKET      = "websocket"
+	TRANSPORT_LONG_POLL      = "long_poll"
+	TRANSPORT_GRPC           = "grpc"
+	TRANSPORT_SSE            = "sse"
+	TRANSPORT_MQTT           = "mqtt"
+	TRANSPORT_AMQP           = "amqp"
+	TRANSPORT_SQS            = "sqs"
 )
 
 var (
-	svcFlag   string         // value of the `-service` command line argument e.g. `-service start`
-	svcLogger service.Logger // logger for the service
-	config    ConfigFile     // global config
-	quit      chan bool      // A channel for each iteration of the task fetch that can be stopped
+	svcFlag        string                   // value of the `-service` command line argument e.g. `-service start`
+	pauseFlag      bool                     // `-pause` - pause task processing in the running connector
+	resumeFlag     bool                     // `-resume` - resume task processing in the running connector
+	onceFlag       bool                     // `-once` - run the tasks from a single fetch and exit
+	configFlag     string                   // `-config` - where the config file is, instead of the default
+	validateFlag   bool                     // `-validate` - check the config, print a report and exit
+	initFlag       bool                     // `init` - set the connector up by answering questions
+	statusFlag     bool                     // `status` - print the state of the running connector
+	reloadFlag     bool                     // `reload` - ask the running connector to reload its config
+	saveFlag       bool                     // `-save` - write the settings given on the command line to the config file
+	configArgs     []string                 // `config set ...` - change the config file
+	historyArgs    []string                 // `history ...` - show recently finished tasks
+	profileFlag    string                   // `-profile` - the profile to run, from `profiles` in the config
+	profileChild   bool                     // `-profile-child` - running a profile for the service, which stops it by closing stdin
+	config         ConfigFile               // global config
+	configFilePath string                   // where the config was loaded from
+	errNoTasks     = errors.New("No Tasks") // returned when the API has no task for us
+	version        = "dev"                  // connector version, set at build time with `-ldflags "-X main.version=1.2.3"`
+)
+
+// ETag of the last "no tasks" answer, sent back in `If-None-Match` so an idle server can answer 304
+var (
+	fetchEtag     string
+	fetchEtagLock sync.Mutex
 )
 
 /**
@@ -49,9 +100,69 @@ type Program struct {
 Configuration from the config.json file in the same directory as the executable
 */
 type ConfigFile struct {
-	Url      string `json:"url"`
-	Interval int    `json:"interval"`
-	ApiKey   string `json:"key"`
+	Version              int                        `json:"version,omitempty"` // layout version, for migrating older files
+	Url                  UrlList                    `json:"url"`               // one API URL, or a list to fail over between
+	Interval             int                        `json:"interval"`
+	MinInterval          int                        `json:"min_interval,omitempty"` // seconds polling speeds up to while tasks keep arriving, default 1
+	PollJitter           int                        `json:"poll_jitter,omitempty"`  // seconds each poll may move either way, default 10% of interval, negative for none
+	ApiKey               string                     `json:"key"`
+	ProtectKey           bool                       `json:"protect_key,omitempty"`            // keep the key encrypted (DPAPI on Windows) or in the system keyring instead of in this file
+	KeyProtected         string                     `json:"key_protected,omitempty"`          // the protected key, set by the connector
+	ProtectDsns          bool                       `json:"protect_dsns,omitempty"`           // move `databases` DSNs out of this file, as `protect_key` does the key
+	AgentId              string                     `json:"agent_id,omitempty"`               // this connector's identity, set by enrollment
+	EnrollmentToken      string                     `json:"enrollment_token,omitempty"`       // one-time token swapped for an agent ID and key on first run
+	Endpoints            *EndpointsConfig           `json:"endpoints,omitempty"`              // separate fetch/result/upload endpoints under `url`
+	AllowedDirs          []string                   `json:"allowed_dirs,omitempty"`           // directories file tasks may read from
+	AllowedServices      []string                   `json:"allowed_services,omitempty"`       // Windows services that service tasks may control
+	DisabledTaskTypes    []uint64                   `json:"disabled_task_types,omitempty"`    // task types this connector refuses to run
+	RemoteConfigInterval int                        `json:"remote_config_interval,omitempty"` // seconds between fetches of settings from the server, default 300, negative for none
+	CompressResults      bool                       `json:"compress_results,omitempty"`       // gzip postbacks over 1KB
+	Http                 *HttpConfig                `json:"http,omitempty"`                   // timeouts and connection limits for HTTP connections
+	Retry                *RetryConfig               `json:"retry,omitempty"`                  // retries for API calls that fail transiently
+	Proxy                *ProxyConfig               `json:"proxy,omitempty"`                  // outbound proxy, otherwise HTTP(S)_PROXY from the environment
+	Tls                  *TlsConfig                 `json:"tls,omitempty"`                    // client certificate and server checks for the API connection
+	OAuth2               *OAuth2Config              `json:"oauth2,omitempty"`                 // client credentials for the API, instead of the key
+	SignRequests         bool                       `json:"sign_requests,omitempty"`          // sign requests with the key (HMAC-SHA256) instead of sending it
+	Transport            string                     `json:"transport,omitempty"`              // how tasks are delivered - "poll" (default), "long_poll", "websocket", "sse", "grpc", "mqtt", "amqp" or "sqs"
+	PushUrl              string                     `json:"push_url,omitempty"`               // URL for push transports, defaults to one under `url`
+	LongPollWait         int                        `json:"long_poll_wait,omitempty"`         // seconds the server may hold a long-poll request open
+	BatchSize            int                        `json:"batch_size,omitempty"`             // most tasks the server may send per fetch
+	HeartbeatInterval    int                        `json:"heartbeat_interval,omitempty"`     // seconds between heartbeats, default 60, negative for none
+	RateLimits           map[string]RateLimitConfig `json:"rate_limits,omitempty"`            // limits per task type, keyed by type number
+	TaskRetries          map[string]TaskRetryConfig `json:"task_retries,omitempty"`           // how failed tasks are retried per task type, keyed by type number
+	ProgressInterval     int                        `json:"progress_interval,omitempty"`      // seconds between progress updates for long tasks, default 15, negative for none
+	ShutdownGrace        int                        `json:"shutdown_grace,omitempty"`         // seconds running tasks get to finish when stopping, default 30
+	TaskTimeout          int                        `json:"task_timeout,omitempty"`           // seconds a task may run for, default 600, negative for no limit
+	QueueSize            int                        `json:"queue_size,omitempty"`             // tasks that can wait for a worker, default 100
+	Concurrency          int                        `json:"concurrency,omitempty"`            // tasks run at once, default 1
+	MaxDbConnections     int                        `json:"max_db_connections,omitempty"`     // database connections open at once across all tasks, no limit by default
+	DedupeWindow         int                        `json:"dedupe_window,omitempty"`          // seconds finished tasks are remembered to catch duplicate deliveries, default 86400, negative for none
+	HistoryDays          int                        `json:"history_days,omitempty"`           // days finished tasks are kept for `goproxy history`, default 30, negative for none
+	Schedules            []ScheduleConfig           `json:"schedules,omitempty"`              // tasks to run on cron schedules
+	Webhook              *WebhookConfig             `json:"webhook,omitempty"`                // local HTTPS listener for pushed tasks, off unless set
+	Mqtt                 *MqttConfig                `json:"mqtt,omitempty"`                   // broker details for the MQTT transport
+	Amqp                 *AmqpConfig                `json:"amqp,omitempty"`                   // broker details for the AMQP transport
+	Sqs                  *SqsConfig                 `json:"sqs,omitempty"`                    // queues and credentials for the SQS transport
+	Mysql                *DbSectionConfig           `json:"mysql,omitempty"`                  // limits for MySQL tasks
+	Mssql                *DbSectionConfig           `json:"mssql,omitempty"`                  // limits for MSSQL tasks
+	Files                *FilesSectionConfig        `json:"files,omitempty"`                  // where file tasks may read from
+	Shell                *ShellSectionConfig        `json:"shell,omitempty"`                  // which scripts PowerShell tasks may run
+	Profiles             map[string]json.RawMessage `json:"profiles,omitempty"`               // named sets of settings laid over the rest, each run by a connector of its own
+	Secrets              *SecretsConfig             `json:"secrets,omitempty"`                // where vault:// and aws-sm:// references in other settings are looked up
+	Databases            map[string]DatabaseConfig  `json:"databases,omitempty"`              // databases tasks can name by `dsn_alias`, keyed by alias
+	RequireDsnAlias      bool                       `json:"require_dsn_alias,omitempty"`      // refuse tasks that send a DSN instead of a `dsn_alias`
+	Log                  *LogConfig                 `json:"log,omitempty"`                    // log level and format
+	Metrics              *MetricsConfig             `json:"metrics,omitempty"`                // local endpoint for Prometheus to scrape
+	Status               *StatusConfig              `json:"status,omitempty"`                 // local health and status endpoint
+	Audit                *AuditConfig               `json:"audit,omitempty"`                  // append-only record of every task run
+	Tracing              *TracingConfig             `json:"tracing,omitempty"`                // OpenTelemetry collector to send task traces to
+	Sentry               *SentryConfig              `json:"sentry,omitempty"`                 // where to report panics and unexpected errors
+	SlowQueries          *SlowQueryConfig           `json:"slow_queries,omitempty"`           // log queries that take longer than a threshold
+	Debug                *DebugConfig               `json:"debug,omitempty"`                  // dumps of requests, responses and payloads for support
+	Statsd               *StatsdConfig              `json:"statsd,omitempty"`                 // StatsD or Datadog agent to send metrics to
+	LogShipping          *LogShippingConfig         `json:"log_shipping,omitempty"`           // send the log to support every so often
+
+	unknownKeys []string // settings in the file the connector doesn't know, explained for Validate to report
 }
 
 /**
@@ -62,14 +173,52 @@ type Task struct {
 	RawConfig json.RawMessage `json:"config"`
 	Type      uint64          `json:"type"`
 	Payload   string          `json:"payload"`
+	Timeout   int             `json:"timeout,omitempty"`  // seconds, overrides `task_timeout`
+	Priority  int             `json:"priority,omitempty"` // higher runs first, default 0
+	RunAt     string          `json:"run_at,omitempty"`   // hold the task until this time, RFC 3339 or local time without an offset
+	Attempt   int             `json:"attempt,omitempty"`  // retries so far, set by the connector under `task_retries`
+	Failures  []TaskFailure   `json:"failures,omitempty"` // errors from earlier runs, set by the connector when it retries
+
+	// Only run once the task with this ID has succeeded, optionally with its result as the payload
+	DependsOn  string `json:"depends_on,omitempty"`
+	PassResult bool   `json:"pass_result,omitempty"`
+
+	// Set instead of a task for control messages, e.g. `{"control": "cancel", "task_id": "123"}`
+	Control  string          `json:"control,omitempty"`
+	TargetId string          `json:"task_id,omitempty"`
+	Schedule *ScheduleConfig `json:"schedule,omitempty"`
+
+	// Sends responses back over the transport the task arrived on - nil for tasks fetched over HTTP
+	respond func(response JsonResponse) error
+	// Cancelled when the task runs out of time
+	ctx context.Context
+	// Set once a result has been sent, so a task that overran can't send another
+	responded *int32
+	// Name of the schedule that started the task, if any
+	schedule string
+	// When the poll that fetched the task started - zero for tasks pushed to us
+	polledAt time.Time
+	// When the task started running - zero until it does
+	startedAt time.Time
+}
+
+/**
+The task's context, cancelled when it runs out of time
+*/
+func (task Task) Context() context.Context {
+	if task.ctx == nil {
+		return context.Background()
+	}
+	return task.ctx
 }
 
 /**
 Config for a DB task to initialise the DB connection
 */
 type DBTaskConfig struct {
-	Type string `json:"type"`
-	Dsn  string `json:"dsn"`
+	Type  string `json:"type"`
+	Dsn   string `json:"dsn"`
+	Alias string `json:"dsn_alias,omitempty"` // a database set up in `databases`, instead of `dsn`
 }
 
 /**
@@ -88,95 +237,402 @@ type MapStringScan struct {
 Used to return responses to the task server e.g. `{"type": "error", "body": "Invalid API Key."}`
 */
 type JsonResponse struct {
-	Type string      `json:"type"`
-	Body interface{} `json:"body"`
+	TaskId   string      `json:"task_id,omitempty"`
+	Schedule string      `json:"schedule,omitempty"`
+	Type     string      `json:"type"`
+	Body     interface{} `json:"body"`
 }
 
 func (p *Program) Start(s service.Service) error {
-	svcLogger.Info("Starting...")
+	logger.Info("Starting", "event_id", EVENT_STARTED, "version", version)
 	// Start should not block. Do the actual work async.
 	go p.run()
 	return nil
 }
 func (p *Program) run() {
+	defer capturePanic()
+	config := currentConfig()
 
-	svcLogger.Info("Running...")
-	// Check for tasks immediately
-	checkForTasks()
+	logger.Info("Running")
 
-	parsedInterval, err := time.ParseDuration(fmt.Sprintf("%ds", config.Interval))
-	errCheck(err)
+	// With profiles, this connector only looks after one connector per profile
+	if isProfileSupervisor() {
+		runProfiles()
+		return
+	}
+
+	go runHeartbeat()
+	if err := loadStoredTasks(); err != nil {
+		logger.Error("Loading stored tasks failed", "error", err)
+	}
+	go reportStoredDeadLetters()
+	go watchConfigFile()
+	go watchRegistryConfig()
+	go runRemoteConfig()
+	go handleReloadSignal()
+	if err := startScheduler(); err != nil {
+		logger.Error("Scheduler failed to start", "error", err)
+	}
+	if config.Webhook != nil {
+		go runWebhookListener()
+	}
+	if config.Metrics != nil {
+		go runMetricsListener()
+	}
+	if config.Status != nil {
+		go runStatusListener()
+	}
+	if isTracing() {
+		go runTraceExporter()
+	}
+	if config.Statsd != nil {
+		go runStatsdGauges()
+	}
+	go runLogShipping()
+
+	switch config.Transport {
+	case TRANSPORT_WEBSOCKET:
+		go runPushTransport("WebSocket", listenWebSocket)
+	case TRANSPORT_SSE:
+		go runPushTransport("Event stream", listenSse)
+	case TRANSPORT_GRPC:
+		go runPushTransport("gRPC", listenGrpc)
+	case TRANSPORT_MQTT:
+		go runPushTransport("MQTT", listenMqtt)
+	case TRANSPORT_AMQP:
+		go runPushTransport("AMQP", listenAmqp)
+	case TRANSPORT_SQS:
+		go runPushTransport("SQS", listenSqs)
+	case TRANSPORT_LONG_POLL:
+		runLongPollTransport()
+		return
+	}
+
+	// Check for tasks straight away, give or take the jitter
+	time.Sleep(initialPollDelay())
+	checkForTasks()
 
-	// Create an interval timer to check for tasks every `config.Interval` seconds
-	ticker := time.NewTicker(parsedInterval)
+	// Check for tasks every `config.Interval` seconds, each moved a little by the jitter
 	for {
-		select {
-		case <-ticker.C:
+		time.Sleep(nextPollDelay())
+		if isShuttingDown() {
+			return
+		}
+		// Tasks are pushed to us while a push transport is connected
+		if isPushConnected() {
+			continue
+		}
+		// Don't fetch more work while there's no room in the queue for it - unless paused, so a resume can get through
+		if tasksBusy() && !isPaused() {
+			continue
 		}
 		checkForTasks()
 	}
 }
 func (p *Program) Stop(s service.Service) error {
-	svcLogger.Info("Stopping...")
-	// Stop should not block. Return with a few seconds.
+	logger.Info("Stopping", "event_id", EVENT_STOPPING)
+	// Blocks for up to `shutdown_grace` seconds while running tasks finish
+	shutdown()
+	stopProfiles()
+	logger.Info("Stopped", "event_id", EVENT_STOPPED)
 	return nil
 }
 
 /**
-Validate the config object - it must have an API key
+Validate the config object, reporting every problem found rather than just the first - it must have an API key or
+OAuth2, https URLs, a sensible interval and no settings the connector doesn't know
 */
 func (c *ConfigFile) Validate() error {
+	var problems ConfigProblems
 
-	if "" == c.ApiKey {
-		return errors.New("Invalid API Key.")
+	problems = append(problems, c.unknownKeys...)
+	if c.Version > CONFIG_VERSION {
+		problems.add(fmt.Errorf("The config is version %d, but this connector only understands up to version %d - upgrade the connector.", c.Version, CONFIG_VERSION))
 	}
 
-	return nil
+	switch {
+	case "" == c.ApiKey && c.OAuth2 == nil:
+		problems.add(errors.New("No API key - set key, run goproxy init, or enroll with -enroll."))
+	case "" != c.ApiKey && !validApiKey.MatchString(c.ApiKey):
+		problems.add(errors.New("key doesn't look like an API key - expected 16 to 256 letters, digits, - or _."))
+	}
+	if c.OAuth2 != nil && (c.OAuth2.TokenUrl == "" || c.OAuth2.ClientId == "") {
+		problems.add(errors.New("OAuth2 needs a token_url and client_id."))
+	}
+	if c.SignRequests && "" == c.ApiKey {
+		problems.add(errors.New("Signing requests needs an API Key."))
+	}
+
+	if len(c.Url) == 0 {
+		problems.add(errors.New("No API URL - set url."))
+	}
+	for _, u := range c.Url {
+		problems.add(checkConfigUrl("url", u))
+	}
+	if c.PushUrl != "" {
+		problems.add(checkConfigUrl("push_url", c.PushUrl))
+	}
+	if c.OAuth2 != nil && c.OAuth2.TokenUrl != "" {
+		problems.add(checkConfigUrl("oauth2.token_url", c.OAuth2.TokenUrl))
+	}
+	if c.Proxy != nil {
+		if _, err := url.Parse(c.Proxy.Url); err != nil || c.Proxy.Url == "" {
+			problems.add(fmt.Errorf("proxy.url %q is not a valid URL.", c.Proxy.Url))
+		}
+	}
+
+	if c.Interval < 1 || c.Interval > VALIDATE_MAX_INTERVAL {
+		problems.add(fmt.Errorf("interval is %d seconds - it must be from 1 to %d.", c.Interval, VALIDATE_MAX_INTERVAL))
+	}
+	if c.MinInterval < 0 || c.MinInterval > c.Interval {
+		problems.add(fmt.Errorf("min_interval is %d seconds - it must be from 0 to interval (%d).", c.MinInterval, c.Interval))
+	}
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"long_poll_wait", c.LongPollWait},
+		{"batch_size", c.BatchSize},
+		{"shutdown_grace", c.ShutdownGrace},
+		{"queue_size", c.QueueSize},
+		{"concurrency", c.Concurrency},
+		{"max_db_connections", c.MaxDbConnections},
+	} {
+		if setting.value < 0 {
+			problems.add(fmt.Errorf("%s is %d - it can't be negative.", setting.name, setting.value))
+		}
+	}
+	switch c.Transport {
+	case "", TRANSPORT_POLL, TRANSPORT_LONG_POLL, TRANSPORT_WEBSOCKET, TRANSPORT_SSE, TRANSPORT_GRPC, TRANSPORT_MQTT, TRANSPORT_AMQP, TRANSPORT_SQS:
+	default:
+		problems.add(fmt.Errorf("transport %q isn't one the connector knows - use poll, long_poll, websocket, sse, grpc, mqtt, amqp or sqs.", c.Transport))
+	}
+
+	for _, dir := range c.AllowedDirs {
+		if !filepath.IsAbs(dir) {
+			problems.add(fmt.Errorf("allowed_dirs entry %q must be an absolute path.", dir))
+		}
+	}
+	if c.Files != nil {
+		for _, dir := range c.Files.AllowedDirs {
+			if !filepath.IsAbs(dir) {
+				problems.add(fmt.Errorf("files.allowed_dirs entry %q must be an absolute path.", dir))
+			}
+		}
+	}
+	if c.Mysql != nil && c.Mysql.MaxRows < 0 {
+		problems.add(fmt.Errorf("mysql.max_rows is %d - it can't be negative.", c.Mysql.MaxRows))
+	}
+	if c.Mssql != nil && c.Mssql.MaxRows < 0 {
+		problems.add(fmt.Errorf("mssql.max_rows is %d - it can't be negative.", c.Mssql.MaxRows))
+	}
+	for name := range c.Profiles {
+		if !profileNamePattern.MatchString(name) {
+			problems.add(fmt.Errorf("Profile names may only have letters, numbers, - and _, not %q.", name))
+		}
+	}
+	for taskType := range c.RateLimits {
+		if _, err := strconv.ParseUint(taskType, 10, 64); err != nil {
+			problems.add(fmt.Errorf("Rate limits must be keyed by task type number, not %q.", taskType))
+		}
+	}
+	for taskType, retryConfig := range c.TaskRetries {
+		if _, err := strconv.ParseUint(taskType, 10, 64); err != nil {
+			problems.add(fmt.Errorf("Task retries must be keyed by task type number, not %q.", taskType))
+		}
+		problems.add(retryConfig.Validate())
+	}
+	for _, schedule := range c.Schedules {
+		problems.add(schedule.Validate())
+	}
+	if c.Webhook != nil {
+		problems.add(c.Webhook.Validate())
+	}
+	if c.Log != nil {
+		problems.add(c.Log.Validate())
+	}
+	if c.Metrics != nil {
+		problems.add(c.Metrics.Validate())
+	}
+	if c.Status != nil {
+		problems.add(c.Status.Validate())
+	}
+	if c.Audit != nil {
+		problems.add(c.Audit.Validate())
+	}
+	if c.Tracing != nil {
+		problems.add(c.Tracing.Validate())
+	}
+	if c.Sentry != nil {
+		problems.add(c.Sentry.Validate())
+	}
+	if c.SlowQueries != nil {
+		problems.add(c.SlowQueries.Validate())
+	}
+	if c.Statsd != nil {
+		problems.add(c.Statsd.Validate())
+	}
+	if c.LogShipping != nil {
+		problems.add(c.LogShipping.Validate(c.Log))
+	}
+	if c.Shell != nil {
+		problems.add(c.Shell.Validate())
+	}
+	for alias, database := range c.Databases {
+		problems.add(database.Validate(alias))
+	}
+
+	return problems.err()
 }
 
 /**
-Read in configuration from a JSON config file - this can be overridden by command line arguments.
-If any config is overridden, the `config.json` file is updated.
+Read the command line. `-key`, `-url`, `-interval` and `-enroll` override the config for this run only, unless
+`-save` is given to write them to the config file too.
 */
-func loadConfiguration() {
+func parseCommandLine() {
 	apiKey := flag.String("key", "", "Digistorm API Key.")
-	apiUrl := flag.String("url", API_URL, "Digistorm API Key.")
-	interval := flag.Int("interval", INTERVAL, "Digistorm API Key.")
+	apiUrl := flag.String("url", API_URL, "Digistorm API URL.")
+	interval := flag.Int("interval", INTERVAL, "Seconds between checks for tasks.")
+	enrollmentToken := flag.String("enroll", "", "One-time enrollment token to register this connector with.")
+	flag.BoolVar(&saveFlag, "save", false, "Save -key, -url, -interval and -enroll to the config file.")
 	flag.StringVar(&svcFlag, "service", "", "Control the system service.")
+	flag.BoolVar(&pauseFlag, "pause", false, "Pause task processing, e.g. for a maintenance window.")
+	flag.BoolVar(&resumeFlag, "resume", false, "Resume task processing after a pause.")
+	flag.BoolVar(&onceFlag, "once", false, "Fetch and run tasks once, then exit.")
+	flag.StringVar(&configFlag, "config", "", "Path to the config file.")
+	flag.BoolVar(&validateFlag, "validate", false, "Check the config and print a report.")
+	flag.StringVar(&profileFlag, "profile", "", "Run one profile from the config.")
+	flag.BoolVar(&profileChild, "profile-child", false, "Run a profile for the service - stops when stdin closes.")
+	flag.BoolVar(&debugFlag, "debug", false, "Log at debug level, with requests, responses and task payloads - secrets masked.")
 
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "validate":
+		validateFlag = true
+	case "init":
+		initFlag = true
+	case "status":
+		statusFlag = true
+	case "reload":
+		reloadFlag = true
+	case "history":
+		historyArgs = flag.Args()[1:]
+	case "config":
+		configArgs = flag.Args()[1:]
+		if len(configArgs) == 0 {
+			errCheckFatal(errors.New("Use goproxy config show, goproxy config set <setting> <value>, or goproxy config unset <setting>."))
+		}
+	}
 
-	_, filename, _, _ := runtime.Caller(1)
-	configFilePath := path.Join(path.Dir(filename), "conf.json")
+	// Only the flags actually given - the defaults are applied after everything else
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "key":
+			commandLineConfig["key"] = *apiKey
+		case "url":
+			commandLineConfig["url"] = UrlList{*apiUrl}
+		case "interval":
+			commandLineConfig["interval"] = *interval
+		case "enroll":
+			commandLineConfig["enrollment_token"] = *enrollmentToken
+		}
+	})
 
-	file, err := os.Open(configFilePath)
-	errCheckFatal(err)
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	errCheckFatal(err)
+	configFilePath = findConfigFile(configFlag)
+}
 
-	var configChanged bool = false
+/**
+Does this run move secrets out of the config file? Only the connector itself does, or `-save` - not commands that just
+look at the config, such as `-validate` or `status`, which may be run by someone other than the service's account
+and would leave the secrets in their keyring. Profiles leave it to the service that runs them.
+*/
+func movesSecrets() bool {
+	if saveFlag {
+		return true
+	}
+	return !validateFlag && !statusFlag && !reloadFlag && !pauseFlag && !resumeFlag && !initFlag && svcFlag == "" && !profileChild
+}
+
+/**
+Read in configuration from the config file, with the remote config, environment and command line over it. The file
+is only written to with `-save`, or to move the key and DSNs out of it when they're protected.
+*/
+func loadConfiguration() {
+	// Settings that are written to the config file
+	changes := map[string]interface{}{}
+	var canWrite bool = true
+
+	errCheckFatal(migrateConfigFile())
+
+	// A missing config file is only created with `-save` - the connector can still run from the environment, e.g. in
+	// a container, or from the command line. The file may be JSON, YAML or TOML, going by its extension.
+	data, err := readConfigFile(configFilePath)
+	if os.IsNotExist(err) && hasEnvironmentConfig() {
+		logger.Info("No config file - configuring from the environment")
+		canWrite = false
+	} else if os.IsNotExist(err) && hasRegistryConfig() {
+		logger.Info("No config file - configuring from the registry")
+		canWrite = false
+	} else if os.IsNotExist(err) && saveFlag {
+		logger.Info("Creating config file", "path", configFilePath)
+		errCheckFatal(os.MkdirAll(filepath.Dir(configFilePath), 0755))
+	} else if os.IsNotExist(err) {
+		if !initFlag {
+			logger.Warn("No config file - run goproxy init to create one", "path", configFilePath)
+		}
+		canWrite = false
+	} else {
+		errCheckFatal(err)
+		errCheckFatal(decodeConfig(data, configFormat(configFilePath), &config))
+	}
 
-	if config.Url == "" {
-		config.Url = *apiUrl
-		configChanged = true
+	// Move a plain key out of the file once `protect_key` is turned on, or recover a key that's already protected
+	if config.ProtectKey && config.ApiKey != "" && !isSecretReference(config.ApiKey) && movesSecrets() {
+		changes["key"] = config.ApiKey
+	} else if config.KeyProtected != "" {
+		config.ApiKey, err = unprotectSecret(config.KeyProtected)
+		errCheckFatal(err)
 	}
-	if config.Interval == 0 {
-		config.Interval = *interval
-		configChanged = true
+	if canWrite && config.ProtectDsns && movesSecrets() {
+		protectDatabaseDsns(changes)
 	}
-	if config.ApiKey == "" {
-		config.ApiKey = *apiKey
-		configChanged = true
+	if saveFlag {
+		for name, value := range commandLineConfig {
+			changes[name] = value
+		}
 	}
 
-	if configChanged == true {
-		configData, err := json.Marshal(config)
-		errCheckFatal(err)
-		err = ioutil.WriteFile(configFilePath, configData, 0644)
-		errCheckFatal(err)
+	if len(changes) > 0 && canWrite {
+		errCheckFatal(updateConfigFile(changes))
 	}
 
+	// Site-specific files dropped into conf.d are merged over the main file, but never written back to it
+	errCheckFatal(applyConfigDir(&config))
+
+	// Settings pushed to the registry, e.g. by Group Policy, win over the files
+	errCheckFatal(applyRegistryConfig(&config))
+
+	// A profile's settings are laid over the rest of the file, and it keeps its state in a directory of its own
+	if profileFlag != "" {
+		errCheckFatal(applyProfile(&config, profileFlag))
+		errCheckFatal(os.MkdirAll(stateDir(), 0755))
+	}
+
+	// Settings from the server, as last fetched, win over the file - and the environment over both
+	if err := loadCachedRemoteConfig(); err != nil {
+		logger.Warn("Cached remote config not loaded", "error", err)
+	}
+	checkCachedRemoteConfig(&config)
+	errCheckFatal(overlayRemoteConfig(&config))
+	errCheckFatal(applyEnvironment(&config))
+	errCheckFatal(applyCommandLine(&config))
+	applyConfigDefaults(&config)
+
+	// Settings that point to a secrets manager are swapped for the secrets themselves, once everything's in place
+	errCheckFatal(unprotectDatabaseDsns(&config))
+	errCheckFatal(resolveConfigSecrets(&config))
+	configureLogging(&config)
+
 }
 
 /**
@@ -223,35 +679,102 @@ func (s *MapStringScan) Get() map[string]string {
 }
 
 /**
-Fetch a pending task from the API and populate a Task from the JSON response
+Fetch pending tasks from the API and populate Tasks from the JSON response. The server may send one task, or a
+batch of up to `batch_size` as an array.
 */
-func getPendingTask() (Task, error) {
+func getPendingTasks() ([]Task, error) {
+	config := currentConfig()
 
 	var task Task
+	polledAt := time.Now()
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	if config.Transport == TRANSPORT_LONG_POLL {
+		client = withRequestTimeout(client, time.Duration(longPollWait())*time.Second+LONG_POLL_GRACE)
+	}
 
-	req, err := http.NewRequest("GET", config.Url, nil)
-	errCheckPostback(err)
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		// Resolved on every attempt, so a retry after failing over goes to the new API URL
+		fetchUrl, err := apiEndpoint(ENDPOINT_FETCH, task)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("GET", fetchUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, nil); err != nil {
+			return nil, err
+		}
+		// Tasks can carry large embedded data - setting this ourselves means we decompress, after checking signatures
+		req.Header.Set("Accept-Encoding", "gzip")
+		if config.Transport == TRANSPORT_LONG_POLL {
+			// Ask the server to hold the request open until a task arrives
+			req.Header.Set("X-Digistorm-Wait", strconv.Itoa(longPollWait()))
+		}
+		fetchEtagLock.Lock()
+		if fetchEtag != "" {
+			req.Header.Set("If-None-Match", fetchEtag)
+		}
+		fetchEtagLock.Unlock()
+		if config.BatchSize > 1 {
+			// Let the server send up to this many tasks at once
+			req.Header.Set("X-Digistorm-Batch", strconv.Itoa(config.BatchSize))
+		}
+		if isPaused() {
+			// Tasks won't be started, so the server can hold on to them and just send control messages
+			req.Header.Set("X-Digistorm-Paused", "1")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
 
-	req.Header.Set("X-Digistorm-Key", config.ApiKey)
+	wireResponse, rawResponse, err := readResponseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		// Nothing has changed since the last empty answer
+		return nil, errNoTasks
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching a task failed: %s", resp.Status)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	errCheckPostback(err)
+	if err := verifyResponse(req, resp, wireResponse); err != nil {
+		return nil, err
+	}
 
-	rawResponse, err := ioutil.ReadAll(resp.Body)
-	errCheckPostback(err)
+	// Only an empty answer is worth revalidating - once tasks come through, the next poll asks afresh
+	noTasks := string(rawResponse) == "0"
+	fetchEtagLock.Lock()
+	fetchEtag = ""
+	if noTasks {
+		fetchEtag = resp.Header.Get("ETag")
+	}
+	fetchEtagLock.Unlock()
 
-	if string(rawResponse) == "0" {
-		return task, errors.New("No Tasks")
+	if noTasks {
+		return nil, errNoTasks
 	}
 
-	err = json.Unmarshal(rawResponse, &task)
-	errCheckPostback(err)
+	tasks, err := parseTasks(rawResponse)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Print("Task found: ")
-	fmt.Println(task.Id)
+	for i, task := range tasks {
+		tasks[i].polledAt = polledAt
+		taskLogger(task).Info("Task found")
+	}
 
-	return task, nil
+	return tasks, nil
 }
 
 /**
@@ -260,9 +783,9 @@ Get DB specific config to initialise a database connection
 func getDbTaskConfig(task Task) DBTaskConfig {
 	var dbConfig DBTaskConfig
 	err := json.Unmarshal(task.RawConfig, &dbConfig)
-	errCheckPostback(err)
-	fmt.Print("Database Configuration: ")
-	fmt.Println(dbConfig)
+	errCheckPostback(task, err)
+	errCheckPostback(task, dbConfig.resolveAlias())
+	taskLogger(task).Debug("Database configuration", "db_type", dbConfig.Type, "dsn_alias", dbConfig.Alias)
 
 	return dbConfig
 }
@@ -271,34 +794,104 @@ func getDbTaskConfig(task Task) DBTaskConfig {
 Initialise database connection based on the task type
 */
 func initDbConnection(task Task) *sql.DB {
-	fmt.Println("Initilising Database Connection...")
-	config := getDbTaskConfig(task)
-	db, err := sql.Open(config.Type, config.Dsn)
-	errCheckPostback(err)
+	taskLogger(task).Debug("Initialising database connection")
+	errCheckPostback(task, acquireDbConnection(task))
+	dbConfig := getDbTaskConfig(task)
+	db, err := sql.Open(dbConfig.Type, dbConfig.Dsn)
+	errCheckPostback(task, err)
+	// One connection per task, so `max_db_connections` holds
+	db.SetMaxOpenConns(1)
 	return db
 }
 
 /**
-POST the result of a task back to the API
+Send the result of a task back to the task server - over the transport it arrived on, or POSTed to the API
 */
-func postJsonResponse(response JsonResponse) {
+func postJsonResponse(task Task, response JsonResponse) {
+	response.TaskId = task.Id
+	response.Schedule = task.schedule
+	if task.responded != nil && !atomic.CompareAndSwapInt32(task.responded, 0, 1) {
+		taskLogger(task).Warn("Dropping late result")
+		return
+	}
+	recordTaskOutcome(task.Id, response)
+	recordTaskMetric(task, response.Type)
+	auditTaskFinished(task, response)
+	recordTaskHistory(task, response)
+
+	// Any failure from here on bails out of the goroutine, and is counted on the way out
+	posted := false
+	defer func() {
+		if !posted {
+			postbackFailures.add(1)
+		}
+		traceTaskFinished(task, response.Type, posted)
+	}()
+	if task.respond != nil {
+		postback := startTaskSpan(task, "postback", SPAN_KIND_CLIENT)
+		err := task.respond(response)
+		postback.finish(err)
+		if !errors.Is(err, errStreamGone) {
+			errCheck(err)
+			posted = true
+			forgetStoredTask(task.Id)
+			storeTaskResult(task.Id, response)
+			return
+		}
+		taskLogger(task).Warn("The stream the task came on has closed, posting its result instead", "error", err)
+	}
+
+	serialize := startTaskSpan(task, "serialize", SPAN_KIND_INTERNAL)
 	payload, err := json.Marshal(response)
 	errCheck(err)
+	payload, encoding, err := compressPayload(payload)
+	serialize.finish(err)
+	errCheck(err)
 
-	req, err := http.NewRequest("POST", config.Url, bytes.NewBuffer(payload))
+	client, err := apiHttpClient()
 	errCheck(err)
 
-	req.Header.Set("X-Digistorm-Key", config.ApiKey)
-	req.Header.Set("Content-Type", "application/json")
+	postback := startTaskSpan(task, "postback", SPAN_KIND_CLIENT)
+	postback.setAttribute("http.request.body.size", len(payload))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	errCheck(err)
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		resultUrl, err := apiEndpoint(ENDPOINT_RESULT, task)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", resultUrl, bytes.NewBuffer(payload))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, payload); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		if isTracing() {
+			req.Header.Set("traceparent", taskTraceParent(task))
+		}
+		return req, nil
+	})
+	if err != nil {
+		postback.finish(err)
+		errCheck(err)
+	}
+	defer closeResponse(resp)
 
 	contents, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = verifyResponse(req, resp, contents)
+	}
+	postback.finish(err)
 	errCheck(err)
+	posted = true
+	forgetStoredTask(task.Id)
+	storeTaskResult(task.Id, response)
 
-	fmt.Println(string(contents))
+	taskLogger(task).Debug("Result posted", "response", string(contents))
 }
 
 /**
@@ -325,142 +918,277 @@ func processDbTask(task Task) {
 	db.SetMaxIdleConns(100)
 	defer db.Close()
 
-	rows, err := db.Query(task.Payload)
-	errCheckPostback(err)
+	start := time.Now()
+	rows, err := db.QueryContext(task.Context(), task.Payload)
+	errCheckPostback(task, err)
 
 	columnNames, err := rows.Columns()
-	errCheckPostback(err)
+	errCheckPostback(task, err)
 
 	var response []map[string]string
 
+	maxRows := 0
+	if section := taskDbSection(task); section != nil {
+		maxRows = section.MaxRows
+	}
+
 	rc := newMapStringScan(columnNames)
 	for rows.Next() {
+		if maxRows > 0 && len(response) >= maxRows {
+			rows.Close()
+			errCheckPostback(task, fmt.Errorf("Query returned more than %d rows, the most allowed by max_rows.", maxRows))
+		}
 		err := rc.Update(rows)
-		errCheckPostback(err)
+		errCheckPostback(task, err)
 		cv := rc.Get()
 
 		response = append(response, cv)
 	}
 	rows.Close()
+	recordRowsReturned(task, len(response))
+	checkSlowQuery(task, time.Since(start), len(response))
 
-	postJsonResponse(JsonResponse{
+	postJsonResponse(task, JsonResponse{
 		Type: "success",
 		Body: response,
 	})
 }
 
+/**
+Hand a task off to the processor for its type
+*/
+func processTask(task Task) {
+	for _, disabled := range currentConfig().DisabledTaskTypes {
+		if task.Type == disabled {
+			errCheckPostback(task, fmt.Errorf("Task type %d is turned off on this connector.", task.Type))
+		}
+	}
+
+	switch {
+	case isDbTask(task):
+		processDbTask(task)
+	case task.Type == TASK_TYPE_WMI_QUERY:
+		processWmiTask(task)
+	case task.Type == TASK_TYPE_TCP_CHECK:
+		processTcpTask(task)
+	case task.Type == TASK_TYPE_PING:
+		processPingTask(task)
+	case task.Type == TASK_TYPE_DNS_LOOKUP:
+		processDnsTask(task)
+	case task.Type == TASK_TYPE_FILE_LIST:
+		processFileListTask(task)
+	case task.Type == TASK_TYPE_LOG_TAIL:
+		processLogTailTask(task)
+	case task.Type == TASK_TYPE_DB_SCHEMA:
+		processDbSchemaTask(task)
+	case task.Type == TASK_TYPE_DB_DUMP:
+		processDbDumpTask(task)
+	case task.Type == TASK_TYPE_DB_RESTORE:
+		processDbRestoreTask(task)
+	case task.Type == TASK_TYPE_CSV_IMPORT:
+		processCsvImportTask(task)
+	case task.Type == TASK_TYPE_POWERSHELL:
+		processPowerShellTask(task)
+	case task.Type == TASK_TYPE_REGISTRY_READ:
+		processRegistryTask(task)
+	case task.Type == TASK_TYPE_INVENTORY:
+		processInventoryTask(task)
+	case task.Type == TASK_TYPE_SERVICE:
+		processServiceTask(task)
+	case task.Type == TASK_TYPE_CERT_CHECK:
+		processCertTask(task)
+	case task.Type == TASK_TYPE_EMAIL:
+		processEmailTask(task)
+	case task.Type == TASK_TYPE_SNMP:
+		processSnmpTask(task)
+	case task.Type == TASK_TYPE_PRINT:
+		processPrintTask(task)
+	case task.Type == TASK_TYPE_SUPPORT_LOGS:
+		processSupportLogsTask(task)
+	}
+}
+
 /**
 Query the task server to see if it returns a task.
 If a task is returned, process it
 */
 func checkForTasks() {
 
-	// Create a channel to execute this iteration of task fetching - can be closed on error without killing the exe
-	quit = make(chan bool)
+	if isShuttingDown() {
+		return
+	}
 
 	go func() {
-		fmt.Println("Checking for tasks...")
+		defer recoverPanic("poll")
+		logger.Debug("Checking for tasks")
 
-		task, err := getPendingTask()
+		tasks, err := getPendingTasks()
+		recordPollResult(err == nil)
+		recordPollOutcome(err)
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("Checking for tasks failed", "error", err)
 			return
 		}
 
-		if isDbTask(task) {
-			processDbTask(task)
+		// Each task posts its own result, tagged with its ID, as soon as it finishes
+		for _, task := range tasks {
+			queueTask(task)
 		}
 	}()
 
 }
 
 /**
-Handle an error - returns true if error was handled
+Handle an error - stops the goroutine running the current task, without killing the exe
 */
 func errCheck(err error) bool {
 	if err != nil {
-		fmt.Println(err)
-
-		// Close the currently running channel
-		quit <- true
+		logger.Error(err.Error())
+		captureError(err, "error", 1, nil)
 
-		return true
+		// Deferred calls still run, so connections and temp files are cleaned up
+		runtime.Goexit()
 	}
 
 	return false
 }
 
 /**
-Handle an error - returns true if error was handled
+Handle an error - exits the program
 */
 func errCheckFatal(err error) {
 	if err != nil {
-
-		// Close the currently running channel
-		quit <- true
-
-		log.Fatal(err)
+		logger.Error(err.Error())
+		captureError(err, "fatal", 1, nil)
+		flushSentry()
+		os.Exit(1)
 	}
 }
 
 /**
-Handle an error - returns true if error was handled
+Handle an error - POSTs it back to the task server, then stops the goroutine running the task
 */
-func errCheckPostback(err error) bool {
+func errCheckPostback(task Task, err error) bool {
 	if err != nil {
-		fmt.Println(err)
+		taskLogger(task).Error("Task failed", "event_id", EVENT_TASK_FAILED, "error", err)
+
+		// Out of time or cancelled - the worker sends a timeout or cancelled result instead
+		if task.Context().Err() != nil {
+			runtime.Goexit()
+		}
+		// Transient failures may be retried here rather than reported
+		retryTaskOnError(task, err)
+		deadLetterTask(task, err)
 
 		// POST the error back to the task server
-		postJsonResponse(JsonResponse{
+		postJsonResponse(task, JsonResponse{
 			Type: "error",
 			Body: err,
 		})
 
-		// Close the currently running channel
-		quit <- true
-
-		return true
+		// Deferred calls still run, so connections and temp files are cleaned up
+		runtime.Goexit()
 	}
 
 	return false
 }
 
+/**
+The system service that runs the program
+*/
+func newService(program *Program) (service.Service, error) {
+	svcConfig := &service.Config{
+		Name:        SERVICE_NAME,
+		DisplayName: "Digistorm Connector",
+		Description: "Runs as a service querying the Digistorm API for tasks to perform on the local machine e.g. executing a database query and then POSTing the result back to the Digistorm API.",
+	}
+	if configFlag != "" {
+		// The installed service needs to find the same config
+		svcConfig.Arguments = []string{"-config", configFilePath}
+	}
+	return service.New(program, svcConfig)
+}
+
 /**
 GO! (haha)
 */
 func main() {
 
+	parseCommandLine()
+	if configArgs != nil {
+		errCheckFatal(runConfigCommand(configArgs))
+		return
+	}
+	if historyArgs != nil {
+		errCheckFatal(runHistoryCommand(historyArgs))
+		return
+	}
 	loadConfiguration()
 
-	err := config.Validate()
+	if pauseFlag || resumeFlag {
+		errCheckFatal(setPaused(pauseFlag))
+		if pauseFlag {
+			fmt.Println("Task processing paused.")
+		} else {
+			fmt.Println("Task processing resumed.")
+		}
+		return
+	}
+
+	if reloadFlag {
+		errCheckFatal(requestReload())
+		fmt.Println("Reload requested - the connector's log says how it went.")
+		return
+	}
+
+	if validateFlag {
+		if !validateConfiguration() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if statusFlag {
+		os.Exit(runStatusCommand())
+	}
+
+	if initFlag {
+		errCheckFatal(runInit())
+		return
+	}
+
+	errCheckFatal(enroll())
+
+	err := validateConfig()
 	if err != nil {
 		errCheckFatal(err)
 	}
 
-	svcConfig := &service.Config{
-		Name:        "DigistormConnector",
-		DisplayName: "Digistorm Connector",
-		Description: "Runs as a service querying the Digistorm API for tasks to perform on the local machine e.g. executing a database query and then POSTing the result back to the Digistorm API.",
+	if onceFlag {
+		if isProfileSupervisor() {
+			errCheckFatal(errors.New("Pick the profile to run once with -profile."))
+		}
+		os.Exit(runOnce())
 	}
 
 	program := &Program{}
 
-	s, err := service.New(program, svcConfig)
+	s, err := newService(program)
 	if err != nil {
 		errCheckFatal(err)
 	}
 
-	svcLogger, err = s.Logger(nil)
-	if err != nil {
-		errCheckFatal(err)
+	if profileChild {
+		runProfileChild(program)
+		return
 	}
 
 	if len(svcFlag) != 0 {
 
 		err := service.Control(s, svcFlag)
 		if err != nil {
-			log.Printf("Valid actions: %q\n", service.ControlAction)
-			log.Fatal(err)
+			logger.Error(err.Error(), "valid_actions", service.ControlAction)
+			os.Exit(1)
 		}
 		return
 	}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HEARTBEAT_DEFAULT_INTERVAL = 60
+)
+
+// When the connector started, for the uptime in heartbeats
+var startedAt = time.Now()
+
+/**
+What a heartbeat tells the server about this connector
+*/
+type Heartbeat struct {
+	Version      string     `json:"version"`
+	Uptime       int64      `json:"uptime"` // seconds
+	StartedAt    time.Time  `json:"started_at"`
+	LastTaskAt   *time.Time `json:"last_task_at,omitempty"`
+	TasksRunning int        `json:"tasks_running"`
+	TasksWaiting int        `json:"tasks_waiting"`
+	Paused       bool       `json:"paused"`
+	Concurrency  int        `json:"concurrency"`
+	Transport    string     `json:"transport"`
+	ApiUrl       string     `json:"api_url"`
+	Hostname     string     `json:"hostname"`
+	OS           string     `json:"os"`
+	Arch         string     `json:"arch"`
+	NumCpu       int        `json:"num_cpu"`
+	GoVersion    string     `json:"go_version"`
+
+	Latency *LatencyReport `json:"latency,omitempty"`
+}
+
+/**
+Gather the connector's current state for a heartbeat
+*/
+func getHeartbeat() Heartbeat {
+	heartbeat := Heartbeat{
+		Version:      version,
+		Uptime:       int64(time.Since(startedAt).Seconds()),
+		StartedAt:    startedAt,
+		TasksRunning: int(atomic.LoadInt32(&tasksRunning)),
+		TasksWaiting: getTaskQueue().Len(),
+		Paused:       isPaused(),
+		Concurrency:  getConcurrency(),
+		Transport:    currentConfig().Transport,
+		ApiUrl:       apiUrl(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		NumCpu:       runtime.NumCPU(),
+		GoVersion:    runtime.Version(),
+		Latency:      getLatencyReport(),
+	}
+	if heartbeat.Transport == "" {
+		heartbeat.Transport = TRANSPORT_POLL
+	}
+	if last := atomic.LoadInt64(&lastTaskStart); last != 0 {
+		lastTaskAt := time.Unix(0, last)
+		heartbeat.LastTaskAt = &lastTaskAt
+	}
+	heartbeat.Hostname, _ = os.Hostname()
+
+	return heartbeat
+}
+
+/**
+POST a heartbeat to the API
+*/
+func sendHeartbeat() error {
+	payload, err := json.Marshal(JsonResponse{
+		Type: "heartbeat",
+		Body: getHeartbeat(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	// Not retried - a missed heartbeat is covered by the next one
+	heartbeatUrl, err := apiEndpoint(ENDPOINT_HEARTBEAT, Task{})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", heartbeatUrl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if err := authenticateRequest(req, payload); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		failoverApiUrl(heartbeatUrl)
+		return err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Heartbeat failed: %s", resp.Status)
+	}
+
+	return verifyResponse(req, resp, body)
+}
+
+/**
+Send a heartbeat every `heartbeat_interval` seconds, whatever the transport is doing, so the server can tell a
+connector that's alive but stuck from one that's gone. A negative interval turns heartbeats off. The interval is
+read each time, so a config reload can change it.
+*/
+func runHeartbeat() {
+	for {
+		interval := currentConfig().HeartbeatInterval
+		if interval == 0 {
+			interval = HEARTBEAT_DEFAULT_INTERVAL
+		}
+		if interval < 0 {
+			// Off for now - check again in case a reload turns them on
+			time.Sleep(HEARTBEAT_DEFAULT_INTERVAL * time.Second)
+			continue
+		}
+
+		if err := sendHeartbeat(); err != nil {
+			logger.Warn("Heartbeat failed", "error", err)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
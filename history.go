@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	HISTORY_FILE           = "history.db"
+	HISTORY_DEFAULT_DAYS   = 30
+	HISTORY_OPEN_TIMEOUT   = 5 * time.Second
+	HISTORY_DEFAULT_LIMIT  = 50
+	HISTORY_MESSAGE_LENGTH = 200 // longer messages are cut short in the table
+)
+
+var historyBucket = []byte("history")
+
+// Only one write to the history at a time from this connector
+var historyLock sync.Mutex
+
+/**
+A finished task, as kept in the history
+*/
+type historyEntry struct {
+	TaskId     string     `json:"task_id"`
+	Type       uint64     `json:"type"`
+	Schedule   string     `json:"schedule,omitempty"`
+	Attempt    int        `json:"attempt,omitempty"`
+	Status     string     `json:"status"`
+	Message    string     `json:"message,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time  `json:"finished_at"`
+}
+
+/**
+How many days finished tasks are kept for `goproxy history` - `history_days`, default 30. 0 if they aren't kept.
+*/
+func getHistoryDays() int {
+	config := currentConfig()
+	if config.HistoryDays < 0 {
+		return 0
+	}
+	if config.HistoryDays == 0 {
+		return HISTORY_DEFAULT_DAYS
+	}
+	return config.HistoryDays
+}
+
+/**
+Open the history. It's kept apart from the task store, and only held open while it's being used, so
+`goproxy history` can read it while the connector is running.
+*/
+func openHistory(readOnly bool) (*bolt.DB, error) {
+	path := filepath.Join(stateDir(), HISTORY_FILE)
+	if readOnly {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: HISTORY_OPEN_TIMEOUT, ReadOnly: readOnly})
+}
+
+/**
+Entries are keyed by when the task finished then its ID, so they're kept in order
+*/
+func historyKey(entry historyEntry) []byte {
+	key := make([]byte, 8, 8+len(entry.TaskId))
+	binary.BigEndian.PutUint64(key, uint64(entry.FinishedAt.UnixNano()))
+	return append(key, entry.TaskId...)
+}
+
+/**
+What a result says went wrong - errors are sent as the error, and stopped tasks with a `message`
+*/
+func responseMessage(body interface{}) string {
+	switch body := body.(type) {
+	case error:
+		return body.Error()
+	case map[string]interface{}:
+		if message, ok := body["message"].(string); ok {
+			return message
+		}
+	}
+	return ""
+}
+
+/**
+Add a finished task to the history, and drop any that have been kept long enough. Failures are logged - the task's
+result is sent either way.
+*/
+func recordTaskHistory(task Task, response JsonResponse) {
+	days := getHistoryDays()
+	if days == 0 || task.Id == "" {
+		return
+	}
+	entry := historyEntry{
+		TaskId:     task.Id,
+		Type:       task.Type,
+		Schedule:   task.schedule,
+		Attempt:    task.Attempt,
+		Status:     response.Type,
+		FinishedAt: time.Now(),
+	}
+	if response.Type != "success" {
+		entry.Message = responseMessage(response.Body)
+	}
+	if !task.startedAt.IsZero() {
+		entry.StartedAt = &task.startedAt
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Task history write failed", "error", err)
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	db, err := openHistory(false)
+	if err != nil {
+		logger.Error("Task history write failed", "error", err)
+		return
+	}
+	defer db.Close()
+
+	cutoff := make([]byte, 8)
+	binary.BigEndian.PutUint64(cutoff, uint64(time.Now().AddDate(0, 0, -days).UnixNano()))
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil && string(key[:8]) < string(cutoff); key, _ = cursor.Next() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(historyKey(entry), data)
+	})
+	if err != nil {
+		logger.Error("Task history write failed", "error", err)
+	}
+}
+
+/**
+A `--since` time - a duration back from now such as `2h` or `7d`, or a date and time as for `run_at`, or a date
+*/
+func parseHistorySince(since string) (time.Time, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(since, "d")); err == nil && strings.HasSuffix(since, "d") {
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	if duration, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if at, err := parseRunAt(since); err == nil {
+		return at, nil
+	}
+	if at, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return at, nil
+	}
+	return time.Time{}, fmt.Errorf("--since %q should be a duration such as 2h or 7d, or a date such as 2024-05-01.", since)
+}
+
+/**
+`goproxy history` - print the tasks that finished recently, oldest first, optionally only those since a time, of a
+type or with a status. `--json` prints one entry per line instead, for scripts.
+*/
+func runHistoryCommand(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	since := flags.String("since", "", "Only tasks finished since this long ago, e.g. 2h or 7d, or since a date.")
+	taskType := flags.Uint64("type", 0, "Only tasks of this type.")
+	status := flags.String("status", "", "Only tasks with this status, e.g. error or timeout.")
+	limit := flags.Int("limit", HISTORY_DEFAULT_LIMIT, "Show at most this many of the most recent tasks.")
+	asJson := flags.Bool("json", false, "Print each task as a line of JSON.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("Use goproxy history [--since 2h] [--type 1] [--status error] [--limit 50] [--json].")
+	}
+	var sinceKey []byte
+	if *since != "" {
+		at, err := parseHistorySince(*since)
+		if err != nil {
+			return err
+		}
+		sinceKey = make([]byte, 8)
+		binary.BigEndian.PutUint64(sinceKey, uint64(at.UnixNano()))
+	}
+
+	db, err := openHistory(true)
+	if err != nil {
+		return fmt.Errorf("The task history can't be read: %v", err)
+	}
+	var entries []historyEntry
+	if db != nil {
+		defer db.Close()
+		err = db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(historyBucket)
+			if bucket == nil {
+				return nil
+			}
+			cursor := bucket.Cursor()
+			key, value := cursor.First()
+			if sinceKey != nil {
+				key, value = cursor.Seek(sinceKey)
+			}
+			for ; key != nil; key, value = cursor.Next() {
+				var entry historyEntry
+				if err := json.Unmarshal(value, &entry); err != nil {
+					return err
+				}
+				if (*taskType != 0 && entry.Type != *taskType) || (*status != "" && entry.Status != *status) {
+					continue
+				}
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[len(entries)-*limit:]
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(entries) == 0 {
+		fmt.Println("No tasks in the history.")
+		return nil
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FINISHED\tTASK\tTYPE\tSTATUS\tDURATION\tSCHEDULE\tMESSAGE")
+	for _, entry := range entries {
+		duration := "-"
+		if entry.StartedAt != nil {
+			duration = entry.FinishedAt.Sub(*entry.StartedAt).Round(time.Millisecond).String()
+		}
+		message := strings.Join(strings.Fields(entry.Message), " ")
+		if len(message) > HISTORY_MESSAGE_LENGTH {
+			message = message[:HISTORY_MESSAGE_LENGTH] + "..."
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", entry.FinishedAt.Local().Format("2006-01-02 15:04:05"),
+			entry.TaskId, entry.Type, entry.Status, duration, entry.Schedule, message)
+	}
+	return table.Flush()
+}
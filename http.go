@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HTTP_DEFAULT_CONNECT_TIMEOUT         = 30
+	HTTP_DEFAULT_TLS_HANDSHAKE_TIMEOUT   = 30
+	HTTP_DEFAULT_RESPONSE_HEADER_TIMEOUT = 60
+	HTTP_DEFAULT_REQUEST_TIMEOUT         = 300
+	HTTP_DEFAULT_IDLE_CONN_TIMEOUT       = 90
+	HTTP_DEFAULT_MAX_IDLE_CONNS          = 10
+	HTTP_DEFAULT_MAX_CONNS_PER_HOST      = 0
+	HTTP2_PING_INTERVAL                  = 30 * time.Second
+	HTTP2_PING_TIMEOUT                   = 15 * time.Second
+	HTTP_MAX_DRAIN                       = 64 * 1024
+)
+
+/**
+Timeouts and connection limits for HTTP connections, in seconds
+e.g. `{"connect_timeout": 30, "request_timeout": 300, "response_header_timeout": 60}`
+*/
+type HttpConfig struct {
+	ConnectTimeout        int  `json:"connect_timeout,omitempty"`         // to open the TCP connection
+	TlsHandshakeTimeout   int  `json:"tls_handshake_timeout,omitempty"`   // to complete the TLS handshake
+	ResponseHeaderTimeout int  `json:"response_header_timeout,omitempty"` // from sending a request to its response headers
+	RequestTimeout        int  `json:"request_timeout,omitempty"`         // for a whole API call, body included
+	IdleConnTimeout       int  `json:"idle_conn_timeout,omitempty"`       // before an idle keep-alive connection is closed
+	MaxIdleConns          int  `json:"max_idle_conns,omitempty"`          // idle keep-alive connections to hold open
+	MaxConnsPerHost       int  `json:"max_conns_per_host,omitempty"`      // 0 for no limit
+	DisableHttp2          bool `json:"disable_http2,omitempty"`           // stick to HTTP/1.1, for proxies that mangle HTTP/2
+}
+
+// The clients shared by every call to the API, and by downloads from elsewhere, built on first use
+var (
+	apiClient          *http.Client
+	apiClientLock      sync.Mutex
+	downloadClient     *http.Client
+	downloadClientLock sync.Mutex
+)
+
+/**
+The HTTP settings, with defaults for anything not configured
+*/
+func getHttpConfig() HttpConfig {
+	config := currentConfig()
+	var httpConfig HttpConfig
+	if config.Http != nil {
+		httpConfig = *config.Http
+	}
+	if httpConfig.ConnectTimeout <= 0 {
+		httpConfig.ConnectTimeout = HTTP_DEFAULT_CONNECT_TIMEOUT
+	}
+	if httpConfig.TlsHandshakeTimeout <= 0 {
+		httpConfig.TlsHandshakeTimeout = HTTP_DEFAULT_TLS_HANDSHAKE_TIMEOUT
+	}
+	if httpConfig.ResponseHeaderTimeout <= 0 {
+		httpConfig.ResponseHeaderTimeout = HTTP_DEFAULT_RESPONSE_HEADER_TIMEOUT
+	}
+	if httpConfig.RequestTimeout <= 0 {
+		httpConfig.RequestTimeout = HTTP_DEFAULT_REQUEST_TIMEOUT
+	}
+	if httpConfig.IdleConnTimeout <= 0 {
+		httpConfig.IdleConnTimeout = HTTP_DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	if httpConfig.MaxIdleConns <= 0 {
+		httpConfig.MaxIdleConns = HTTP_DEFAULT_MAX_IDLE_CONNS
+	}
+	if httpConfig.MaxConnsPerHost < 0 {
+		httpConfig.MaxConnsPerHost = HTTP_DEFAULT_MAX_CONNS_PER_HOST
+	}
+	return httpConfig
+}
+
+/**
+A HTTP transport with our timeouts and connection limits, going through the proxy
+*/
+func newHttpTransport() *http.Transport {
+	httpConfig := getHttpConfig()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(httpConfig.ConnectTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = time.Duration(httpConfig.TlsHandshakeTimeout) * time.Second
+	transport.ResponseHeaderTimeout = time.Duration(httpConfig.ResponseHeaderTimeout) * time.Second
+	if currentConfig().Transport == TRANSPORT_LONG_POLL {
+		// Long polls don't get their headers until a task turns up
+		longPoll := time.Duration(longPollWait())*time.Second + LONG_POLL_GRACE
+		if longPoll > transport.ResponseHeaderTimeout {
+			transport.ResponseHeaderTimeout = longPoll
+		}
+	}
+	transport.IdleConnTimeout = time.Duration(httpConfig.IdleConnTimeout) * time.Second
+	transport.MaxIdleConns = httpConfig.MaxIdleConns
+	transport.MaxIdleConnsPerHost = httpConfig.MaxIdleConns
+	transport.MaxConnsPerHost = httpConfig.MaxConnsPerHost
+	configureProxy(transport)
+
+	return transport
+}
+
+/**
+Turn on HTTP/2 for a transport, once its TLS settings are in place, unless `disable_http2` is set. Idle HTTP/2
+connections are pinged so a dead one is noticed before a request is sent down it.
+*/
+func configureHttp2(transport *http.Transport) error {
+	if getHttpConfig().DisableHttp2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return nil
+	}
+
+	h2Transport, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return err
+	}
+	h2Transport.ReadIdleTimeout = HTTP2_PING_INTERVAL
+	h2Transport.PingTimeout = HTTP2_PING_TIMEOUT
+	return nil
+}
+
+/**
+The HTTP client for talking to the task API - one client is shared by every call so connections are reused
+*/
+func apiHttpClient() (*http.Client, error) {
+	apiClientLock.Lock()
+	defer apiClientLock.Unlock()
+	if apiClient != nil {
+		return apiClient, nil
+	}
+
+	tlsConfig, err := apiTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := newHttpTransport()
+	transport.TLSClientConfig = tlsConfig
+	if err := configureHttp2(transport); err != nil {
+		return nil, err
+	}
+
+	apiClient = &http.Client{
+		Transport: dumpingTransport{next: transport},
+		Timeout:   time.Duration(getHttpConfig().RequestTimeout) * time.Second,
+	}
+	return apiClient, nil
+}
+
+/**
+The HTTP client for downloading files from servers other than the task API - no API TLS settings, but still shared
+*/
+func downloadHttpClient() (*http.Client, error) {
+	downloadClientLock.Lock()
+	defer downloadClientLock.Unlock()
+	if downloadClient != nil {
+		return downloadClient, nil
+	}
+
+	transport := newHttpTransport()
+	if err := configureHttp2(transport); err != nil {
+		return nil, err
+	}
+
+	downloadClient = &http.Client{Transport: transport}
+	return downloadClient, nil
+}
+
+/**
+Close a response, reading off what's left of a short body first so the connection goes back to the pool
+*/
+func closeResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, HTTP_MAX_DRAIN))
+	resp.Body.Close()
+}
+
+/**
+A copy of a client with a different overall timeout - for long polls, streams and big transfers. 0 means no limit,
+leaving only the connect and response header timeouts.
+*/
+func withRequestTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	copied := *client
+	copied.Timeout = timeout
+	return &copied
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/kardianos/service"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+/**
+Set the connector up by asking for its settings, for `goproxy init`: the API URL and key, the poll interval and
+whether to protect the key. The server is checked before the config is written, and the service can be installed and
+started at the end - so first-time setup needs no hand editing.
+*/
+func runInit() error {
+	input := bufio.NewReader(os.Stdin)
+	fmt.Println("Setting up the Digistorm Connector.")
+	fmt.Printf("Config file: %s\n\n", configFilePath)
+
+	defaultUrl := API_URL
+	if len(config.Url) > 0 {
+		defaultUrl = config.Url[0]
+	}
+	apiUrl, err := promptValue(input, "API URL", defaultUrl)
+	if err != nil {
+		return err
+	}
+
+	// The current key isn't shown as the default, to keep it off the screen
+	keyQuestion := "API key"
+	if config.ApiKey != "" {
+		keyQuestion = "API key (Enter to keep the current one)"
+	}
+	var apiKey string
+	for {
+		if apiKey, err = promptValue(input, keyQuestion, ""); err != nil {
+			return err
+		}
+		if apiKey == "" {
+			apiKey = config.ApiKey
+		}
+		if validApiKey.MatchString(apiKey) {
+			break
+		}
+		fmt.Println("That doesn't look like an API key - expected 16 to 256 letters, digits, - or _.")
+	}
+
+	defaultInterval := config.Interval
+	if defaultInterval <= 0 {
+		defaultInterval = INTERVAL
+	}
+	var interval int
+	for {
+		value, err := promptValue(input, "Seconds between checks for tasks", strconv.Itoa(defaultInterval))
+		if err != nil {
+			return err
+		}
+		if interval, err = strconv.Atoi(value); err == nil && interval >= 1 && interval <= VALIDATE_MAX_INTERVAL {
+			break
+		}
+		fmt.Printf("Enter a number from 1 to %d.\n", VALIDATE_MAX_INTERVAL)
+	}
+
+	protectKey, err := promptYesNo(input, "Keep the key encrypted instead of in the config file?", config.ProtectKey)
+	if err != nil {
+		return err
+	}
+
+	config.Url = UrlList{apiUrl}
+	config.ApiKey = apiKey
+	config.Interval = interval
+	config.ProtectKey = protectKey
+
+	fmt.Println("\nChecking the server...")
+	if err := checkInitConnection(); err != nil {
+		fmt.Println(err)
+		save, err := promptYesNo(input, "Save the config anyway?", false)
+		if err != nil {
+			return err
+		}
+		if !save {
+			return errors.New("Setup cancelled - nothing was saved.")
+		}
+	} else {
+		fmt.Println("The server accepted the key.")
+	}
+
+	changes := map[string]interface{}{
+		"url":      config.Url,
+		"key":      apiKey,
+		"interval": interval,
+	}
+	if protectKey {
+		changes["protect_key"] = true
+	}
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+		return err
+	}
+	if err := updateConfigFile(changes); err != nil {
+		return err
+	}
+	// Windows permissions aren't file modes - the default ACL on the config directory keeps it to administrators
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(configFilePath, 0600); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Saved %s\n\n", configFilePath)
+
+	install, err := promptYesNo(input, "Install and start the service?", true)
+	if err != nil || !install {
+		return err
+	}
+	s, err := newService(&Program{})
+	if err != nil {
+		return err
+	}
+	for _, action := range []string{"install", "start"} {
+		if err := service.Control(s, action); err != nil {
+			return fmt.Errorf("Could not %s the service: %v", action, err)
+		}
+	}
+	fmt.Println("The connector is running.")
+	return nil
+}
+
+/**
+Ask for a value, showing the default if there is one - an empty answer takes the default
+*/
+func promptValue(input *bufio.Reader, question string, defaultValue string) (string, error) {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", question, defaultValue)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := input.ReadString('\n')
+	if err == io.EOF && answer == "" {
+		return "", errors.New("Setup cancelled - nothing was saved.")
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultValue, nil
+	}
+	return answer, nil
+}
+
+/**
+Ask a yes or no question
+*/
+func promptYesNo(input *bufio.Reader, question string, defaultValue bool) (bool, error) {
+	choices := "y/N"
+	if defaultValue {
+		choices = "Y/n"
+	}
+	for {
+		answer, err := promptValue(input, question+" ("+choices+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return defaultValue, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+/**
+Make sure the server answers and takes the key, without fetching tasks - a task fetched here would never be run
+*/
+func checkInitConnection() error {
+	for _, check := range checkApiUrls() {
+		if check.err != nil {
+			return check.err
+		}
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+	configUrl, err := apiEndpoint(ENDPOINT_CONFIG, Task{})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", configUrl, nil)
+	if err != nil {
+		return err
+	}
+	if err := authenticateRequest(req, nil); err != nil {
+		return err
+	}
+	resp, err := withRequestTimeout(client, VALIDATE_REQUEST_TIMEOUT).Do(req)
+	if err != nil {
+		return fmt.Errorf("The server is not reachable: %v", err)
+	}
+	closeResponse(resp)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("The server rejected the key: %s", resp.Status)
+	}
+	return nil
+}
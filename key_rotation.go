@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// What a key from the server has to look like before we'll trust it
+var validApiKey = regexp.MustCompile(`^[A-Za-z0-9_\-]{16,256}$`)
+
+var keyRotationLock sync.Mutex
+
+/**
+Change values in the config file without touching anything else in it - a nil value removes the setting. The file
+is kept in its own format, though comments in YAML and TOML files are lost, and is created if it doesn't exist. An
+encrypted file stays encrypted.
+*/
+func updateConfigFile(changes map[string]interface{}) error {
+	format := configFormat(configFilePath)
+	data, err := ioutil.ReadFile(configFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	encrypted := isEncryptedConfig(data)
+	if data, err = decryptConfigData(data); err != nil {
+		return err
+	}
+	values, err := decodeConfigValues(data, format)
+	if err != nil {
+		return err
+	}
+	// A new file starts out in the current layout
+	if len(values) == 0 {
+		values["version"] = CONFIG_VERSION
+	}
+	if changes, err = protectKeyChange(changes); err != nil {
+		return err
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(values, name)
+			continue
+		}
+		plain, err := plainConfigValue(value)
+		if err != nil {
+			return err
+		}
+		values[name] = plain
+	}
+	data, err = encodeConfigValues(values, format)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		passphrase, err := configPassphrase()
+		if err != nil {
+			return err
+		}
+		if data, err = encryptConfigData(data, passphrase); err != nil {
+			return err
+		}
+	}
+	return writeConfigFile(data)
+}
+
+/**
+Replace the config file. The new file is written alongside the old one and renamed over it, so a crash part way
+through never leaves a broken config.
+*/
+func writeConfigFile(data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(configFilePath), ".conf-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(configFilePath); err == nil {
+		os.Chmod(tmpFile.Name(), info.Mode())
+	}
+
+	return os.Rename(tmpFile.Name(), configFilePath)
+}
+
+/**
+Switch the running connector to another API key
+*/
+func setApiKey(key string) {
+	updateConfig(func(next *ConfigFile) {
+		next.ApiKey = key
+	})
+}
+
+/**
+Tell the server we've switched to the new key - the request is authenticated with it, and retried and failed over
+like any other call, so a dropped connection doesn't leave the rotation unconfirmed
+*/
+func confirmKeyRotation() error {
+	payload, err := json.Marshal(JsonResponse{
+		Type: "key_rotated",
+		Body: map[string]string{"key_id": apiKeyId()},
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		resultUrl, err := apiEndpoint(ENDPOINT_RESULT, Task{})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", resultUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, payload); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Key rotation was not confirmed: %s", resp.Status)
+	}
+
+	return verifyResponse(req, resp, body)
+}
+
+/**
+Switch to a new API key the server has sent in `X-Rotate-Key`. The key must come with `X-Rotate-Key-Signature`,
+an HMAC-SHA256 of the new key made with the current one, so only the server holding our key can rotate it.
+The new key is saved to the config and confirmed with the server - if either fails we stay on the old key.
+*/
+func handleKeyRotation(resp *http.Response) error {
+	newKey := resp.Header.Get("X-Rotate-Key")
+	if newKey == "" || currentConfig().OAuth2 != nil {
+		return nil
+	}
+
+	// Only one rotation at a time - responses that arrive while one is under way are skipped
+	if !keyRotationLock.TryLock() {
+		return nil
+	}
+	defer keyRotationLock.Unlock()
+
+	oldKey := currentConfig().ApiKey
+	if newKey == oldKey {
+		return nil
+	}
+	if !validApiKey.MatchString(newKey) {
+		return errors.New("Ignoring key rotation: the new key is not a valid key.")
+	}
+	if !hmac.Equal([]byte(computeSignature(newKey)), []byte(resp.Header.Get("X-Rotate-Key-Signature"))) {
+		return errors.New("Ignoring key rotation: the signature does not match our current key.")
+	}
+
+	logger.Info("Rotating API key")
+	if err := updateConfigFile(map[string]interface{}{"key": newKey}); err != nil {
+		return err
+	}
+
+	setApiKey(newKey)
+	if err := confirmKeyRotation(); err != nil {
+		setApiKey(oldKey)
+		if restoreErr := updateConfigFile(map[string]interface{}{"key": oldKey}); restoreErr != nil {
+			return fmt.Errorf("%v, and restoring the old key failed: %v", err, restoreErr)
+		}
+		return err
+	}
+
+	logger.Info("API key rotated", "key_id", apiKeyId())
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	KEY_PROTECT_DPAPI   = "dpapi:"
+	KEY_PROTECT_KEYRING = "keyring:"
+)
+
+/**
+Swap a new API key in a config change for its protected form when `protect_key` is on, so the key itself never
+reaches the config file
+*/
+func protectKeyChange(changes map[string]interface{}) (map[string]interface{}, error) {
+	key, ok := changes["key"].(string)
+	if !ok || key == "" || !currentConfig().ProtectKey {
+		return changes, nil
+	}
+
+	protected, err := protectSecret(configFilePath, key)
+	if err != nil {
+		return nil, fmt.Errorf("Protecting the API key: %v", err)
+	}
+	protectedChanges := map[string]interface{}{}
+	for name, value := range changes {
+		protectedChanges[name] = value
+	}
+	protectedChanges["key"] = nil
+	protectedChanges["key_protected"] = protected
+	return protectedChanges, nil
+}
+
+/**
+Recover a secret from its protected form, e.g. the API key from `key_protected`
+*/
+func unprotectSecret(protected string) (string, error) {
+	switch {
+	case strings.HasPrefix(protected, KEY_PROTECT_DPAPI):
+		return unprotectDpapi(strings.TrimPrefix(protected, KEY_PROTECT_DPAPI))
+	case strings.HasPrefix(protected, KEY_PROTECT_KEYRING):
+		return unprotectKeyring(strings.TrimPrefix(protected, KEY_PROTECT_KEYRING))
+	}
+	return "", fmt.Errorf("Unknown protected value format.")
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	KEYRING_SERVICE = "goproxy"
+)
+
+/**
+Keep a secret in the system keyring - the macOS keychain, or the Secret Service (GNOME Keyring or KWallet) on
+Linux - under an account named after the config file, so connectors with different configs don't clash
+*/
+func protectSecret(account string, secret string) (string, error) {
+	if err := keyring.Set(KEYRING_SERVICE, account, secret); err != nil {
+		return "", err
+	}
+	return KEY_PROTECT_KEYRING + account, nil
+}
+
+/**
+Read a secret back from the system keyring
+*/
+func unprotectKeyring(account string) (string, error) {
+	return keyring.Get(KEYRING_SERVICE, account)
+}
+
+/**
+Secrets protected with DPAPI can only be read on the Windows machine that protected them
+*/
+func unprotectDpapi(encoded string) (string, error) {
+	return "", errors.New("This was protected with DPAPI, which is only available on Windows - set it again.")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"golang.org/x/sys/windows"
+	"unsafe"
+)
+
+// Mixed in with DPAPI so other programs on the machine can't unprotect our secrets just by asking - it predates
+// protecting anything but the key, and can't change without losing what's already protected
+var dpapiEntropy = []byte("Digistorm Connector API key")
+
+/**
+Protect a secret with DPAPI, tied to this machine rather than a user so the service and admins can both read it.
+The account only matters for keyrings.
+*/
+func protectSecret(account string, secret string) (string, error) {
+	data := []byte(secret)
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	entropy := windows.DataBlob{Size: uint32(len(dpapiEntropy)), Data: &dpapiEntropy[0]}
+	var out windows.DataBlob
+	err := windows.CryptProtectData(&in, nil, &entropy, 0, nil, windows.CRYPTPROTECT_LOCAL_MACHINE|windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	protected := unsafe.Slice(out.Data, out.Size)
+	return KEY_PROTECT_DPAPI + base64.StdEncoding.EncodeToString(protected), nil
+}
+
+/**
+Recover a secret protected with DPAPI
+*/
+func unprotectDpapi(encoded string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) == 0 {
+		return "", errors.New("The protected value is corrupt.")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	entropy := windows.DataBlob{Size: uint32(len(dpapiEntropy)), Data: &dpapiEntropy[0]}
+	var out windows.DataBlob
+	err = windows.CryptUnprotectData(&in, nil, &entropy, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	return string(unsafe.Slice(out.Data, out.Size)), nil
+}
+
+/**
+Keyrings are only used outside Windows
+*/
+func unprotectKeyring(account string) (string, error) {
+	return "", errors.New("This is kept in a keyring, which isn't used on Windows - set it again.")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LATENCY_WINDOW      = time.Hour // percentiles are of tasks that finished within this long
+	LATENCY_MAX_SAMPLES = 1000      // and of at most this many of the latest for each type or database
+	LATENCY_MAX_SERIES  = 100       // types and databases tracked - any more are left out
+)
+
+// The percentiles worked out for each type and database
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+/**
+Recent task durations, kept for each type or database so their percentiles can be worked out
+*/
+type latencyTracker struct {
+	name    string
+	help    string
+	label   string
+	samples map[string][]latencySample
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+/**
+The percentiles of recent durations for a type or database, in milliseconds
+*/
+type LatencyPercentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+/**
+Percentiles of how long tasks took over the last hour, by task type and by database, for heartbeats and the status
+endpoint - so a database that's getting slower shows up before its tasks start timing out
+*/
+type LatencyReport struct {
+	ByType map[string]LatencyPercentiles `json:"by_type"`
+	ByDsn  map[string]LatencyPercentiles `json:"by_dsn,omitempty"`
+}
+
+// Held while any tracker is read or changed
+var latencyLock sync.Mutex
+
+var (
+	taskLatency = &latencyTracker{
+		name:  "goproxy_task_latency_seconds",
+		help:  "Percentiles of how long tasks took over the last hour, by type.",
+		label: "type",
+	}
+	dbLatency = &latencyTracker{
+		name:  "goproxy_db_latency_seconds",
+		help:  "Percentiles of how long database tasks took over the last hour, by database.",
+		label: "dsn",
+	}
+)
+
+/**
+Drop samples that are too old, or past the most kept
+*/
+func trimLatencySamples(samples []latencySample) []latencySample {
+	cutoff := time.Now().Add(-LATENCY_WINDOW)
+	start := 0
+	for start < len(samples) && (samples[start].at.Before(cutoff) || len(samples)-start > LATENCY_MAX_SAMPLES) {
+		start++
+	}
+	return samples[start:]
+}
+
+/**
+Record how long something took
+*/
+func (t *latencyTracker) observe(key string, duration time.Duration) {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	if t.samples == nil {
+		t.samples = map[string][]latencySample{}
+	}
+	if _, ok := t.samples[key]; !ok && len(t.samples) >= LATENCY_MAX_SERIES {
+		return
+	}
+	t.samples[key] = trimLatencySamples(append(t.samples[key], latencySample{at: time.Now(), duration: duration}))
+}
+
+/**
+The recent durations for each key, sorted - keys with none left are forgotten. Called with `latencyLock` held.
+*/
+func (t *latencyTracker) sorted() map[string][]time.Duration {
+	sorted := map[string][]time.Duration{}
+	for key, samples := range t.samples {
+		samples = trimLatencySamples(samples)
+		if len(samples) == 0 {
+			delete(t.samples, key)
+			continue
+		}
+		t.samples[key] = samples
+		durations := make([]time.Duration, len(samples))
+		for i, sample := range samples {
+			durations[i] = sample.duration
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		sorted[key] = durations
+	}
+	return sorted
+}
+
+/**
+The nearest-rank percentile of sorted durations
+*/
+func latencyQuantile(sorted []time.Duration, quantile float64) time.Duration {
+	rank := int(math.Ceil(quantile*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+/**
+The percentiles for each key
+*/
+func (t *latencyTracker) report() map[string]LatencyPercentiles {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	report := map[string]LatencyPercentiles{}
+	for key, durations := range t.sorted() {
+		milliseconds := func(quantile float64) float64 {
+			return float64(latencyQuantile(durations, quantile).Microseconds()) / 1000
+		}
+		report[key] = LatencyPercentiles{Count: len(durations), P50: milliseconds(0.5), P95: milliseconds(0.95), P99: milliseconds(0.99)}
+	}
+	return report
+}
+
+/**
+Write the percentiles out as a Prometheus summary
+*/
+func (t *latencyTracker) writeSummary(w io.Writer) {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", t.name, t.help, t.name)
+	sorted := t.sorted()
+	keys := make([]string, 0, len(sorted))
+	for key := range sorted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		durations := sorted[key]
+		label := fmt.Sprintf("%s=%s", t.label, strconv.Quote(key))
+		var sum time.Duration
+		for _, duration := range durations {
+			sum += duration
+		}
+		for _, quantile := range latencyQuantiles {
+			fmt.Fprintf(w, "%s{%s,quantile=\"%s\"} %s\n", t.name, label, formatMetric(quantile), formatMetric(latencyQuantile(durations, quantile).Seconds()))
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", t.name, label, formatMetric(sum.Seconds()))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", t.name, label, len(durations))
+	}
+}
+
+/**
+Record how long a task took, by its type, and by its database if it has one
+*/
+func recordTaskLatency(task Task, duration time.Duration) {
+	taskLatency.observe(strconv.FormatUint(task.Type, 10), duration)
+	if label := taskDsnLabel(task); label != "" {
+		dbLatency.observe(label, duration)
+	}
+}
+
+/**
+The name of a task's database, as `dsnLabel` gives it - empty for tasks without one
+*/
+func taskDsnLabel(task Task) string {
+	var dbConfig DBTaskConfig
+	if len(task.RawConfig) == 0 || json.Unmarshal(task.RawConfig, &dbConfig) != nil {
+		return ""
+	}
+	return dsnLabel(dbConfig)
+}
+
+/**
+A name for a task's database that's safe to show - its alias, or its host and database name, never its password.
+A DSN that can't be made sense of is named by a hash of it. Empty for tasks without a database.
+*/
+func dsnLabel(dbConfig DBTaskConfig) string {
+	if dbConfig.Alias != "" {
+		return dbConfig.Alias
+	}
+	dsn := dbConfig.Dsn
+	if dsn == "" {
+		return ""
+	}
+	if dbConfig.Type == "mysql" {
+		if mysqlConfig, err := mysql.ParseDSN(dsn); err == nil {
+			return mysqlConfig.Addr + "/" + mysqlConfig.DBName
+		}
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Host + "/" + u.Query().Get("database")
+	}
+	// SQL Server's `server=...;database=...` form
+	var server, database string
+	for _, part := range strings.Split(dsn, ";") {
+		name, value, _ := strings.Cut(part, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "server", "data source", "addr", "address":
+			server = strings.TrimSpace(value)
+		case "database", "initial catalog":
+			database = strings.TrimSpace(value)
+		}
+	}
+	if server != "" {
+		return server + "/" + database
+	}
+	sum := sha256.Sum256([]byte(dsn))
+	return "dsn-" + hex.EncodeToString(sum[:4])
+}
+
+/**
+The latency percentiles for a heartbeat - nil until a task has finished
+*/
+func getLatencyReport() *LatencyReport {
+	report := &LatencyReport{ByType: taskLatency.report(), ByDsn: dbLatency.report()}
+	if len(report.ByType) == 0 {
+		return nil
+	}
+	return report
+}
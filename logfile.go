@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_FILE_DEFAULT_MAX_SIZE  = 10 // MB
+	LOG_FILE_DEFAULT_MAX_AGE   = 30 // days
+	LOG_FILE_DEFAULT_MAX_FILES = 10
+	LOG_FILE_TIME_FORMAT       = "20060102T150405"
+)
+
+/**
+A log file that's rotated once it reaches its size limit, and at the start of each day, so no one file grows without
+bound. Rotated files are renamed with the time, e.g. `goproxy-20240501T000000.log`, and removed once there are too
+many or they're too old. The file is only opened on the first write, so commands that don't log never create it.
+*/
+type rotatingLogFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedOn string // the day the file was started, so it's rotated when the day changes
+	failed   bool   // the file couldn't be opened, which has been reported once already
+}
+
+/**
+A log file as the config describes it. A relative path is in the state directory, so each profile gets its own.
+*/
+func newRotatingLogFile(logConfig *LogConfig) *rotatingLogFile {
+	path := logFilePath(logConfig)
+	maxSize := logConfig.MaxSize
+	if maxSize == 0 {
+		maxSize = LOG_FILE_DEFAULT_MAX_SIZE
+	}
+	maxAge := logConfig.MaxAge
+	if maxAge == 0 {
+		maxAge = LOG_FILE_DEFAULT_MAX_AGE
+	}
+	maxFiles := logConfig.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = LOG_FILE_DEFAULT_MAX_FILES
+	}
+	return &rotatingLogFile{
+		path:     path,
+		maxSize:  int64(maxSize) * 1024 * 1024,
+		maxAge:   time.Duration(maxAge) * 24 * time.Hour,
+		maxFiles: maxFiles,
+	}
+}
+
+/**
+Where the config's log file is, with a relative path in the state directory
+*/
+func logFilePath(logConfig *LogConfig) string {
+	if filepath.IsAbs(logConfig.File) {
+		return logConfig.File
+	}
+	return filepath.Join(stateDir(), logConfig.File)
+}
+
+/**
+The files a log file has been rotated to, oldest first - the time in their names sorts them
+*/
+func rotatedLogFiles(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+/**
+Write a log line, rotating the file first if it's full or from an earlier day. A file that can't be written is
+reported on stderr once, and the line dropped - the log still goes to stdout.
+*/
+func (r *rotatingLogFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	today := time.Now().Format("20060102")
+	if r.file != nil && r.size > 0 && (r.size+int64(len(p)) > r.maxSize || r.openedOn != today) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Log file %s couldn't be rotated: %v\n", r.path, err)
+		}
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			if !r.failed {
+				fmt.Fprintf(os.Stderr, "Log file %s couldn't be opened: %v\n", r.path, err)
+				r.failed = true
+			}
+			return len(p), nil
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+/**
+Open the log file to append to it, carrying on from where it was if it's from today
+*/
+func (r *rotatingLogFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.openedOn = info.ModTime().Format("20060102")
+	if info.Size() == 0 {
+		r.openedOn = time.Now().Format("20060102")
+	}
+	r.failed = false
+	return nil
+}
+
+/**
+Move the current file aside and start a new one, then clear out old files
+*/
+func (r *rotatingLogFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	ext := filepath.Ext(r.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().Format(LOG_FILE_TIME_FORMAT), ext)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	r.removeOldFiles()
+	return nil
+}
+
+/**
+Remove rotated files beyond `max_files`, oldest first, and any older than `max_age`
+*/
+func (r *rotatingLogFile) removeOldFiles() {
+	rotated, err := rotatedLogFiles(r.path)
+	if err != nil {
+		return
+	}
+	for i, path := range rotated {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if i < len(rotated)-r.maxFiles || time.Since(info.ModTime()) > r.maxAge {
+			os.Remove(path)
+		}
+	}
+}
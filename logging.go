@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+/**
+How the connector logs - `level` is debug, info (default), warn or error, and `format` is text (key=value, the
+default) or json, one object per line. With a `file`, the log is written there too, rotated once it reaches
+`max_size` MB and daily, keeping `max_files` rotated files for up to `max_age` days. With `syslog`, it's sent to a
+syslog server too.
+*/
+type LogConfig struct {
+	Level    string `json:"level,omitempty"`
+	Format   string `json:"format,omitempty"`
+	File     string `json:"file,omitempty"`
+	MaxSize  int    `json:"max_size,omitempty"`
+	MaxAge   int    `json:"max_age,omitempty"`
+	MaxFiles int    `json:"max_files,omitempty"`
+
+	Syslog *SyslogConfig `json:"syslog,omitempty"`
+}
+
+// Changed in place when the config is reloaded, so loggers made from the one below follow it
+var logLevel = new(slog.LevelVar)
+
+// Starts out as text to stdout, until the config says otherwise
+var logger = newLogger(LOG_FORMAT_TEXT, os.Stdout, nil)
+
+/**
+A logger writing in the given format, and to syslog if there's a config for it. A connector running a profile tags
+every line with it, as the connectors for all the profiles share the service's output.
+*/
+func newLogger(format string, out io.Writer, syslog *SyslogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(out, options)
+	if format == LOG_FORMAT_JSON {
+		handler = slog.NewJSONHandler(out, options)
+	}
+	if syslog != nil {
+		handler = newSyslogHandler(handler, format, syslog)
+	}
+	handler = eventLogHandler{next: handler}
+	if profileFlag != "" {
+		return slog.New(handler).With("profile", profileFlag)
+	}
+	return slog.New(handler)
+}
+
+/**
+Check the log level and format are ones the connector knows
+*/
+func (l *LogConfig) Validate() error {
+	if _, err := parseLogLevel(l.Level); err != nil {
+		return err
+	}
+	switch l.Format {
+	case "", LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		return fmt.Errorf("log.format %q isn't one the connector knows - use text or json.", l.Format)
+	}
+	if l.MaxSize < 0 || l.MaxAge < 0 || l.MaxFiles < 0 {
+		return errors.New("log.max_size, log.max_age and log.max_files can't be negative.")
+	}
+	if l.Syslog != nil {
+		return l.Syslog.Validate()
+	}
+	return nil
+}
+
+/**
+The level for a name in the config, info if there isn't one
+*/
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.ToLower(name))); err != nil {
+		return level, fmt.Errorf("log.level %q isn't one the connector knows - use debug, info, warn or error.", name)
+	}
+	return level, nil
+}
+
+/**
+Log in the format the config asks for, at its level, and to its log file. This is only done at startup, before
+anything else is logging - a reload only changes the level. The log file comes first, as writing to stdout fails
+when a Windows service has no console.
+*/
+func configureLogging(c *ConfigFile) {
+	setLogLevel(c)
+	var out io.Writer = os.Stdout
+	var syslog *SyslogConfig
+	if c.Log != nil && c.Log.File != "" {
+		out = io.MultiWriter(newRotatingLogFile(c.Log), os.Stdout)
+	}
+	if c.Log != nil {
+		syslog = c.Log.Syslog
+	}
+	logger = newLogger(logFormatOf(c), out, syslog)
+}
+
+/**
+Log at the level the config asks for, or debug with `-debug` - a level that doesn't validate is left as it was
+*/
+func setLogLevel(c *ConfigFile) {
+	name := ""
+	if c.Log != nil {
+		name = c.Log.Level
+	}
+	if level, err := parseLogLevel(name); err == nil {
+		logLevel.Set(level)
+	}
+	if debugFlag {
+		logLevel.Set(slog.LevelDebug)
+	}
+}
+
+/**
+The log format a config asks for
+*/
+func logFormatOf(c *ConfigFile) string {
+	if c.Log != nil && c.Log.Format == LOG_FORMAT_JSON {
+		return LOG_FORMAT_JSON
+	}
+	return LOG_FORMAT_TEXT
+}
+
+/**
+The log settings that only take effect on a restart - everything but the level
+*/
+func logRestartSettings(c *ConfigFile) LogConfig {
+	if c.Log == nil {
+		return LogConfig{}
+	}
+	settings := *c.Log
+	settings.Level = ""
+	return settings
+}
+
+/**
+A logger for one task, so every line about it can be picked out by its ID and type
+*/
+func taskLogger(task Task) *slog.Logger {
+	return logger.With("task_id", task.Id, "type", task.Type)
+}
+
+/**
+How long something has taken, in milliseconds, as a log field
+*/
+func durationField(start time.Time) slog.Attr {
+	return slog.Int64("duration_ms", time.Since(start).Milliseconds())
+}
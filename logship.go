@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LOG_SHIPPING_DEFAULT_MAX_SIZE = 20 // MB
+	LOG_SHIPPING_CHECK_INTERVAL   = time.Minute
+	LOG_SHIPPING_MARK_SIZE        = 256
+)
+
+/**
+Send the connector's log to the `support_logs` endpoint every `interval` hours, e.g. `{"interval": 24}`, so support
+can see what it's been doing without asking anyone to find the file. Without an interval logs are only sent when a
+support logs task asks for them. `max_size` caps how much log is sent at once, in MB before compression.
+*/
+type LogShippingConfig struct {
+	Interval int `json:"interval,omitempty"`
+	MaxSize  int `json:"max_size,omitempty"`
+}
+
+/**
+Check the interval and size, and that there's a log file to send
+*/
+func (l *LogShippingConfig) Validate(logConfig *LogConfig) error {
+	if l.Interval < 0 || l.MaxSize < 0 {
+		return errors.New("log_shipping.interval and log_shipping.max_size can't be negative.")
+	}
+	if l.Interval > 0 && (logConfig == nil || logConfig.File == "") {
+		return errors.New("log_shipping needs log.file to be set, as that's the log it sends.")
+	}
+	return nil
+}
+
+/**
+The most log to send at once, in bytes
+*/
+func logShippingMaxSize() int64 {
+	config := currentConfig()
+	maxSize := LOG_SHIPPING_DEFAULT_MAX_SIZE
+	if config.LogShipping != nil && config.LogShipping.MaxSize > 0 {
+		maxSize = config.LogShipping.MaxSize
+	}
+	return int64(maxSize) * 1024 * 1024
+}
+
+/**
+A log file, or part of one, in a bundle. `offset` is where in the file the part starts.
+*/
+type LogBundleFile struct {
+	Name      string    `json:"name"`
+	Offset    int64     `json:"offset,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Modified  time.Time `json:"modified"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+/**
+How much of the log the scheduled uploads have sent - the length of the file that was current at the last one, and its
+first bytes to find it by once it's been rotated to a new name
+*/
+type logShipMark struct {
+	head   []byte
+	offset int64
+}
+
+/**
+The mark for a log file `size` bytes long, or nil for an empty one
+*/
+func readLogShipMark(path string, size int64) (*logShipMark, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, size)
+	if size > LOG_SHIPPING_MARK_SIZE {
+		head = head[:LOG_SHIPPING_MARK_SIZE]
+	}
+	if _, err := io.ReadFull(file, head); err != nil {
+		return nil, err
+	}
+	return &logShipMark{head: head, offset: size}, nil
+}
+
+/**
+Whether a log file is the one the mark was taken from
+*/
+func (m *logShipMark) matches(path string, size int64) bool {
+	if m == nil || size < m.offset {
+		return false
+	}
+	head, err := readLogShipMark(path, int64(len(m.head)))
+	return err == nil && head != nil && bytes.Equal(head.head, m.head)
+}
+
+/**
+The log files sent to the `support_logs` endpoint, as a gzipped tar of `files`. `bytes` is its compressed size.
+*/
+type LogBundle struct {
+	Since time.Time       `json:"since"`
+	Files []LogBundleFile `json:"files"`
+	Bytes int             `json:"bytes"`
+}
+
+/**
+A gzipped tar of the log files written to since `since` - the current file and any it's been rotated to - starting
+after what `mark` says was sent last time, if there's a mark. The newest lines are kept if there's more than `maxSize`
+bytes of them, cut at the start of a line. Also returns the mark for the log as it is now.
+*/
+func buildLogBundle(since time.Time, mark *logShipMark, maxSize int64) ([]byte, LogBundle, *logShipMark, error) {
+	config := currentConfig()
+	bundle := LogBundle{Since: since, Files: []LogBundleFile{}}
+	if config.Log == nil || config.Log.File == "" {
+		return nil, bundle, mark, errors.New("The connector isn't logging to a file - set log.file to send its logs.")
+	}
+	path := logFilePath(config.Log)
+	paths, err := rotatedLogFiles(path)
+	if err != nil {
+		return nil, bundle, mark, err
+	}
+	paths = append(paths, path)
+
+	// Newest first, until there's enough - a file last written before `since`, or the marked file, is older than all of it
+	var contents [][]byte
+	nextMark := mark
+	remaining := maxSize
+	for i := len(paths) - 1; i >= 0 && remaining > 0; i-- {
+		info, err := os.Stat(paths[i])
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, bundle, mark, err
+		}
+		if i == len(paths)-1 {
+			if nextMark, err = readLogShipMark(paths[i], info.Size()); err != nil {
+				return nil, bundle, mark, err
+			}
+		}
+		if info.ModTime().Before(since) {
+			break
+		}
+		start := int64(0)
+		marked := mark.matches(paths[i], info.Size())
+		if marked {
+			start = mark.offset
+		}
+		content, truncated, err := readLogEnd(paths[i], start, info.Size(), remaining)
+		if err != nil {
+			return nil, bundle, mark, err
+		}
+		// Too little room left for a whole line
+		if len(content) == 0 && truncated {
+			break
+		}
+		if len(content) > 0 {
+			remaining -= int64(len(content))
+			bundle.Files = append([]LogBundleFile{{
+				Name:      filepath.Base(paths[i]),
+				Offset:    info.Size() - int64(len(content)),
+				Bytes:     int64(len(content)),
+				Modified:  info.ModTime(),
+				Truncated: truncated,
+			}}, bundle.Files...)
+			contents = append([][]byte{content}, contents...)
+		}
+		if marked {
+			break
+		}
+	}
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for i, file := range bundle.Files {
+		header := &tar.Header{Name: file.Name, Mode: 0640, Size: file.Bytes, ModTime: file.Modified}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, bundle, mark, err
+		}
+		if _, err := tarWriter.Write(contents[i]); err != nil {
+			return nil, bundle, mark, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, bundle, mark, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, bundle, mark, err
+	}
+	bundle.Bytes = buffer.Len()
+	return buffer.Bytes(), bundle, nextMark, nil
+}
+
+/**
+The bytes of a log file from `start` up to `size`, or its last `limit` bytes from the start of a line if that's less.
+The file may still be written to, so only what was there when it was looked at is read.
+*/
+func readLogEnd(path string, start int64, size int64, limit int64) ([]byte, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	offset := start
+	if size-offset > limit {
+		offset = size - limit
+	}
+	content := make([]byte, size-offset)
+	if _, err := io.ReadFull(io.NewSectionReader(file, offset, size-offset), content); err != nil {
+		return nil, false, err
+	}
+	if offset > start {
+		if newline := bytes.IndexByte(content, '\n'); newline >= 0 {
+			content = content[newline+1:]
+		}
+	}
+	return content, offset > start, nil
+}
+
+/**
+POST a log bundle to the `support_logs` endpoint, for a task if it was asked for by one
+*/
+func sendLogBundle(task Task, data []byte, bundle LogBundle) error {
+	query := url.Values{}
+	query.Set("since", bundle.Since.Format(time.RFC3339))
+	if task.Id != "" {
+		query.Set("task", task.Id)
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		supportLogsUrl, err := apiEndpointWithQuery(ENDPOINT_SUPPORT_LOGS, task, query)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", supportLogsUrl, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, data); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/gzip")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Sending logs failed: %s", resp.Status)
+	}
+	return verifyResponse(req, resp, body)
+}
+
+/**
+Send the log written since `since` and after `mark`, if there is any, and return the mark to carry on from
+*/
+func shipLogs(task Task, since time.Time, mark *logShipMark) (LogBundle, *logShipMark, error) {
+	data, bundle, nextMark, err := buildLogBundle(since, mark, logShippingMaxSize())
+	if err != nil || len(bundle.Files) == 0 {
+		return bundle, nextMark, err
+	}
+	return bundle, nextMark, sendLogBundle(task, data, bundle)
+}
+
+/**
+Send the log every `log_shipping.interval` hours while the connector runs. Each upload carries on from where the last
+one that got through stopped, so a failed upload's lines go with the next and no line is sent twice. The interval is
+checked every minute, so a reload can turn shipping on or off.
+*/
+func runLogShipping() {
+	var mark *logShipMark
+	lastShipped := time.Now()
+	lastAttempt := lastShipped
+	for {
+		time.Sleep(LOG_SHIPPING_CHECK_INTERVAL)
+		if isShuttingDown() {
+			return
+		}
+		shipping := currentConfig().LogShipping
+		if shipping == nil || shipping.Interval <= 0 || time.Since(lastAttempt) < time.Duration(shipping.Interval)*time.Hour {
+			continue
+		}
+
+		lastAttempt = time.Now()
+		bundle, nextMark, err := shipLogs(Task{}, lastShipped, mark)
+		if err != nil {
+			logger.Warn("Sending logs failed", "error", err)
+			continue
+		}
+		logger.Info("Logs sent", "files", len(bundle.Files), "bytes", bundle.Bytes)
+		lastShipped = lastAttempt
+		mark = nextMark
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_DEFAULT_LISTEN = "127.0.0.1:9464"
+	METRICS_PATH           = "/metrics"
+)
+
+/**
+A local endpoint Prometheus can scrape, e.g. `{"listen": "127.0.0.1:9464"}`. It has no authentication, so only listen
+on an interface the monitoring server can reach.
+*/
+type MetricsConfig struct {
+	Listen string `json:"listen,omitempty"` // address and port to listen on, 127.0.0.1:9464 by default
+}
+
+/**
+Check the listen address is a host and port
+*/
+func (m *MetricsConfig) Validate() error {
+	if m.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		return fmt.Errorf("metrics.listen %q must be a host and port, e.g. 127.0.0.1:9464.", m.Listen)
+	}
+	return nil
+}
+
+/**
+A counter, kept for each combination of its labels' values
+*/
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+/**
+A histogram, kept for each combination of its labels' values
+*/
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // observations in each bucket, not counting earlier buckets
+	sum    float64
+	count  uint64
+}
+
+// Held while any counter or histogram is read or changed
+var metricsLock sync.Mutex
+
+var (
+	pollsTotal = &metricCounter{
+		name:   "goproxy_polls_total",
+		help:   "Polls of the API for tasks, by result (tasks, empty or error).",
+		labels: []string{"result"},
+	}
+	tasksTotal = &metricCounter{
+		name:   "goproxy_tasks_total",
+		help:   "Tasks finished, by type and the status of their result.",
+		labels: []string{"type", "status"},
+	}
+	taskDuration = &metricHistogram{
+		name:    "goproxy_task_duration_seconds",
+		help:    "How long tasks took to run, by type.",
+		labels:  []string{"type"},
+		buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600},
+	}
+	rowsReturned = &metricCounter{
+		name:   "goproxy_rows_returned_total",
+		help:   "Rows returned by database queries, by task type.",
+		labels: []string{"type"},
+	}
+	postbackFailures = &metricCounter{
+		name: "goproxy_postback_failures_total",
+		help: "Task results that couldn't be sent back to the server.",
+	}
+	crashesTotal = &metricCounter{
+		name:   "goproxy_crashes_total",
+		help:   "Panics recovered from, by where they happened (task, worker, poll or result).",
+		labels: []string{"where"},
+	}
+)
+
+/**
+Add to a counter
+*/
+func (c *metricCounter) add(value float64, labelValues ...string) {
+	metricsLock.Lock()
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[strings.Join(labelValues, "\x00")] += value
+	metricsLock.Unlock()
+	sendStatsd(c.name, value, "c", c.labels, labelValues)
+}
+
+/**
+Record an observation in a histogram
+*/
+func (h *metricHistogram) observe(value float64, labelValues ...string) {
+	// Histograms are of seconds, and StatsD timings are in milliseconds
+	sendStatsd(h.name, value*1000, "ms", h.labels, labelValues)
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if h.series == nil {
+		h.series = map[string]*histogramSeries{}
+	}
+	key := strings.Join(labelValues, "\x00")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+/**
+Count a finished task by its type and result
+*/
+func recordTaskMetric(task Task, status string) {
+	tasksTotal.add(1, strconv.FormatUint(task.Type, 10), status)
+}
+
+/**
+Record how long a task ran for
+*/
+func recordTaskDuration(task Task, duration time.Duration) {
+	taskDuration.observe(duration.Seconds(), strconv.FormatUint(task.Type, 10))
+	recordTaskLatency(task, duration)
+}
+
+/**
+Count the rows a database query returned
+*/
+func recordRowsReturned(task Task, rows int) {
+	rowsReturned.add(float64(rows), strconv.FormatUint(task.Type, 10))
+}
+
+/**
+Write every metric out in the Prometheus text format
+*/
+func writeMetrics(w io.Writer) {
+	metricsLock.Lock()
+	for _, counter := range []*metricCounter{pollsTotal, tasksTotal, rowsReturned, postbackFailures, crashesTotal} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		if len(counter.labels) == 0 && len(counter.values) == 0 {
+			fmt.Fprintf(w, "%s 0\n", counter.name)
+		}
+		for _, key := range sortedMetricKeys(counter.values) {
+			fmt.Fprintf(w, "%s%s %s\n", counter.name, metricLabels(counter.labels, key, ""), formatMetric(counter.values[key]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", taskDuration.name, taskDuration.help, taskDuration.name)
+	keys := make([]string, 0, len(taskDuration.series))
+	for key := range taskDuration.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := taskDuration.series[key]
+		var cumulative uint64
+		for i, bound := range taskDuration.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", taskDuration.name, metricLabels(taskDuration.labels, key, formatMetric(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", taskDuration.name, metricLabels(taskDuration.labels, key, "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", taskDuration.name, metricLabels(taskDuration.labels, key, ""), formatMetric(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", taskDuration.name, metricLabels(taskDuration.labels, key, ""), series.count)
+	}
+	metricsLock.Unlock()
+
+	taskLatency.writeSummary(w)
+	dbLatency.writeSummary(w)
+
+	for _, gauge := range currentGauges() {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", gauge.name, gauge.help, gauge.name, gauge.name, gauge.value)
+	}
+}
+
+/**
+A gauge, read as it is now
+*/
+type metricGauge struct {
+	name  string
+	help  string
+	value int
+}
+
+/**
+The gauges as they are now
+*/
+func currentGauges() []metricGauge {
+	return []metricGauge{
+		{"goproxy_tasks_running", "Tasks running now.", int(atomic.LoadInt32(&tasksRunning))},
+		{"goproxy_tasks_queued", "Tasks waiting for a worker.", getTaskQueue().Len()},
+		{"goproxy_db_connections_open", "Database connections open for tasks.", len(dbConnectionSlots)},
+		{"goproxy_paused", "1 while task processing is paused.", boolMetric(isPaused())},
+	}
+}
+
+/**
+The keys of a counter's values, in order
+*/
+func sortedMetricKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/**
+Labels for a series, e.g. `{type="1",status="success"}`, with the `le` label for a histogram bucket
+*/
+func metricLabels(names []string, key string, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(value)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/**
+A metric value as Prometheus writes it
+*/
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+/**
+1 for true, 0 for false
+*/
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+/**
+Serve `/metrics` for Prometheus to scrape
+*/
+func runMetricsListener() {
+	listen := currentConfig().Metrics.Listen
+	if listen == "" {
+		listen = METRICS_DEFAULT_LISTEN
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	logger.Info("Metrics listening", "url", "http://"+listen+METRICS_PATH)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error("Metrics listener stopped", "error", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	CONFIG_VERSION = 2
+)
+
+/**
+Moves a config file's values from one layout version to the next, in place
+*/
+type configMigration func(values map[string]interface{}) error
+
+// The migration from each older version to the one after it
+var configMigrations = map[int]configMigration{
+	1: migrateConfigV1,
+}
+
+/**
+The layout version of decoded config values - files from before versions were added are version 1
+*/
+func configVersion(values map[string]interface{}) (int, error) {
+	switch version := values["version"].(type) {
+	case nil:
+		return 1, nil
+	case float64:
+		return int(version), nil
+	case int:
+		return version, nil
+	case int64:
+		return int(version), nil
+	default:
+		return 0, fmt.Errorf("The config version should be a number, not %v.", version)
+	}
+}
+
+/**
+Bring an older config file up to the current layout on startup, so a change to the layout doesn't break existing
+installs. The original is kept alongside it, e.g. `conf.json.v1.bak`. A config newer than this connector is an
+error - it would be misread.
+*/
+func migrateConfigFile() error {
+	original, err := ioutil.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := decryptConfigData(original)
+	if err != nil {
+		return err
+	}
+	values, err := decodeConfigValues(data, configFormat(configFilePath))
+	if err != nil {
+		return err
+	}
+	version, err := configVersion(values)
+	if err != nil {
+		return err
+	}
+	if version > CONFIG_VERSION {
+		return fmt.Errorf("The config is version %d, but this connector only understands up to version %d - upgrade the connector.", version, CONFIG_VERSION)
+	}
+	if version == CONFIG_VERSION {
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", configFilePath, version)
+	if _, err := os.Stat(backupPath); err == nil {
+		backupPath = fmt.Sprintf("%s.v%d.%s.bak", configFilePath, version, time.Now().Format("20060102150405"))
+	}
+	// Backed up as it was, so an encrypted config stays encrypted
+	if err := ioutil.WriteFile(backupPath, original, 0600); err != nil {
+		return fmt.Errorf("Backing up the config before migrating it: %v", err)
+	}
+
+	names := map[string]bool{}
+	for name := range values {
+		names[name] = true
+	}
+	for from := version; from < CONFIG_VERSION; from++ {
+		if err := configMigrations[from](values); err != nil {
+			return fmt.Errorf("Migrating the config from version %d: %v", from, err)
+		}
+	}
+	values["version"] = CONFIG_VERSION
+
+	changes := map[string]interface{}{}
+	for name, value := range values {
+		changes[name] = value
+	}
+	for name := range names {
+		if _, ok := values[name]; !ok {
+			changes[name] = nil
+		}
+	}
+	if err := updateConfigFile(changes); err != nil {
+		return err
+	}
+	logger.Info("Config migrated", "from_version", version, "to_version", CONFIG_VERSION, "backup", backupPath)
+	return nil
+}
+
+/**
+Version 2 gave each kind of task a section of its own - `allowed_dirs` moves into `files`
+*/
+func migrateConfigV1(values map[string]interface{}) error {
+	dirs, ok := values["allowed_dirs"]
+	if !ok {
+		return nil
+	}
+	files, ok := values["files"].(map[string]interface{})
+	if !ok {
+		files = map[string]interface{}{}
+	}
+	// Directories already in the section win - they were the ones in use
+	if _, ok := files["allowed_dirs"]; !ok {
+		files["allowed_dirs"] = dirs
+	}
+	values["files"] = files
+	delete(values, "allowed_dirs")
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"net/url"
+	"sync"
+)
+
+/**
+OAuth2 client credentials for the task API, used instead of the static API key
+e.g. `{"token_url": "https://auth.digistorm.com.au/oauth/token", "client_id": "school-1", "client_secret": "...", "scopes": ["tasks"]}`
+*/
+type OAuth2Config struct {
+	TokenUrl     string            `json:"token_url"`
+	ClientId     string            `json:"client_id"`
+	ClientSecret string            `json:"client_secret"`
+	Scopes       []string          `json:"scopes,omitempty"`
+	Params       map[string]string `json:"params,omitempty"` // extra token request parameters, e.g. audience
+}
+
+// Caches the access token and fetches a new one when it's about to expire
+var (
+	oauthTokenSource     oauth2.TokenSource
+	oauthTokenSourceLock sync.Mutex
+)
+
+/**
+The shared token source for the API, built on first use
+*/
+func getOAuthTokenSource() (oauth2.TokenSource, error) {
+	config := currentConfig()
+	oauthTokenSourceLock.Lock()
+	defer oauthTokenSourceLock.Unlock()
+	if oauthTokenSource != nil {
+		return oauthTokenSource, nil
+	}
+
+	// Token requests go through the same proxy and TLS settings as the API
+	client, err := apiHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+
+	params := url.Values{}
+	for name, value := range config.OAuth2.Params {
+		params.Set(name, value)
+	}
+	credentials := &clientcredentials.Config{
+		ClientID:       config.OAuth2.ClientId,
+		ClientSecret:   config.OAuth2.ClientSecret,
+		TokenURL:       config.OAuth2.TokenUrl,
+		Scopes:         config.OAuth2.Scopes,
+		EndpointParams: params,
+	}
+	oauthTokenSource = credentials.TokenSource(ctx)
+
+	return oauthTokenSource, nil
+}
+
+/**
+A current access token for the API
+*/
+func getOAuthToken() (*oauth2.Token, error) {
+	tokenSource, err := getOAuthTokenSource()
+	if err != nil {
+		return nil, err
+	}
+	return tokenSource.Token()
+}
@@ -0,0 +1,64 @@
+package main
+
+const (
+	ONCE_EXIT_OK          = 0
+	ONCE_EXIT_FETCH_ERROR = 1
+	ONCE_EXIT_TASK_FAILED = 2
+)
+
+/**
+Fetch tasks once, run them one after another, post their results and return an exit code - for `-once`, so the
+connector can be run from cron, a debugging session or a smoke test without installing the service.
+0 if every task succeeded or there were none, 1 if the fetch failed, 2 if any task didn't succeed.
+*/
+func runOnce() int {
+	defer flushTraces()
+
+	if isPaused() {
+		logger.Info("Task processing is paused")
+		return ONCE_EXIT_OK
+	}
+
+	logger.Info("Checking for tasks")
+	tasks, err := getPendingTasks()
+	recordPollOutcome(err)
+	if err == errNoTasks {
+		logger.Info("No tasks")
+		return ONCE_EXIT_OK
+	}
+	if err != nil {
+		logger.Error("Checking for tasks failed", "error", err)
+		return ONCE_EXIT_FETCH_ERROR
+	}
+
+	exitCode := ONCE_EXIT_OK
+	var succeeded, failed int
+	for _, task := range tasks {
+		if task.Control != "" {
+			handleControlMessage(task)
+			continue
+		}
+		if isDuplicateTask(task) {
+			continue
+		}
+
+		// Run straight away, ignoring `run_at` and `depends_on` - there's no service to hold the task for
+		auditTaskReceived(task)
+		traceTaskReceived(task)
+		storeTask(task)
+		runTask(task)
+
+		dependencyLock.Lock()
+		outcome, ok := taskOutcomes[task.Id]
+		dependencyLock.Unlock()
+		if ok && outcome.success {
+			succeeded++
+		} else {
+			failed++
+			exitCode = ONCE_EXIT_TASK_FAILED
+		}
+	}
+
+	logger.Info("Tasks run", "succeeded", succeeded, "failed", failed)
+	return exitCode
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CONTROL_PAUSE        = "pause"
+	CONTROL_RESUME       = "resume"
+	PAUSE_FILE           = "paused"
+	PAUSE_CHECK_INTERVAL = time.Second
+)
+
+/**
+The file that marks task processing as paused, in the state directory. Keeping the state in a file means
+`-pause` and `-resume` can reach the running service, and a pause lasts through a restart.
+*/
+func pauseFilePath() string {
+	return filepath.Join(stateDir(), PAUSE_FILE)
+}
+
+/**
+Is task processing paused? Tasks are still accepted and queued while it is, but none are started.
+*/
+func isPaused() bool {
+	if _, err := os.Stat(pauseFilePath()); err == nil {
+		return true
+	}
+	// A pause without `-profile` holds every profile
+	if profileFlag != "" {
+		_, err := os.Stat(filepath.Join(filepath.Dir(configFilePath), PAUSE_FILE))
+		return err == nil
+	}
+	return false
+}
+
+/**
+Pause or resume task processing
+*/
+func setPaused(paused bool) error {
+	if !paused {
+		err := os.Remove(pauseFilePath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(pauseFilePath(), []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
+
+/**
+Hold a worker while task processing is paused. Gives up if the connector starts shutting down, so waiting tasks
+are reported as interrupted.
+*/
+func waitWhilePaused() {
+	logged := false
+	for isPaused() && !isShuttingDown() {
+		if !logged {
+			logger.Info("Task processing is paused - waiting to be resumed")
+			logged = true
+		}
+		time.Sleep(PAUSE_CHECK_INTERVAL)
+	}
+}
+
+/**
+Act on a pause or resume control message from the server
+*/
+func handlePauseControl(message Task) error {
+	paused := message.Control == CONTROL_PAUSE
+	if err := setPaused(paused); err != nil {
+		return err
+	}
+	if paused {
+		logger.Info("Task processing paused")
+	} else {
+		logger.Info("Task processing resumed")
+	}
+	return nil
+}
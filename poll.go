@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	POLL_DEFAULT_JITTER_PERCENT = 10
+	POLL_DEFAULT_MIN_INTERVAL   = 1
+)
+
+// The interval polling is running at right now - shorter than `interval` while tasks keep arriving
+var (
+	currentInterval     time.Duration
+	currentIntervalLock sync.Mutex
+)
+
+/**
+How far either way each poll may be moved from `interval` - `poll_jitter` seconds, or 10% of the interval if not
+set. A negative `poll_jitter` turns jitter off.
+*/
+func getPollJitter(interval time.Duration) time.Duration {
+	config := currentConfig()
+	if config.PollJitter < 0 {
+		return 0
+	}
+	if config.PollJitter > 0 {
+		return time.Duration(config.PollJitter) * time.Second
+	}
+	return interval * POLL_DEFAULT_JITTER_PERCENT / 100
+}
+
+/**
+The shortest interval polling speeds up to while tasks keep arriving - `min_interval`, never more than `interval`
+*/
+func getMinInterval() time.Duration {
+	config := currentConfig()
+	interval := time.Duration(config.Interval) * time.Second
+	minInterval := time.Duration(config.MinInterval) * time.Second
+	if config.MinInterval <= 0 {
+		minInterval = POLL_DEFAULT_MIN_INTERVAL * time.Second
+	}
+	if minInterval > interval {
+		minInterval = interval
+	}
+	return minInterval
+}
+
+/**
+The interval polling is running at
+*/
+func getCurrentInterval() time.Duration {
+	currentIntervalLock.Lock()
+	defer currentIntervalLock.Unlock()
+
+	if currentInterval == 0 {
+		currentInterval = time.Duration(currentConfig().Interval) * time.Second
+	}
+	return currentInterval
+}
+
+/**
+Adapt the poll interval to how the last poll went - halve it, down to `min_interval`, when it found tasks, and double
+it back up to `interval` when it didn't, so bursts drain quickly and idle connectors poll at the usual rate
+*/
+func recordPollResult(foundTasks bool) {
+	interval := getCurrentInterval()
+
+	if foundTasks {
+		interval /= 2
+		if minInterval := getMinInterval(); interval < minInterval {
+			interval = minInterval
+		}
+	} else {
+		interval *= 2
+		if maxInterval := time.Duration(currentConfig().Interval) * time.Second; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+
+	currentIntervalLock.Lock()
+	currentInterval = interval
+	currentIntervalLock.Unlock()
+}
+
+/**
+The poll interval moved by a random amount within the jitter, so connectors set up with the same interval drift
+apart instead of all hitting the API on the same second
+*/
+func nextPollDelay() time.Duration {
+	interval := getCurrentInterval()
+	jitter := getPollJitter(interval)
+	if jitter <= 0 {
+		return interval
+	}
+	if jitter > interval {
+		jitter = interval
+	}
+
+	delay := interval - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
+	if delay < time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+/**
+A random wait of up to the jitter before the first poll, so connectors restarted together don't poll together
+*/
+func initialPollDelay() time.Duration {
+	jitter := getPollJitter(time.Duration(currentConfig().Interval) * time.Second)
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter) + 1))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	PROFILES_DIR          = "profiles"
+	PROFILE_RESTART_DELAY = 10 * time.Second
+)
+
+// Profile names become directory names, so keep them plain
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Settings a profile can't have - they belong to the config file as a whole
+var profileOnlyTopLevel = map[string]bool{
+	"profiles":         true,
+	"protect_key":      true,
+	"protect_dsns":     true,
+	"key_protected":    true,
+	"enrollment_token": true,
+}
+
+// The connectors running a profile each, by profile name - stdin is closed to stop one
+var (
+	profileProcesses     = map[string]*exec.Cmd{}
+	profileStdins        = map[string]io.WriteCloser{}
+	profileProcessesLock sync.Mutex
+)
+
+/**
+Where this connector keeps its task store, schedules, pause marker and remote config - next to the config file, or in
+a directory of its own under `profiles` when running a profile, so profiles don't share state
+*/
+func stateDir() string {
+	dir := filepath.Dir(configFilePath)
+	if profileFlag != "" {
+		return filepath.Join(dir, PROFILES_DIR, profileFlag)
+	}
+	return dir
+}
+
+/**
+Lay a named profile's settings over the rest of the config
+*/
+func applyProfile(target *ConfigFile, name string) error {
+	raw, ok := target.Profiles[name]
+	if !ok {
+		return fmt.Errorf("There's no profile named %q in the config.", name)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("Profile %q: %v", name, err)
+	}
+	for setting := range values {
+		if profileOnlyTopLevel[setting] {
+			return fmt.Errorf("Profile %q: %s can't be set per profile.", name, setting)
+		}
+	}
+	if err := json.Unmarshal(raw, target); err != nil {
+		return fmt.Errorf("Profile %q: %v", name, err)
+	}
+	return nil
+}
+
+/**
+The profile names in order
+*/
+func profileNames() []string {
+	config := currentConfig()
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+Is this the connector that runs one connector per profile, rather than polling itself?
+*/
+func isProfileSupervisor() bool {
+	return len(currentConfig().Profiles) > 0 && profileFlag == ""
+}
+
+/**
+Validate the config - or with profiles, the config as each profile sees it
+*/
+func validateConfig() error {
+	if !isProfileSupervisor() {
+		return currentConfig().Validate()
+	}
+
+	base, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	for _, name := range profileNames() {
+		// A fresh copy for each, so profiles don't change each other's maps
+		var profile ConfigFile
+		if err := json.Unmarshal(base, &profile); err != nil {
+			return err
+		}
+		profile.unknownKeys = config.unknownKeys
+		if err := applyProfile(&profile, name); err != nil {
+			return err
+		}
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("Profile %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+/**
+Run a connector for each profile, each restarted if it stops, until the service stops
+*/
+func runProfiles() {
+	names := profileNames()
+	logger.Info("Running profiles", "profiles", names)
+	for _, name := range names {
+		go superviseProfile(name)
+	}
+}
+
+/**
+Keep the connector for a profile running, with its output prefixed by the profile name
+*/
+func superviseProfile(name string) {
+	for !isShuttingDown() {
+		if err := runProfileProcess(name); err != nil {
+			logger.Error("Profile failed", "profile", name, "error", err)
+		}
+		if isShuttingDown() {
+			return
+		}
+		logger.Warn("Profile stopped - restarting", "profile", name, "delay", PROFILE_RESTART_DELAY.String())
+		time.Sleep(PROFILE_RESTART_DELAY)
+	}
+}
+
+/**
+Start the connector for a profile and wait for it to exit
+*/
+func runProfileProcess(name string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-config", configFilePath, "-profile", name, "-profile-child"}
+	if debugFlag {
+		args = append(args, "-debug")
+	}
+	cmd := exec.Command(executable, args...)
+
+	output, outputWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		outputWriter.Close()
+		return err
+	}
+
+	profileProcessesLock.Lock()
+	if isShuttingDown() {
+		profileProcessesLock.Unlock()
+		outputWriter.Close()
+		return nil
+	}
+	err = cmd.Start()
+	outputWriter.Close()
+	if err == nil {
+		profileProcesses[name] = cmd
+		profileStdins[name] = stdin
+	}
+	profileProcessesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The child tags its own log lines with the profile, so they're passed on as they are - whole lines, so profiles'
+	// lines don't get mixed up, however long they are
+	reader := bufio.NewReader(output)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		os.Stdout.Write(line)
+		if readErr != nil {
+			break
+		}
+	}
+	err = cmd.Wait()
+
+	profileProcessesLock.Lock()
+	delete(profileProcesses, name)
+	delete(profileStdins, name)
+	profileProcessesLock.Unlock()
+	return err
+}
+
+/**
+Stop the connectors for each profile, giving them the same time to wind down as a connector of their own, then
+killing any still running
+*/
+func stopProfiles() {
+	profileProcessesLock.Lock()
+	processes := make(map[string]*exec.Cmd, len(profileProcesses))
+	for name, cmd := range profileProcesses {
+		processes[name] = cmd
+		profileStdins[name].Close()
+	}
+	profileProcessesLock.Unlock()
+
+	deadline := time.Now().Add(getShutdownGrace() + SHUTDOWN_RESULT_WAIT + TASK_ABANDON_GRACE)
+	for name, cmd := range processes {
+		for {
+			profileProcessesLock.Lock()
+			_, running := profileProcesses[name]
+			profileProcessesLock.Unlock()
+			if !running {
+				break
+			}
+			if time.Now().After(deadline) {
+				logger.Warn("Profile didn't stop in time - killing it", "profile", name)
+				cmd.Process.Kill()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+/**
+Run as the connector for one profile under the service, until the service closes our stdin or we're interrupted
+*/
+func runProfileChild(p *Program) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		stop <- os.Interrupt
+	}()
+
+	go p.run()
+	<-stop
+	shutdown()
+}
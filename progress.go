@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROGRESS_DEFAULT_INTERVAL = 15
+)
+
+/**
+How far through a long-running task is
+*/
+type Progress struct {
+	Stage      string  `json:"stage"`
+	Rows       int64   `json:"rows,omitempty"`
+	Bytes      int64   `json:"bytes,omitempty"`
+	TotalBytes int64   `json:"total_bytes,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	Elapsed    int64   `json:"elapsed_seconds"`
+	Eta        int64   `json:"eta_seconds,omitempty"`
+}
+
+/**
+Sends progress updates for one stage of a task, no more often than every `progress_interval` seconds
+*/
+type ProgressReporter struct {
+	task       Task
+	stage      string
+	totalBytes int64
+	started    time.Time
+	lastSent   time.Time
+	sending    int32
+	lock       sync.Mutex
+}
+
+/**
+Start reporting progress for a stage of a task - `totalBytes` is 0 if the size isn't known
+*/
+func newProgressReporter(task Task, stage string, totalBytes int64) *ProgressReporter {
+	now := time.Now()
+	return &ProgressReporter{
+		task:       task,
+		stage:      stage,
+		totalBytes: totalBytes,
+		started:    now,
+		lastSent:   now,
+	}
+}
+
+/**
+How often to send progress updates, or 0 if they're turned off
+*/
+func getProgressInterval() time.Duration {
+	config := currentConfig()
+	if config.ProgressInterval < 0 {
+		return 0
+	}
+	if config.ProgressInterval == 0 {
+		return PROGRESS_DEFAULT_INTERVAL * time.Second
+	}
+	return time.Duration(config.ProgressInterval) * time.Second
+}
+
+/**
+Record how many rows and bytes have been processed so far, sending an update if one is due. Updates are sent in the
+background so a slow API doesn't hold the task up.
+*/
+func (p *ProgressReporter) Update(rows int64, bytesDone int64) {
+	interval := getProgressInterval()
+	if p == nil || interval == 0 {
+		return
+	}
+
+	p.lock.Lock()
+	if time.Since(p.lastSent) < interval {
+		p.lock.Unlock()
+		return
+	}
+	p.lastSent = time.Now()
+	p.lock.Unlock()
+
+	progress := Progress{
+		Stage:      p.stage,
+		Rows:       rows,
+		Bytes:      bytesDone,
+		TotalBytes: p.totalBytes,
+		Elapsed:    int64(time.Since(p.started).Seconds()),
+	}
+	if p.totalBytes > 0 && bytesDone > 0 {
+		progress.Percent = float64(bytesDone) * 100 / float64(p.totalBytes)
+		remaining := time.Duration(float64(time.Since(p.started)) * float64(p.totalBytes-bytesDone) / float64(bytesDone))
+		progress.Eta = int64(remaining.Seconds())
+	}
+
+	// Skip this update if the last one is still on its way
+	if !atomic.CompareAndSwapInt32(&p.sending, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&p.sending, 0)
+		if err := sendProgress(p.task, progress); err != nil {
+			taskLogger(p.task).Warn("Progress not sent", "error", err)
+		}
+	}()
+}
+
+/**
+Send a progress update over the transport the task came in on, or POST it to the progress endpoint. Not retried -
+the next update will do.
+*/
+func sendProgress(task Task, progress Progress) error {
+	response := JsonResponse{TaskId: task.Id, Schedule: task.schedule, Type: "progress", Body: progress}
+	if task.respond != nil {
+		if err := task.respond(response); !errors.Is(err, errStreamGone) {
+			return err
+		}
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+	progressUrl, err := apiEndpoint(ENDPOINT_PROGRESS, task)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", progressUrl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if err := authenticateRequest(req, payload); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Progress update failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-ntlmssp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	PROXY_AUTH_BASIC     = "basic"
+	PROXY_AUTH_NTLM      = "ntlm"
+	PROXY_AUTH_NEGOTIATE = "negotiate"
+)
+
+/**
+Outbound proxy for connections to the task API. Without one, the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment
+variables are used.
+e.g. `{"url": "http://proxy.school.local:8080", "username": "SCHOOL\\svc-goproxy", "password": "...", "auth": "ntlm"}`
+*/
+type ProxyConfig struct {
+	Url      string `json:"url"`
+	Username string `json:"username,omitempty"` // DOMAIN\user for NTLM
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"` // "basic" (default), "ntlm" or "negotiate"
+}
+
+/**
+Send a CONNECT request down the proxy connection and read the response
+*/
+func proxyConnect(conn net.Conn, reader *bufio.Reader, addr string, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	req.Header.Set("Proxy-Connection", "Keep-Alive")
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	// A CONNECT response has no body unless it failed - drain it so the connection can be reused for the handshake
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	return resp, nil
+}
+
+/**
+CONNECT with an NTLM handshake - negotiate, read the proxy's challenge, then authenticate, all on the same connection
+*/
+func proxyConnectNtlm(conn net.Conn, reader *bufio.Reader, addr string, scheme string, proxyConfig *ProxyConfig) (*http.Response, error) {
+	user, domain, domainNeeded := ntlmssp.GetDomain(proxyConfig.Username)
+
+	negotiate, err := ntlmssp.NewNegotiateMessage(domain, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proxyConnect(conn, reader, addr, scheme+" "+base64.StdEncoding.EncodeToString(negotiate))
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+
+	var challenge []byte
+	for _, header := range resp.Header.Values("Proxy-Authenticate") {
+		if strings.HasPrefix(header, scheme+" ") {
+			challenge, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(header, scheme+" "))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("Proxy did not send an %s challenge.", scheme)
+	}
+
+	authenticate, err := ntlmssp.ProcessChallenge(challenge, user, proxyConfig.Password, domainNeeded)
+	if err != nil {
+		return nil, err
+	}
+	return proxyConnect(conn, reader, addr, scheme+" "+base64.StdEncoding.EncodeToString(authenticate))
+}
+
+/**
+Open a tunnel to `addr` through the configured proxy, authenticating with basic, NTLM or Negotiate (NTLM inside
+SPNEGO). NTLM authenticates the connection rather than the request, so the whole handshake happens on one connection.
+*/
+func dialProxy(ctx context.Context, network string, addr string) (net.Conn, error) {
+	proxyConfig := currentConfig().Proxy
+	proxyUrl, err := url.Parse(proxyConfig.Url)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "8080")
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(getHttpConfig().ConnectTimeout) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	auth := strings.ToLower(proxyConfig.Auth)
+	if auth == "" {
+		auth = PROXY_AUTH_BASIC
+	}
+
+	var resp *http.Response
+	switch {
+	case proxyConfig.Username == "":
+		resp, err = proxyConnect(conn, reader, addr, "")
+	case auth == PROXY_AUTH_BASIC:
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyConfig.Username + ":" + proxyConfig.Password))
+		resp, err = proxyConnect(conn, reader, addr, "Basic "+credentials)
+	case auth == PROXY_AUTH_NTLM || auth == PROXY_AUTH_NEGOTIATE:
+		scheme := "NTLM"
+		if auth == PROXY_AUTH_NEGOTIATE {
+			scheme = "Negotiate"
+		}
+		resp, err = proxyConnectNtlm(conn, reader, addr, scheme, proxyConfig)
+	default:
+		return fail(fmt.Errorf("Unsupported proxy auth %q.", proxyConfig.Auth))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fail(errors.New("Proxy refused the connection: " + resp.Status))
+	}
+	if reader.Buffered() > 0 {
+		return fail(errors.New("Proxy sent unexpected data after CONNECT."))
+	}
+
+	return conn, nil
+}
+
+/**
+Route a transport through the configured proxy, or through the environment's proxy settings when there isn't one
+*/
+func configureProxy(transport *http.Transport) {
+	config := currentConfig()
+	if config.Proxy == nil || config.Proxy.Url == "" {
+		transport.Proxy = http.ProxyFromEnvironment
+		return
+	}
+
+	// Every connection is tunnelled with CONNECT so NTLM can authenticate it, for http:// URLs as well as https://
+	transport.Proxy = nil
+	transport.DialContext = dialProxy
+}
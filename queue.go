@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+/**
+A task waiting in the queue, with the order it arrived in so tasks of the same priority stay first come, first served,
+and the key of anything it must not run alongside
+*/
+type queuedTask struct {
+	task     Task
+	sequence uint64
+	key      string
+}
+
+/**
+Queued tasks ordered by priority, highest first - implements `heap.Interface`
+*/
+type taskHeap []queuedTask
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].task.Priority != h[j].task.Priority {
+		return h[i].task.Priority > h[j].task.Priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(queuedTask)) }
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+/**
+A bounded queue of tasks waiting for a worker, handing out the highest priority task first. Tasks with the same
+key (e.g. the same database) are handed out one at a time - the next one waits until the last is done - while tasks
+with different keys run side by side.
+*/
+type TaskQueue struct {
+	tasks    taskHeap
+	size     int
+	sequence uint64
+	busyKeys map[string]bool
+	lock     sync.Mutex
+	ready    *sync.Cond
+	notFull  *sync.Cond
+}
+
+/**
+Make a queue that holds up to `size` tasks
+*/
+func newTaskQueue(size int) *TaskQueue {
+	queue := &TaskQueue{size: size, busyKeys: map[string]bool{}}
+	queue.ready = sync.NewCond(&queue.lock)
+	queue.notFull = sync.NewCond(&queue.lock)
+	return queue
+}
+
+/**
+Add a task, waiting while the queue is full - `onFull` is called first if it has to wait. Tasks with the same
+non-empty `key` never run at the same time.
+*/
+func (q *TaskQueue) Push(task Task, key string, onFull func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.tasks) >= q.size && onFull != nil {
+		onFull()
+	}
+	for len(q.tasks) >= q.size {
+		q.notFull.Wait()
+	}
+
+	q.sequence++
+	heap.Push(&q.tasks, queuedTask{task: task, sequence: q.sequence, key: key})
+	// Not every worker can take every task, so wake them all to look
+	q.ready.Broadcast()
+}
+
+/**
+The index of the highest priority task whose key isn't busy, or -1 if there isn't one. Must be called holding the lock.
+*/
+func (q *TaskQueue) nextReady() int {
+	next := -1
+	for i, item := range q.tasks {
+		if item.key != "" && q.busyKeys[item.key] {
+			continue
+		}
+		// The top of the heap is the best there is
+		if i == 0 {
+			return 0
+		}
+		if next < 0 || q.tasks.Less(i, next) {
+			next = i
+		}
+	}
+	return next
+}
+
+/**
+Take the highest priority task that can run now, waiting until there is one. Its key stays busy until `Done` is
+called with it.
+*/
+func (q *TaskQueue) Pop() (Task, string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	next := q.nextReady()
+	for next < 0 {
+		q.ready.Wait()
+		next = q.nextReady()
+	}
+
+	item := heap.Remove(&q.tasks, next).(queuedTask)
+	if item.key != "" {
+		q.busyKeys[item.key] = true
+	}
+	q.notFull.Signal()
+	return item.task, item.key
+}
+
+/**
+Mark a task's key as free, so the next task with the same key can run
+*/
+func (q *TaskQueue) Done(key string) {
+	if key == "" {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.busyKeys, key)
+	q.ready.Broadcast()
+}
+
+/**
+Take every waiting task out of the queue, highest priority first
+*/
+func (q *TaskQueue) Drain() []Task {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var tasks []Task
+	for len(q.tasks) > 0 {
+		tasks = append(tasks, heap.Pop(&q.tasks).(queuedTask).task)
+	}
+	q.notFull.Broadcast()
+	return tasks
+}
+
+/**
+Is the queue full?
+*/
+func (q *TaskQueue) Full() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.tasks) >= q.size
+}
+
+/**
+How many tasks are waiting
+*/
+func (q *TaskQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.tasks)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+Limits on how often, and how many at once, tasks of one type may run
+e.g. `{"per_minute": 10, "burst": 2, "concurrent": 1}`
+*/
+type RateLimitConfig struct {
+	PerMinute  float64 `json:"per_minute,omitempty"` // tasks started per minute, 0 for no limit
+	Burst      int     `json:"burst,omitempty"`      // tasks that may start back to back before `per_minute` applies, default 1
+	Concurrent int     `json:"concurrent,omitempty"` // tasks running at once, 0 for no limit
+}
+
+/**
+The limiters for one task type, built from its config on first use
+*/
+type typeLimiter struct {
+	rate  *rate.Limiter
+	slots chan struct{}
+}
+
+var (
+	typeLimiters     = map[uint64]*typeLimiter{}
+	typeLimitersLock sync.Mutex
+)
+
+/**
+The limiters for a task type, or nil if the type isn't limited
+*/
+func getTypeLimiter(taskType uint64) *typeLimiter {
+	typeLimitersLock.Lock()
+	defer typeLimitersLock.Unlock()
+
+	if limiter, ok := typeLimiters[taskType]; ok {
+		return limiter
+	}
+
+	limitConfig, ok := currentConfig().RateLimits[strconv.FormatUint(taskType, 10)]
+	if !ok {
+		typeLimiters[taskType] = nil
+		return nil
+	}
+	limiter := &typeLimiter{}
+	if limitConfig.PerMinute > 0 {
+		burst := limitConfig.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiter.rate = rate.NewLimiter(rate.Limit(limitConfig.PerMinute/60), burst)
+	}
+	if limitConfig.Concurrent > 0 {
+		limiter.slots = make(chan struct{}, limitConfig.Concurrent)
+	}
+	typeLimiters[taskType] = limiter
+	return limiter
+}
+
+/**
+Wait until a task's type is allowed to run another task. The returned function gives its slot back once the task is
+done. Fails if the context is cancelled while waiting.
+*/
+func acquireTypeLimit(ctx context.Context, task Task) (func(), error) {
+	limiter := getTypeLimiter(task.Type)
+	if limiter == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if limiter.slots != nil {
+			<-limiter.slots
+		}
+	}
+	if limiter.rate != nil {
+		if err := limiter.rate.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	if waited := time.Since(start); waited > time.Second {
+		taskLogger(task).Info("Task waited for its type's rate limit", "waited", waited.Round(time.Second).String())
+	}
+	return release, nil
+}
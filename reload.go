@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CONFIG_RELOAD_SETTLE  = time.Second
+	RELOAD_FILE           = "reload"
+	RELOAD_CHECK_INTERVAL = time.Second
+)
+
+// Held while the config is reloaded, so reloads from the watcher and signals don't overlap
+var configReloadLock sync.Mutex
+
+// The config the connector is running with, once it's been changed while running - see currentConfig
+var (
+	liveConfig       atomic.Pointer[ConfigFile]
+	configUpdateLock sync.Mutex
+)
+
+/**
+The config the connector is running with. Nothing changes it in place once the connector is running - a reload
+publishes a new copy instead - so it's safe to read from any goroutine. Functions that read several settings take it
+once, as `config := currentConfig()`, so they all come from the same copy. Until the first change it's the config
+loaded at startup.
+*/
+func currentConfig() *ConfigFile {
+	if live := liveConfig.Load(); live != nil {
+		return live
+	}
+	return &config
+}
+
+/**
+Publish a copy of the running config with changes made to it. Sections and maps in the copy are shared with the old
+one, so `change` must replace them rather than change them.
+*/
+func updateConfig(change func(next *ConfigFile)) {
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+	next := *currentConfig()
+	change(&next)
+	liveConfig.Store(&next)
+}
+
+/**
+Load the config file again, with the remote config over it, and apply what can change while tasks are running - the
+API URLs and endpoints, poll timing, timeouts, retries, limits and allowlists. Anything else needs a restart, and is
+logged if it changed. A config that doesn't load or validate is ignored, leaving the current one in place.
+*/
+func reloadConfiguration() error {
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+	current := currentConfig()
+
+	// As at startup, there may be no file when the config comes from the environment or registry
+	var reloaded ConfigFile
+	data, err := readConfigFile(configFilePath)
+	if err == nil {
+		err = decodeConfig(data, configFormat(configFilePath), &reloaded)
+	} else if os.IsNotExist(err) && (hasEnvironmentConfig() || hasRegistryConfig()) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := applyConfigDir(&reloaded); err != nil {
+		return err
+	}
+	if err := applyRegistryConfig(&reloaded); err != nil {
+		return err
+	}
+	if profileFlag != "" {
+		if err := applyProfile(&reloaded, profileFlag); err != nil {
+			return err
+		}
+	}
+	if err := overlayRemoteConfig(&reloaded); err != nil {
+		return err
+	}
+	if err := applyEnvironment(&reloaded); err != nil {
+		return err
+	}
+	if err := applyCommandLine(&reloaded); err != nil {
+		return err
+	}
+	applyConfigDefaults(&reloaded)
+	if err := unprotectDatabaseDsns(&reloaded); err != nil {
+		return err
+	}
+	if err := resolveConfigSecrets(&reloaded); err != nil {
+		return err
+	}
+	// The key is only recovered from `key_protected` at startup
+	if reloaded.ApiKey == "" {
+		reloaded.ApiKey = current.ApiKey
+	}
+	if err := reloaded.Validate(); err != nil {
+		return err
+	}
+
+	for name, changed := range map[string]bool{
+		"transport":          reloaded.Transport != current.Transport,
+		"concurrency":        reloaded.Concurrency != current.Concurrency,
+		"queue_size":         reloaded.QueueSize != current.QueueSize,
+		"max_db_connections": reloaded.MaxDbConnections != current.MaxDbConnections,
+		"schedules":          !sameJson(reloaded.Schedules, current.Schedules),
+		"webhook":            !sameJson(reloaded.Webhook, current.Webhook),
+		"metrics":            !sameJson(reloaded.Metrics, current.Metrics),
+		"status":             !sameJson(reloaded.Status, current.Status),
+		"audit":              !sameJson(reloaded.Audit, current.Audit),
+		"tracing":            !sameJson(reloaded.Tracing, current.Tracing),
+		"statsd":             !sameJson(reloaded.Statsd, current.Statsd),
+		"log":                !sameJson(logRestartSettings(&reloaded), logRestartSettings(current)),
+	} {
+		if changed {
+			logger.Warn("Config changed - restart the connector to apply it", "event_id", EVENT_CONFIG_NEEDS_RESTART, "setting", name)
+		}
+	}
+
+	// A new copy of the config is published rather than the running one changed under the goroutines reading it.
+	// The URL and rate limits change along with the state that goes with them.
+	activeUrlLock.Lock()
+	typeLimitersLock.Lock()
+	updateConfig(func(next *ConfigFile) {
+		if !sameJson(reloaded.Url, next.Url) {
+			next.Url = reloaded.Url
+			activeUrl = 0
+		}
+		next.Endpoints = reloaded.Endpoints
+		next.Interval = reloaded.Interval
+		next.MinInterval = reloaded.MinInterval
+		next.PollJitter = reloaded.PollJitter
+		next.LongPollWait = reloaded.LongPollWait
+		next.BatchSize = reloaded.BatchSize
+		next.HeartbeatInterval = reloaded.HeartbeatInterval
+		next.ProgressInterval = reloaded.ProgressInterval
+		next.ShutdownGrace = reloaded.ShutdownGrace
+		next.TaskTimeout = reloaded.TaskTimeout
+		next.DedupeWindow = reloaded.DedupeWindow
+		next.HistoryDays = reloaded.HistoryDays
+		next.Sentry = reloaded.Sentry
+		next.SlowQueries = reloaded.SlowQueries
+		next.Debug = reloaded.Debug
+		next.LogShipping = reloaded.LogShipping
+		next.Retry = reloaded.Retry
+		next.TaskRetries = reloaded.TaskRetries
+		next.AllowedDirs = reloaded.AllowedDirs
+		next.AllowedServices = reloaded.AllowedServices
+		next.Mysql = reloaded.Mysql
+		next.Mssql = reloaded.Mssql
+		next.Files = reloaded.Files
+		next.Shell = reloaded.Shell
+		next.Databases = reloaded.Databases
+		next.RequireDsnAlias = reloaded.RequireDsnAlias
+		next.DisabledTaskTypes = reloaded.DisabledTaskTypes
+		next.RemoteConfigInterval = reloaded.RemoteConfigInterval
+		next.RateLimits = reloaded.RateLimits
+	})
+	// Limiters are built again from the new limits as tasks need them
+	typeLimiters = map[uint64]*typeLimiter{}
+	typeLimitersLock.Unlock()
+	activeUrlLock.Unlock()
+	setLogLevel(&reloaded)
+
+	logger.Info("Config reloaded", "event_id", EVENT_CONFIG_RELOADED)
+	return nil
+}
+
+/**
+Do two values encode to the same JSON?
+*/
+func sameJson(a interface{}, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
+
+/**
+Reload the config, logging why if it can't be
+*/
+func reloadConfigurationAndLog() {
+	if err := reloadConfiguration(); err != nil {
+		logger.Error("Config not reloaded", "event_id", EVENT_CONFIG_RELOAD_FAILED, "error", err)
+	}
+}
+
+/**
+Reload the config whenever its file, or a file in conf.d, changes. The directories are watched rather than the files,
+as editors often save by writing a new file and renaming it over the old one. Changes are left to settle first, so a
+save in several writes is only loaded once. A conf.d directory created after startup isn't watched until a restart.
+*/
+func watchConfigFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Config watcher not started", "error", err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(configFilePath)); err != nil {
+		logger.Error("Config watcher not started", "error", err)
+		watcher.Close()
+		return
+	}
+	if info, err := os.Stat(configDirPath()); err == nil && info.IsDir() {
+		if err := watcher.Add(configDirPath()); err != nil {
+			logger.Warn("Config watcher can't watch conf.d", "error", err)
+		}
+	}
+
+	settle := time.NewTimer(CONFIG_RELOAD_SETTLE)
+	settle.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Removing a drop-in file changes the config too, where removing the main file doesn't
+			inConfigDir := filepath.Dir(filepath.Clean(event.Name)) == filepath.Clean(configDirPath())
+			isConfigFile := filepath.Clean(event.Name) == filepath.Clean(configFilePath)
+			if isConfigFile && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 ||
+				inConfigDir && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				settle.Reset(CONFIG_RELOAD_SETTLE)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("Config watcher failed", "error", err)
+		case <-settle.C:
+			reloadConfigurationAndLog()
+		}
+	}
+}
+
+/**
+The file `goproxy reload` leaves in the state directory to ask the running connector to reload. It reaches the
+service on any platform, including Windows, where it can't be sent a signal.
+*/
+func reloadRequestPath() string {
+	return filepath.Join(stateDir(), RELOAD_FILE)
+}
+
+/**
+Ask the running connector to reload its config
+*/
+func requestReload() error {
+	return ioutil.WriteFile(reloadRequestPath(), []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
+
+/**
+Reload the config whenever `goproxy reload` asks for it. The request file is removed as it's seen, so each request
+reloads once.
+*/
+func watchReloadRequests() {
+	// One left from before a restart has already been met by loading the config
+	os.Remove(reloadRequestPath())
+	for !isShuttingDown() {
+		time.Sleep(RELOAD_CHECK_INTERVAL)
+		if err := os.Remove(reloadRequestPath()); err == nil {
+			logger.Info("Reload requested")
+			reloadConfigurationAndLog()
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/**
+Reload the config on SIGHUP, as Unix daemons do, or when `goproxy reload` asks
+*/
+func handleReloadSignal() {
+	go watchReloadRequests()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfigurationAndLog()
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+/**
+Windows has no SIGHUP, and the service manager has no reload control the service library can receive - so there
+`goproxy reload` asks for one through the state directory
+*/
+func handleReloadSignal() {
+	watchReloadRequests()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	REMOTE_CONFIG_DEFAULT_INTERVAL = 300
+	REMOTE_CONFIG_FILE             = "remote_config.json"
+)
+
+// Settings the server may set - ones that can change while the connector runs. The URL, key, transport and anything
+// else that decides how the connector reaches the server stay local, so a bad remote config can't cut it off. So do
+// the admin's limits on what the server may do - allowed dirs and services, shell and file settings - apart from
+// `disabled_task_types`, which the server can only add to.
+var remoteConfigKeys = map[string]bool{
+	"interval":            true,
+	"min_interval":        true,
+	"poll_jitter":         true,
+	"batch_size":          true,
+	"heartbeat_interval":  true,
+	"progress_interval":   true,
+	"shutdown_grace":      true,
+	"task_timeout":        true,
+	"dedupe_window":       true,
+	"task_retries":        true,
+	"rate_limits":         true,
+	"disabled_task_types": true,
+}
+
+// The settings last fetched from the server, laid over the local config
+var (
+	remoteConfig     map[string]json.RawMessage
+	remoteConfigLock sync.Mutex
+)
+
+/**
+Where the last remote config is kept, so it still applies if the server can't be reached after a restart
+*/
+func remoteConfigPath() string {
+	return filepath.Join(stateDir(), REMOTE_CONFIG_FILE)
+}
+
+/**
+Load the remote config saved the last time it was fetched
+*/
+func loadCachedRemoteConfig() error {
+	data, err := ioutil.ReadFile(remoteConfigPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	remoteConfigLock.Lock()
+	remoteConfig = values
+	remoteConfigLock.Unlock()
+	return nil
+}
+
+/**
+Lay the remote config over a config loaded from the local file - remote settings win, except that task types turned
+off locally stay off. Settings the server may not set are skipped, in case they're in a config saved by an older
+version.
+*/
+func overlayRemoteConfig(target *ConfigFile) error {
+	remoteConfigLock.Lock()
+	values := remoteConfig
+	remoteConfigLock.Unlock()
+	return applyRemoteConfig(target, values)
+}
+
+/**
+Lay remote config values over a config, as overlayRemoteConfig does
+*/
+func applyRemoteConfig(target *ConfigFile, remote map[string]json.RawMessage) error {
+	values := map[string]json.RawMessage{}
+	for name, value := range remote {
+		if remoteConfigKeys[name] {
+			values[name] = value
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	localDisabled := target.DisabledTaskTypes
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("Applying remote config: %v", err)
+	}
+	for _, taskType := range localDisabled {
+		if !isTaskTypeIn(taskType, target.DisabledTaskTypes) {
+			target.DisabledTaskTypes = append(target.DisabledTaskTypes, taskType)
+		}
+	}
+	return nil
+}
+
+/**
+Check that remote config values decode and validate when laid over `base`, with `finish` applying whatever goes over
+them. A problem the config has without them isn't theirs, so it's left for the config's own checks to report.
+*/
+func checkRemoteConfig(base *ConfigFile, values map[string]json.RawMessage, finish func(target *ConfigFile) error) error {
+	// Copies, so decoding into them can't write to the maps and slices of a config that's in use
+	withRemote, err := copyConfig(base)
+	if err != nil {
+		return err
+	}
+	if err := applyRemoteConfig(withRemote, values); err != nil {
+		return err
+	}
+	if err := finish(withRemote); err != nil {
+		return err
+	}
+	problem := withRemote.Validate()
+	if problem == nil {
+		return nil
+	}
+
+	without, err := copyConfig(base)
+	if err != nil {
+		return err
+	}
+	if err := finish(without); err != nil || without.Validate() != nil {
+		return nil
+	}
+	return problem
+}
+
+/**
+A deep copy of a config
+*/
+func copyConfig(source *ConfigFile) (*ConfigFile, error) {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+	var target ConfigFile
+	if err := json.Unmarshal(data, &target); err != nil {
+		return nil, err
+	}
+	target.unknownKeys = source.unknownKeys
+	return &target, nil
+}
+
+/**
+Check the cached remote config against the config loaded as far as it, with the environment and command line over it
+as at startup. One that fails is dropped with a warning rather than stopping the connector, as only the server can
+fix it.
+*/
+func checkCachedRemoteConfig(local *ConfigFile) {
+	remoteConfigLock.Lock()
+	values := remoteConfig
+	remoteConfigLock.Unlock()
+
+	err := checkRemoteConfig(local, values, func(target *ConfigFile) error {
+		if err := applyEnvironment(target); err != nil {
+			return err
+		}
+		if err := applyCommandLine(target); err != nil {
+			return err
+		}
+		applyConfigDefaults(target)
+		return nil
+	})
+	if err != nil {
+		logger.Warn("Cached remote config ignored", "error", err)
+		remoteConfigLock.Lock()
+		remoteConfig = nil
+		remoteConfigLock.Unlock()
+	}
+}
+
+/**
+Is a task type in a list of them?
+*/
+func isTaskTypeIn(taskType uint64, types []uint64) bool {
+	for _, listed := range types {
+		if listed == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Fetch the connector's settings from the `config` endpoint, keeping only the ones the server may set. nil if the
+server has no config for us.
+*/
+func fetchRemoteConfig() (map[string]json.RawMessage, error) {
+	client, err := apiHttpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		configUrl, err := apiEndpoint(ENDPOINT_CONFIG, Task{})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("GET", configUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Fetching remote config failed: %s", resp.Status)
+	}
+	if err := verifyResponse(req, resp, body); err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(body, &values); err != nil {
+		return nil, err
+	}
+	var ignored []string
+	for name := range values {
+		if !remoteConfigKeys[name] {
+			ignored = append(ignored, name)
+			delete(values, name)
+		}
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		logger.Warn("Remote config: ignoring settings that can only be set locally", "settings", ignored)
+	}
+	return values, nil
+}
+
+/**
+Fetch the remote config now and then, every `remote_config_interval` seconds (default 300, negative to turn it off),
+and reload the config whenever it changes
+*/
+func runRemoteConfig() {
+	for {
+		interval := currentConfig().RemoteConfigInterval
+		if interval == 0 {
+			interval = REMOTE_CONFIG_DEFAULT_INTERVAL
+		}
+		if interval < 0 {
+			return
+		}
+
+		if err := refreshRemoteConfig(); err != nil {
+			logger.Warn("Remote config not refreshed", "error", err)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+/**
+Fetch the remote config, and if it has changed, and works over the current config, save it and reload. A remote config
+that doesn't is left unused, so the connector carries on with the last good one.
+*/
+func refreshRemoteConfig() error {
+	values, err := fetchRemoteConfig()
+	if err != nil {
+		return err
+	}
+
+	remoteConfigLock.Lock()
+	changed := !sameJson(values, remoteConfig)
+	remoteConfigLock.Unlock()
+	if !changed {
+		return nil
+	}
+	noChange := func(target *ConfigFile) error { return nil }
+	if err := checkRemoteConfig(currentConfig(), values, noChange); err != nil {
+		return fmt.Errorf("The remote config can't be used: %v", err)
+	}
+
+	remoteConfigLock.Lock()
+	remoteConfig = values
+	remoteConfigLock.Unlock()
+
+	logger.Info("Remote config changed")
+	data, err := json.MarshalIndent(values, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(remoteConfigPath(), data, 0600); err != nil {
+		return err
+	}
+	return reloadConfiguration()
+}
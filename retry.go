@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	RETRY_DEFAULT_MAX_ATTEMPTS = 4
+	RETRY_DEFAULT_BASE_DELAY   = 1
+	RETRY_DEFAULT_MAX_DELAY    = 30
+	RETRY_BUDGET_MAX           = 10.0
+	RETRY_BUDGET_REFILL        = 0.2
+)
+
+/**
+How API calls are retried after transient failures - timeouts, connection resets and 5xx/429 responses
+e.g. `{"max_attempts": 4, "base_delay": 1, "max_delay": 30}`
+*/
+type RetryConfig struct {
+	MaxAttempts int `json:"max_attempts,omitempty"` // attempts per call, including the first
+	BaseDelay   int `json:"base_delay,omitempty"`   // seconds before the first retry, doubling each time
+	MaxDelay    int `json:"max_delay,omitempty"`    // cap on the delay between attempts, in seconds
+}
+
+// Retries are paid for from a shared budget that successful calls top up, so a dead API doesn't get a storm
+// of retries from every task at once
+var (
+	retryBudget     = RETRY_BUDGET_MAX
+	retryBudgetLock sync.Mutex
+)
+
+/**
+The retry settings, with defaults for anything not configured
+*/
+func getRetryConfig() RetryConfig {
+	config := currentConfig()
+	var retryConfig RetryConfig
+	if config.Retry != nil {
+		retryConfig = *config.Retry
+	}
+	if retryConfig.MaxAttempts <= 0 {
+		retryConfig.MaxAttempts = RETRY_DEFAULT_MAX_ATTEMPTS
+	}
+	if retryConfig.BaseDelay <= 0 {
+		retryConfig.BaseDelay = RETRY_DEFAULT_BASE_DELAY
+	}
+	if retryConfig.MaxDelay <= 0 {
+		retryConfig.MaxDelay = RETRY_DEFAULT_MAX_DELAY
+	}
+	return retryConfig
+}
+
+/**
+Take a retry from the budget - false if it's spent
+*/
+func spendRetryBudget() bool {
+	retryBudgetLock.Lock()
+	defer retryBudgetLock.Unlock()
+	if retryBudget < 1 {
+		return false
+	}
+	retryBudget--
+	return true
+}
+
+/**
+Top the retry budget up after a successful call
+*/
+func refillRetryBudget() {
+	retryBudgetLock.Lock()
+	defer retryBudgetLock.Unlock()
+	retryBudget += RETRY_BUDGET_REFILL
+	if retryBudget > RETRY_BUDGET_MAX {
+		retryBudget = RETRY_BUDGET_MAX
+	}
+}
+
+/**
+Is this a network failure worth trying again? Certificate and other TLS errors aren't - they won't fix themselves.
+*/
+func isTransientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+/**
+Is this a response worth trying again?
+*/
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+/**
+Delay before the given retry - exponential backoff with full jitter
+*/
+func retryDelay(retryConfig RetryConfig, retry int) time.Duration {
+	ceiling := time.Duration(retryConfig.BaseDelay) * time.Second << uint(retry)
+	maxDelay := time.Duration(retryConfig.MaxDelay) * time.Second
+	if ceiling > maxDelay || ceiling <= 0 {
+		ceiling = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+/**
+Send an API request, retrying transient failures with backoff. `newRequest` is called for every attempt so the body
+and signature are fresh each time. The response is returned unread, as soon as it isn't one worth retrying.
+*/
+func doWithRetry(client *http.Client, newRequest func() (*http.Request, error)) (*http.Request, *http.Response, error) {
+	retryConfig := getRetryConfig()
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := client.Do(req)
+		var failure error
+		switch {
+		case err != nil:
+			if !isTransientError(err) {
+				return req, nil, err
+			}
+			failure = err
+		case isTransientStatus(resp.StatusCode):
+			failure = fmt.Errorf("%s %s returned %s", req.Method, req.URL.Path, resp.Status)
+		default:
+			refillRetryBudget()
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				logger.Error("API rejected the connector's credentials", "event_id", EVENT_AUTH_FAILED, "url", req.URL.Path, "status", resp.Status)
+			}
+			return req, resp, nil
+		}
+
+		if attempt >= retryConfig.MaxAttempts || !spendRetryBudget() {
+			// Out of attempts - hand back the last response if there was one, so the caller sees the real status
+			return req, resp, err
+		}
+		if resp != nil {
+			closeResponse(resp)
+		}
+		// The next attempt goes to the next API URL, if there's more than one
+		failoverApiUrl(req.URL.String())
+
+		delay := retryDelay(retryConfig, attempt-1)
+		logger.Warn("Request failed - retrying", "error", failure, "delay", delay.Round(time.Millisecond).String(), "attempt", attempt+1, "attempts", retryConfig.MaxAttempts)
+		time.Sleep(delay)
+	}
+}
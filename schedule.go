@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	CONTROL_SCHEDULE   = "schedule"
+	CONTROL_UNSCHEDULE = "unschedule"
+	SCHEDULES_FILE     = "schedules.json"
+)
+
+/**
+A task run on a cron schedule, from the config file or registered by the server
+e.g. `{"name": "nightly-students", "cron": "0 2 * * *", "task": {"type": 1, "config": {...}, "payload": "SELECT ..."}}`
+*/
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	Cron string `json:"cron"` // standard 5 field cron expression, or a descriptor like "@daily" or "@every 1h"
+	Task *Task  `json:"task,omitempty"`
+}
+
+// The running scheduler, the entries it has for each schedule, and the schedules the server has registered
+var (
+	scheduler       *cron.Cron
+	scheduleEntries = map[string]cron.EntryID{}
+	serverSchedules = map[string]ScheduleConfig{}
+	schedulerLock   sync.Mutex
+	scheduleParser  = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+)
+
+/**
+Check a schedule has a name, a valid cron expression and a task
+*/
+func (s ScheduleConfig) Validate() error {
+	if s.Name == "" {
+		return errors.New("Schedules need a name.")
+	}
+	if s.Task == nil {
+		return fmt.Errorf("Schedule %s has no task.", s.Name)
+	}
+	if _, err := scheduleParser.Parse(s.Cron); err != nil {
+		return fmt.Errorf("Schedule %s has an invalid cron expression: %v", s.Name, err)
+	}
+	return nil
+}
+
+/**
+Where schedules registered by the server are kept, in the state directory
+*/
+func serverSchedulesPath() string {
+	return filepath.Join(stateDir(), SCHEDULES_FILE)
+}
+
+/**
+Load the schedules the server registered before the connector last stopped
+*/
+func loadServerSchedules() error {
+	data, err := ioutil.ReadFile(serverSchedulesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var schedules []ScheduleConfig
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		serverSchedules[schedule.Name] = schedule
+	}
+	return nil
+}
+
+/**
+Save the schedules the server has registered, so they survive a restart
+*/
+func saveServerSchedules() error {
+	schedules := []ScheduleConfig{}
+	for _, schedule := range serverSchedules {
+		schedules = append(schedules, schedule)
+	}
+	data, err := json.MarshalIndent(schedules, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := serverSchedulesPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, serverSchedulesPath())
+}
+
+/**
+Add a schedule to the scheduler, replacing any with the same name. Must be called holding `schedulerLock`.
+*/
+func addSchedule(schedule ScheduleConfig) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	removeSchedule(schedule.Name)
+
+	entryId, err := scheduler.AddFunc(schedule.Cron, func() {
+		task := *schedule.Task
+		task.Id = fmt.Sprintf("%s-%d", schedule.Name, time.Now().Unix())
+		task.schedule = schedule.Name
+
+		taskLogger(task).Info("Scheduled task due", "schedule", schedule.Name)
+		queueTask(task)
+	})
+	if err != nil {
+		return err
+	}
+	scheduleEntries[schedule.Name] = entryId
+	return nil
+}
+
+/**
+Take a schedule off the scheduler. Must be called holding `schedulerLock`.
+*/
+func removeSchedule(name string) {
+	if entryId, ok := scheduleEntries[name]; ok {
+		scheduler.Remove(entryId)
+		delete(scheduleEntries, name)
+	}
+}
+
+/**
+Start running the schedules from the config file and those registered by the server. Scheduled tasks run whether
+or not polling is working, and post their results like any other task, tagged with the schedule's name.
+*/
+func startScheduler() error {
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+
+	scheduler = cron.New(cron.WithParser(scheduleParser))
+
+	if err := loadServerSchedules(); err != nil {
+		return err
+	}
+	for _, schedule := range currentConfig().Schedules {
+		if err := addSchedule(schedule); err != nil {
+			return err
+		}
+	}
+	for _, schedule := range serverSchedules {
+		if err := addSchedule(schedule); err != nil {
+			logger.Error("Schedule not added", "schedule", schedule.Name, "error", err)
+		}
+	}
+
+	scheduler.Start()
+	if len(scheduleEntries) > 0 {
+		logger.Info("Scheduler started", "schedules", len(scheduleEntries))
+	}
+	return nil
+}
+
+/**
+Register or remove a schedule for the server, e.g.
+`{"control": "schedule", "schedule": {"name": "nightly", "cron": "0 2 * * *", "task": {...}}}` or
+`{"control": "unschedule", "schedule": {"name": "nightly"}}`
+*/
+func handleScheduleControl(message Task) error {
+	if message.Schedule == nil || message.Schedule.Name == "" {
+		return errors.New("Schedule control messages need a schedule name.")
+	}
+
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+	if scheduler == nil {
+		return errors.New("The scheduler is not running.")
+	}
+
+	schedule := *message.Schedule
+	switch message.Control {
+	case CONTROL_SCHEDULE:
+		if err := addSchedule(schedule); err != nil {
+			return err
+		}
+		serverSchedules[schedule.Name] = schedule
+		logger.Info("Schedule registered", "schedule", schedule.Name)
+	case CONTROL_UNSCHEDULE:
+		if _, ok := serverSchedules[schedule.Name]; !ok {
+			return fmt.Errorf("Schedule %s was not registered by the server.", schedule.Name)
+		}
+		removeSchedule(schedule.Name)
+		delete(serverSchedules, schedule.Name)
+		logger.Info("Schedule removed", "schedule", schedule.Name)
+	}
+
+	return saveServerSchedules()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	SECRET_VAULT_PREFIX  = "vault://"
+	SECRET_AWS_SM_PREFIX = "aws-sm://"
+	SECRET_FETCH_TIMEOUT = 30 * time.Second
+)
+
+/**
+Where secret references in the config are looked up - `secrets.vault` for `vault://` references and `secrets.aws` for
+`aws-sm://` ones
+*/
+type SecretsConfig struct {
+	Vault *VaultConfig      `json:"vault,omitempty"`
+	Aws   *AwsSecretsConfig `json:"aws,omitempty"`
+}
+
+/**
+A HashiCorp Vault server. The address and token fall back to VAULT_ADDR and VAULT_TOKEN.
+*/
+type VaultConfig struct {
+	Address   string `json:"address,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"` // file holding the token, e.g. written by a Vault agent
+	Namespace string `json:"namespace,omitempty"`  // Vault Enterprise namespace
+}
+
+/**
+AWS Secrets Manager. Credentials come from the usual AWS chain (environment, shared config, instance role), and the
+region from here, the secret's ARN or AWS_REGION.
+*/
+type AwsSecretsConfig struct {
+	Region string `json:"region,omitempty"`
+}
+
+/**
+Is the value a reference to a secret held elsewhere, rather than the value itself?
+*/
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, SECRET_VAULT_PREFIX) || strings.HasPrefix(value, SECRET_AWS_SM_PREFIX)
+}
+
+/**
+Replace every secret reference in the config with the secret it points to, e.g.
+`"key": "vault://secret/data/goproxy#api_key"` or `"key": "aws-sm://goproxy/school-1#api_key"`. The secrets are only
+held in memory - the file keeps the references.
+*/
+func resolveConfigSecrets(target *ConfigFile) error {
+	resolved := map[string]string{}
+	var problems ConfigProblems
+
+	var resolve func(value reflect.Value, path string)
+	resolve = func(value reflect.Value, path string) {
+		switch value.Kind() {
+		case reflect.Ptr:
+			if !value.IsNil() {
+				resolve(value.Elem(), path)
+			}
+		case reflect.Struct:
+			fields := value.Type()
+			for i := 0; i < value.NumField(); i++ {
+				field := fields.Field(i)
+				// Where to look secrets up can't itself be looked up
+				if field.PkgPath != "" || field.Type == reflect.TypeOf(&SecretsConfig{}) {
+					continue
+				}
+				name := strings.Split(field.Tag.Get("json"), ",")[0]
+				if name == "" {
+					name = field.Name
+				}
+				resolve(value.Field(i), joinConfigPath(path, name))
+			}
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				resolve(value.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			}
+		case reflect.Map:
+			if value.Type().Elem().Kind() != reflect.String {
+				return
+			}
+			for _, key := range value.MapKeys() {
+				reference := value.MapIndex(key).String()
+				if !isSecretReference(reference) {
+					continue
+				}
+				secret, err := lookupSecret(target.Secrets, reference, resolved)
+				if err != nil {
+					problems.add(fmt.Errorf("%s: %v", joinConfigPath(path, key.String()), err))
+					continue
+				}
+				value.SetMapIndex(key, reflect.ValueOf(secret).Convert(value.Type().Elem()))
+			}
+		case reflect.String:
+			if !isSecretReference(value.String()) || !value.CanSet() {
+				return
+			}
+			secret, err := lookupSecret(target.Secrets, value.String(), resolved)
+			if err != nil {
+				problems.add(fmt.Errorf("%s: %v", path, err))
+				return
+			}
+			value.SetString(secret)
+		}
+	}
+	resolve(reflect.ValueOf(target).Elem(), "")
+
+	return problems.err()
+}
+
+/**
+Look up the secret a reference points to, once per reference
+*/
+func lookupSecret(secretsConfig *SecretsConfig, reference string, resolved map[string]string) (string, error) {
+	if secret, ok := resolved[reference]; ok {
+		return secret, nil
+	}
+
+	// The part after the last # picks a field out of a secret holding several
+	location, field := reference, ""
+	if i := strings.LastIndex(reference, "#"); i >= 0 {
+		location, field = reference[:i], reference[i+1:]
+	}
+
+	var fields map[string]interface{}
+	var err error
+	switch {
+	case strings.HasPrefix(location, SECRET_VAULT_PREFIX):
+		fields, err = fetchVaultSecret(secretsConfig, strings.TrimPrefix(location, SECRET_VAULT_PREFIX))
+	default:
+		var secret string
+		secret, err = fetchAwsSecret(secretsConfig, strings.TrimPrefix(location, SECRET_AWS_SM_PREFIX))
+		if err == nil && field == "" {
+			resolved[reference] = secret
+			return secret, nil
+		}
+		if err == nil {
+			if json.Unmarshal([]byte(secret), &fields) != nil {
+				err = fmt.Errorf("%s isn't JSON, so it has no field %q", location, field)
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if field == "" {
+		if len(fields) != 1 {
+			return "", fmt.Errorf("%s holds %d values - pick one with #field", location, len(fields))
+		}
+		for name := range fields {
+			field = name
+		}
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("%s has no field %q", location, field)
+	}
+	secret, ok := value.(string)
+	if !ok {
+		data, _ := json.Marshal(value)
+		secret = string(data)
+	}
+	resolved[reference] = secret
+	return secret, nil
+}
+
+/**
+Read a secret from Vault's HTTP API. Both versions of the KV engine are understood - for version 2, give the path
+with `data/` in it, e.g. `secret/data/goproxy`.
+*/
+func fetchVaultSecret(secretsConfig *SecretsConfig, path string) (map[string]interface{}, error) {
+	var vaultConfig VaultConfig
+	if secretsConfig != nil && secretsConfig.Vault != nil {
+		vaultConfig = *secretsConfig.Vault
+	}
+	if vaultConfig.Address == "" {
+		vaultConfig.Address = os.Getenv("VAULT_ADDR")
+	}
+	if vaultConfig.Token == "" && vaultConfig.TokenFile != "" {
+		token, err := ioutil.ReadFile(vaultConfig.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		vaultConfig.Token = strings.TrimSpace(string(token))
+	}
+	if vaultConfig.Token == "" {
+		vaultConfig.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if vaultConfig.Address == "" || vaultConfig.Token == "" {
+		return nil, errors.New("Vault needs secrets.vault.address and a token, or VAULT_ADDR and VAULT_TOKEN")
+	}
+
+	client, err := downloadHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(vaultConfig.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vaultConfig.Token)
+	if vaultConfig.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vaultConfig.Namespace)
+	}
+	resp, err := withRequestTimeout(client, SECRET_FETCH_TIMEOUT).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault answered %s for %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	// KV version 2 nests the values, alongside their metadata
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+/**
+Read a secret's string value from AWS Secrets Manager, by name or ARN
+*/
+func fetchAwsSecret(secretsConfig *SecretsConfig, secretId string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SECRET_FETCH_TIMEOUT)
+	defer cancel()
+
+	var options []func(*awsconfig.LoadOptions) error
+	region := ""
+	if secretsConfig != nil && secretsConfig.Aws != nil {
+		region = secretsConfig.Aws.Region
+	}
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if parts := strings.Split(secretId, ":"); region == "" && len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region != "" {
+		options = append(options, awsconfig.WithRegion(region))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return "", err
+	}
+	if awsConfig.Region == "" {
+		return "", errors.New("No AWS region - set secrets.aws.region or AWS_REGION")
+	}
+	credentials, err := awsConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretId})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", awsConfig.Region), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	bodyHash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(bodyHash[:]), "secretsmanager", awsConfig.Region, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	client, err := downloadHttpClient()
+	if err != nil {
+		return "", err
+	}
+	resp, err := withRequestTimeout(client, SECRET_FETCH_TIMEOUT).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer closeResponse(resp)
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+		Message      string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Secrets Manager answered %s for %s: %s", resp.Status, secretId, secret.Message)
+	}
+	if secret.SecretString == "" {
+		return "", fmt.Errorf("%s has no string value", secretId)
+	}
+	return secret.SecretString, nil
+}
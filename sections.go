@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/**
+Limits for tasks against one kind of database - the `mysql` and `mssql` sections e.g.
+`"mysql": {"max_rows": 50000, "timeout": 120}`
+*/
+type DbSectionConfig struct {
+	MaxRows int `json:"max_rows,omitempty"` // rows a query may return, no limit by default
+	Timeout int `json:"timeout,omitempty"`  // seconds a task may run for, instead of `task_timeout`
+}
+
+/**
+Where file tasks may read from - the `files` section e.g. `"files": {"allowed_dirs": ["D:\\Exports"]}`
+*/
+type FilesSectionConfig struct {
+	AllowedDirs []string `json:"allowed_dirs,omitempty"`
+}
+
+/**
+Which scripts may run - the `shell` section. `allowlist` holds the SHA-256 hashes of scripts that may run; when it's
+set, any other script is refused even if it's signed.
+*/
+type ShellSectionConfig struct {
+	Allowlist []string `json:"allowlist,omitempty"`
+}
+
+/**
+Check the script hashes are hex SHA-256
+*/
+func (c *ShellSectionConfig) Validate() error {
+	for _, hash := range c.Allowlist {
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("Shell allowlist entries must be SHA-256 hashes, not %q.", hash)
+		}
+	}
+	return nil
+}
+
+/**
+The section for a kind of database, or nil if there isn't one
+*/
+func dbSection(dbType string) *DbSectionConfig {
+	config := currentConfig()
+	switch dbType {
+	case "mysql":
+		return config.Mysql
+	case "mssql":
+		return config.Mssql
+	default:
+		return nil
+	}
+}
+
+/**
+The section for the database a task runs against, or nil if it isn't a database task or there's no section
+*/
+func taskDbSection(task Task) *DbSectionConfig {
+	var dbConfig DBTaskConfig
+	if json.Unmarshal(task.RawConfig, &dbConfig) != nil || dbConfig.resolveAlias() != nil {
+		return nil
+	}
+	return dbSection(dbConfig.Type)
+}
+
+/**
+Directories file tasks may read from - `files.allowed_dirs` if set, otherwise `allowed_dirs`
+*/
+func allowedDirs() []string {
+	config := currentConfig()
+	if config.Files != nil && len(config.Files.AllowedDirs) > 0 {
+		return config.Files.AllowedDirs
+	}
+	return config.AllowedDirs
+}
+
+/**
+May this script run? Always, unless `shell.allowlist` is set and doesn't have the script's hash.
+*/
+func isScriptAllowed(script string) bool {
+	config := currentConfig()
+	if config.Shell == nil || len(config.Shell.Allowlist) == 0 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(script))
+	hash := hex.EncodeToString(sum[:])
+	for _, allowed := range config.Shell.Allowlist {
+		if strings.EqualFold(allowed, hash) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SENTRY_TIMEOUT        = 10 * time.Second
+	SENTRY_FLUSH_TIMEOUT  = 5 * time.Second
+	SENTRY_MAX_PER_MINUTE = 10 // events past this in a minute are dropped, so a failure loop can't flood the project
+	SENTRY_MAX_FRAMES     = 50
+)
+
+/**
+Where to report panics and unexpected errors, e.g. `{"dsn": "https://abc123@o1.ingest.sentry.io/42"}`
+*/
+type SentryConfig struct {
+	Dsn         string `json:"dsn"`
+	Environment string `json:"environment,omitempty"` // e.g. production, sent with every event
+}
+
+/**
+Check the DSN has a key, host and project
+*/
+func (s *SentryConfig) Validate() error {
+	if s.Dsn == "" {
+		return errors.New("sentry.dsn must be set, e.g. https://abc123@o1.ingest.sentry.io/42.")
+	}
+	if _, _, err := sentryEndpoint(s.Dsn); err != nil {
+		return err
+	}
+	return nil
+}
+
+var (
+	sentryLock     sync.Mutex
+	sentryWindow   time.Time // start of the minute events are being counted for
+	sentrySent     int
+	sentryInFlight sync.WaitGroup
+)
+
+/**
+A frame of a stack trace, in the form Sentry wants
+*/
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+/**
+Is Sentry turned on?
+*/
+func isSentryEnabled() bool {
+	config := currentConfig()
+	return config.Sentry != nil && config.Sentry.Dsn != ""
+}
+
+/**
+The envelope URL and public key for a DSN - `https://<key>@<host>/<project>` sends to
+`https://<host>/api/<project>/envelope/`
+*/
+func sentryEndpoint(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("sentry.dsn must be a Sentry DSN, e.g. https://abc123@o1.ingest.sentry.io/42.")
+	}
+	path := strings.Trim(u.Path, "/")
+	project := path[strings.LastIndex(path, "/")+1:]
+	prefix := strings.TrimSuffix(path, project)
+	if project == "" {
+		return "", "", errors.New("sentry.dsn must end with the project ID, e.g. https://abc123@o1.ingest.sentry.io/42.")
+	}
+	endpoint := fmt.Sprintf("%s://%s/%sapi/%s/envelope/", u.Scheme, u.Host, prefix, project)
+	return endpoint, u.User.Username(), nil
+}
+
+/**
+The stack of the calling goroutine, oldest call first as Sentry lists it, less the frames that did the capturing
+*/
+func sentryStack(skip int) []sentryFrame {
+	pcs := make([]uintptr, SENTRY_MAX_FRAMES)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+2, pcs)])
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		module, function := "", frame.Function
+		// The package is up to the first dot after the path, e.g. `main` in `main.runTask.func1`
+		slash := strings.LastIndex(function, "/") + 1
+		if dot := strings.Index(function[slash:], "."); dot >= 0 {
+			module, function = function[:slash+dot], function[slash+dot+1:]
+		}
+		stack = append([]sentryFrame{{
+			Function: function,
+			Module:   module,
+			Filename: filepath.Base(frame.File),
+			AbsPath:  frame.File,
+			Lineno:   frame.Line,
+			InApp:    module == "main",
+		}}, stack...)
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+/**
+Report an error to Sentry with where it happened - `skip` is how many callers to leave off the stack. The event is
+sent in the background; `flushSentry` waits for it.
+*/
+func captureError(err error, level string, skip int, extra map[string]interface{}) {
+	if !isSentryEnabled() || err == nil {
+		return
+	}
+	sentryLock.Lock()
+	if time.Since(sentryWindow) > time.Minute {
+		sentryWindow, sentrySent = time.Now(), 0
+	}
+	sentrySent++
+	dropped := sentrySent > SENTRY_MAX_PER_MINUTE
+	sentryLock.Unlock()
+	if dropped {
+		return
+	}
+
+	event := sentryEvent(fmt.Sprintf("%T", err), err.Error(), level, sentryStack(skip+1))
+	if len(extra) > 0 {
+		event["extra"] = extra
+	}
+	sentryInFlight.Add(1)
+	go func() {
+		defer sentryInFlight.Done()
+		if err := sendSentryEvent(event); err != nil {
+			logger.Warn("Sentry report failed", "error", err)
+		}
+	}()
+}
+
+/**
+Report a panic, then carry on panicking - deferred at the top of goroutines, so a panic is on record even though
+it stops the connector. The report is sent before the panic goes on.
+*/
+func capturePanic() {
+	if r := recover(); r != nil {
+		err, ok := r.(error)
+		if !ok {
+			err = fmt.Errorf("%v", r)
+		}
+		captureError(err, "fatal", 2, map[string]interface{}{"stack": string(debug.Stack())})
+		flushSentry()
+		panic(r)
+	}
+}
+
+/**
+Wait for reports still being sent, for a few seconds at most - before the connector exits
+*/
+func flushSentry() {
+	done := make(chan struct{})
+	go func() {
+		sentryInFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SENTRY_FLUSH_TIMEOUT):
+	}
+}
+
+/**
+A Sentry event, tagged with what's useful to know about the connector that sent it
+*/
+func sentryEvent(errorType string, message string, level string, stack []sentryFrame) map[string]interface{} {
+	config := currentConfig()
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	tags := map[string]string{
+		"transport": config.Transport,
+		"key_id":    apiKeyId(),
+		"os.arch":   runtime.GOARCH,
+	}
+	if profileFlag != "" {
+		tags["profile"] = profileFlag
+	}
+	return map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "goproxy",
+		"release":     "goproxy@" + version,
+		"environment": config.Sentry.Environment,
+		"server_name": hostname,
+		"tags":        tags,
+		"contexts": map[string]interface{}{
+			"os":      map[string]string{"name": runtime.GOOS},
+			"runtime": map[string]string{"name": "go", "version": runtime.Version()},
+		},
+		"exception": map[string]interface{}{
+			"values": []interface{}{map[string]interface{}{
+				"type":       errorType,
+				"value":      message,
+				"stacktrace": map[string]interface{}{"frames": stack},
+			}},
+		},
+	}
+}
+
+/**
+Send an event to Sentry in an envelope
+*/
+func sendSentryEvent(event map[string]interface{}) error {
+	config := currentConfig()
+	endpoint, key, err := sentryEndpoint(config.Sentry.Dsn)
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(map[string]string{"event_id": event["event_id"].(string), "dsn": config.Sentry.Dsn})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var envelope bytes.Buffer
+	envelope.Write(header)
+	envelope.WriteString("\n{\"type\":\"event\"}\n")
+	envelope.Write(body)
+	envelope.WriteString("\n")
+
+	req, err := http.NewRequest("POST", endpoint, &envelope)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=goproxy/%s, sentry_key=%s", version, key))
+
+	client := &http.Client{Timeout: SENTRY_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Sentry answered %s", resp.Status)
+	}
+	return nil
+}
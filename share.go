@@ -0,0 +1,22 @@
+package main
+
+/**
+Credentials for a network share that a file task needs to read from
+e.g. `{"path": "\\\\fileserver\\exports", "username": "svc_connector", "password": "...", "domain": "SCHOOL"}`
+*/
+type ShareConfig struct {
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Domain   string `json:"domain"`
+}
+
+/**
+Connect to a share if the task config has one, returning a function to disconnect again
+*/
+func connectTaskShare(share *ShareConfig) (func(), error) {
+	if share == nil || share.Path == "" {
+		return func() {}, nil
+	}
+	return connectShare(*share)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/**
+Outside Windows shares have to be mounted by the system (e.g. cifs in /etc/fstab) - just check the mount is there
+*/
+func connectShare(share ShareConfig) (func(), error) {
+	info, err := os.Stat(share.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Share %s is not mounted: %v", share.Path, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Share %s is not a directory.", share.Path)
+	}
+
+	return func() {}, nil
+}
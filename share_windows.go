@@ -0,0 +1,78 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	RESOURCETYPE_DISK = 0x00000001
+)
+
+/**
+NETRESOURCEW from the Win32 API
+*/
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+var (
+	mpr                        = windows.NewLazySystemDLL("mpr.dll")
+	procWNetAddConnection2W    = mpr.NewProc("WNetAddConnection2W")
+	procWNetCancelConnection2W = mpr.NewProc("WNetCancelConnection2W")
+)
+
+/**
+Connect to a UNC share with the given credentials so its files can be read with normal file APIs.
+The connection is made without a drive letter and the password never appears on a command line.
+*/
+func connectShare(share ShareConfig) (func(), error) {
+	remoteName, err := windows.UTF16PtrFromString(share.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	username := share.Username
+	if share.Domain != "" {
+		username = share.Domain + `\` + share.Username
+	}
+
+	var usernamePtr, passwordPtr *uint16
+	if username != "" {
+		if usernamePtr, err = windows.UTF16PtrFromString(username); err != nil {
+			return nil, err
+		}
+		if passwordPtr, err = windows.UTF16PtrFromString(share.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	resource := netResource{
+		Type:       RESOURCETYPE_DISK,
+		RemoteName: remoteName,
+	}
+
+	ret, _, _ := procWNetAddConnection2W.Call(
+		uintptr(unsafe.Pointer(&resource)),
+		uintptr(unsafe.Pointer(passwordPtr)),
+		uintptr(unsafe.Pointer(usernamePtr)),
+		0,
+	)
+	if ret != 0 {
+		return nil, syscall.Errno(ret)
+	}
+
+	disconnect := func() {
+		procWNetCancelConnection2W.Call(uintptr(unsafe.Pointer(remoteName)), 0, 1)
+	}
+
+	return disconnect, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SHUTDOWN_DEFAULT_GRACE = 30
+	SHUTDOWN_RESULT_WAIT   = 10 * time.Second
+)
+
+// 1 once the connector has started shutting down
+var shuttingDown int32
+
+/**
+Is the connector shutting down? No new tasks are started once it is.
+*/
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+/**
+How long to wait for running tasks to finish when shutting down
+*/
+func getShutdownGrace() time.Duration {
+	config := currentConfig()
+	if config.ShutdownGrace <= 0 {
+		return SHUTDOWN_DEFAULT_GRACE * time.Second
+	}
+	return time.Duration(config.ShutdownGrace) * time.Second
+}
+
+/**
+Wait until no tasks are running, or the timeout passes. Returns whether they all finished.
+*/
+func waitForRunningTasks(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&tasksRunning) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+/**
+Shut down without losing track of tasks: stop taking new ones, report queued tasks as interrupted, give running tasks
+`shutdown_grace` seconds to finish and post their results, then cancel whatever is left and report it as interrupted.
+*/
+func shutdown() {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return
+	}
+	logger.Info("Shutting down")
+	defer flushTraces()
+
+	schedulerLock.Lock()
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	schedulerLock.Unlock()
+
+	for _, task := range append(getTaskQueue().Drain(), drainWaitingTasks()...) {
+		postStoppedResult(task, "interrupted", "The connector shut down before the task started", nil)
+	}
+
+	grace := getShutdownGrace()
+	if atomic.LoadInt32(&tasksRunning) > 0 {
+		logger.Info("Waiting for running tasks to finish", "grace", grace.String())
+	}
+	if waitForRunningTasks(grace) {
+		return
+	}
+
+	logger.Warn("Interrupting tasks that are still running")
+	cancelAllTasks()
+	if !waitForRunningTasks(SHUTDOWN_RESULT_WAIT) {
+		logger.Warn("Some tasks could not be reported as interrupted")
+	}
+}
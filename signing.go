@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SIGNATURE_MAX_SKEW = 5 * time.Minute
+	SIGNING_KEYS_KEPT  = 2
+)
+
+// The keys requests have been signed with lately, by key ID, so a response is checked with the key its request was
+// signed with even if the key has been rotated or reloaded while the request was in flight
+var (
+	signingKeys     = map[string]string{}
+	signingKeyOrder []string
+	signingKeysLock sync.Mutex
+)
+
+/**
+Identifies the API key without revealing it - the first 16 hex characters of its SHA-256
+*/
+func apiKeyId() string {
+	return keyId(currentConfig().ApiKey)
+}
+
+/**
+Identifies a key without revealing it
+*/
+func keyId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+/**
+HMAC-SHA256 of the newline separated parts with the API key, hex encoded
+*/
+func computeSignature(parts ...string) string {
+	return signWithKey(currentConfig().ApiKey, parts...)
+}
+
+/**
+HMAC-SHA256 of the newline separated parts with a key, hex encoded - for when the key has to be the one already used
+elsewhere in a request, even if the key is rotated in the meantime
+*/
+func signWithKey(key string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	for i, part := range parts {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+Remember a key requests are being signed with, forgetting the oldest beyond SIGNING_KEYS_KEPT
+*/
+func rememberSigningKey(id string, key string) {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+
+	if _, ok := signingKeys[id]; ok {
+		return
+	}
+	signingKeys[id] = key
+	signingKeyOrder = append(signingKeyOrder, id)
+	if len(signingKeyOrder) > SIGNING_KEYS_KEPT {
+		delete(signingKeys, signingKeyOrder[0])
+		signingKeyOrder = signingKeyOrder[1:]
+	}
+}
+
+/**
+The key a request with this key ID was signed with, if it's one we still know
+*/
+func signingKey(id string) (string, bool) {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+
+	key, ok := signingKeys[id]
+	return key, ok
+}
+
+/**
+Hex SHA-256 of a request or response body
+*/
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+Headers that authenticate a request to the API - an OAuth2 bearer token if configured, otherwise the API key.
+With `sign_requests` on, the key itself is never sent - the request is signed instead:
+HMAC-SHA256(key, method \n path?query \n timestamp \n sha256(body))
+*/
+func apiAuthHeaders(method string, requestUri string, body []byte) (http.Header, error) {
+	config := currentConfig()
+	header := http.Header{}
+	if config.OAuth2 != nil {
+		token, err := getOAuthToken()
+		if err != nil {
+			return nil, err
+		}
+		token.SetAuthHeader(&http.Request{Header: header})
+	} else if !config.SignRequests {
+		header.Set("X-Digistorm-Key", config.ApiKey)
+	}
+	if config.AgentId != "" {
+		header.Set("X-Digistorm-Agent-Id", config.AgentId)
+	}
+	if !config.SignRequests {
+		return header, nil
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	id := keyId(config.ApiKey)
+	rememberSigningKey(id, config.ApiKey)
+	header.Set("X-Digistorm-Key-Id", id)
+	header.Set("X-Digistorm-Timestamp", timestamp)
+	header.Set("X-Digistorm-Signature", signWithKey(config.ApiKey, method, requestUri, timestamp, bodyHash(body)))
+
+	return header, nil
+}
+
+/**
+Add authentication headers to a request to the API
+*/
+func authenticateRequest(req *http.Request, body []byte) error {
+	header, err := apiAuthHeaders(req.Method, req.URL.RequestURI(), body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return nil
+}
+
+/**
+Check the server's signature on a response, given the SHA-256 of its body. The server signs
+HMAC-SHA256(key, request signature \n status \n timestamp \n sha256(body)) with the key the request was signed with,
+tying each response to its request.
+*/
+func checkResponseSignature(req *http.Request, resp *http.Response, hash string) error {
+	if !currentConfig().SignRequests {
+		return nil
+	}
+
+	signature := resp.Header.Get("X-Digistorm-Signature")
+	timestamp := resp.Header.Get("X-Digistorm-Timestamp")
+	if signature == "" || timestamp == "" {
+		return errors.New("Response from the API is not signed.")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid response timestamp %q.", timestamp)
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); math.Abs(float64(skew)) > float64(SIGNATURE_MAX_SKEW) {
+		return fmt.Errorf("Response timestamp is %s out from our clock.", skew)
+	}
+
+	key, ok := signingKey(req.Header.Get("X-Digistorm-Key-Id"))
+	if !ok {
+		return errors.New("The request was signed with a key the connector no longer has, so the response can't be checked.")
+	}
+	expected := signWithKey(key, req.Header.Get("X-Digistorm-Signature"), strconv.Itoa(resp.StatusCode), timestamp, hash)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("Response signature from the API does not match - it may have been tampered with.")
+	}
+
+	return nil
+}
+
+/**
+Check a response from the API, given the SHA-256 of its body, then act on any key rotation it carries
+*/
+func verifyResponseHash(req *http.Request, resp *http.Response, hash string) error {
+	if err := checkResponseSignature(req, resp, hash); err != nil {
+		return err
+	}
+
+	// A failed rotation leaves us on the current key, which still works - the server will ask again
+	if err := handleKeyRotation(resp); err != nil {
+		logger.Error("Key rotation failed", "error", err)
+	}
+
+	return nil
+}
+
+/**
+Check the server's signature on a response whose body has been read in full
+*/
+func verifyResponse(req *http.Request, resp *http.Response, body []byte) error {
+	return verifyResponseHash(req, resp, bodyHash(body))
+}
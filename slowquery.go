@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+When a query counts as slow, e.g. `{"threshold": 5, "report": true}` - `threshold` is in seconds, and with `report`
+slow queries are sent to the `slow_query` endpoint as well as logged
+*/
+type SlowQueryConfig struct {
+	Threshold float64 `json:"threshold"`
+	Report    bool    `json:"report,omitempty"`
+}
+
+/**
+Check there's a threshold
+*/
+func (s *SlowQueryConfig) Validate() error {
+	if s.Threshold <= 0 {
+		return errors.New("slow_queries.threshold must be more than 0 seconds.")
+	}
+	return nil
+}
+
+/**
+A query that took longer than the threshold. The statement itself isn't included, as it can hold a school's data -
+its hash is enough to find it in the task that sent it.
+*/
+type SlowQuery struct {
+	TaskId        string `json:"task_id"`
+	Type          uint64 `json:"type"`
+	Schedule      string `json:"schedule,omitempty"`
+	Dsn           string `json:"dsn"`
+	StatementHash string `json:"statement_hash"`
+	DurationMs    int64  `json:"duration_ms"`
+	Rows          int    `json:"rows"`
+}
+
+/**
+A hash that identifies a statement however it's laid out - the SHA-256 of it with its whitespace collapsed, cut to 16
+hex digits
+*/
+func statementHash(statement string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(statement), " ")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+/**
+Log a query that took longer than `slow_queries.threshold`, and report it if asked to. `duration` covers running the
+query and reading its rows.
+*/
+func checkSlowQuery(task Task, duration time.Duration, rows int) {
+	slowQueries := currentConfig().SlowQueries
+	if slowQueries == nil || duration.Seconds() < slowQueries.Threshold {
+		return
+	}
+	slow := SlowQuery{
+		TaskId:        task.Id,
+		Type:          task.Type,
+		Schedule:      task.schedule,
+		Dsn:           taskDsnLabel(task),
+		StatementHash: statementHash(task.Payload),
+		DurationMs:    duration.Milliseconds(),
+		Rows:          rows,
+	}
+	taskLogger(task).Warn("Slow query", "dsn", slow.Dsn, "statement_hash", slow.StatementHash, "duration_ms", slow.DurationMs, "rows", rows)
+	if slowQueries.Report {
+		go func() {
+			if err := sendSlowQuery(task, slow); err != nil {
+				taskLogger(task).Warn("Slow query report failed", "error", err)
+			}
+		}()
+	}
+}
+
+/**
+POST a slow query to the `slow_query` endpoint
+*/
+func sendSlowQuery(task Task, slow SlowQuery) error {
+	payload, err := json.Marshal(JsonResponse{TaskId: slow.TaskId, Type: "slow_query", Body: slow})
+	if err != nil {
+		return err
+	}
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		slowQueryUrl, err := apiEndpoint(ENDPOINT_SLOW_QUERY, task)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", slowQueryUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, payload); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Slow query report failed: %s", resp.Status)
+	}
+	return verifyResponse(req, resp, body)
+}
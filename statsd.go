@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STATSD_DEFAULT_ADDRESS = "127.0.0.1:8125"
+	STATSD_DEFAULT_PREFIX  = "goproxy."
+	STATSD_FORMAT_DATADOG  = "datadog"
+	STATSD_FORMAT_STATSD   = "statsd"
+	STATSD_GAUGE_INTERVAL  = 10 * time.Second
+)
+
+/**
+A StatsD or Datadog agent to send metrics to, e.g. `{"address": "127.0.0.1:8125", "tags": {"site": "riverside"}}`.
+The same counters and timings as `/metrics` are sent as they happen, and the gauges every 10 seconds.
+*/
+type StatsdConfig struct {
+	Address string            `json:"address,omitempty"` // host and port of the agent, 127.0.0.1:8125 by default
+	Prefix  string            `json:"prefix,omitempty"`  // put before every metric name, goproxy. by default
+	Format  string            `json:"format,omitempty"`  // datadog (the default) sends labels as tags, statsd puts them in the name
+	Tags    map[string]string `json:"tags,omitempty"`    // added to every metric, datadog only
+}
+
+/**
+Check the address and format
+*/
+func (s *StatsdConfig) Validate() error {
+	if s.Address != "" {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("statsd.address %q must be a host and port, e.g. 127.0.0.1:8125.", s.Address)
+		}
+	}
+	switch s.Format {
+	case "", STATSD_FORMAT_DATADOG, STATSD_FORMAT_STATSD:
+	default:
+		return fmt.Errorf("statsd.format %q must be datadog or statsd.", s.Format)
+	}
+	if s.Format == STATSD_FORMAT_STATSD && len(s.Tags) > 0 {
+		return errors.New("statsd.tags are only sent in the datadog format.")
+	}
+	return nil
+}
+
+var (
+	statsdConn     net.Conn
+	statsdConnOnce sync.Once
+)
+
+/**
+The UDP socket metrics go out on, opened the first time one's sent - nil if it can't be
+*/
+func getStatsdConn() net.Conn {
+	statsdConnOnce.Do(func() {
+		address := currentConfig().Statsd.Address
+		if address == "" {
+			address = STATSD_DEFAULT_ADDRESS
+		}
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			logger.Error("StatsD not started", "error", err)
+			return
+		}
+		statsdConn = conn
+	})
+	return statsdConn
+}
+
+/**
+The StatsD name for a metric - the Prometheus name without `goproxy_` and its unit, e.g. `polls` for
+`goproxy_polls_total`
+*/
+func statsdName(name string) string {
+	name = strings.TrimPrefix(name, "goproxy_")
+	for _, suffix := range []string{"_total", "_seconds"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+/**
+Send a metric to the agent, if there is one - `kind` is `c` for a counter, `ms` for a timing or `g` for a gauge. Labels
+become tags, or parts of the name in the plain StatsD format. Nothing is retried - UDP metrics are best effort.
+*/
+func sendStatsd(name string, value float64, kind string, labels []string, labelValues []string) {
+	config := currentConfig()
+	if config.Statsd == nil {
+		return
+	}
+	conn := getStatsdConn()
+	if conn == nil {
+		return
+	}
+
+	prefix := config.Statsd.Prefix
+	if prefix == "" {
+		prefix = STATSD_DEFAULT_PREFIX
+	}
+	metric := prefix + statsdName(name)
+	var tags []string
+	if config.Statsd.Format == STATSD_FORMAT_STATSD {
+		for _, labelValue := range labelValues {
+			metric += "." + strings.NewReplacer(".", "_", ":", "_", "|", "_", " ", "_").Replace(labelValue)
+		}
+	} else {
+		for i, labelValue := range labelValues {
+			tags = append(tags, labels[i]+":"+labelValue)
+		}
+		for tag, tagValue := range config.Statsd.Tags {
+			tags = append(tags, tag+":"+tagValue)
+		}
+		sort.Strings(tags)
+	}
+
+	line := fmt.Sprintf("%s:%s|%s", metric, formatMetric(value), kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	conn.Write([]byte(line))
+}
+
+/**
+Send the gauges every few seconds while the connector runs
+*/
+func runStatsdGauges() {
+	for {
+		for _, gauge := range currentGauges() {
+			sendStatsd(gauge.name, float64(gauge.value), "g", nil, nil)
+		}
+		time.Sleep(STATSD_GAUGE_INTERVAL)
+	}
+}
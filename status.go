@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STATUS_DEFAULT_LISTEN = "127.0.0.1:9465"
+	STATUS_HEALTH_PATH    = "/healthz"
+	STATUS_PATH           = "/status"
+	STATUS_POLL_GRACE     = 60 * time.Second // on top of three intervals, before a connector that hasn't polled is unhealthy
+)
+
+/**
+A local endpoint monitoring agents and support tooling can check the connector on, e.g. `{"listen": "127.0.0.1:9465"}`.
+It only listens on the loopback interface.
+*/
+type StatusConfig struct {
+	Listen string `json:"listen,omitempty"` // address and port to listen on, 127.0.0.1:9465 by default
+}
+
+/**
+Check the listen address is a loopback host and port
+*/
+func (s *StatusConfig) Validate() error {
+	if s.Listen == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(s.Listen)
+	if err != nil {
+		return fmt.Errorf("status.listen %q must be a host and port, e.g. 127.0.0.1:9465.", s.Listen)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("status.listen %q must be on localhost, e.g. 127.0.0.1:9465.", s.Listen)
+	}
+	return nil
+}
+
+// When the API was last polled, and last polled without an error (Unix nanoseconds)
+var (
+	lastPollAt        int64
+	lastPollSuccessAt int64
+)
+
+// The last task started, for the status endpoint
+var lastTaskId atomic.Value
+
+/**
+The connector's state, as served on `/status` - the heartbeat, and more about polling and the config
+*/
+type ConnectorStatus struct {
+	Heartbeat
+	State                string     `json:"state"` // running, paused or stopping
+	Healthy              bool       `json:"healthy"`
+	Problem              string     `json:"problem,omitempty"`
+	LastPollAt           *time.Time `json:"last_poll_at,omitempty"`
+	LastSuccessfulPollAt *time.Time `json:"last_successful_poll_at,omitempty"`
+	LastTaskId           string     `json:"last_task_id,omitempty"`
+	PushConnected        bool       `json:"push_connected"`
+	ConfigChecksum       string     `json:"config_checksum"`
+}
+
+/**
+Note how a poll of the API went, for the status endpoint and metrics
+*/
+func recordPollOutcome(err error) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&lastPollAt, now)
+	switch err {
+	case nil:
+		atomic.StoreInt64(&lastPollSuccessAt, now)
+		pollsTotal.add(1, "tasks")
+	case errNoTasks:
+		atomic.StoreInt64(&lastPollSuccessAt, now)
+		pollsTotal.add(1, "empty")
+	default:
+		pollsTotal.add(1, "error")
+	}
+}
+
+/**
+Note the task that just started
+*/
+func recordLastTask(task Task) {
+	atomic.StoreInt64(&lastTaskStart, time.Now().UnixNano())
+	lastTaskId.Store(task.Id)
+}
+
+/**
+A time stored as Unix nanoseconds, or nil if it was never set
+*/
+func storedTime(value *int64) *time.Time {
+	nanos := atomic.LoadInt64(value)
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos)
+	return &t
+}
+
+/**
+Is the connector working? It has to be running and in touch with the API - connected over a push transport, or
+having polled successfully within three intervals. A connector that's only just started is given the same time.
+*/
+func checkHealth() error {
+	if isShuttingDown() {
+		return errors.New("The connector is stopping.")
+	}
+	if isPushConnected() {
+		return nil
+	}
+	allowed := 3*time.Duration(currentConfig().Interval)*time.Second + STATUS_POLL_GRACE
+	since := startedAt
+	if last := storedTime(&lastPollSuccessAt); last != nil {
+		since = *last
+	}
+	if time.Since(since) > allowed {
+		return fmt.Errorf("No successful poll of the API for %s.", time.Since(since).Round(time.Second))
+	}
+	return nil
+}
+
+/**
+A checksum of the config in use, so support can tell whether two connectors have the same settings, or whether a
+change has been picked up
+*/
+func configChecksum() string {
+	data, err := json.Marshal(currentConfig())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+Gather the connector's state for `/status`
+*/
+func getStatus() ConnectorStatus {
+	status := ConnectorStatus{
+		Heartbeat:            getHeartbeat(),
+		State:                "running",
+		LastPollAt:           storedTime(&lastPollAt),
+		LastSuccessfulPollAt: storedTime(&lastPollSuccessAt),
+		PushConnected:        isPushConnected(),
+		ConfigChecksum:       configChecksum(),
+	}
+	switch {
+	case isShuttingDown():
+		status.State = "stopping"
+	case status.Paused:
+		status.State = "paused"
+	}
+	if id, ok := lastTaskId.Load().(string); ok {
+		status.LastTaskId = id
+	}
+	if err := checkHealth(); err != nil {
+		status.Problem = err.Error()
+	} else {
+		status.Healthy = true
+	}
+	return status
+}
+
+/**
+Serve `/healthz`, which answers 200 when the connector is healthy and 503 when it isn't, and `/status` with the
+details as JSON
+*/
+func runStatusListener() {
+	listen := currentConfig().Status.Listen
+	if listen == "" {
+		listen = STATUS_DEFAULT_LISTEN
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(STATUS_HEALTH_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := checkHealth(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc(STATUS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		encoder.Encode(getStatus())
+	})
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	logger.Info("Status listening", "url", "http://"+listen+STATUS_PATH)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error("Status listener stopped", "error", err)
+	}
+}
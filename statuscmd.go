@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kardianos/service"
+	"net/http"
+	"time"
+)
+
+const (
+	STATUS_COMMAND_TIMEOUT = 5 * time.Second
+)
+
+/**
+How long ago a time was, for `goproxy status` e.g. `2024-05-01 09:30:12 (42s ago)`
+*/
+func formatStatusTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format("2006-01-02 15:04:05"), time.Since(*t).Round(time.Second))
+}
+
+/**
+What the service manager says about the service
+*/
+func serviceState() string {
+	s, err := newService(&Program{})
+	if err != nil {
+		return "unknown - " + err.Error()
+	}
+	status, err := s.Status()
+	switch {
+	case err == service.ErrNotInstalled:
+		return "not installed"
+	case err != nil:
+		return "unknown - " + err.Error()
+	case status == service.StatusRunning:
+		return "running"
+	case status == service.StatusStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+Ask the running connector how it is, over its status endpoint
+*/
+func fetchStatus() (ConnectorStatus, error) {
+	var status ConnectorStatus
+	listen := currentConfig().Status.Listen
+	if listen == "" {
+		listen = STATUS_DEFAULT_LISTEN
+	}
+	client := &http.Client{Timeout: STATUS_COMMAND_TIMEOUT}
+	resp, err := client.Get("http://" + listen + STATUS_PATH)
+	if err != nil {
+		return status, fmt.Errorf("The connector isn't answering on %s - is it running? (%v)", listen, err)
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("The status endpoint answered %s.", resp.Status)
+	}
+	return status, json.NewDecoder(resp.Body).Decode(&status)
+}
+
+/**
+`goproxy status` - print the state of the running connector, so site IT can check it's healthy with one command.
+The exit code is 0 when it's healthy, and 1 when it isn't or can't be reached.
+*/
+func runStatusCommand() int {
+	fmt.Printf("Service:          %s\n", serviceState())
+	if currentConfig().Status == nil {
+		fmt.Println("The status endpoint is off - set status.listen in the config, e.g. with `goproxy config set status.listen 127.0.0.1:9465`, to see more.")
+		return 1
+	}
+
+	status, err := fetchStatus()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	health := "healthy"
+	if !status.Healthy {
+		health = "unhealthy - " + status.Problem
+	}
+	fmt.Printf("State:            %s, %s\n", status.State, health)
+	fmt.Printf("Version:          %s, up %s\n", status.Version, (time.Duration(status.Uptime) * time.Second).String())
+	fmt.Printf("API:              %s over %s\n", status.ApiUrl, status.Transport)
+	if status.Transport != TRANSPORT_POLL && status.Transport != TRANSPORT_LONG_POLL {
+		fmt.Printf("Push connected:   %t\n", status.PushConnected)
+	}
+	fmt.Printf("Last poll:        %s\n", formatStatusTime(status.LastPollAt))
+	fmt.Printf("Last good poll:   %s\n", formatStatusTime(status.LastSuccessfulPollAt))
+	if status.LastTaskId != "" {
+		fmt.Printf("Last task:        %s, started %s\n", status.LastTaskId, formatStatusTime(status.LastTaskAt))
+	} else {
+		fmt.Printf("Last task:        none since starting\n")
+	}
+	fmt.Printf("Tasks:            %d running, %d queued, %d workers\n", status.TasksRunning, status.TasksWaiting, status.Concurrency)
+	checksum := status.ConfigChecksum
+	if checksum == configChecksum() {
+		checksum += " (the same as the config here)"
+	} else {
+		checksum += " (different to the config here - it may need a reload or restart)"
+	}
+	fmt.Printf("Config checksum:  %s\n", checksum)
+
+	if !status.Healthy {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSLOG_DEFAULT_FACILITY = "daemon"
+	SYSLOG_DEFAULT_APP_NAME = "goproxy"
+	SYSLOG_DIAL_TIMEOUT     = 5 * time.Second
+	SYSLOG_TIMESTAMP        = "2006-01-02T15:04:05.000000Z07:00" // RFC 5424 allows up to microseconds
+)
+
+// Where the local syslog daemon listens, on the systems that have one
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+/**
+Where to send the log over syslog, e.g. `{"network": "tcp", "address": "logs.school.local:514", "facility": "local0"}`.
+Without an `address` it goes to the local syslog daemon.
+*/
+type SyslogConfig struct {
+	Network  string `json:"network,omitempty"`  // udp (default) or tcp, for a remote server
+	Address  string `json:"address,omitempty"`  // host and port of a remote server
+	Facility string `json:"facility,omitempty"` // daemon by default
+	AppName  string `json:"app_name,omitempty"` // APP-NAME of each message, goproxy by default
+}
+
+/**
+Check the network, address and facility make sense
+*/
+func (s *SyslogConfig) Validate() error {
+	if s.Facility != "" {
+		if _, ok := syslogFacilities[strings.ToLower(s.Facility)]; !ok {
+			return fmt.Errorf("log.syslog.facility %q isn't a syslog facility, e.g. daemon or local0.", s.Facility)
+		}
+	}
+	if s.Address == "" {
+		if s.Network != "" {
+			return errors.New("log.syslog.address must be set with log.syslog.network.")
+		}
+		if runtime.GOOS == "windows" {
+			return errors.New("log.syslog.address must be set - Windows has no local syslog.")
+		}
+		return nil
+	}
+	switch s.Network {
+	case "", "udp", "tcp":
+	default:
+		return fmt.Errorf("log.syslog.network %q must be udp or tcp.", s.Network)
+	}
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return fmt.Errorf("log.syslog.address %q must be a host and port, e.g. logs.school.local:514.", s.Address)
+	}
+	return nil
+}
+
+/**
+Sends RFC 5424 messages to a syslog server, connecting when the first one is sent and again after a failure
+*/
+type syslogSender struct {
+	lock     sync.Mutex
+	config   SyslogConfig
+	conn     net.Conn
+	stream   bool // TCP, where each message is framed with its length
+	hostname string
+	facility int
+	buf      bytes.Buffer // each line as formatted by `syslogHandler`
+}
+
+func newSyslogSender(c *SyslogConfig) *syslogSender {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	facility, ok := syslogFacilities[strings.ToLower(c.Facility)]
+	if !ok {
+		facility = syslogFacilities[SYSLOG_DEFAULT_FACILITY]
+	}
+	sender := &syslogSender{config: *c, hostname: hostname, facility: facility}
+	if sender.config.AppName == "" {
+		sender.config.AppName = SYSLOG_DEFAULT_APP_NAME
+	}
+	return sender
+}
+
+/**
+Connect to the server, or the first local socket that answers
+*/
+func (s *syslogSender) connect() error {
+	if s.config.Address != "" {
+		network := s.config.Network
+		if network == "" {
+			network = "udp"
+		}
+		conn, err := net.DialTimeout(network, s.config.Address, SYSLOG_DIAL_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		s.conn, s.stream = conn, network == "tcp"
+		return nil
+	}
+
+	err := errors.New("No local syslog socket found.")
+	for _, path := range syslogLocalSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.DialTimeout(network, path, SYSLOG_DIAL_TIMEOUT); err == nil {
+				s.conn, s.stream = conn, network == "unix"
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+/**
+The syslog severity for a log level
+*/
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+/**
+Send a message, trying once more on a new connection if the old one has gone. A message that still can't be sent
+is dropped - there's nowhere to log that to but the log.
+*/
+func (s *syslogSender) send(level slog.Level, message string) {
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", s.facility*8+syslogSeverity(level),
+		time.Now().Format(SYSLOG_TIMESTAMP), s.hostname, s.config.AppName, os.Getpid(), message)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil && s.connect() != nil {
+			return
+		}
+		framed := line
+		if s.stream {
+			framed = fmt.Sprintf("%d %s", len(line), line)
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(SYSLOG_DIAL_TIMEOUT))
+		if _, err := s.conn.Write([]byte(framed)); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+/**
+Passes log lines on to the next handler, and also sends them to syslog - formatted as they are for the log, less
+the time and level, which syslog has fields of its own for
+*/
+type syslogHandler struct {
+	next   slog.Handler
+	format slog.Handler // writes to the sender's buffer
+	sender *syslogSender
+}
+
+func newSyslogHandler(next slog.Handler, format string, c *SyslogConfig) syslogHandler {
+	sender := newSyslogSender(c)
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}
+	var formatter slog.Handler = slog.NewTextHandler(&sender.buf, options)
+	if format == LOG_FORMAT_JSON {
+		formatter = slog.NewJSONHandler(&sender.buf, options)
+	}
+	return syslogHandler{next: next, format: formatter, sender: sender}
+}
+
+func (h syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.sender.lock.Lock()
+	h.sender.buf.Reset()
+	if err := h.format.Handle(ctx, record); err == nil {
+		h.sender.send(record.Level, strings.TrimSuffix(h.sender.buf.String(), "\n"))
+	}
+	h.sender.lock.Unlock()
+	return h.next.Handle(ctx, record)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{next: h.next.WithAttrs(attrs), format: h.format.WithAttrs(attrs), sender: h.sender}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{next: h.next.WithGroup(name), format: h.format.WithGroup(name), sender: h.sender}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	CERT_DEFAULT_PORT    = 443
+	CERT_DEFAULT_TIMEOUT = 10
+)
+
+/**
+Config for a certificate check e.g. `{"host": "lms.school.local", "port": 443, "server_name": "lms.school.edu"}`
+*/
+type CertTaskConfig struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	ServerName string `json:"server_name"`
+	Timeout    int    `json:"timeout"`
+}
+
+/**
+Details of one certificate in the chain presented by the server
+*/
+type CertInfo struct {
+	Subject       string    `json:"subject"`
+	Issuer        string    `json:"issuer"`
+	SerialNumber  string    `json:"serial_number"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+	IsCA          bool      `json:"is_ca"`
+}
+
+/**
+The certificate chain presented by a server and whether it verifies against the local trust store
+*/
+type CertCheckResult struct {
+	Address       string     `json:"address"`
+	ServerName    string     `json:"server_name"`
+	TLSVersion    string     `json:"tls_version"`
+	Verified      bool       `json:"verified"`
+	VerifyError   string     `json:"verify_error,omitempty"`
+	ExpiresInDays int        `json:"expires_in_days"`
+	Chain         []CertInfo `json:"chain"`
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+/**
+Get certificate check specific config for the task
+*/
+func getCertTaskConfig(task Task) CertTaskConfig {
+	var certConfig CertTaskConfig
+	err := json.Unmarshal(task.RawConfig, &certConfig)
+	errCheckPostback(task, err)
+	if certConfig.Port <= 0 {
+		certConfig.Port = CERT_DEFAULT_PORT
+	}
+	if certConfig.ServerName == "" {
+		certConfig.ServerName = certConfig.Host
+	}
+	if certConfig.Timeout <= 0 {
+		certConfig.Timeout = CERT_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("Certificate check configuration", "config", certConfig)
+
+	return certConfig
+}
+
+/**
+Connect to a TLS server and inspect the certificate chain it presents.
+Verification is done separately so expired or untrusted chains can still be reported on.
+*/
+func checkCertificate(ctx context.Context, certConfig CertTaskConfig) (CertCheckResult, error) {
+	result := CertCheckResult{
+		Address:    net.JoinHostPort(certConfig.Host, strconv.Itoa(certConfig.Port)),
+		ServerName: certConfig.ServerName,
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: time.Duration(certConfig.Timeout) * time.Second},
+		Config: &tls.Config{
+			ServerName:         certConfig.ServerName,
+			InsecureSkipVerify: true,
+		},
+	}
+	netConn, err := dialer.DialContext(ctx, "tcp", result.Address)
+	if err != nil {
+		return result, err
+	}
+	defer netConn.Close()
+	conn := netConn.(*tls.Conn)
+
+	state := conn.ConnectionState()
+	result.TLSVersion = tlsVersionNames[state.Version]
+	if len(state.PeerCertificates) == 0 {
+		return result, errors.New("Server did not present a certificate.")
+	}
+
+	now := time.Now()
+	for _, cert := range state.PeerCertificates {
+		result.Chain = append(result.Chain, CertInfo{
+			Subject:       cert.Subject.String(),
+			Issuer:        cert.Issuer.String(),
+			SerialNumber:  cert.SerialNumber.String(),
+			DNSNames:      cert.DNSNames,
+			NotBefore:     cert.NotBefore,
+			NotAfter:      cert.NotAfter,
+			DaysRemaining: int(cert.NotAfter.Sub(now).Hours() / 24),
+			IsCA:          cert.IsCA,
+		})
+	}
+	result.ExpiresInDays = result.Chain[0].DaysRemaining
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       certConfig.ServerName,
+		Intermediates: intermediates,
+	})
+	result.Verified = err == nil
+	if err != nil {
+		result.VerifyError = err.Error()
+	}
+
+	return result, nil
+}
+
+/**
+Retrieve a server's certificate chain and POST the subjects, issuers and expiry dates back to the API
+*/
+func processCertTask(task Task) {
+
+	certConfig := getCertTaskConfig(task)
+
+	taskLogger(task).Info("Checking certificate")
+	result, err := checkCertificate(task.Context(), certConfig)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
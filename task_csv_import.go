@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	CSV_IMPORT_DEFAULT_BATCH_SIZE = 500
+	CSV_IMPORT_MAX_REJECTED       = 1000
+	MSSQL_MAX_PARAMS              = 2000 // SQL Server allows 2100 parameters per statement
+	MSSQL_MAX_VALUES_ROWS         = 1000 // and 1000 rows in a VALUES list
+	MYSQL_MAX_PARAMS              = 65000
+)
+
+/**
+Config for a CSV import. The CSV is either sent inline as the task payload or downloaded from `source`.
+`mapping` maps CSV header names to table columns, and `key_columns` turns the inserts into upserts e.g.
+`{"type": "mysql", "dsn": "...", "table": "students", "mapping": {"Student ID": "id", "Name": "name"}, "key_columns": ["id"]}`
+*/
+type CsvImportTaskConfig struct {
+	DBTaskConfig
+	Table      string            `json:"table"`
+	Source     string            `json:"source"`
+	Compressed bool              `json:"compressed"`
+	Mapping    map[string]string `json:"mapping"`
+	KeyColumns []string          `json:"key_columns"`
+	BatchSize  int               `json:"batch_size"`
+}
+
+/**
+Row counts for a single batch of an import
+*/
+type CsvImportBatch struct {
+	Batch    int   `json:"batch"`
+	Rows     int   `json:"rows"`
+	Affected int64 `json:"affected"`
+	Rejected int   `json:"rejected"`
+}
+
+/**
+A CSV row that could not be imported
+*/
+type CsvRejectedRow struct {
+	Line   int      `json:"line"`
+	Error  string   `json:"error"`
+	Record []string `json:"record"`
+}
+
+/**
+Summary of a CSV import. Only the first CSV_IMPORT_MAX_REJECTED rejected rows are listed, but all are counted.
+*/
+type CsvImportResult struct {
+	Table         string           `json:"table"`
+	Rows          int              `json:"rows"`
+	Affected      int64            `json:"affected"`
+	Batches       []CsvImportBatch `json:"batches"`
+	Rejected      []CsvRejectedRow `json:"rejected"`
+	RejectedCount int              `json:"rejected_count"`
+}
+
+/**
+Note a row that couldn't be imported, listing it if there's still room
+*/
+func (r *CsvImportResult) reject(row CsvRejectedRow) {
+	r.RejectedCount++
+	if len(r.Rejected) < CSV_IMPORT_MAX_REJECTED {
+		r.Rejected = append(r.Rejected, row)
+	}
+}
+
+/**
+A CSV record waiting to be written, along with its line number for error reporting
+*/
+type csvImportRow struct {
+	line   int
+	record []string
+	values []interface{}
+}
+
+/**
+Get CSV import specific config for the task
+*/
+func getCsvImportTaskConfig(task Task) CsvImportTaskConfig {
+	var importConfig CsvImportTaskConfig
+	err := json.Unmarshal(task.RawConfig, &importConfig)
+	errCheckPostback(task, err)
+	errCheckPostback(task, importConfig.resolveAlias())
+	if importConfig.BatchSize <= 0 {
+		importConfig.BatchSize = CSV_IMPORT_DEFAULT_BATCH_SIZE
+	}
+	for _, key := range importConfig.KeyColumns {
+		if importConfig.Mapping != nil && !isMappedColumn(importConfig.Mapping, key) {
+			errCheckPostback(task, fmt.Errorf("Key column %q isn't one of the columns in the mapping.", key))
+		}
+	}
+	taskLogger(task).Debug("CSV import configuration", "db_type", importConfig.Type, "table", importConfig.Table, "mapping", importConfig.Mapping, "key_columns", importConfig.KeyColumns)
+
+	return importConfig
+}
+
+/**
+Is a table column one the mapping writes to?
+*/
+func isMappedColumn(mapping map[string]string, column string) bool {
+	for _, mapped := range mapping {
+		if mapped == column {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+The most rows to write in one statement - the batch size, cut down so the statement stays within the database's limit
+on bind parameters, and for SQL Server, on rows in a VALUES list
+*/
+func csvImportBatchSize(importConfig CsvImportTaskConfig, columnCount int) int {
+	batchSize := importConfig.BatchSize
+	maxParams := MYSQL_MAX_PARAMS
+	if importConfig.Type == "mssql" {
+		maxParams = MSSQL_MAX_PARAMS
+		if batchSize > MSSQL_MAX_VALUES_ROWS {
+			batchSize = MSSQL_MAX_VALUES_ROWS
+		}
+	}
+	if batchSize*columnCount > maxParams {
+		batchSize = maxParams / columnCount
+	}
+	return batchSize
+}
+
+/**
+Build a batched INSERT (or upsert when key columns are given) for `rowCount` rows
+*/
+func buildCsvImportStatement(dbType string, table string, columns []string, keyColumns []string, rowCount int) string {
+	quotedTable := quoteIdentifier(dbType, table)
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quoteIdentifier(dbType, column)
+	}
+
+	param := 0
+	rowPlaceholders := make([]string, rowCount)
+	for r := 0; r < rowCount; r++ {
+		placeholders := make([]string, len(columns))
+		for c := range columns {
+			param++
+			if dbType == "mssql" {
+				placeholders[c] = fmt.Sprintf("@p%d", param)
+			} else {
+				placeholders[c] = "?"
+			}
+		}
+		rowPlaceholders[r] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	values := strings.Join(rowPlaceholders, ", ")
+
+	isKey := make(map[string]bool, len(keyColumns))
+	for _, key := range keyColumns {
+		isKey[key] = true
+	}
+
+	if len(keyColumns) == 0 {
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", quotedTable, strings.Join(quotedColumns, ", "), values)
+	}
+
+	if dbType == "mssql" {
+		var matches, updates, sourceColumns []string
+		for i, column := range columns {
+			sourceColumns = append(sourceColumns, "source."+quotedColumns[i])
+			if isKey[column] {
+				matches = append(matches, fmt.Sprintf("target.%s = source.%s", quotedColumns[i], quotedColumns[i]))
+			} else {
+				updates = append(updates, fmt.Sprintf("%s = source.%s", quotedColumns[i], quotedColumns[i]))
+			}
+		}
+		statement := fmt.Sprintf("MERGE INTO %s AS target USING (VALUES %s) AS source (%s) ON %s",
+			quotedTable, values, strings.Join(quotedColumns, ", "), strings.Join(matches, " AND "))
+		if len(updates) > 0 {
+			statement += " WHEN MATCHED THEN UPDATE SET " + strings.Join(updates, ", ")
+		}
+		return statement + fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);",
+			strings.Join(quotedColumns, ", "), strings.Join(sourceColumns, ", "))
+	}
+
+	var updates []string
+	for i, column := range columns {
+		if !isKey[column] {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quotedColumns[i], quotedColumns[i]))
+		}
+	}
+	if len(updates) == 0 {
+		// Nothing to update - just skip rows that already exist
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES %s", quotedTable, strings.Join(quotedColumns, ", "), values)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE %s",
+		quotedTable, strings.Join(quotedColumns, ", "), values, strings.Join(updates, ", "))
+}
+
+/**
+Write a batch of rows in one statement. If the batch fails, fall back to writing the rows one at a time
+so only the bad rows are rejected. Stops with the context's error if the task is cancelled or times out.
+*/
+func writeCsvImportBatch(ctx context.Context, db *sql.DB, importConfig CsvImportTaskConfig, columns []string, rows []csvImportRow, result *CsvImportResult) error {
+	batch := CsvImportBatch{Batch: len(result.Batches) + 1, Rows: len(rows)}
+
+	var args []interface{}
+	for _, row := range rows {
+		args = append(args, row.values...)
+	}
+
+	statement := buildCsvImportStatement(importConfig.Type, importConfig.Table, columns, importConfig.KeyColumns, len(rows))
+	res, err := db.ExecContext(ctx, statement, args...)
+	if err == nil {
+		batch.Affected, _ = res.RowsAffected()
+	} else {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		single := buildCsvImportStatement(importConfig.Type, importConfig.Table, columns, importConfig.KeyColumns, 1)
+		for _, row := range rows {
+			res, err := db.ExecContext(ctx, single, row.values...)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				batch.Rejected++
+				result.reject(CsvRejectedRow{Line: row.line, Error: err.Error(), Record: row.record})
+				continue
+			}
+			affected, _ := res.RowsAffected()
+			batch.Affected += affected
+		}
+	}
+
+	result.Rows += batch.Rows
+	result.Affected += batch.Affected
+	result.Batches = append(result.Batches, batch)
+	return nil
+}
+
+/**
+Read a CSV, map its columns to table columns and write it to the table in batches
+*/
+func importCsv(ctx context.Context, db *sql.DB, importConfig CsvImportTaskConfig, source io.Reader, progress *ProgressReporter) (CsvImportResult, error) {
+	result := CsvImportResult{Table: importConfig.Table, Batches: []CsvImportBatch{}, Rejected: []CsvRejectedRow{}}
+
+	reader := csv.NewReader(source)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return result, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], UTF8_BOM)
+	}
+
+	// Work out which CSV fields go into which table columns - without a mapping the header is used as is
+	var columns []string
+	var fieldIndexes []int
+	for i, name := range header {
+		column := name
+		if importConfig.Mapping != nil {
+			mapped, ok := importConfig.Mapping[name]
+			if !ok {
+				continue
+			}
+			column = mapped
+		}
+		columns = append(columns, column)
+		fieldIndexes = append(fieldIndexes, i)
+	}
+	if len(columns) == 0 {
+		return result, errors.New("None of the CSV columns are mapped to table columns.")
+	}
+	// Upserts match on the key columns, so each has to be written
+	importing := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		importing[column] = true
+	}
+	for _, key := range importConfig.KeyColumns {
+		if !importing[key] {
+			return result, fmt.Errorf("Key column %q isn't one of the columns being imported.", key)
+		}
+	}
+	batchSize := csvImportBatchSize(importConfig, len(columns))
+
+	var rows []csvImportRow
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return result, err
+			}
+			result.reject(CsvRejectedRow{Line: line, Error: err.Error(), Record: record})
+			continue
+		}
+		if len(record) != len(header) {
+			result.reject(CsvRejectedRow{
+				Line:   line,
+				Error:  fmt.Sprintf("Expected %d fields, found %d", len(header), len(record)),
+				Record: record,
+			})
+			continue
+		}
+
+		values := make([]interface{}, len(fieldIndexes))
+		for i, index := range fieldIndexes {
+			values[i] = record[index]
+		}
+		rows = append(rows, csvImportRow{line: line, record: record, values: values})
+
+		if len(rows) >= batchSize {
+			if err := writeCsvImportBatch(ctx, db, importConfig, columns, rows, &result); err != nil {
+				return result, err
+			}
+			rows = nil
+			progress.Update(int64(line-1), reader.InputOffset())
+		}
+	}
+	if len(rows) > 0 {
+		if err := writeCsvImportBatch(ctx, db, importConfig, columns, rows, &result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+/**
+Import a server-provided CSV into a table and POST per-batch counts and rejected rows back to the API
+*/
+func processCsvImportTask(task Task) {
+
+	importConfig := getCsvImportTaskConfig(task)
+	if importConfig.Table == "" {
+		errCheckPostback(task, errors.New("No table given to import into."))
+	}
+
+	var source io.Reader = strings.NewReader(task.Payload)
+	size := int64(len(task.Payload))
+	if importConfig.Source != "" {
+		taskLogger(task).Info("Downloading CSV")
+		filePath, err := downloadFile(importConfig.Source, importConfig.Compressed)
+		errCheckPostback(task, err)
+		defer os.Remove(filePath)
+
+		file, err := os.Open(filePath)
+		errCheckPostback(task, err)
+		defer file.Close()
+		source = file
+
+		info, err := file.Stat()
+		errCheckPostback(task, err)
+		size = info.Size()
+	}
+
+	db := initDbConnection(task)
+	defer db.Close()
+
+	taskLogger(task).Info("Importing CSV")
+	result, err := importCsv(task.Context(), db, importConfig, source, newProgressReporter(task, "importing", size))
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	DUMP_METHOD_MYSQLDUMP   = "mysqldump"
+	DUMP_METHOD_NATIVE      = "native"
+	DUMP_ROWS_PER_STATEMENT = 100
+)
+
+/**
+Config for a database dump e.g. `{"type": "mysql", "dsn": "...", "tables": ["students"], "method": "mysqldump"}`
+*/
+type DbDumpTaskConfig struct {
+	DBTaskConfig
+	Tables    []string `json:"tables"`
+	Method    string   `json:"method"`
+	ChunkSize int64    `json:"chunk_size"`
+}
+
+/**
+Summary of a completed dump and its upload
+*/
+type DbDumpResult struct {
+	Method           string       `json:"method"`
+	Tables           []string     `json:"tables"`
+	Rows             int64        `json:"rows,omitempty"`
+	UncompressedSize int64        `json:"uncompressed_bytes"`
+	Upload           UploadResult `json:"upload"`
+}
+
+/**
+Counts bytes written through it so we know the uncompressed size of a dump
+*/
+type countingWriter struct {
+	w        io.Writer
+	count    int64
+	progress *ProgressReporter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	c.progress.Update(0, c.count)
+	return n, err
+}
+
+/**
+Get dump specific config for the task - mysqldump is used for MySQL unless the native dumper is requested
+*/
+func getDbDumpTaskConfig(task Task) DbDumpTaskConfig {
+	var dumpConfig DbDumpTaskConfig
+	err := json.Unmarshal(task.RawConfig, &dumpConfig)
+	errCheckPostback(task, err)
+	errCheckPostback(task, dumpConfig.resolveAlias())
+	if dumpConfig.Method == "" {
+		dumpConfig.Method = DUMP_METHOD_NATIVE
+		if dumpConfig.Type == "mysql" {
+			dumpConfig.Method = DUMP_METHOD_MYSQLDUMP
+		}
+	}
+	taskLogger(task).Debug("Dump configuration", "db_type", dumpConfig.Type, "tables", dumpConfig.Tables, "method", dumpConfig.Method)
+
+	return dumpConfig
+}
+
+/**
+Quote a (possibly schema qualified) table or column name for the given database type
+*/
+func quoteIdentifier(dbType string, name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if dbType == "mssql" {
+			parts[i] = "[" + strings.Replace(part, "]", "]]", -1) + "]"
+		} else {
+			parts[i] = "`" + strings.Replace(part, "`", "``", -1) + "`"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+/**
+Format a value as a SQL literal for the given database type
+*/
+func sqlLiteral(dbType string, value sql.NullString) string {
+	if !value.Valid {
+		return "NULL"
+	}
+	if dbType == "mssql" {
+		return "N'" + strings.Replace(value.String, "'", "''", -1) + "'"
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, "'", `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+	return "'" + replacer.Replace(value.String) + "'"
+}
+
+/**
+Build the connection arguments and environment for the mysql command line tools from a DSN.
+The password is passed through the environment so it doesn't show up in the process list. The database name comes
+last, after `--` so nothing from there on is taken as an option - further options go before the returned args.
+*/
+func mysqlClientArgs(dsn string) ([]string, []string, error) {
+	mysqlConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mysqlConfig.DBName == "" || strings.HasPrefix(mysqlConfig.DBName, "-") {
+		return nil, nil, fmt.Errorf("%q isn't a database name the mysql tools can be given - set one in the DSN.", mysqlConfig.DBName)
+	}
+
+	args := []string{"--user=" + mysqlConfig.User}
+	if mysqlConfig.Net == "unix" {
+		args = append(args, "--socket="+mysqlConfig.Addr)
+	} else if host, port, err := net.SplitHostPort(mysqlConfig.Addr); err == nil {
+		args = append(args, "--host="+host, "--port="+port)
+	}
+	args = append(args, "--", mysqlConfig.DBName)
+
+	env := append(os.Environ(), "MYSQL_PWD="+mysqlConfig.Passwd)
+
+	return args, env, nil
+}
+
+/**
+Dump the tables of a MySQL database by running `mysqldump`. Table names go on its command line, so one that looks
+like an option, e.g. `--result-file=...`, is refused rather than passed to it.
+*/
+func dumpWithMysqldump(ctx context.Context, dsn string, tables []string, w io.Writer) error {
+	for _, table := range tables {
+		if table == "" || strings.HasPrefix(table, "-") {
+			return fmt.Errorf("%q isn't a table name mysqldump can be given.", table)
+		}
+	}
+	args, env, err := mysqlClientArgs(dsn)
+	if err != nil {
+		return err
+	}
+	args = append([]string{"--single-transaction", "--quick"}, args...)
+	args = append(args, tables...)
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "mysqldump", args...)
+	cmd.Env = env
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mysqldump failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+/**
+Dump a single table as batched INSERT statements, returning the number of rows written
+*/
+func dumpTableNative(ctx context.Context, db *sql.DB, dbType string, table string, w io.Writer) (int64, error) {
+	quotedTable := quoteIdentifier(dbType, table)
+
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+quotedTable)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	quotedColumns := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		quotedColumns[i] = quoteIdentifier(dbType, name)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES\n", quotedTable, strings.Join(quotedColumns, ", "))
+
+	fmt.Fprintf(w, "-- Table %s\n", table)
+
+	values := make([]sql.NullString, len(columnNames))
+	pointers := make([]interface{}, len(columnNames))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	literals := make([]string, len(columnNames))
+
+	var count int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		for i, value := range values {
+			literals[i] = sqlLiteral(dbType, value)
+		}
+
+		separator := ",\n"
+		if count%DUMP_ROWS_PER_STATEMENT == 0 {
+			if count > 0 {
+				io.WriteString(w, ";\n")
+			}
+			io.WriteString(w, insert)
+			separator = ""
+		}
+		if _, err := fmt.Fprintf(w, "%s(%s)", separator, strings.Join(literals, ", ")); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if count > 0 {
+		io.WriteString(w, ";\n")
+	}
+	io.WriteString(w, "\n")
+
+	return count, rows.Err()
+}
+
+/**
+List the base tables in a database so the native dumper can dump everything when no tables are given
+*/
+func listBaseTables(ctx context.Context, db *sql.DB, dbType string) ([]string, error) {
+	queries, ok := dbSchemaQueries[dbType]
+	if !ok {
+		return nil, fmt.Errorf("Cannot list tables for database type %s", dbType)
+	}
+	tableRows, err := queryStringRows(ctx, db, queries.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	for _, row := range tableRows {
+		if row["table_type"] == "BASE TABLE" {
+			tables = append(tables, row["table_schema"]+"."+row["table_name"])
+		}
+	}
+
+	return tables, nil
+}
+
+/**
+Dump tables from the task's database to a compressed file, upload it in chunks and POST a summary back to the API
+*/
+func processDbDumpTask(task Task) {
+
+	dumpConfig := getDbDumpTaskConfig(task)
+	result := DbDumpResult{Method: dumpConfig.Method, Tables: dumpConfig.Tables}
+
+	tmpFile, err := ioutil.TempFile("", "goproxy-dump-")
+	errCheckPostback(task, err)
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	buffered := bufio.NewWriter(tmpFile)
+	gz := gzip.NewWriter(buffered)
+	counter := &countingWriter{w: gz, progress: newProgressReporter(task, "dumping", 0)}
+
+	taskLogger(task).Info("Dumping database")
+	switch dumpConfig.Method {
+	case DUMP_METHOD_MYSQLDUMP:
+		if dumpConfig.Type != "mysql" {
+			errCheckPostback(task, fmt.Errorf("mysqldump cannot dump database type %s", dumpConfig.Type))
+		}
+		errCheckPostback(task, acquireDbConnection(task))
+		err = dumpWithMysqldump(task.Context(), dumpConfig.Dsn, dumpConfig.Tables, counter)
+		errCheckPostback(task, err)
+	case DUMP_METHOD_NATIVE:
+		db := initDbConnection(task)
+		defer db.Close()
+
+		if len(result.Tables) == 0 {
+			result.Tables, err = listBaseTables(task.Context(), db, dumpConfig.Type)
+			errCheckPostback(task, err)
+		}
+		for _, table := range result.Tables {
+			count, err := dumpTableNative(task.Context(), db, dumpConfig.Type, table, counter)
+			errCheckPostback(task, err)
+			result.Rows += count
+		}
+	default:
+		errCheckPostback(task, fmt.Errorf("Unknown dump method %s", dumpConfig.Method))
+	}
+
+	err = gz.Close()
+	errCheckPostback(task, err)
+	err = buffered.Flush()
+	errCheckPostback(task, err)
+	result.UncompressedSize = counter.count
+
+	taskLogger(task).Info("Uploading database dump")
+	result.Upload, err = uploadFile(task, tmpFile.Name(), dumpConfig.ChunkSize)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
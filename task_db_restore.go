@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	RESTORE_FORMAT_CSV = "csv"
+	RESTORE_FORMAT_SQL = "sql"
+	UTF8_BOM           = "\ufeff"
+)
+
+/**
+Config for a bulk restore e.g.
+`{"type": "mysql", "dsn": "...", "table": "lookup_codes", "format": "csv", "source": "/files/123", "compressed": true, "replace": true, "expected_rows": 1200}`
+*/
+type DbRestoreTaskConfig struct {
+	DBTaskConfig
+	Table        string `json:"table"`
+	Format       string `json:"format"`
+	Source       string `json:"source"`
+	Compressed   bool   `json:"compressed"`
+	Replace      bool   `json:"replace"`
+	ExpectedRows *int64 `json:"expected_rows"`
+}
+
+/**
+Summary of a bulk restore, including the row count of the table afterwards for verification. `transactional` says
+whether the load ran in a transaction, so that a failed one was rolled back - a MySQL SQL file is loaded by the mysql
+client, which commits as it goes.
+*/
+type DbRestoreResult struct {
+	Table         string `json:"table"`
+	Format        string `json:"format"`
+	RowsLoaded    int64  `json:"rows_loaded"`
+	TableRows     int64  `json:"table_rows"`
+	Transactional bool   `json:"transactional"`
+}
+
+/**
+Get restore specific config for the task
+*/
+func getDbRestoreTaskConfig(task Task) DbRestoreTaskConfig {
+	var restoreConfig DbRestoreTaskConfig
+	err := json.Unmarshal(task.RawConfig, &restoreConfig)
+	errCheckPostback(task, err)
+	errCheckPostback(task, restoreConfig.resolveAlias())
+	if restoreConfig.Format == "" {
+		restoreConfig.Format = RESTORE_FORMAT_CSV
+	}
+	taskLogger(task).Debug("Restore configuration", "db_type", restoreConfig.Type, "table", restoreConfig.Table, "format", restoreConfig.Format, "source", restoreConfig.Source)
+
+	return restoreConfig
+}
+
+/**
+Read the header row of a CSV file - the column names to load into
+*/
+func readCsvHeader(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := csv.NewReader(bufio.NewReader(file)).Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		// Excel likes to start files with a byte order mark
+		header[0] = strings.TrimPrefix(header[0], UTF8_BOM)
+	}
+
+	return header, nil
+}
+
+/**
+Load a CSV file into a MySQL table with `LOAD DATA LOCAL INFILE`
+*/
+func loadCsvMysql(tx *sql.Tx, task Task, table string, filePath string) (int64, error) {
+	columns, err := readCsvHeader(filePath)
+	if err != nil {
+		return 0, err
+	}
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quoteIdentifier("mysql", column)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	handlerName := "restore-" + task.Id
+	mysql.RegisterReaderHandler(handlerName, func() io.Reader { return file })
+	defer mysql.DeregisterReaderHandler(handlerName)
+
+	result, err := tx.ExecContext(task.Context(), fmt.Sprintf(
+		`LOAD DATA LOCAL INFILE 'Reader::%s' INTO TABLE %s CHARACTER SET utf8mb4
+		FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"' ESCAPED BY ''
+		LINES TERMINATED BY '\n' IGNORE 1 LINES (%s)`,
+		handlerName, quoteIdentifier("mysql", table), strings.Join(quotedColumns, ", "),
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/**
+Load a CSV file into a MSSQL table with a bulk copy
+*/
+func loadCsvMssql(ctx context.Context, tx *sql.Tx, table string, filePath string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	columns, err := reader.Read()
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) > 0 {
+		columns[0] = strings.TrimPrefix(columns[0], UTF8_BOM)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, mssql.CopyIn(quoteIdentifier("mssql", table), mssql.BulkOptions{}, columns...))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	values := make([]interface{}, len(columns))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		for i, value := range record {
+			values[i] = value
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return 0, err
+		}
+	}
+
+	// An Exec with no values flushes the bulk copy
+	result, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/**
+Load a MySQL SQL dump by piping it through the `mysql` client
+*/
+func loadSqlMysql(ctx context.Context, dsn string, filePath string) error {
+	args, env, err := mysqlClientArgs(dsn)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "mysql", args...)
+	cmd.Env = env
+	cmd.Stdin = file
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mysql client failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+/**
+Run a MSSQL script, splitting it into batches on `GO` lines like sqlcmd does
+*/
+func loadSqlMssql(ctx context.Context, tx *sql.Tx, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var batch strings.Builder
+	execBatch := func() error {
+		if strings.TrimSpace(batch.String()) == "" {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, batch.String())
+		batch.Reset()
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.EqualFold(strings.TrimSpace(line), "GO") {
+			if err := execBatch(); err != nil {
+				return err
+			}
+			continue
+		}
+		batch.WriteString(line)
+		batch.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return execBatch()
+}
+
+/**
+Count the rows in a table
+*/
+func countTableRows(ctx context.Context, queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, dbType string, table string) (int64, error) {
+	var count int64
+	err := queryer.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdentifier(dbType, table)).Scan(&count)
+	return count, err
+}
+
+/**
+Load a server-provided data file into a table using the database's bulk load path, verify the row count
+and POST the result back to the API
+*/
+func processDbRestoreTask(task Task) {
+
+	restoreConfig := getDbRestoreTaskConfig(task)
+	if restoreConfig.Table == "" {
+		errCheckPostback(task, errors.New("No table given to restore into."))
+	}
+	result := DbRestoreResult{Table: restoreConfig.Table, Format: restoreConfig.Format}
+
+	taskLogger(task).Info("Downloading restore file")
+	filePath, err := downloadFile(restoreConfig.Source, restoreConfig.Compressed)
+	errCheckPostback(task, err)
+	defer os.Remove(filePath)
+
+	db := initDbConnection(task)
+	defer db.Close()
+
+	taskLogger(task).Info("Restoring table")
+
+	// A MySQL SQL dump is handed to the mysql client, which manages its own connection - so nothing it does can be
+	// rolled back, and the table can't be emptied first in the same transaction
+	if restoreConfig.Format == RESTORE_FORMAT_SQL && restoreConfig.Type == "mysql" {
+		if restoreConfig.Replace {
+			errCheckPostback(task, errors.New("replace can't be used with MySQL SQL files, as they can't be loaded in a transaction - empty the table in the file instead."))
+		}
+		before, err := countTableRows(task.Context(), db, restoreConfig.Type, restoreConfig.Table)
+		errCheckPostback(task, err)
+		err = loadSqlMysql(task.Context(), restoreConfig.Dsn, filePath)
+		errCheckPostback(task, err)
+		result.TableRows, err = countTableRows(task.Context(), db, restoreConfig.Type, restoreConfig.Table)
+		errCheckPostback(task, err)
+		result.RowsLoaded = result.TableRows - before
+
+		if restoreConfig.ExpectedRows != nil && result.RowsLoaded != *restoreConfig.ExpectedRows {
+			errCheckPostback(task, fmt.Errorf("Row count mismatch: expected %d rows, loaded %d. A MySQL SQL file can't be rolled back, so the rows are still in the table.", *restoreConfig.ExpectedRows, result.RowsLoaded))
+		}
+
+		postJsonResponse(task, JsonResponse{
+			Type: "success",
+			Body: result,
+		})
+		return
+	}
+
+	tx, err := db.BeginTx(task.Context(), nil)
+	errCheckPostback(task, err)
+	defer tx.Rollback()
+	result.Transactional = true
+
+	if restoreConfig.Replace {
+		_, err = tx.ExecContext(task.Context(), "DELETE FROM "+quoteIdentifier(restoreConfig.Type, restoreConfig.Table))
+		errCheckPostback(task, err)
+	}
+
+	before, err := countTableRows(task.Context(), tx, restoreConfig.Type, restoreConfig.Table)
+	errCheckPostback(task, err)
+
+	switch {
+	case restoreConfig.Format == RESTORE_FORMAT_CSV && restoreConfig.Type == "mysql":
+		result.RowsLoaded, err = loadCsvMysql(tx, task, restoreConfig.Table, filePath)
+	case restoreConfig.Format == RESTORE_FORMAT_CSV && restoreConfig.Type == "mssql":
+		result.RowsLoaded, err = loadCsvMssql(task.Context(), tx, restoreConfig.Table, filePath)
+	case restoreConfig.Format == RESTORE_FORMAT_SQL && restoreConfig.Type == "mssql":
+		err = loadSqlMssql(task.Context(), tx, filePath)
+	default:
+		err = fmt.Errorf("Cannot restore %s files into database type %s", restoreConfig.Format, restoreConfig.Type)
+	}
+	errCheckPostback(task, err)
+
+	result.TableRows, err = countTableRows(task.Context(), tx, restoreConfig.Type, restoreConfig.Table)
+	errCheckPostback(task, err)
+	if restoreConfig.Format == RESTORE_FORMAT_SQL {
+		result.RowsLoaded = result.TableRows - before
+	}
+
+	// Roll back if the load doesn't match what the server sent
+	if restoreConfig.ExpectedRows != nil && result.RowsLoaded != *restoreConfig.ExpectedRows {
+		errCheckPostback(task, fmt.Errorf("Row count mismatch: expected %d rows, loaded %d.", *restoreConfig.ExpectedRows, result.RowsLoaded))
+	}
+
+	err = tx.Commit()
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+/**
+Per-dialect queries used to introspect a database schema. Each dialect aliases its columns to the same names
+so the results can be assembled the same way.
+*/
+type schemaQueries struct {
+	Tables  string
+	Columns string
+	Indexes string
+}
+
+var dbSchemaQueries = map[string]schemaQueries{
+	"mysql": {
+		Tables: `SELECT TABLE_SCHEMA AS table_schema, TABLE_NAME AS table_name, TABLE_TYPE AS table_type,
+				COALESCE(TABLE_ROWS, 0) AS row_estimate
+			FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = DATABASE()
+			ORDER BY TABLE_NAME`,
+		Columns: `SELECT TABLE_SCHEMA AS table_schema, TABLE_NAME AS table_name, COLUMN_NAME AS column_name,
+				COLUMN_TYPE AS data_type, IS_NULLABLE AS is_nullable, COLUMN_DEFAULT AS column_default
+			FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE()
+			ORDER BY TABLE_NAME, ORDINAL_POSITION`,
+		Indexes: `SELECT TABLE_SCHEMA AS table_schema, TABLE_NAME AS table_name, INDEX_NAME AS index_name,
+				CASE NON_UNIQUE WHEN 0 THEN 1 ELSE 0 END AS is_unique, COLUMN_NAME AS column_name
+			FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE()
+			ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`,
+	},
+	"mssql": {
+		Tables: `SELECT t.TABLE_SCHEMA AS table_schema, t.TABLE_NAME AS table_name, t.TABLE_TYPE AS table_type,
+				COALESCE((SELECT SUM(p.rows) FROM sys.partitions p
+					WHERE p.object_id = OBJECT_ID(QUOTENAME(t.TABLE_SCHEMA) + '.' + QUOTENAME(t.TABLE_NAME))
+					AND p.index_id IN (0, 1)), 0) AS row_estimate
+			FROM INFORMATION_SCHEMA.TABLES t
+			ORDER BY t.TABLE_SCHEMA, t.TABLE_NAME`,
+		Columns: `SELECT TABLE_SCHEMA AS table_schema, TABLE_NAME AS table_name, COLUMN_NAME AS column_name,
+				DATA_TYPE + COALESCE('(' + CASE CHARACTER_MAXIMUM_LENGTH WHEN -1 THEN 'max'
+					ELSE CAST(CHARACTER_MAXIMUM_LENGTH AS varchar(10)) END + ')', '') AS data_type,
+				IS_NULLABLE AS is_nullable, COLUMN_DEFAULT AS column_default
+			FROM INFORMATION_SCHEMA.COLUMNS
+			ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION`,
+		Indexes: `SELECT s.name AS table_schema, t.name AS table_name, i.name AS index_name,
+				CAST(i.is_unique AS int) AS is_unique, c.name AS column_name
+			FROM sys.indexes i
+			JOIN sys.tables t ON t.object_id = i.object_id
+			JOIN sys.schemas s ON s.schema_id = t.schema_id
+			JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+			JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+			WHERE i.name IS NOT NULL
+			ORDER BY s.name, t.name, i.name, ic.key_ordinal`,
+	},
+}
+
+/**
+A column in an introspected table
+*/
+type SchemaColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Default  string `json:"default"`
+}
+
+/**
+An index in an introspected table
+*/
+type SchemaIndex struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Columns []string `json:"columns"`
+}
+
+/**
+A table (or view) in an introspected database
+*/
+type SchemaTable struct {
+	Schema      string         `json:"schema"`
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	RowEstimate int64          `json:"row_estimate"`
+	Columns     []SchemaColumn `json:"columns"`
+	Indexes     []*SchemaIndex `json:"indexes"`
+}
+
+/**
+Run a query and return every row as a map of column name to string value
+*/
+func queryStringRows(ctx context.Context, db *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]string
+
+	rc := newMapStringScan(columnNames)
+	for rows.Next() {
+		if err := rc.Update(rows); err != nil {
+			return nil, err
+		}
+		// Copy the row - MapStringScan reuses its map between rows
+		row := make(map[string]string, len(columnNames))
+		for k, v := range rc.Get() {
+			row[k] = v
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+/**
+Read the tables, columns and indexes of a database into a list of tables
+*/
+func introspectSchema(ctx context.Context, db *sql.DB, queries schemaQueries) ([]*SchemaTable, error) {
+	tableRows, err := queryStringRows(ctx, db, queries.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*SchemaTable
+	tablesByName := make(map[string]*SchemaTable)
+
+	for _, row := range tableRows {
+		rowEstimate, _ := strconv.ParseInt(row["row_estimate"], 10, 64)
+		table := &SchemaTable{
+			Schema:      row["table_schema"],
+			Name:        row["table_name"],
+			Type:        row["table_type"],
+			RowEstimate: rowEstimate,
+			Columns:     []SchemaColumn{},
+			Indexes:     []*SchemaIndex{},
+		}
+		tables = append(tables, table)
+		tablesByName[table.Schema+"."+table.Name] = table
+	}
+
+	columnRows, err := queryStringRows(ctx, db, queries.Columns)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range columnRows {
+		table, ok := tablesByName[row["table_schema"]+"."+row["table_name"]]
+		if !ok {
+			continue
+		}
+		table.Columns = append(table.Columns, SchemaColumn{
+			Name:     row["column_name"],
+			Type:     row["data_type"],
+			Nullable: row["is_nullable"] == "YES",
+			Default:  row["column_default"],
+		})
+	}
+
+	indexRows, err := queryStringRows(ctx, db, queries.Indexes)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range indexRows {
+		table, ok := tablesByName[row["table_schema"]+"."+row["table_name"]]
+		if !ok {
+			continue
+		}
+		// Index rows are ordered, so columns of the same index are consecutive
+		var index *SchemaIndex
+		if n := len(table.Indexes); n > 0 && table.Indexes[n-1].Name == row["index_name"] {
+			index = table.Indexes[n-1]
+		} else {
+			index = &SchemaIndex{Name: row["index_name"], Unique: row["is_unique"] == "1"}
+			table.Indexes = append(table.Indexes, index)
+		}
+		index.Columns = append(index.Columns, row["column_name"])
+	}
+
+	return tables, nil
+}
+
+/**
+Introspect the schema of the task's database and POST it back to the API
+*/
+func processDbSchemaTask(task Task) {
+
+	dbConfig := getDbTaskConfig(task)
+	queries, ok := dbSchemaQueries[dbConfig.Type]
+	if !ok {
+		errCheckPostback(task, fmt.Errorf("Schema introspection is not supported for database type %s", dbConfig.Type))
+	}
+
+	db := initDbConnection(task)
+	defer db.Close()
+
+	taskLogger(task).Info("Introspecting database schema")
+	tables, err := introspectSchema(task.Context(), db, queries)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: tables,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DNS_DEFAULT_TIMEOUT = 5
+)
+
+/**
+Config for a DNS lookup e.g. `{"host": "sqlserver.school.local", "types": ["A", "MX"], "timeout": 5}`
+*/
+type DnsTaskConfig struct {
+	Host    string   `json:"host"`
+	Types   []string `json:"types"`
+	Timeout int      `json:"timeout"`
+}
+
+/**
+The records returned for one record type, and how long the local resolver took to answer
+*/
+type DnsLookupResult struct {
+	Type     string   `json:"type"`
+	Records  []string `json:"records"`
+	TimeMs   float64  `json:"time_ms"`
+	Error    string   `json:"error,omitempty"`
+	NotFound bool     `json:"not_found,omitempty"`
+}
+
+/**
+Get DNS lookup specific config for the task, defaulting to A/AAAA lookups
+*/
+func getDnsTaskConfig(task Task) DnsTaskConfig {
+	var dnsConfig DnsTaskConfig
+	err := json.Unmarshal(task.RawConfig, &dnsConfig)
+	errCheckPostback(task, err)
+	if len(dnsConfig.Types) == 0 {
+		dnsConfig.Types = []string{"A", "AAAA"}
+	}
+	if dnsConfig.Timeout <= 0 {
+		dnsConfig.Timeout = DNS_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("DNS configuration", "config", dnsConfig)
+
+	return dnsConfig
+}
+
+/**
+Look up a single record type for a host using the system resolver, giving up when `ctx` is done
+*/
+func lookupDns(ctx context.Context, resolver *net.Resolver, host string, recordType string, timeout time.Duration) DnsLookupResult {
+	result := DnsLookupResult{Type: strings.ToUpper(recordType)}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+
+	switch result.Type {
+	case "A", "AAAA":
+		var addrs []net.IPAddr
+		addrs, err = resolver.LookupIPAddr(ctx, host)
+		for _, addr := range addrs {
+			isV4 := addr.IP.To4() != nil
+			if isV4 == (result.Type == "A") {
+				result.Records = append(result.Records, addr.String())
+			}
+		}
+	case "CNAME":
+		var cname string
+		cname, err = resolver.LookupCNAME(ctx, host)
+		if err == nil {
+			result.Records = []string{cname}
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, host)
+		for _, mx := range mxs {
+			result.Records = append(result.Records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = resolver.LookupNS(ctx, host)
+		for _, ns := range nss {
+			result.Records = append(result.Records, ns.Host)
+		}
+	case "TXT":
+		result.Records, err = resolver.LookupTXT(ctx, host)
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = resolver.LookupSRV(ctx, "", "", host)
+		for _, srv := range srvs {
+			result.Records = append(result.Records, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	case "PTR":
+		result.Records, err = resolver.LookupAddr(ctx, host)
+	default:
+		err = fmt.Errorf("Unsupported DNS record type %s", recordType)
+	}
+
+	result.TimeMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if err != nil {
+		result.Error = err.Error()
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			result.NotFound = dnsErr.IsNotFound
+		}
+	}
+
+	return result
+}
+
+/**
+Resolve a hostname with the agent's local resolvers and POST the records back to the API
+*/
+func processDnsTask(task Task) {
+
+	dnsConfig := getDnsTaskConfig(task)
+
+	taskLogger(task).Info("Resolving hostname")
+	resolver := &net.Resolver{}
+	timeout := time.Duration(dnsConfig.Timeout) * time.Second
+
+	var results []DnsLookupResult
+	for _, recordType := range dnsConfig.Types {
+		results = append(results, lookupDns(task.Context(), resolver, dnsConfig.Host, recordType, timeout))
+	}
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: results,
+	})
+}
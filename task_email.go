@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTP_DEFAULT_PORT    = 25
+	SMTP_DEFAULT_TIMEOUT = 30
+)
+
+/**
+Config for an email task - the relay to send through and the message headers. The task payload is the message body.
+e.g. `{"host": "smtp.school.local", "port": 25, "from": "noreply@school.edu", "to": ["office@school.edu"], "subject": "Report"}`
+*/
+type EmailTaskConfig struct {
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	ImplicitTLS bool     `json:"implicit_tls"`
+	SkipVerify  bool     `json:"skip_verify"`
+	Timeout     int      `json:"timeout"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+	Cc          []string `json:"cc"`
+	Bcc         []string `json:"bcc"`
+	Subject     string   `json:"subject"`
+	Html        bool     `json:"html"`
+}
+
+/**
+One step of the SMTP conversation and how the relay responded
+*/
+type SmtpStep struct {
+	Step  string `json:"step"`
+	Ok    bool   `json:"ok"`
+	Code  int    `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+/**
+The outcome of sending an email, with the SMTP transcript status
+*/
+type EmailResult struct {
+	Sent       bool       `json:"sent"`
+	MessageId  string     `json:"message_id"`
+	Recipients int        `json:"recipients"`
+	Transcript []SmtpStep `json:"transcript"`
+}
+
+/**
+Get email specific config for the task
+*/
+func getEmailTaskConfig(task Task) EmailTaskConfig {
+	var emailConfig EmailTaskConfig
+	err := json.Unmarshal(task.RawConfig, &emailConfig)
+	errCheckPostback(task, err)
+	if emailConfig.Port <= 0 {
+		emailConfig.Port = SMTP_DEFAULT_PORT
+	}
+	if emailConfig.Timeout <= 0 {
+		emailConfig.Timeout = SMTP_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("Email configuration", "host", emailConfig.Host, "port", emailConfig.Port, "from", emailConfig.From, "to", emailConfig.To)
+
+	return emailConfig
+}
+
+/**
+Build a MIME message with quoted-printable body
+*/
+func buildEmailMessage(emailConfig EmailTaskConfig, body string, messageId string) ([]byte, error) {
+	var msg bytes.Buffer
+
+	contentType := "text/plain"
+	if emailConfig.Html {
+		contentType = "text/html"
+	}
+
+	headers := []string{
+		"From: " + emailConfig.From,
+		"To: " + strings.Join(emailConfig.To, ", "),
+	}
+	if len(emailConfig.Cc) > 0 {
+		headers = append(headers, "Cc: "+strings.Join(emailConfig.Cc, ", "))
+	}
+	headers = append(headers,
+		"Subject: "+mime.QEncoding.Encode("utf-8", emailConfig.Subject),
+		"Date: "+time.Now().Format(time.RFC1123Z),
+		"Message-ID: "+messageId,
+		"MIME-Version: 1.0",
+		"Content-Type: "+contentType+"; charset=UTF-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	)
+	msg.WriteString(strings.Join(headers, "\r\n"))
+	msg.WriteString("\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+/**
+Send an email through an SMTP relay, recording the outcome of each step of the conversation
+*/
+func sendEmail(emailConfig EmailTaskConfig, body string) (EmailResult, error) {
+	var result EmailResult
+
+	step := func(name string, err error) error {
+		s := SmtpStep{Step: name, Ok: err == nil}
+		if err != nil {
+			s.Error = err.Error()
+			if protoErr, ok := err.(*textproto.Error); ok {
+				s.Code = protoErr.Code
+			}
+		}
+		result.Transcript = append(result.Transcript, s)
+		return err
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+	domain := "localhost"
+	if at := strings.LastIndex(emailConfig.From, "@"); at >= 0 {
+		domain = strings.Trim(emailConfig.From[at+1:], ">")
+	}
+	result.MessageId = fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain)
+
+	message, err := buildEmailMessage(emailConfig, body, result.MessageId)
+	if err != nil {
+		return result, err
+	}
+
+	address := net.JoinHostPort(emailConfig.Host, strconv.Itoa(emailConfig.Port))
+	tlsConfig := &tls.Config{ServerName: emailConfig.Host, InsecureSkipVerify: emailConfig.SkipVerify}
+	timeout := time.Duration(emailConfig.Timeout) * time.Second
+
+	var conn net.Conn
+	if emailConfig.ImplicitTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	}
+	if step("connect", err) != nil {
+		return result, nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, emailConfig.Host)
+	if step("greeting", err) != nil {
+		conn.Close()
+		return result, nil
+	}
+	defer client.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if step("hello", client.Hello(hostname)) != nil {
+		return result, nil
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !emailConfig.ImplicitTLS {
+		if step("starttls", client.StartTLS(tlsConfig)) != nil {
+			return result, nil
+		}
+	}
+
+	if emailConfig.Username != "" {
+		auth := smtp.PlainAuth("", emailConfig.Username, emailConfig.Password, emailConfig.Host)
+		if step("auth", client.Auth(auth)) != nil {
+			return result, nil
+		}
+	}
+
+	if step("mail from", client.Mail(emailConfig.From)) != nil {
+		return result, nil
+	}
+
+	recipients := append(append(append([]string{}, emailConfig.To...), emailConfig.Cc...), emailConfig.Bcc...)
+	for _, recipient := range recipients {
+		if step("rcpt to "+recipient, client.Rcpt(recipient)) == nil {
+			result.Recipients++
+		}
+	}
+	if result.Recipients == 0 {
+		return result, nil
+	}
+
+	writer, err := client.Data()
+	if step("data", err) != nil {
+		return result, nil
+	}
+	if _, err := writer.Write(message); step("message", err) != nil {
+		return result, nil
+	}
+	if step("end of data", writer.Close()) != nil {
+		return result, nil
+	}
+	result.Sent = true
+
+	step("quit", client.Quit())
+
+	return result, nil
+}
+
+/**
+Send an email through the site's SMTP relay and POST the transcript status back to the API
+*/
+func processEmailTask(task Task) {
+
+	emailConfig := getEmailTaskConfig(task)
+	if emailConfig.Host == "" || emailConfig.From == "" || len(emailConfig.To) == 0 {
+		errCheckPostback(task, errors.New("Email tasks need a host, from address and at least one to address."))
+	}
+
+	taskLogger(task).Info("Sending email")
+	result, err := sendEmail(emailConfig, task.Payload)
+	errCheckPostback(task, err)
+
+	responseType := "success"
+	if !result.Sent {
+		responseType = "error"
+	}
+
+	postJsonResponse(task, JsonResponse{
+		Type: responseType,
+		Body: result,
+	})
+}
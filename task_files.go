@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	FILE_LIST_MAX_ENTRIES = 10000
+)
+
+/**
+Config for a directory listing e.g. `{"path": "D:\\Exports", "pattern": "*.csv", "recursive": false, "checksum": true}`
+Files on a network share can be listed by adding the share's credentials in `share`.
+*/
+type FileListTaskConfig struct {
+	Path      string       `json:"path"`
+	Pattern   string       `json:"pattern"`
+	Recursive bool         `json:"recursive"`
+	Checksum  bool         `json:"checksum"`
+	Share     *ShareConfig `json:"share"`
+}
+
+/**
+Metadata for a single file in a directory listing
+*/
+type FileInfo struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"mtime"`
+	IsDir    bool      `json:"is_dir"`
+	Sha256   string    `json:"sha256,omitempty"`
+}
+
+/**
+Resolve a path requested by the server and make sure it sits inside one of the allowed directories in the config
+*/
+func resolveAllowedPath(requested string, allowedDirs []string) (string, error) {
+	if requested == "" {
+		return "", errors.New("No path given.")
+	}
+
+	resolved, err := filepath.Abs(requested)
+	if err != nil {
+		return "", err
+	}
+	// Follow symlinks so a link inside an allowed directory can't point outside it
+	if evaluated, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = evaluated
+	}
+
+	for _, dir := range allowedDirs {
+		allowed, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if evaluated, err := filepath.EvalSymlinks(allowed); err == nil {
+			allowed = evaluated
+		}
+		rel, err := filepath.Rel(allowed, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", fmt.Errorf("Path %s is not in an allowed directory.", requested)
+}
+
+/**
+Calculate the SHA-256 checksum of a file
+*/
+func fileChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+Get directory listing specific config for the task
+*/
+func getFileListTaskConfig(task Task) FileListTaskConfig {
+	var fileConfig FileListTaskConfig
+	err := json.Unmarshal(task.RawConfig, &fileConfig)
+	errCheckPostback(task, err)
+	taskLogger(task).Debug("File listing configuration", "path", fileConfig.Path, "pattern", fileConfig.Pattern, "recursive", fileConfig.Recursive, "checksum", fileConfig.Checksum)
+
+	return fileConfig
+}
+
+/**
+List the files in a directory (optionally recursively) matching a glob pattern
+*/
+func listFiles(root string, fileConfig FileListTaskConfig) ([]FileInfo, error) {
+	var files []FileInfo
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == root {
+			return nil
+		}
+		// Sub-directories are listed but not descended into unless the listing is recursive
+		var skip error
+		if info.IsDir() && !fileConfig.Recursive {
+			skip = filepath.SkipDir
+		}
+		if fileConfig.Pattern != "" {
+			matched, err := filepath.Match(fileConfig.Pattern, info.Name())
+			if err != nil {
+				return err
+			}
+			if !matched {
+				return skip
+			}
+		}
+		if len(files) >= FILE_LIST_MAX_ENTRIES {
+			return fmt.Errorf("Directory listing exceeds %d entries.", FILE_LIST_MAX_ENTRIES)
+		}
+
+		entry := FileInfo{
+			Path:     filePath,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			IsDir:    info.IsDir(),
+		}
+		if fileConfig.Checksum && info.Mode().IsRegular() {
+			entry.Sha256, err = fileChecksum(filePath)
+			if err != nil {
+				return err
+			}
+		}
+		files = append(files, entry)
+
+		return skip
+	})
+
+	return files, err
+}
+
+/**
+List files under an allowed directory and POST their metadata back to the API
+*/
+func processFileListTask(task Task) {
+
+	fileConfig := getFileListTaskConfig(task)
+
+	disconnect, err := connectTaskShare(fileConfig.Share)
+	errCheckPostback(task, err)
+	defer disconnect()
+
+	root, err := resolveAllowedPath(fileConfig.Path, allowedDirs())
+	errCheckPostback(task, err)
+
+	taskLogger(task).Info("Listing files")
+	files, err := listFiles(root, fileConfig)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: files,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+/**
+Size and free space of a mounted disk or drive
+*/
+type DiskInfo struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total_bytes"`
+	Free  uint64 `json:"free_bytes"`
+}
+
+/**
+Details of the connector host for support triage
+*/
+type SystemInventory struct {
+	Hostname         string     `json:"hostname"`
+	OS               string     `json:"os"`
+	OSVersion        string     `json:"os_version"`
+	Arch             string     `json:"arch"`
+	CPUModel         string     `json:"cpu_model"`
+	CPUCount         int        `json:"cpu_count"`
+	MemoryTotal      uint64     `json:"memory_total_bytes"`
+	MemoryAvailable  uint64     `json:"memory_available_bytes"`
+	Disks            []DiskInfo `json:"disks"`
+	DotNetVersions   []string   `json:"dotnet_versions,omitempty"`
+	OdbcDrivers      []string   `json:"odbc_drivers"`
+	ConnectorVersion string     `json:"connector_version"`
+	GoVersion        string     `json:"go_version"`
+	CollectedAt      time.Time  `json:"collected_at"`
+}
+
+/**
+Collect the platform independent details, then fill in the rest for the current OS
+*/
+func collectInventory() SystemInventory {
+	inventory := SystemInventory{
+		OS:               runtime.GOOS,
+		Arch:             runtime.GOARCH,
+		CPUCount:         runtime.NumCPU(),
+		Disks:            []DiskInfo{},
+		OdbcDrivers:      []string{},
+		ConnectorVersion: version,
+		GoVersion:        runtime.Version(),
+		CollectedAt:      time.Now(),
+	}
+	inventory.Hostname, _ = os.Hostname()
+
+	collectPlatformInventory(&inventory)
+
+	return inventory
+}
+
+/**
+Report details of the connector host back to the API
+*/
+func processInventoryTask(task Task) {
+
+	taskLogger(task).Info("Collecting system inventory")
+	inventory := collectInventory()
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: inventory,
+	})
+}
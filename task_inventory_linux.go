@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/**
+Fill in Linux specific inventory from /etc and /proc
+*/
+func collectPlatformInventory(inventory *SystemInventory) {
+	inventory.OSVersion = readOsRelease()
+	inventory.CPUModel = readCpuModel()
+	inventory.MemoryTotal, inventory.MemoryAvailable = readMemInfo()
+	inventory.Disks = readLinuxDisks()
+	inventory.OdbcDrivers = readOdbcInstIni("/etc/odbcinst.ini")
+}
+
+/**
+The distribution name from /etc/os-release e.g. "Ubuntu 22.04.3 LTS"
+*/
+func readOsRelease() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+		}
+	}
+	return ""
+}
+
+/**
+The CPU model name from /proc/cpuinfo
+*/
+func readCpuModel() string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "model name" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+/**
+Total and available memory in bytes from /proc/meminfo
+*/
+func readMemInfo() (uint64, uint64) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+/**
+Size and free space of each mounted block device
+*/
+func readLinuxDisks() []DiskInfo {
+	disks := []DiskInfo{}
+
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return disks
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(fields[1], &stat); err != nil {
+			continue
+		}
+		disks = append(disks, DiskInfo{
+			Path:  fields[1],
+			Total: stat.Blocks * uint64(stat.Bsize),
+			Free:  stat.Bavail * uint64(stat.Bsize),
+		})
+	}
+	return disks
+}
+
+/**
+The driver sections of a unixODBC odbcinst.ini file
+*/
+func readOdbcInstIni(path string) []string {
+	drivers := []string{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return drivers
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") && line != "[ODBC]" {
+			drivers = append(drivers, strings.Trim(line, "[]"))
+		}
+	}
+	return drivers
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+/**
+Fill in what we can on other platforms (OSX) from `uname`
+*/
+func collectPlatformInventory(inventory *SystemInventory) {
+	if out, err := exec.Command("uname", "-sr").Output(); err == nil {
+		inventory.OSVersion = strings.TrimSpace(string(out))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"sort"
+	"unsafe"
+)
+
+/**
+MEMORYSTATUSEX from the Win32 API
+*/
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+/**
+Fill in Windows specific inventory from the registry and Win32 API
+*/
+func collectPlatformInventory(inventory *SystemInventory) {
+	inventory.OSVersion = readWindowsVersion()
+	inventory.CPUModel = readRegistryString(`HARDWARE\DESCRIPTION\System\CentralProcessor\0`, "ProcessorNameString")
+	inventory.MemoryTotal, inventory.MemoryAvailable = readWindowsMemory()
+	inventory.Disks = readWindowsDisks()
+	inventory.DotNetVersions = readDotNetVersions()
+	inventory.OdbcDrivers = readWindowsOdbcDrivers()
+}
+
+/**
+Read a string value from HKLM, returning an empty string if it can't be read
+*/
+func readRegistryString(path string, name string) string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE|registry.WOW64_64KEY)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+
+	value, _, err := key.GetStringValue(name)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+/**
+The Windows edition and build e.g. "Windows Server 2019 Standard 1809 (build 17763)"
+*/
+func readWindowsVersion() string {
+	path := `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	product := readRegistryString(path, "ProductName")
+	release := readRegistryString(path, "DisplayVersion")
+	if release == "" {
+		release = readRegistryString(path, "ReleaseId")
+	}
+	build := readRegistryString(path, "CurrentBuild")
+
+	return fmt.Sprintf("%s %s (build %s)", product, release, build)
+}
+
+/**
+Total and available physical memory in bytes
+*/
+func readWindowsMemory() (uint64, uint64) {
+	var status memoryStatusEx
+	status.Length = uint32(unsafe.Sizeof(status))
+
+	ret, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return 0, 0
+	}
+	return status.TotalPhys, status.AvailPhys
+}
+
+/**
+Size and free space of each fixed drive
+*/
+func readWindowsDisks() []DiskInfo {
+	disks := []DiskInfo{}
+
+	mask, err := windows.GetLogicalDrives()
+	if err != nil {
+		return disks
+	}
+
+	for i := uint(0); i < 26; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		root := string(rune('A'+i)) + `:\`
+		rootPtr, err := windows.UTF16PtrFromString(root)
+		if err != nil || windows.GetDriveType(rootPtr) != windows.DRIVE_FIXED {
+			continue
+		}
+
+		var freeToCaller, total, free uint64
+		if err := windows.GetDiskFreeSpaceEx(rootPtr, &freeToCaller, &total, &free); err != nil {
+			continue
+		}
+		disks = append(disks, DiskInfo{Path: root, Total: total, Free: free})
+	}
+	return disks
+}
+
+/**
+Installed .NET Framework versions from the NDP setup keys
+*/
+func readDotNetVersions() []string {
+	var versions []string
+
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\NET Framework Setup\NDP`, registry.ENUMERATE_SUB_KEYS|registry.WOW64_64KEY)
+	if err != nil {
+		return versions
+	}
+	defer key.Close()
+
+	names, err := key.ReadSubKeyNames(-1)
+	if err != nil {
+		return versions
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// v4 keeps its version under the Full/Client profile subkeys
+		for _, path := range []string{name, name + `\Full`} {
+			if v := readRegistryString(`SOFTWARE\Microsoft\NET Framework Setup\NDP\`+path, "Version"); v != "" {
+				versions = append(versions, v)
+				break
+			}
+		}
+	}
+	return versions
+}
+
+/**
+Installed ODBC drivers (both 64 and 32 bit)
+*/
+func readWindowsOdbcDrivers() []string {
+	drivers := []string{}
+	seen := make(map[string]bool)
+
+	for _, view := range []uint32{registry.WOW64_64KEY, registry.WOW64_32KEY} {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\ODBC\ODBCINST.INI\ODBC Drivers`, registry.QUERY_VALUE|view)
+		if err != nil {
+			continue
+		}
+		names, err := key.ReadValueNames(-1)
+		key.Close()
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				drivers = append(drivers, name)
+			}
+		}
+	}
+	sort.Strings(drivers)
+	return drivers
+}
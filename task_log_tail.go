@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	LOG_TAIL_DEFAULT_LINES = 100
+	LOG_TAIL_MAX_BYTES     = 1024 * 1024
+	LOG_TAIL_CHUNK_SIZE    = 4096
+)
+
+/**
+Config for a log collection task - either the last `lines` lines, or `length` bytes from `offset`
+e.g. `{"path": "C:\\MIS\\export.log", "lines": 200}` or `{"path": "...", "offset": 1024, "length": 4096}`
+*/
+type LogTailTaskConfig struct {
+	Path   string       `json:"path"`
+	Lines  int          `json:"lines"`
+	Offset *int64       `json:"offset"`
+	Length int64        `json:"length"`
+	Share  *ShareConfig `json:"share"`
+}
+
+/**
+The collected portion of a log file
+*/
+type LogTailResult struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Content   string `json:"content"`
+	Truncated bool   `json:"truncated"`
+}
+
+/**
+Get log collection specific config for the task
+*/
+func getLogTailTaskConfig(task Task) LogTailTaskConfig {
+	var logConfig LogTailTaskConfig
+	err := json.Unmarshal(task.RawConfig, &logConfig)
+	errCheckPostback(task, err)
+	if logConfig.Lines <= 0 {
+		logConfig.Lines = LOG_TAIL_DEFAULT_LINES
+	}
+	taskLogger(task).Debug("Log collection configuration", "path", logConfig.Path, "lines", logConfig.Lines)
+
+	return logConfig
+}
+
+/**
+Read `length` bytes of a file starting at `offset`, capped at LOG_TAIL_MAX_BYTES
+*/
+func readLogRange(file *os.File, size int64, offset int64, length int64) (LogTailResult, error) {
+	result := LogTailResult{Size: size, Offset: offset}
+
+	if offset < 0 || offset > size {
+		return result, fmt.Errorf("Offset %d is outside the file (size %d).", offset, size)
+	}
+	if length <= 0 || length > LOG_TAIL_MAX_BYTES {
+		length = LOG_TAIL_MAX_BYTES
+	}
+	if offset+length < size {
+		result.Truncated = true
+	}
+
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return result, err
+	}
+	result.Content = string(buf[:n])
+
+	return result, nil
+}
+
+/**
+Read the last `lines` lines of a file by scanning backwards from the end in chunks
+*/
+func readLogTail(file *os.File, size int64, lines int) (LogTailResult, error) {
+	result := LogTailResult{Size: size}
+
+	var tail []byte
+	offset := size
+	newlines := 0
+
+	for offset > 0 && newlines <= lines && int64(len(tail)) < LOG_TAIL_MAX_BYTES {
+		chunkSize := int64(LOG_TAIL_CHUNK_SIZE)
+		if offset < chunkSize {
+			chunkSize = offset
+		}
+		offset -= chunkSize
+
+		chunk := make([]byte, chunkSize)
+		if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return result, err
+		}
+		tail = append(chunk, tail...)
+		newlines = bytes.Count(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	}
+
+	// Drop everything before the first line we want
+	trimmed := bytes.TrimRight(tail, "\n")
+	for newlines >= lines {
+		i := bytes.IndexByte(trimmed, '\n')
+		offset += int64(i + 1)
+		trimmed = trimmed[i+1:]
+		tail = tail[i+1:]
+		newlines--
+	}
+	if int64(len(tail)) > LOG_TAIL_MAX_BYTES {
+		offset += int64(len(tail)) - LOG_TAIL_MAX_BYTES
+		tail = tail[int64(len(tail))-LOG_TAIL_MAX_BYTES:]
+	}
+
+	result.Offset = offset
+	result.Truncated = offset > 0
+	result.Content = string(tail)
+
+	return result, nil
+}
+
+/**
+Collect part of an allowed log file and POST it back to the API
+*/
+func processLogTailTask(task Task) {
+
+	logConfig := getLogTailTaskConfig(task)
+
+	disconnect, err := connectTaskShare(logConfig.Share)
+	errCheckPostback(task, err)
+	defer disconnect()
+
+	logPath, err := resolveAllowedPath(logConfig.Path, allowedDirs())
+	errCheckPostback(task, err)
+
+	file, err := os.Open(logPath)
+	errCheckPostback(task, err)
+	defer file.Close()
+
+	info, err := file.Stat()
+	errCheckPostback(task, err)
+	if info.IsDir() {
+		errCheckPostback(task, errors.New("Path is a directory, not a log file."))
+	}
+
+	taskLogger(task).Info("Collecting log file")
+	var result LogTailResult
+	if logConfig.Offset != nil {
+		result, err = readLogRange(file, info.Size(), *logConfig.Offset, logConfig.Length)
+	} else {
+		result, err = readLogTail(file, info.Size(), logConfig.Lines)
+	}
+	errCheckPostback(task, err)
+	result.Path = logPath
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	PING_DEFAULT_COUNT   = 4
+	PING_DEFAULT_TIMEOUT = 2
+	PING_MAX_COUNT       = 100
+	ICMP_PROTOCOL_IPV4   = 1
+)
+
+/**
+Config for a ping task e.g. `{"host": "10.0.0.5", "count": 4, "timeout": 2}`
+*/
+type PingTaskConfig struct {
+	Host    string `json:"host"`
+	Count   int    `json:"count"`
+	Timeout int    `json:"timeout"`
+}
+
+/**
+Round trip times and packet loss for a ping task
+*/
+type PingResult struct {
+	Host       string    `json:"host"`
+	Address    string    `json:"address"`
+	Mode       string    `json:"mode"`
+	Sent       int       `json:"sent"`
+	Received   int       `json:"received"`
+	PacketLoss float64   `json:"packet_loss"`
+	RttsMs     []float64 `json:"rtts_ms"`
+	MinRttMs   float64   `json:"min_rtt_ms"`
+	AvgRttMs   float64   `json:"avg_rtt_ms"`
+	MaxRttMs   float64   `json:"max_rtt_ms"`
+}
+
+/**
+Get ping specific config for the task
+*/
+func getPingTaskConfig(task Task) PingTaskConfig {
+	var pingConfig PingTaskConfig
+	err := json.Unmarshal(task.RawConfig, &pingConfig)
+	errCheckPostback(task, err)
+	if pingConfig.Count <= 0 {
+		pingConfig.Count = PING_DEFAULT_COUNT
+	}
+	if pingConfig.Count > PING_MAX_COUNT {
+		pingConfig.Count = PING_MAX_COUNT
+	}
+	if pingConfig.Timeout <= 0 {
+		pingConfig.Timeout = PING_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("Ping configuration", "config", pingConfig)
+
+	return pingConfig
+}
+
+/**
+Open an ICMP socket - raw sockets need admin/root, so fall back to unprivileged UDP ICMP sockets (Linux/OSX)
+*/
+func listenIcmp() (*icmp.PacketConn, bool, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err == nil {
+		return conn, true, nil
+	}
+
+	udpConn, udpErr := icmp.ListenPacket("udp4", "0.0.0.0")
+	if udpErr != nil {
+		return nil, false, fmt.Errorf("Cannot open ICMP socket: %v (UDP fallback: %v)", err, udpErr)
+	}
+
+	return udpConn, false, nil
+}
+
+/**
+Send `count` ICMP echo requests to a host and record the round trip time of each reply, stopping when `ctx` is done
+*/
+func ping(ctx context.Context, host string, count int, timeout time.Duration) (PingResult, error) {
+	result := PingResult{Host: host}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return result, err
+	}
+	ipAddr := &net.IPAddr{IP: ips[0]}
+	result.Address = ipAddr.String()
+
+	conn, privileged, err := listenIcmp()
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	// Closing the socket ends a wait for a reply straight away
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var dst net.Addr = ipAddr
+	result.Mode = "privileged"
+	if !privileged {
+		dst = &net.UDPAddr{IP: ipAddr.IP}
+		result.Mode = "udp"
+	}
+
+	id := os.Getpid() & 0xffff
+	buf := make([]byte, 1500)
+
+	for seq := 0; seq < count; seq++ {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("goproxy")},
+		}
+		payload, err := msg.Marshal(nil)
+		if err != nil {
+			return result, err
+		}
+
+		start := time.Now()
+		if _, err := conn.WriteTo(payload, dst); err != nil {
+			return result, err
+		}
+		result.Sent++
+		conn.SetReadDeadline(start.Add(timeout))
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return result, ctx.Err()
+				}
+				// Timed out waiting for this reply - count it as lost
+				break
+			}
+			reply, err := icmp.ParseMessage(ICMP_PROTOCOL_IPV4, buf[:n])
+			if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			// The kernel rewrites the ID of unprivileged echo requests, so only match it on raw sockets
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (privileged && echo.ID != id) {
+				continue
+			}
+			result.Received++
+			result.RttsMs = append(result.RttsMs, float64(time.Since(start))/float64(time.Millisecond))
+			break
+		}
+	}
+
+	if result.Sent == 0 {
+		return result, errors.New("No ICMP echo requests were sent.")
+	}
+	result.PacketLoss = float64(result.Sent-result.Received) / float64(result.Sent) * 100
+
+	var total float64
+	for i, rtt := range result.RttsMs {
+		if i == 0 || rtt < result.MinRttMs {
+			result.MinRttMs = rtt
+		}
+		if rtt > result.MaxRttMs {
+			result.MaxRttMs = rtt
+		}
+		total += rtt
+	}
+	if result.Received > 0 {
+		result.AvgRttMs = total / float64(result.Received)
+	}
+
+	return result, nil
+}
+
+/**
+Ping a host and POST the round trip times and packet loss back to the API
+*/
+func processPingTask(task Task) {
+
+	pingConfig := getPingTaskConfig(task)
+
+	taskLogger(task).Info("Pinging host")
+	result, err := ping(task.Context(), pingConfig.Host, pingConfig.Count, time.Duration(pingConfig.Timeout)*time.Second)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
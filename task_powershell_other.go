@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+/**
+PowerShell scripts are only run on Windows - report that back to the API
+*/
+func processPowerShellTask(task Task) {
+	errCheckPostback(task, errors.New("PowerShell tasks are only supported on Windows."))
+}
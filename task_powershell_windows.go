@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	POWERSHELL_DEFAULT_DEPTH = 4
+)
+
+/**
+Config for a PowerShell task - how deep to serialise the output objects e.g. `{"depth": 4}`
+*/
+type PowerShellTaskConfig struct {
+	Depth int `json:"depth"`
+}
+
+/**
+The JSON output of a PowerShell script, along with anything written to stderr
+*/
+type PowerShellResult struct {
+	ExitCode int             `json:"exit_code"`
+	Output   json.RawMessage `json:"output"`
+	Errors   string          `json:"errors,omitempty"`
+}
+
+/**
+Get PowerShell specific config for the task
+*/
+func getPowerShellTaskConfig(task Task) PowerShellTaskConfig {
+	var psConfig PowerShellTaskConfig
+	if len(task.RawConfig) > 0 {
+		err := json.Unmarshal(task.RawConfig, &psConfig)
+		errCheckPostback(task, err)
+	}
+	if psConfig.Depth <= 0 {
+		psConfig.Depth = POWERSHELL_DEFAULT_DEPTH
+	}
+	taskLogger(task).Debug("PowerShell configuration", "config", psConfig)
+
+	return psConfig
+}
+
+/**
+Run a signed script under the AllSigned execution policy in constrained language mode, converting its output to JSON.
+The script is written to a temporary .ps1 file because signatures can only be checked on script files.
+*/
+func runPowerShell(ctx context.Context, script string, depth int) (PowerShellResult, error) {
+	var result PowerShellResult
+
+	tmpFile, err := ioutil.TempFile("", "goproxy-*.ps1")
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(script)
+	tmpFile.Close()
+	if err != nil {
+		return result, err
+	}
+
+	scriptPath := strings.Replace(tmpFile.Name(), "'", "''", -1)
+	command := fmt.Sprintf(
+		"$ErrorActionPreference = 'Stop'; "+
+			"$signature = Get-AuthenticodeSignature -LiteralPath '%s'; "+
+			"if ($signature.Status -ne 'Valid') { throw \"Script signature is $($signature.Status)\" }; "+
+			"$ExecutionContext.SessionState.LanguageMode = 'ConstrainedLanguage'; "+
+			"@(& '%s') | ConvertTo-Json -Depth %d -Compress",
+		scriptPath, scriptPath, depth,
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "AllSigned", "-Command", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	result.Errors = strings.TrimSpace(stderr.String())
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return result, err
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if len(output) == 0 {
+		output = []byte("null")
+	}
+	if !json.Valid(output) {
+		return result, fmt.Errorf("PowerShell output is not valid JSON: %s", output)
+	}
+	result.Output = output
+
+	return result, nil
+}
+
+/**
+Run a signed PowerShell script and POST its output back to the API
+*/
+func processPowerShellTask(task Task) {
+
+	psConfig := getPowerShellTaskConfig(task)
+	if !isScriptAllowed(task.Payload) {
+		errCheckPostback(task, errors.New("Script is not in the shell allowlist."))
+	}
+
+	taskLogger(task).Info("Running PowerShell script")
+	result, err := runPowerShell(task.Context(), task.Payload, psConfig.Depth)
+	errCheckPostback(task, err)
+
+	responseType := "success"
+	if result.ExitCode != 0 {
+		responseType = "error"
+	}
+
+	postJsonResponse(task, JsonResponse{
+		Type: responseType,
+		Body: result,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	PRINT_DEFAULT_WAIT = 30
+	PRINT_MAX_COPIES   = 100
+	PRINT_MAX_WAIT     = 600
+)
+
+/**
+Config for a print task - the PDF to download and the local printer to send it to
+e.g. `{"printer": "Office-Laser", "source": "/files/123", "title": "Daily Attendance", "copies": 1, "wait": 30}`
+*/
+type PrintTaskConfig struct {
+	Printer    string `json:"printer"`
+	Source     string `json:"source"`
+	Compressed bool   `json:"compressed"`
+	Title      string `json:"title"`
+	Copies     int    `json:"copies"`
+	Wait       int    `json:"wait"`
+}
+
+/**
+The print job created for a task and its last known status
+*/
+type PrintJobResult struct {
+	Printer string `json:"printer"`
+	JobId   string `json:"job_id"`
+	Status  string `json:"status"`
+}
+
+/**
+Get print specific config for the task
+*/
+func getPrintTaskConfig(task Task) PrintTaskConfig {
+	var printConfig PrintTaskConfig
+	err := json.Unmarshal(task.RawConfig, &printConfig)
+	errCheckPostback(task, err)
+	if printConfig.Copies <= 0 {
+		printConfig.Copies = 1
+	}
+	if printConfig.Wait < 0 {
+		printConfig.Wait = 0
+	} else if printConfig.Wait == 0 {
+		printConfig.Wait = PRINT_DEFAULT_WAIT
+	} else if printConfig.Wait > PRINT_MAX_WAIT {
+		printConfig.Wait = PRINT_MAX_WAIT
+	}
+	if printConfig.Title == "" {
+		printConfig.Title = "Task " + task.Id
+	}
+	taskLogger(task).Debug("Print configuration", "config", printConfig)
+
+	return printConfig
+}
+
+/**
+Download a PDF, send it to a local printer and POST the job status back to the API
+*/
+func processPrintTask(task Task) {
+
+	printConfig := getPrintTaskConfig(task)
+	if printConfig.Printer == "" || printConfig.Source == "" {
+		errCheckPostback(task, errors.New("Print tasks need a printer and a source document."))
+	}
+	if printConfig.Copies > PRINT_MAX_COPIES {
+		errCheckPostback(task, fmt.Errorf("Print tasks can ask for at most %d copies.", PRINT_MAX_COPIES))
+	}
+
+	taskLogger(task).Info("Downloading document")
+	filePath, err := downloadFile(printConfig.Source, printConfig.Compressed)
+	errCheckPostback(task, err)
+	defer os.Remove(filePath)
+
+	taskLogger(task).Info("Printing document")
+	result, err := submitPrintJob(task.Context(), printConfig, filePath)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
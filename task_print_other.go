@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cupsRequestId = regexp.MustCompile(`request id is (\S+)`)
+
+/**
+Submit a document to a CUPS printer with `lp`, then watch `lpstat` until the job completes, the wait runs out or `ctx`
+is done
+*/
+func submitPrintJob(ctx context.Context, printConfig PrintTaskConfig, filePath string) (PrintJobResult, error) {
+	result := PrintJobResult{Printer: printConfig.Printer}
+
+	out, err := exec.CommandContext(ctx, "lp",
+		"-d", printConfig.Printer,
+		"-t", printConfig.Title,
+		"-n", strconv.Itoa(printConfig.Copies),
+		filePath,
+	).CombinedOutput()
+	if err != nil {
+		return result, fmt.Errorf("lp failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	match := cupsRequestId.FindStringSubmatch(string(out))
+	if match == nil {
+		return result, fmt.Errorf("Could not find the job id in lp output: %s", strings.TrimSpace(string(out)))
+	}
+	result.JobId = match[1]
+	result.Status = "queued"
+
+	if printConfig.Wait == 0 {
+		return result, nil
+	}
+	deadline := time.After(time.Duration(printConfig.Wait) * time.Second)
+	for {
+		completed, err := exec.CommandContext(ctx, "lpstat", "-W", "completed", "-o", printConfig.Printer).Output()
+		if err == nil && strings.Contains(string(completed), result.JobId+" ") {
+			result.Status = "completed"
+			return result, nil
+		}
+		pending, err := exec.CommandContext(ctx, "lpstat", "-W", "not-completed", "-o", printConfig.Printer).Output()
+		if err == nil && strings.Contains(string(pending), result.JobId+" ") {
+			result.Status = "pending"
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-deadline:
+			return result, nil
+		case <-time.After(time.Second):
+		}
+	}
+}
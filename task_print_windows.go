@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/windows"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	JOB_STATUS_ERROR             = 0x2
+	JOB_STATUS_OFFLINE           = 0x20
+	JOB_STATUS_PAPEROUT          = 0x40
+	JOB_STATUS_PRINTED           = 0x80
+	JOB_STATUS_DELETED           = 0x100
+	JOB_STATUS_BLOCKED_DEVQ      = 0x200
+	JOB_STATUS_USER_INTERVENTION = 0x400
+	JOB_STATUS_COMPLETE          = 0x1000
+)
+
+/**
+DOC_INFO_1W from the Win32 spooler API
+*/
+type docInfo1 struct {
+	DocName    *uint16
+	OutputFile *uint16
+	Datatype   *uint16
+}
+
+/**
+JOB_INFO_1W from the Win32 spooler API - the strings it points at follow it in the same buffer
+*/
+type jobInfo1 struct {
+	JobId        uint32
+	PrinterName  *uint16
+	MachineName  *uint16
+	UserName     *uint16
+	Document     *uint16
+	Datatype     *uint16
+	StatusText   *uint16
+	Status       uint32
+	Priority     uint32
+	Position     uint32
+	TotalPages   uint32
+	PagesPrinted uint32
+	Submitted    windows.Systemtime
+}
+
+var (
+	winspool             = windows.NewLazySystemDLL("winspool.drv")
+	procOpenPrinterW     = winspool.NewProc("OpenPrinterW")
+	procClosePrinter     = winspool.NewProc("ClosePrinter")
+	procStartDocPrinterW = winspool.NewProc("StartDocPrinterW")
+	procEndDocPrinter    = winspool.NewProc("EndDocPrinter")
+	procStartPagePrinter = winspool.NewProc("StartPagePrinter")
+	procEndPagePrinter   = winspool.NewProc("EndPagePrinter")
+	procWritePrinter     = winspool.NewProc("WritePrinter")
+	procGetJobW          = winspool.NewProc("GetJobW")
+)
+
+/**
+Send a document straight to the Windows spooler as a RAW job, then watch the spooler until every copy has printed or
+the wait runs out or `ctx` is done. The printer must accept PDF directly, which most office printers do.
+*/
+func submitPrintJob(ctx context.Context, printConfig PrintTaskConfig, filePath string) (PrintJobResult, error) {
+	result := PrintJobResult{Printer: printConfig.Printer}
+
+	document, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return result, err
+	}
+	if len(document) == 0 {
+		return result, errors.New("The document to print is empty.")
+	}
+
+	printerName, err := windows.UTF16PtrFromString(printConfig.Printer)
+	if err != nil {
+		return result, err
+	}
+	var printer windows.Handle
+	ret, _, err := procOpenPrinterW.Call(uintptr(unsafe.Pointer(printerName)), uintptr(unsafe.Pointer(&printer)), 0)
+	if ret == 0 {
+		return result, err
+	}
+	defer procClosePrinter.Call(uintptr(printer))
+
+	docName, _ := windows.UTF16PtrFromString(printConfig.Title)
+	datatype, _ := windows.UTF16PtrFromString("RAW")
+
+	var jobIds []uint32
+	for copy := 0; copy < printConfig.Copies; copy++ {
+		info := docInfo1{DocName: docName, Datatype: datatype}
+		jobId, _, err := procStartDocPrinterW.Call(uintptr(printer), 1, uintptr(unsafe.Pointer(&info)))
+		if jobId == 0 {
+			return result, err
+		}
+		if result.JobId == "" {
+			result.JobId = strconv.Itoa(int(jobId))
+		}
+		jobIds = append(jobIds, uint32(jobId))
+
+		if ret, _, err := procStartPagePrinter.Call(uintptr(printer)); ret == 0 {
+			procEndDocPrinter.Call(uintptr(printer))
+			return result, err
+		}
+
+		var written uint32
+		ret, _, err = procWritePrinter.Call(
+			uintptr(printer),
+			uintptr(unsafe.Pointer(&document[0])),
+			uintptr(len(document)),
+			uintptr(unsafe.Pointer(&written)),
+		)
+		procEndPagePrinter.Call(uintptr(printer))
+		procEndDocPrinter.Call(uintptr(printer))
+		if ret == 0 {
+			return result, err
+		}
+		if int(written) != len(document) {
+			return result, syscall.EIO
+		}
+	}
+	result.Status = "queued"
+
+	if printConfig.Wait == 0 {
+		return result, nil
+	}
+	deadline := time.After(time.Duration(printConfig.Wait) * time.Second)
+	for {
+		result.Status = spoolerJobsStatus(printer, jobIds)
+		if result.Status == "completed" {
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-deadline:
+			return result, nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/**
+Summarise the spooler status of a task's jobs - "completed" once every copy has printed or left the queue, "error"
+while any needs attention at the printer and "pending" otherwise
+*/
+func spoolerJobsStatus(printer windows.Handle, jobIds []uint32) string {
+	status := "completed"
+	for _, jobId := range jobIds {
+		info, ok := getSpoolerJob(printer, jobId)
+		if !ok || info.Status&(JOB_STATUS_PRINTED|JOB_STATUS_COMPLETE|JOB_STATUS_DELETED) != 0 {
+			// Jobs leave the queue once printed unless the printer keeps them
+			continue
+		}
+		if info.Status&(JOB_STATUS_ERROR|JOB_STATUS_OFFLINE|JOB_STATUS_PAPEROUT|JOB_STATUS_BLOCKED_DEVQ|JOB_STATUS_USER_INTERVENTION) != 0 {
+			return "error"
+		}
+		status = "pending"
+	}
+
+	return status
+}
+
+/**
+Read a job's JOB_INFO_1W from the spooler, or false once the job is no longer queued
+*/
+func getSpoolerJob(printer windows.Handle, jobId uint32) (jobInfo1, bool) {
+	var needed uint32
+	procGetJobW.Call(uintptr(printer), uintptr(jobId), 1, 0, 0, uintptr(unsafe.Pointer(&needed)))
+	if needed < uint32(unsafe.Sizeof(jobInfo1{})) {
+		return jobInfo1{}, false
+	}
+
+	// Back the buffer with uint64s so the struct at its start is aligned
+	buf := make([]uint64, (needed+7)/8)
+	ret, _, _ := procGetJobW.Call(
+		uintptr(printer),
+		uintptr(jobId),
+		1,
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(needed),
+		uintptr(unsafe.Pointer(&needed)),
+	)
+	if ret == 0 {
+		return jobInfo1{}, false
+	}
+
+	return *(*jobInfo1)(unsafe.Pointer(&buf[0])), true
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+/**
+The registry only exists on Windows - report that back to the API
+*/
+func processRegistryTask(task Task) {
+	errCheckPostback(task, errors.New("Registry tasks are only supported on Windows."))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/windows/registry"
+	"strings"
+)
+
+/**
+Hives the server may read from. HKCU is left out as the service runs as SYSTEM.
+*/
+var registryHives = map[string]registry.Key{
+	"HKLM":               registry.LOCAL_MACHINE,
+	"HKEY_LOCAL_MACHINE": registry.LOCAL_MACHINE,
+	"HKCR":               registry.CLASSES_ROOT,
+	"HKEY_CLASSES_ROOT":  registry.CLASSES_ROOT,
+	"HKU":                registry.USERS,
+	"HKEY_USERS":         registry.USERS,
+}
+
+/**
+Sensitive parts of the allowed hives that can never be read
+*/
+var registryDeniedPaths = []string{
+	`HKLM\SAM`,
+	`HKLM\SECURITY`,
+}
+
+/**
+A registry key to read e.g. `{"path": "HKLM\\SOFTWARE\\ODBC\\ODBCINST.INI\\ODBC Drivers", "values": [], "subkeys": true}`
+An empty `values` list reads every value in the key.
+*/
+type RegistryKeyRequest struct {
+	Path    string   `json:"path"`
+	Values  []string `json:"values"`
+	Subkeys bool     `json:"subkeys"`
+}
+
+/**
+Config for a registry read - `view` is "64" (default) or "32" to read the WOW6432Node view
+*/
+type RegistryTaskConfig struct {
+	Keys []RegistryKeyRequest `json:"keys"`
+	View string               `json:"view"`
+}
+
+/**
+The values (and optionally subkey names) read from a registry key
+*/
+type RegistryKeyResult struct {
+	Path    string                 `json:"path"`
+	Exists  bool                   `json:"exists"`
+	Values  map[string]interface{} `json:"values,omitempty"`
+	Subkeys []string               `json:"subkeys,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+/**
+Get registry specific config for the task
+*/
+func getRegistryTaskConfig(task Task) RegistryTaskConfig {
+	var regConfig RegistryTaskConfig
+	err := json.Unmarshal(task.RawConfig, &regConfig)
+	errCheckPostback(task, err)
+	taskLogger(task).Debug("Registry configuration", "config", regConfig)
+
+	return regConfig
+}
+
+/**
+Split a path like `HKLM\SOFTWARE\ODBC` into its (allowed) hive and the path within it
+*/
+func parseRegistryPath(path string) (registry.Key, string, error) {
+	parts := strings.SplitN(path, `\`, 2)
+	hive, ok := registryHives[strings.ToUpper(parts[0])]
+	if !ok {
+		return 0, "", fmt.Errorf("Registry hive %s is not allowed.", parts[0])
+	}
+	subPath := ""
+	if len(parts) > 1 {
+		subPath = strings.Trim(parts[1], `\`)
+	}
+
+	normalised := strings.ToUpper(path)
+	if hive == registry.LOCAL_MACHINE {
+		normalised = `HKLM\` + strings.ToUpper(subPath)
+	}
+	for _, denied := range registryDeniedPaths {
+		if normalised == denied || strings.HasPrefix(normalised, denied+`\`) {
+			return 0, "", fmt.Errorf("Registry key %s is not allowed.", path)
+		}
+	}
+
+	return hive, subPath, nil
+}
+
+/**
+Read a single registry value, converting it to something that can be JSON encoded
+*/
+func readRegistryValue(key registry.Key, name string) (interface{}, error) {
+	_, valueType, err := key.GetValue(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueType {
+	case registry.SZ, registry.EXPAND_SZ:
+		value, _, err := key.GetStringValue(name)
+		return value, err
+	case registry.DWORD, registry.QWORD:
+		value, _, err := key.GetIntegerValue(name)
+		return value, err
+	case registry.MULTI_SZ:
+		value, _, err := key.GetStringsValue(name)
+		return value, err
+	default:
+		value, _, err := key.GetBinaryValue(name)
+		return hex.EncodeToString(value), err
+	}
+}
+
+/**
+Read the requested values and subkeys of a registry key
+*/
+func readRegistryKey(request RegistryKeyRequest, access uint32) RegistryKeyResult {
+	result := RegistryKeyResult{Path: request.Path}
+
+	hive, subPath, err := parseRegistryPath(request.Path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	key, err := registry.OpenKey(hive, subPath, access)
+	if err == registry.ErrNotExist {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer key.Close()
+	result.Exists = true
+
+	names := request.Values
+	if len(names) == 0 {
+		names, err = key.ReadValueNames(-1)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	result.Values = make(map[string]interface{}, len(names))
+	for _, name := range names {
+		value, err := readRegistryValue(key, name)
+		if err == registry.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Values[name] = value
+	}
+
+	if request.Subkeys {
+		result.Subkeys, err = key.ReadSubKeyNames(-1)
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+
+	return result
+}
+
+/**
+Read registry keys from the allowed hives and POST their values back to the API
+*/
+func processRegistryTask(task Task) {
+
+	regConfig := getRegistryTaskConfig(task)
+
+	access := uint32(registry.QUERY_VALUE | registry.ENUMERATE_SUB_KEYS | registry.WOW64_64KEY)
+	if regConfig.View == "32" {
+		access = registry.QUERY_VALUE | registry.ENUMERATE_SUB_KEYS | registry.WOW64_32KEY
+	}
+
+	taskLogger(task).Info("Reading registry")
+	var results []RegistryKeyResult
+	for _, request := range regConfig.Keys {
+		results = append(results, readRegistryKey(request, access))
+	}
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: results,
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+/**
+Service management is only implemented for the Windows service control manager - report that back to the API
+*/
+func processServiceTask(task Task) {
+	errCheckPostback(task, errors.New("Service management tasks are only supported on Windows."))
+}
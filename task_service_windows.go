@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"strings"
+	"time"
+)
+
+const (
+	SERVICE_DEFAULT_TIMEOUT = 30
+)
+
+var serviceStateNames = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "start_pending",
+	svc.StopPending:     "stop_pending",
+	svc.Running:         "running",
+	svc.ContinuePending: "continue_pending",
+	svc.PausePending:    "pause_pending",
+	svc.Paused:          "paused",
+}
+
+/**
+Config for a service management task e.g. `{"service": "MISExportService", "action": "restart", "timeout": 30}`
+The action is one of query, start, stop or restart.
+*/
+type ServiceTaskConfig struct {
+	Service string `json:"service"`
+	Action  string `json:"action"`
+	Timeout int    `json:"timeout"`
+}
+
+/**
+The state of a service after the action was performed
+*/
+type ServiceTaskResult struct {
+	Service string `json:"service"`
+	Action  string `json:"action"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+/**
+Get service management specific config for the task
+*/
+func getServiceTaskConfig(task Task) ServiceTaskConfig {
+	var serviceConfig ServiceTaskConfig
+	err := json.Unmarshal(task.RawConfig, &serviceConfig)
+	errCheckPostback(task, err)
+	serviceConfig.Action = strings.ToLower(serviceConfig.Action)
+	if serviceConfig.Action == "" {
+		serviceConfig.Action = "query"
+	}
+	if serviceConfig.Timeout <= 0 {
+		serviceConfig.Timeout = SERVICE_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("Service configuration", "config", serviceConfig)
+
+	return serviceConfig
+}
+
+/**
+Is the service in the allowlist from the config?
+*/
+func isServiceAllowed(name string) bool {
+	for _, allowed := range currentConfig().AllowedServices {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Poll a service until it reaches the wanted state or the timeout passes
+*/
+func waitForServiceState(s *mgr.Service, want svc.State, timeout time.Duration) (svc.State, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return svc.Stopped, err
+		}
+		if status.State == want {
+			return status.State, nil
+		}
+		if time.Now().After(deadline) {
+			return status.State, fmt.Errorf("Timed out waiting for service to become %s", serviceStateNames[want])
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+/**
+Perform an action on a service through the service control manager, returning its resulting state
+*/
+func controlService(name string, action string, timeout time.Duration) (svc.State, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return svc.Stopped, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return svc.Stopped, err
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return svc.Stopped, err
+	}
+
+	stop := func() (svc.State, error) {
+		if status.State == svc.Stopped {
+			return status.State, nil
+		}
+		if _, err := s.Control(svc.Stop); err != nil {
+			return status.State, err
+		}
+		return waitForServiceState(s, svc.Stopped, timeout)
+	}
+	start := func() (svc.State, error) {
+		if status.State == svc.Running {
+			return status.State, nil
+		}
+		if err := s.Start(); err != nil {
+			return status.State, err
+		}
+		return waitForServiceState(s, svc.Running, timeout)
+	}
+
+	switch action {
+	case "query":
+		return status.State, nil
+	case "start":
+		return start()
+	case "stop":
+		return stop()
+	case "restart":
+		state, err := stop()
+		if err != nil {
+			return state, err
+		}
+		status.State = state
+		return start()
+	}
+
+	return status.State, fmt.Errorf("Unknown service action %s", action)
+}
+
+/**
+Query or control an allowed Windows service and POST its resulting state back to the API
+*/
+func processServiceTask(task Task) {
+
+	serviceConfig := getServiceTaskConfig(task)
+	if !isServiceAllowed(serviceConfig.Service) {
+		errCheckPostback(task, fmt.Errorf("Service %s is not in the allowed services list.", serviceConfig.Service))
+	}
+
+	taskLogger(task).Info("Controlling service")
+	state, err := controlService(serviceConfig.Service, serviceConfig.Action, time.Duration(serviceConfig.Timeout)*time.Second)
+
+	result := ServiceTaskResult{
+		Service: serviceConfig.Service,
+		Action:  serviceConfig.Action,
+		State:   serviceStateNames[state],
+	}
+	responseType := "success"
+	if err != nil {
+		result.Error = err.Error()
+		responseType = "error"
+	}
+
+	postJsonResponse(task, JsonResponse{
+		Type: responseType,
+		Body: result,
+	})
+}
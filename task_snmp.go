@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gosnmp/gosnmp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	SNMP_DEFAULT_PORT     = 161
+	SNMP_DEFAULT_TIMEOUT  = 5
+	SNMP_DEFAULT_RETRIES  = 1
+	SNMP_MAX_WALK_RESULTS = 10000
+)
+
+/**
+SNMPv3 user security settings
+*/
+type SnmpV3Config struct {
+	Username       string `json:"username"`
+	AuthProtocol   string `json:"auth_protocol"`
+	AuthPassphrase string `json:"auth_passphrase"`
+	PrivProtocol   string `json:"priv_protocol"`
+	PrivPassphrase string `json:"priv_passphrase"`
+}
+
+/**
+Config for an SNMP task. `operation` is "get" (fetch each OID) or "walk" (fetch everything under each OID)
+e.g. `{"host": "10.0.0.20", "community": "public", "version": "2c", "operation": "get", "oids": [".1.3.6.1.2.1.1.3.0"]}`
+*/
+type SnmpTaskConfig struct {
+	Host      string        `json:"host"`
+	Port      uint16        `json:"port"`
+	Version   string        `json:"version"`
+	Community string        `json:"community"`
+	V3        *SnmpV3Config `json:"v3"`
+	Operation string        `json:"operation"`
+	Oids      []string      `json:"oids"`
+	Timeout   int           `json:"timeout"`
+	Retries   int           `json:"retries"`
+}
+
+/**
+A single OID value returned by a device
+*/
+type SnmpValue struct {
+	Oid   string      `json:"oid"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA256": gosnmp.SHA256,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":    gosnmp.NoPriv,
+	"DES": gosnmp.DES,
+	"AES": gosnmp.AES,
+}
+
+/**
+Get SNMP specific config for the task
+*/
+func getSnmpTaskConfig(task Task) SnmpTaskConfig {
+	var snmpConfig SnmpTaskConfig
+	err := json.Unmarshal(task.RawConfig, &snmpConfig)
+	errCheckPostback(task, err)
+	if snmpConfig.Port == 0 {
+		snmpConfig.Port = SNMP_DEFAULT_PORT
+	}
+	if snmpConfig.Version == "" {
+		snmpConfig.Version = "2c"
+	}
+	if snmpConfig.Community == "" {
+		snmpConfig.Community = "public"
+	}
+	if snmpConfig.Operation == "" {
+		snmpConfig.Operation = "get"
+	}
+	if snmpConfig.Timeout <= 0 {
+		snmpConfig.Timeout = SNMP_DEFAULT_TIMEOUT
+	}
+	if snmpConfig.Retries <= 0 {
+		snmpConfig.Retries = SNMP_DEFAULT_RETRIES
+	}
+	taskLogger(task).Debug("SNMP configuration", "host", snmpConfig.Host, "port", snmpConfig.Port, "version", snmpConfig.Version, "operation", snmpConfig.Operation, "oids", snmpConfig.Oids)
+
+	return snmpConfig
+}
+
+/**
+Build an SNMP client for the configured version and credentials
+*/
+func newSnmpClient(snmpConfig SnmpTaskConfig) (*gosnmp.GoSNMP, error) {
+	client := &gosnmp.GoSNMP{
+		Target:    snmpConfig.Host,
+		Port:      snmpConfig.Port,
+		Community: snmpConfig.Community,
+		Timeout:   time.Duration(snmpConfig.Timeout) * time.Second,
+		Retries:   snmpConfig.Retries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+
+	switch snmpConfig.Version {
+	case "1":
+		client.Version = gosnmp.Version1
+	case "2c":
+		client.Version = gosnmp.Version2c
+	case "3":
+		if snmpConfig.V3 == nil {
+			return nil, errors.New("SNMPv3 needs v3 credentials in the task config.")
+		}
+		authProtocol, ok := snmpAuthProtocols[strings.ToUpper(snmpConfig.V3.AuthProtocol)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown SNMPv3 auth protocol %s", snmpConfig.V3.AuthProtocol)
+		}
+		privProtocol, ok := snmpPrivProtocols[strings.ToUpper(snmpConfig.V3.PrivProtocol)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown SNMPv3 privacy protocol %s", snmpConfig.V3.PrivProtocol)
+		}
+
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = gosnmp.NoAuthNoPriv
+		if authProtocol != gosnmp.NoAuth {
+			client.MsgFlags = gosnmp.AuthNoPriv
+			if privProtocol != gosnmp.NoPriv {
+				client.MsgFlags = gosnmp.AuthPriv
+			}
+		}
+		client.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 snmpConfig.V3.Username,
+			AuthenticationProtocol:   authProtocol,
+			AuthenticationPassphrase: snmpConfig.V3.AuthPassphrase,
+			PrivacyProtocol:          privProtocol,
+			PrivacyPassphrase:        snmpConfig.V3.PrivPassphrase,
+		}
+	default:
+		return nil, fmt.Errorf("Unknown SNMP version %s", snmpConfig.Version)
+	}
+
+	return client, nil
+}
+
+/**
+Convert an SNMP variable to a JSON friendly value - octet strings are returned as text when printable, otherwise hex
+*/
+func snmpValue(pdu gosnmp.SnmpPDU) SnmpValue {
+	value := SnmpValue{Oid: pdu.Name, Type: pdu.Type.String(), Value: pdu.Value}
+
+	switch v := pdu.Value.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			value.Value = string(v)
+		} else {
+			value.Value = hex.EncodeToString(v)
+		}
+	}
+
+	return value
+}
+
+/**
+Run an SNMP GET or WALK against a device
+*/
+func querySnmp(snmpConfig SnmpTaskConfig) ([]SnmpValue, error) {
+	client, err := newSnmpClient(snmpConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	defer client.Conn.Close()
+
+	var pdus []gosnmp.SnmpPDU
+
+	switch snmpConfig.Operation {
+	case "get":
+		packet, err := client.Get(snmpConfig.Oids)
+		if err != nil {
+			return nil, err
+		}
+		pdus = packet.Variables
+	case "walk":
+		for _, oid := range snmpConfig.Oids {
+			var results []gosnmp.SnmpPDU
+			// GETBULK isn't available in SNMPv1
+			if client.Version == gosnmp.Version1 {
+				results, err = client.WalkAll(oid)
+			} else {
+				results, err = client.BulkWalkAll(oid)
+			}
+			if err != nil {
+				return nil, err
+			}
+			pdus = append(pdus, results...)
+			if len(pdus) > SNMP_MAX_WALK_RESULTS {
+				return nil, fmt.Errorf("SNMP walk returned more than %d values.", SNMP_MAX_WALK_RESULTS)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown SNMP operation %s", snmpConfig.Operation)
+	}
+
+	values := make([]SnmpValue, len(pdus))
+	for i, pdu := range pdus {
+		values[i] = snmpValue(pdu)
+	}
+
+	return values, nil
+}
+
+/**
+Query a network device over SNMP and POST the OID values back to the API
+*/
+func processSnmpTask(task Task) {
+
+	snmpConfig := getSnmpTaskConfig(task)
+
+	taskLogger(task).Info("Querying SNMP device")
+	values, err := querySnmp(snmpConfig)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: values,
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	SUPPORT_LOGS_DEFAULT_HOURS = 24
+)
+
+/**
+Config for a support logs task - how many hours of the connector's own log to send, e.g. `{"hours": 48}`
+*/
+type SupportLogsTaskConfig struct {
+	Hours int `json:"hours"`
+}
+
+/**
+Send the connector's recent log to the `support_logs` endpoint and POST what was sent back to the API
+*/
+func processSupportLogsTask(task Task) {
+	var logsConfig SupportLogsTaskConfig
+	if len(task.RawConfig) > 0 {
+		errCheckPostback(task, json.Unmarshal(task.RawConfig, &logsConfig))
+	}
+	if logsConfig.Hours <= 0 {
+		logsConfig.Hours = SUPPORT_LOGS_DEFAULT_HOURS
+	}
+
+	taskLogger(task).Info("Sending logs", "hours", logsConfig.Hours)
+	bundle, _, err := shipLogs(task, time.Now().Add(-time.Duration(logsConfig.Hours)*time.Hour), nil)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: bundle,
+	})
+}
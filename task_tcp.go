@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	TCP_DEFAULT_TIMEOUT = 5
+)
+
+/**
+Config for a TCP connectivity check e.g. `{"host": "sqlserver", "port": 1433, "timeout": 5}`
+*/
+type TcpTaskConfig struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Timeout int    `json:"timeout"`
+}
+
+/**
+The outcome of a TCP connectivity check - a failed connection is a valid result, not a task error
+*/
+type TcpCheckResult struct {
+	Address   string  `json:"address"`
+	Connected bool    `json:"connected"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+/**
+Get TCP check specific config for the task
+*/
+func getTcpTaskConfig(task Task) TcpTaskConfig {
+	var tcpConfig TcpTaskConfig
+	err := json.Unmarshal(task.RawConfig, &tcpConfig)
+	errCheckPostback(task, err)
+	if tcpConfig.Timeout <= 0 {
+		tcpConfig.Timeout = TCP_DEFAULT_TIMEOUT
+	}
+	taskLogger(task).Debug("TCP check configuration", "config", tcpConfig)
+
+	return tcpConfig
+}
+
+/**
+Attempt a TCP connection to host:port and time how long it takes to establish
+*/
+func checkTcpConnection(ctx context.Context, host string, port int, timeout time.Duration) TcpCheckResult {
+	result := TcpCheckResult{
+		Address: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+
+	start := time.Now()
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", result.Address)
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	conn.Close()
+	result.Connected = true
+
+	return result
+}
+
+/**
+Check TCP connectivity to a host and POST the result back to the API
+*/
+func processTcpTask(task Task) {
+
+	tcpConfig := getTcpTaskConfig(task)
+
+	taskLogger(task).Info("Checking TCP connectivity")
+	result := checkTcpConnection(task.Context(), tcpConfig.Host, tcpConfig.Port, time.Duration(tcpConfig.Timeout)*time.Second)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+/**
+WMI is only available on Windows - report that back to the API
+*/
+func processWmiTask(task Task) {
+	errCheckPostback(task, errors.New("WMI tasks are only supported on Windows."))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"runtime"
+)
+
+const (
+	WMI_DEFAULT_NAMESPACE = `root\cimv2`
+	S_FALSE               = 0x00000001
+)
+
+/**
+Config for a WMI task - the namespace to connect to, defaults to `root\cimv2`
+*/
+type WmiTaskConfig struct {
+	Namespace string `json:"namespace"`
+}
+
+/**
+Get WMI specific config for the task
+*/
+func getWmiTaskConfig(task Task) WmiTaskConfig {
+	var wmiConfig WmiTaskConfig
+	if len(task.RawConfig) > 0 {
+		err := json.Unmarshal(task.RawConfig, &wmiConfig)
+		errCheckPostback(task, err)
+	}
+	if wmiConfig.Namespace == "" {
+		wmiConfig.Namespace = WMI_DEFAULT_NAMESPACE
+	}
+	taskLogger(task).Debug("WMI configuration", "config", wmiConfig)
+
+	return wmiConfig
+}
+
+/**
+Run a WQL query e.g. `SELECT Name, Version FROM Win32_Product` and return every property of each result object
+*/
+func queryWmi(namespace string, query string) ([]map[string]interface{}, error) {
+
+	// COM is initialised per OS thread so keep this goroutine on the one thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := ole.CoInitializeEx(0, ole.COINIT_MULTITHREADED); err != nil {
+		if oleErr, ok := err.(*ole.OleError); !ok || (oleErr.Code() != ole.S_OK && oleErr.Code() != S_FALSE) {
+			return nil, err
+		}
+	}
+	defer ole.CoUninitialize()
+
+	unknown, err := oleutil.CreateObject("WbemScripting.SWbemLocator")
+	if err != nil {
+		return nil, err
+	}
+	defer unknown.Release()
+
+	locator, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		return nil, err
+	}
+	defer locator.Release()
+
+	serviceRaw, err := oleutil.CallMethod(locator, "ConnectServer", nil, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer serviceRaw.Clear()
+	wmiService := serviceRaw.ToIDispatch()
+
+	resultRaw, err := oleutil.CallMethod(wmiService, "ExecQuery", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resultRaw.Clear()
+
+	var rows []map[string]interface{}
+
+	err = oleutil.ForEach(resultRaw.ToIDispatch(), func(item *ole.VARIANT) error {
+		propsRaw, err := oleutil.GetProperty(item.ToIDispatch(), "Properties_")
+		if err != nil {
+			return err
+		}
+		defer propsRaw.Clear()
+
+		row := make(map[string]interface{})
+		err = oleutil.ForEach(propsRaw.ToIDispatch(), func(prop *ole.VARIANT) error {
+			name, err := oleutil.GetProperty(prop.ToIDispatch(), "Name")
+			if err != nil {
+				return err
+			}
+			defer name.Clear()
+
+			value, err := oleutil.GetProperty(prop.ToIDispatch(), "Value")
+			if err != nil {
+				return err
+			}
+			defer value.Clear()
+
+			row[name.ToString()] = wmiValue(value)
+			return nil
+		})
+		rows = append(rows, row)
+		return err
+	})
+
+	return rows, err
+}
+
+/**
+Convert a WMI property value to something that can be JSON encoded
+*/
+func wmiValue(v *ole.VARIANT) interface{} {
+	if v.VT&ole.VT_ARRAY != 0 {
+		return v.ToArray().ToValueArray()
+	}
+	switch v.VT {
+	case ole.VT_UNKNOWN, ole.VT_DISPATCH:
+		// Embedded objects cannot be serialised
+		return nil
+	}
+	return v.Value()
+}
+
+/**
+Execute a WQL query against the local WMI service and POST the result back to the API
+*/
+func processWmiTask(task Task) {
+
+	wmiConfig := getWmiTaskConfig(task)
+
+	taskLogger(task).Info("Executing WMI query")
+	rows, err := queryWmi(wmiConfig.Namespace, task.Payload)
+	errCheckPostback(task, err)
+
+	postJsonResponse(task, JsonResponse{
+		Type: "success",
+		Body: rows,
+	})
+}
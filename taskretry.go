@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RETRY_ON_ANY        = "any"
+	RETRY_ON_CONNECTION = "connection"
+	RETRY_ON_TIMEOUT    = "timeout"
+	RETRY_ON_DEADLOCK   = "deadlock"
+
+	TASK_RETRY_DEFAULT_BACKOFF     = 5
+	TASK_RETRY_DEFAULT_MAX_BACKOFF = 300
+)
+
+// Errors that are retried when `retry_on` isn't given
+var defaultRetryOn = []string{RETRY_ON_CONNECTION, RETRY_ON_TIMEOUT, RETRY_ON_DEADLOCK}
+
+/**
+How failed tasks of one type are retried by the connector, before the failure is reported
+e.g. `{"attempts": 3, "backoff": 5, "max_backoff": 60, "retry_on": ["connection", "deadlock"]}`
+*/
+type TaskRetryConfig struct {
+	Attempts   int      `json:"attempts"`              // runs per task, including the first
+	Backoff    int      `json:"backoff,omitempty"`     // seconds before the first retry, doubling each time, default 5
+	MaxBackoff int      `json:"max_backoff,omitempty"` // cap on the delay between runs in seconds, default 300
+	RetryOn    []string `json:"retry_on,omitempty"`    // kinds of error to retry, default connection, timeout and deadlock
+}
+
+/**
+Check the retry config only asks to retry kinds of error the connector knows about
+*/
+func (c TaskRetryConfig) Validate() error {
+	for _, class := range c.RetryOn {
+		switch class {
+		case RETRY_ON_ANY, RETRY_ON_CONNECTION, RETRY_ON_TIMEOUT, RETRY_ON_DEADLOCK:
+		default:
+			return fmt.Errorf("Unknown retry_on error class %q.", class)
+		}
+	}
+	return nil
+}
+
+/**
+Which kinds of error this is, for matching against `retry_on`
+*/
+func errorClasses(err error) []string {
+	var classes []string
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		classes = append(classes, RETRY_ON_TIMEOUT)
+	}
+	message := strings.ToLower(err.Error())
+	if isTransientError(err) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		strings.Contains(message, "connection refused") || strings.Contains(message, "connection reset") ||
+		strings.Contains(message, "broken pipe") {
+		classes = append(classes, RETRY_ON_CONNECTION)
+	}
+
+	// MySQL: 1213 deadlock, 1205 lock wait timeout. SQL Server: 1205 deadlock victim, 1222 lock request timeout.
+	var mysqlErr *mysql.MySQLError
+	var mssqlErr mssql.Error
+	switch {
+	case errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205):
+		classes = append(classes, RETRY_ON_DEADLOCK)
+	case errors.As(err, &mssqlErr) && (mssqlErr.Number == 1205 || mssqlErr.Number == 1222):
+		classes = append(classes, RETRY_ON_DEADLOCK)
+	}
+
+	return classes
+}
+
+/**
+Should a task that failed with this error be run again? Only if its type has a retry policy, the error is one the
+policy retries, and it has attempts left.
+*/
+func shouldRetryTask(task Task, err error) (TaskRetryConfig, bool) {
+	retryConfig, ok := currentConfig().TaskRetries[strconv.FormatUint(task.Type, 10)]
+	if !ok || task.Attempt+1 >= retryConfig.Attempts {
+		return retryConfig, false
+	}
+
+	retryOn := retryConfig.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	classes := errorClasses(err)
+	for _, wanted := range retryOn {
+		if wanted == RETRY_ON_ANY {
+			return retryConfig, true
+		}
+		for _, class := range classes {
+			if class == wanted {
+				return retryConfig, true
+			}
+		}
+	}
+	return retryConfig, false
+}
+
+/**
+Run a failed task again after a backoff, if its retry policy allows - the failure is only reported once it runs out
+of attempts. The retry is held like a task with `run_at`, so it survives a restart. Ends the task's goroutine if
+it's being retried.
+*/
+func retryTaskOnError(task Task, err error) {
+	retryConfig, retry := shouldRetryTask(task, err)
+	if !retry {
+		return
+	}
+
+	backoff := retryConfig.Backoff
+	if backoff <= 0 {
+		backoff = TASK_RETRY_DEFAULT_BACKOFF
+	}
+	maxBackoff := retryConfig.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = TASK_RETRY_DEFAULT_MAX_BACKOFF
+	}
+	delay := time.Duration(backoff) * time.Second << uint(task.Attempt)
+	if delay > time.Duration(maxBackoff)*time.Second || delay <= 0 {
+		delay = time.Duration(maxBackoff) * time.Second
+	}
+
+	recordTaskFailure(&task, err)
+	task.Attempt++
+	task.RunAt = time.Now().Add(delay).Format(time.RFC3339)
+	taskLogger(task).Warn("Task failed - retrying", "delay", delay.String(), "attempt", task.Attempt+1, "attempts", retryConfig.Attempts)
+	storeTask(task)
+	go dispatchTask(task)
+
+	runtime.Goexit()
+}
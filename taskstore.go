@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TASK_STORE_FILE         = "tasks.db"
+	TASK_STORE_OPEN_TIMEOUT = 5 * time.Second
+)
+
+var (
+	taskStoreTasksBucket       = []byte("tasks")
+	taskStoreOutcomesBucket    = []byte("outcomes")
+	taskStoreDeadLettersBucket = []byte("dead_letters")
+	taskStoreResultsBucket     = []byte("results")
+)
+
+// Tasks that have been accepted but not yet reported on, kept on disk so a restart or crash doesn't lose them.
+// nil if the store couldn't be opened, in which case tasks are only kept in memory.
+var (
+	taskStore     *bolt.DB
+	taskStoreOnce sync.Once
+)
+
+/**
+A task as kept in the task store
+*/
+type storedTask struct {
+	Task     Task   `json:"task"`
+	Schedule string `json:"schedule,omitempty"`
+	Started  bool   `json:"started"`
+}
+
+/**
+How a finished task turned out, as kept in the task store for tasks that depend on it
+*/
+type storedOutcome struct {
+	Success    bool            `json:"success"`
+	Body       json.RawMessage `json:"body"`
+	FinishedAt time.Time       `json:"finished_at"`
+}
+
+/**
+The task store, opened the first time it's needed
+*/
+func getTaskStore() *bolt.DB {
+	taskStoreOnce.Do(func() {
+		path := filepath.Join(stateDir(), TASK_STORE_FILE)
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: TASK_STORE_OPEN_TIMEOUT})
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
+				for _, bucket := range [][]byte{taskStoreTasksBucket, taskStoreOutcomesBucket, taskStoreDeadLettersBucket, taskStoreResultsBucket} {
+					if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			logger.Error("Task store not opened - tasks will not survive a restart", "error", err)
+			return
+		}
+		taskStore = db
+	})
+	return taskStore
+}
+
+/**
+Write a value to a bucket of the task store, or delete it if `value` is nil. Failures are logged - the task carries
+on either way.
+*/
+func putTaskStore(bucket []byte, key string, value interface{}) {
+	db := getTaskStore()
+	if db == nil {
+		return
+	}
+
+	var data []byte
+	if value != nil {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			logger.Error("Task store write failed", "error", err)
+			return
+		}
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if data == nil {
+			return tx.Bucket(bucket).Delete([]byte(key))
+		}
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		logger.Error("Task store write failed", "error", err)
+	}
+}
+
+/**
+Keep an accepted task until it's been reported on
+*/
+func storeTask(task Task) {
+	putTaskStore(taskStoreTasksBucket, task.Id, storedTask{Task: task, Schedule: task.schedule})
+}
+
+/**
+Note a stored task has started, so it's reported as interrupted rather than run again if the connector stops
+before it finishes
+*/
+func markTaskStarted(task Task) {
+	putTaskStore(taskStoreTasksBucket, task.Id, storedTask{Task: task, Schedule: task.schedule, Started: true})
+}
+
+/**
+Drop a task from the store once its result has been sent
+*/
+func forgetStoredTask(id string) {
+	putTaskStore(taskStoreTasksBucket, id, nil)
+}
+
+/**
+Keep how a task turned out, for tasks that depend on it
+*/
+func storeTaskOutcome(id string, outcome taskOutcome) {
+	body, err := json.Marshal(outcome.body)
+	if err != nil {
+		body = nil
+	}
+	putTaskStore(taskStoreOutcomesBucket, id, storedOutcome{Success: outcome.success, Body: body, FinishedAt: time.Now()})
+}
+
+/**
+Drop a task's outcome once it's too old to keep
+*/
+func forgetTaskOutcome(id string) {
+	putTaskStore(taskStoreOutcomesBucket, id, nil)
+}
+
+/**
+Pick up where the connector left off when it last stopped: the outcomes of recent tasks are remembered again,
+tasks that were waiting are queued, and tasks that were running are reported as interrupted - running them again
+could repeat work that was half done.
+*/
+func loadStoredTasks() error {
+	db := getTaskStore()
+	if db == nil {
+		return nil
+	}
+
+	var tasks []storedTask
+	outcomes := map[string]storedOutcome{}
+	err := db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(taskStoreTasksBucket).ForEach(func(key, value []byte) error {
+			var stored storedTask
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			tasks = append(tasks, stored)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(taskStoreOutcomesBucket).ForEach(func(key, value []byte) error {
+			var outcome storedOutcome
+			if err := json.Unmarshal(value, &outcome); err != nil {
+				return err
+			}
+			outcomes[string(key)] = outcome
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Oldest first, so the newest are the ones kept
+	ids := make([]string, 0, len(outcomes))
+	for id := range outcomes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return outcomes[ids[i]].FinishedAt.Before(outcomes[ids[j]].FinishedAt)
+	})
+	if len(ids) > DEPENDENCY_RESULTS_KEPT {
+		for _, id := range ids[:len(ids)-DEPENDENCY_RESULTS_KEPT] {
+			forgetTaskOutcome(id)
+		}
+		ids = ids[len(ids)-DEPENDENCY_RESULTS_KEPT:]
+	}
+	dependencyLock.Lock()
+	for _, id := range ids {
+		var body interface{}
+		json.Unmarshal(outcomes[id].Body, &body)
+		taskOutcomes[id] = taskOutcome{success: outcomes[id].Success, body: body}
+		taskOutcomeOrder = append(taskOutcomeOrder, id)
+	}
+	dependencyLock.Unlock()
+
+	if len(tasks) > 0 {
+		logger.Info("Picking up tasks from before the connector stopped", "count", len(tasks))
+	}
+	go func() {
+		for _, stored := range tasks {
+			task := stored.Task
+			task.schedule = stored.Schedule
+			if stored.Started {
+				taskLogger(task).Warn("Task was interrupted")
+				postStoppedResult(task, "interrupted", "The connector stopped while the task was running", nil)
+				continue
+			}
+			dispatchTask(task)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pkcs12"
+	"io/ioutil"
+)
+
+/**
+TLS settings for connections to the task API
+e.g. `{"client_cert": "C:\\goproxy\\client.crt", "client_key": "C:\\goproxy\\client.key", "server_name": "tasks.digistorm.com.au"}`
+*/
+type TlsConfig struct {
+	ClientCert           string   `json:"client_cert,omitempty"`            // PEM certificate (with any intermediates) to present to the API
+	ClientKey            string   `json:"client_key,omitempty"`             // PEM private key for `client_cert`
+	ClientPkcs12         string   `json:"client_pkcs12,omitempty"`          // or a .p12/.pfx bundle holding both
+	ClientPkcs12Password string   `json:"client_pkcs12_password,omitempty"` // password for `client_pkcs12`
+	ServerName           string   `json:"server_name,omitempty"`            // name the API certificate must be issued to, if not the URL host
+	CaFile               string   `json:"ca_file,omitempty"`                // PEM bundle of CAs to trust for the API instead of the system pool
+	PinSha256            []string `json:"pin_sha256,omitempty"`             // base64 SHA-256 of public keys (SPKI), one must appear in the API's chain
+}
+
+/**
+Load the client certificate from a PKCS#12 bundle
+*/
+func loadPkcs12Certificate(path string, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var certPem, keyPem bytes.Buffer
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(&certPem, block)
+		} else {
+			pem.Encode(&keyPem, block)
+		}
+	}
+
+	return tls.X509KeyPair(certPem.Bytes(), keyPem.Bytes())
+}
+
+/**
+Make sure one of the certificates presented by the server has a pinned public key - a TLS intercepting proxy
+can get its CA trusted, but it can't present the API's real key
+*/
+func checkPublicKeyPins(certs []*x509.Certificate, pins []string) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		fingerprint := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if fingerprint == pin {
+				return nil
+			}
+		}
+	}
+
+	if len(certs) == 0 {
+		return errors.New("The API presented no certificate to check against the pinned keys.")
+	}
+	sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	return fmt.Errorf("The API certificate for %s (key %s) does not match any pinned key - the connection may be intercepted.",
+		certs[0].Subject, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+/**
+Build the TLS config for connections to the task API from the `tls` config
+*/
+func apiTlsConfig() (*tls.Config, error) {
+	config := currentConfig()
+	tlsConfig := &tls.Config{}
+	if config.Tls == nil {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ServerName = config.Tls.ServerName
+
+	if config.Tls.CaFile != "" {
+		caPem, err := ioutil.ReadFile(config.Tls.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No certificates found in %s.", config.Tls.CaFile)
+		}
+	}
+
+	if len(config.Tls.PinSha256) > 0 {
+		pins := config.Tls.PinSha256
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkPublicKeyPins(state.PeerCertificates, pins)
+		}
+	}
+
+	switch {
+	case config.Tls.ClientPkcs12 != "":
+		cert, err := loadPkcs12Certificate(config.Tls.ClientPkcs12, config.Tls.ClientPkcs12Password)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case config.Tls.ClientCert != "":
+		if config.Tls.ClientKey == "" {
+			return nil, errors.New("A client_key is needed with the client_cert.")
+		}
+		cert, err := tls.LoadX509KeyPair(config.Tls.ClientCert, config.Tls.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
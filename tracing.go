@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TRACING_DEFAULT_SERVICE = "goproxy"
+	TRACING_EXPORT_PATH     = "/v1/traces"
+	TRACING_EXPORT_INTERVAL = 5 * time.Second
+	TRACING_EXPORT_TIMEOUT  = 10 * time.Second
+	TRACING_MAX_QUEUED      = 2048 // spans kept while the collector can't be reached - the oldest are dropped after this
+
+	// OTLP span kinds and status codes
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT   = 3
+	SPAN_STATUS_OK     = 1
+	SPAN_STATUS_ERROR  = 2
+)
+
+/**
+Where to send traces, e.g. `{"endpoint": "http://otel-collector:4318", "headers": {"x-api-key": "..."}}`
+*/
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`               // OTLP/HTTP collector, `/v1/traces` is added if there's no path
+	Headers     map[string]string `json:"headers,omitempty"`      // sent with every export, e.g. for authentication
+	ServiceName string            `json:"service_name,omitempty"` // `service.name` of the spans, goproxy by default
+}
+
+/**
+Check the endpoint is an HTTP URL
+*/
+func (t *TracingConfig) Validate() error {
+	if t.Endpoint == "" {
+		return errors.New("tracing.endpoint must be set, e.g. http://otel-collector:4318.")
+	}
+	if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing.endpoint %q must be an http or https URL.", t.Endpoint)
+	}
+	return nil
+}
+
+/**
+One timed step of a task. Each task has a trace of its own, whose ID comes from the task ID so the server can find
+it: a `task` span from being polled to its result being posted, with `poll`, `execute`, `serialize` and `postback`
+spans under it.
+*/
+type traceSpan struct {
+	traceId    [16]byte
+	spanId     [8]byte
+	parentId   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+var (
+	tracingLock  sync.Mutex
+	tracedSpans  []*traceSpan             // finished spans waiting to be exported
+	tracedStarts = map[string]time.Time{} // when each task's `task` span started
+)
+
+/**
+Is tracing turned on?
+*/
+func isTracing() bool {
+	config := currentConfig()
+	return config.Tracing != nil && config.Tracing.Endpoint != ""
+}
+
+/**
+The trace ID for a task - the first 16 bytes of a SHA-256 of its ID, so the same task always has the same trace
+*/
+func taskTraceId(task Task) (traceId [16]byte) {
+	sum := sha256.Sum256([]byte(task.Id))
+	copy(traceId[:], sum[:16])
+	return traceId
+}
+
+/**
+The ID of a task's `task` span, which its other spans hang off - worked out rather than stored, so any step can
+find it. Each attempt at the task gets its own.
+*/
+func taskRootSpanId(task Task) (spanId [8]byte) {
+	sum := sha256.Sum256([]byte(task.Id + "#" + strconv.Itoa(task.Attempt)))
+	copy(spanId[:], sum[:8])
+	return spanId
+}
+
+/**
+Key for a task attempt in `tracedStarts`
+*/
+func taskTraceKey(task Task) string {
+	return task.Id + "#" + strconv.Itoa(task.Attempt)
+}
+
+/**
+W3C `traceparent` for a request made by a task, so the server's own spans join the task's trace
+*/
+func taskTraceParent(task Task) string {
+	traceId, spanId := taskTraceId(task), taskRootSpanId(task)
+	return "00-" + hex.EncodeToString(traceId[:]) + "-" + hex.EncodeToString(spanId[:]) + "-01"
+}
+
+/**
+Start a span under a task's `task` span - nil when tracing is off, which `finish` ignores
+*/
+func startTaskSpan(task Task, name string, kind int) *traceSpan {
+	if !isTracing() {
+		return nil
+	}
+	span := &traceSpan{
+		traceId:    taskTraceId(task),
+		parentId:   taskRootSpanId(task),
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{"task.id": task.Id, "task.type": task.Type},
+	}
+	rand.Read(span.spanId[:])
+	tracingLock.Lock()
+	if _, ok := tracedStarts[taskTraceKey(task)]; !ok {
+		tracedStarts[taskTraceKey(task)] = span.start
+	}
+	tracingLock.Unlock()
+	return span
+}
+
+/**
+Add an attribute to a span
+*/
+func (s *traceSpan) setAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+/**
+End a span, and queue it for export
+*/
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	tracingLock.Lock()
+	defer tracingLock.Unlock()
+	tracedSpans = append(tracedSpans, s)
+	if len(tracedSpans) > TRACING_MAX_QUEUED {
+		tracedSpans = tracedSpans[len(tracedSpans)-TRACING_MAX_QUEUED:]
+	}
+}
+
+/**
+Start a task's trace once it's accepted. A polled task's trace starts with the poll that fetched it.
+*/
+func traceTaskReceived(task Task) {
+	if !isTracing() {
+		return
+	}
+	if task.polledAt.IsZero() {
+		startTaskSpan(task, "receive", SPAN_KIND_INTERNAL).finish(nil)
+		return
+	}
+	span := startTaskSpan(task, "poll", SPAN_KIND_CLIENT)
+	span.start = task.polledAt
+	tracingLock.Lock()
+	tracedStarts[taskTraceKey(task)] = task.polledAt
+	tracingLock.Unlock()
+	span.finish(nil)
+}
+
+/**
+End a task's trace with its `task` span, once its result has been posted - or has failed to be
+*/
+func traceTaskFinished(task Task, outcome string, posted bool) {
+	if !isTracing() {
+		return
+	}
+	span := startTaskSpan(task, "task", SPAN_KIND_INTERNAL)
+	span.spanId, span.parentId = taskRootSpanId(task), [8]byte{}
+	tracingLock.Lock()
+	span.start = tracedStarts[taskTraceKey(task)]
+	delete(tracedStarts, taskTraceKey(task))
+	tracingLock.Unlock()
+	span.setAttribute("task.outcome", outcome)
+	if task.schedule != "" {
+		span.setAttribute("task.schedule", task.schedule)
+	}
+	var err error
+	if outcome != "success" {
+		err = fmt.Errorf("Task finished with %s", outcome)
+	}
+	if !posted {
+		err = errors.New("The result could not be posted")
+	}
+	span.finish(err)
+}
+
+/**
+An OTLP attribute - strings, numbers and booleans are all that's needed
+*/
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var typed map[string]interface{}
+	switch v := value.(type) {
+	case bool:
+		typed = map[string]interface{}{"boolValue": v}
+	case int:
+		typed = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		typed = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		typed = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	default:
+		typed = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return map[string]interface{}{"key": key, "value": typed}
+}
+
+/**
+An OTLP/JSON export request for spans
+*/
+func otlpTraceRequest(spans []*traceSpan) map[string]interface{} {
+	serviceName := currentConfig().Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = TRACING_DEFAULT_SERVICE
+	}
+	hostname, _ := os.Hostname()
+	resource := []interface{}{
+		otlpAttribute("service.name", serviceName),
+		otlpAttribute("service.version", version),
+		otlpAttribute("host.name", hostname),
+	}
+	if profileFlag != "" {
+		resource = append(resource, otlpAttribute("goproxy.profile", profileFlag))
+	}
+
+	var encoded []interface{}
+	for _, s := range spans {
+		var attributes []interface{}
+		for key, value := range s.attributes {
+			attributes = append(attributes, otlpAttribute(key, value))
+		}
+		status := map[string]interface{}{"code": SPAN_STATUS_OK}
+		if s.err != "" {
+			status = map[string]interface{}{"code": SPAN_STATUS_ERROR, "message": s.err}
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceId[:]),
+			"spanId":            hex.EncodeToString(s.spanId[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            status,
+		}
+		if s.parentId != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentId[:])
+		}
+		encoded = append(encoded, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": TRACING_DEFAULT_SERVICE, "version": version},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+/**
+The collector URL to POST traces to
+*/
+func tracingExportUrl() string {
+	endpoint := strings.TrimRight(currentConfig().Tracing.Endpoint, "/")
+	if u, err := url.Parse(endpoint); err == nil && u.Path == "" {
+		endpoint += TRACING_EXPORT_PATH
+	}
+	return endpoint
+}
+
+/**
+Send the finished spans to the collector. Spans that can't be sent are put back to try again with the next lot.
+*/
+func exportTraces() error {
+	if !isTracing() {
+		return nil
+	}
+	tracingLock.Lock()
+	spans := tracedSpans
+	tracedSpans = nil
+	tracingLock.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err := postTraces(spans)
+	if err != nil {
+		tracingLock.Lock()
+		tracedSpans = append(spans, tracedSpans...)
+		if len(tracedSpans) > TRACING_MAX_QUEUED {
+			tracedSpans = tracedSpans[len(tracedSpans)-TRACING_MAX_QUEUED:]
+		}
+		tracingLock.Unlock()
+	}
+	return err
+}
+
+/**
+POST spans to the collector as OTLP/JSON
+*/
+func postTraces(spans []*traceSpan) error {
+	payload, err := json.Marshal(otlpTraceRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", tracingExportUrl(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range currentConfig().Tracing.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: TRACING_EXPORT_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Exporting traces failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+/**
+Export spans every few seconds while the connector runs
+*/
+func runTraceExporter() {
+	logger.Info("Exporting traces", "url", tracingExportUrl())
+	for {
+		time.Sleep(TRACING_EXPORT_INTERVAL)
+		if err := exportTraces(); err != nil {
+			logger.Warn("Exporting traces failed", "error", err)
+		}
+	}
+}
+
+/**
+Export whatever spans are left, on the way out
+*/
+func flushTraces() {
+	if err := exportTraces(); err != nil {
+		logger.Warn("Exporting traces failed", "error", err)
+	}
+}
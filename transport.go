@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PUSH_MAX_BACKOFF = 60 * time.Second
+)
+
+// 1 while a push transport is connected - polling is paused until it drops
+var pushConnected int32
+
+/**
+Is a push transport currently delivering tasks?
+*/
+func isPushConnected() bool {
+	return atomic.LoadInt32(&pushConnected) == 1
+}
+
+/**
+Mark the push transport as connected or disconnected
+*/
+func setPushConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&pushConnected, 1)
+	} else {
+		atomic.StoreInt32(&pushConnected, 0)
+	}
+}
+
+/**
+Keep a push transport connected, reconnecting with backoff whenever it drops.
+`listen` should block for as long as its connection is up. While it's down the regular poll picks up tasks instead.
+*/
+func runPushTransport(name string, listen func() error) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := listen()
+		logger.Warn("Push transport disconnected, falling back to polling", "transport", name, "error", err)
+
+		// Only back off further if the connection didn't stay up for long
+		if time.Since(start) > PUSH_MAX_BACKOFF {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > PUSH_MAX_BACKOFF {
+			backoff = PUSH_MAX_BACKOFF
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	GRPC_CONNECT_METHOD         = "/digistorm.goproxy.v1.TaskService/Connect"
+	GRPC_RESULT_CHUNK_SIZE      = 1024 * 1024
+	GRPC_FIELD_HELLO            = 1
+	GRPC_FIELD_ACK              = 2
+	GRPC_FIELD_RESULT           = 3
+	GRPC_FIELD_SERVER_TASK      = 1
+	GRPC_FIELD_SERVER_CONTROL   = 2
+	GRPC_FIELD_TASK_ID          = 1
+	GRPC_FIELD_TASK_TYPE        = 2
+	GRPC_FIELD_TASK_PAYLOAD     = 3
+	GRPC_FIELD_TASK_CONFIG      = 4
+	GRPC_FIELD_TASK_TIMEOUT     = 5
+	GRPC_FIELD_TASK_PRIORITY    = 6
+	GRPC_FIELD_TASK_RUN_AT      = 7
+	GRPC_FIELD_TASK_DEPENDS_ON  = 8
+	GRPC_FIELD_TASK_PASS_RESULT = 9
+	GRPC_FIELD_CONTROL_CONTROL  = 1
+	GRPC_FIELD_CONTROL_TASK_ID  = 2
+	GRPC_FIELD_CONTROL_SCHEDULE = 3
+)
+
+// Returned when the stream a task arrived on is gone, so its result is POSTed instead
+var errStreamGone = errors.New("Stream closed")
+
+/**
+An already encoded protobuf message - see proto/tasks.proto for the schema
+*/
+type wireMessage struct {
+	data []byte
+}
+
+/**
+gRPC codec that passes pre-encoded messages straight through, so we don't need generated protobuf code
+*/
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(*wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot encode %T for gRPC.", v)
+	}
+	return message.data, nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*wireMessage)
+	if !ok {
+		return fmt.Errorf("Cannot decode gRPC message into %T.", v)
+	}
+	message.data = append([]byte(nil), data...)
+	return nil
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+/**
+Wrap an encoded message in the AgentMessage oneof
+*/
+func encodeAgentMessage(field protowire.Number, message []byte) *wireMessage {
+	var b []byte
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	b = protowire.AppendBytes(b, message)
+	return &wireMessage{data: b}
+}
+
+/**
+Hello - sent when the stream opens
+*/
+func encodeGrpcHello() *wireMessage {
+	hostname, _ := os.Hostname()
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, version)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, hostname)
+	return encodeAgentMessage(GRPC_FIELD_HELLO, b)
+}
+
+/**
+TaskAck - sent when a task is received
+*/
+func encodeGrpcAck(taskId string) *wireMessage {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, taskId)
+	return encodeAgentMessage(GRPC_FIELD_ACK, b)
+}
+
+/**
+TaskResult - one chunk of a task's JSON encoded result
+*/
+func encodeGrpcResult(taskId string, resultType string, body []byte, chunk int, last bool) *wireMessage {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, taskId)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, resultType)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, body)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(chunk))
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, protowire.EncodeBool(last))
+	return encodeAgentMessage(GRPC_FIELD_RESULT, b)
+}
+
+/**
+Walk the fields of an encoded message, skipping any we don't know about
+*/
+func consumeGrpcFields(b []byte, field func(num protowire.Number, typ protowire.Type, value []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		used := field(num, typ, b)
+		if used == 0 {
+			used = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if used < 0 {
+			return protowire.ParseError(used)
+		}
+		b = b[used:]
+	}
+	return nil
+}
+
+/**
+Decode a ServerMessage - a task, or a control message as a Task with `control` set. Returns false if it carries
+neither.
+*/
+func decodeGrpcTask(data []byte) (Task, bool, error) {
+	var task Task
+	var found bool
+
+	err := consumeGrpcFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if typ != protowire.BytesType || (num != GRPC_FIELD_SERVER_TASK && num != GRPC_FIELD_SERVER_CONTROL) {
+			return 0
+		}
+		message, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		found = true
+
+		decodeField := decodeGrpcTaskField
+		if num == GRPC_FIELD_SERVER_CONTROL {
+			decodeField = decodeGrpcControlField
+		}
+		err := consumeGrpcFields(message, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			return decodeField(&task, num, typ, b)
+		})
+		if err != nil {
+			return -1
+		}
+		return n
+	})
+	if err != nil {
+		return task, false, errors.New("Invalid gRPC task message: " + err.Error())
+	}
+	if task.Control != "" {
+		return task, found, nil
+	}
+
+	return task, found && task.Id != "", nil
+}
+
+/**
+Decode a field of a Task message - returns how much of `b` it used, 0 for a field we don't know
+*/
+func decodeGrpcTaskField(task *Task, num protowire.Number, typ protowire.Type, b []byte) int {
+	switch {
+	case num == GRPC_FIELD_TASK_ID && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.Id = value
+		return n
+	case num == GRPC_FIELD_TASK_TYPE && typ == protowire.VarintType:
+		value, n := protowire.ConsumeVarint(b)
+		task.Type = value
+		return n
+	case num == GRPC_FIELD_TASK_PAYLOAD && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.Payload = value
+		return n
+	case num == GRPC_FIELD_TASK_CONFIG && typ == protowire.BytesType:
+		value, n := protowire.ConsumeBytes(b)
+		task.RawConfig = append(json.RawMessage(nil), value...)
+		return n
+	case num == GRPC_FIELD_TASK_TIMEOUT && typ == protowire.VarintType:
+		value, n := protowire.ConsumeVarint(b)
+		task.Timeout = int(int32(value))
+		return n
+	case num == GRPC_FIELD_TASK_PRIORITY && typ == protowire.VarintType:
+		value, n := protowire.ConsumeVarint(b)
+		task.Priority = int(int32(value))
+		return n
+	case num == GRPC_FIELD_TASK_RUN_AT && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.RunAt = value
+		return n
+	case num == GRPC_FIELD_TASK_DEPENDS_ON && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.DependsOn = value
+		return n
+	case num == GRPC_FIELD_TASK_PASS_RESULT && typ == protowire.VarintType:
+		value, n := protowire.ConsumeVarint(b)
+		task.PassResult = protowire.DecodeBool(value)
+		return n
+	}
+	return 0
+}
+
+/**
+Decode a field of a Control message into the Task that carries it
+*/
+func decodeGrpcControlField(task *Task, num protowire.Number, typ protowire.Type, b []byte) int {
+	switch {
+	case num == GRPC_FIELD_CONTROL_CONTROL && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.Control = value
+		return n
+	case num == GRPC_FIELD_CONTROL_TASK_ID && typ == protowire.BytesType:
+		value, n := protowire.ConsumeString(b)
+		task.TargetId = value
+		return n
+	case num == GRPC_FIELD_CONTROL_SCHEDULE && typ == protowire.BytesType:
+		value, n := protowire.ConsumeBytes(b)
+		if n >= 0 {
+			task.Schedule = new(ScheduleConfig)
+			if err := json.Unmarshal(value, task.Schedule); err != nil {
+				return -1
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+/**
+The gRPC server address and credentials - `push_url` as grpc://host:port (plaintext) or grpcs://host:port (TLS),
+defaulting to the API host
+*/
+func grpcTarget() (string, credentials.TransportCredentials, error) {
+	rawUrl := currentConfig().PushUrl
+	if rawUrl == "" {
+		rawUrl = apiUrl()
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	target := u.Host
+	switch u.Scheme {
+	case "grpcs", "https":
+		if u.Port() == "" {
+			target += ":443"
+		}
+		tlsConfig, err := apiTlsConfig()
+		if err != nil {
+			return "", nil, err
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		return target, credentials.NewTLS(tlsConfig), nil
+	case "grpc", "http":
+		if u.Port() == "" {
+			target += ":80"
+		}
+		return target, insecure.NewCredentials(), nil
+	}
+
+	return "", nil, fmt.Errorf("Unsupported gRPC URL scheme %q.", u.Scheme)
+}
+
+/**
+Open a Connect stream to the task server and process tasks as they are pushed, streaming results back
+on the same connection, until the stream drops
+*/
+func listenGrpc() error {
+	config := currentConfig()
+	target, creds, err := grpcTarget()
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})),
+	}
+	if config.Proxy != nil && config.Proxy.Url != "" {
+		options = append(options, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialProxy(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.NewClient(target, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	header, err := apiAuthHeaders("POST", GRPC_CONNECT_METHOD, nil)
+	if err != nil {
+		return err
+	}
+	var pairs []string
+	for name, values := range header {
+		pairs = append(pairs, strings.ToLower(name), values[0])
+	}
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), pairs...))
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "Connect",
+		ServerStreams: true,
+		ClientStreams: true,
+	}, GRPC_CONNECT_METHOD)
+	if err != nil {
+		return err
+	}
+
+	// Tasks run concurrently but a stream only allows one sender at a time. A stream can't be sent on again once a
+	// send fails, and the tasks from it may still be running after it's gone, so their results go by HTTP instead.
+	var sendLock sync.Mutex
+	closed := false
+	defer func() {
+		sendLock.Lock()
+		closed = true
+		sendLock.Unlock()
+	}()
+	send := func(message *wireMessage) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if closed {
+			return errStreamGone
+		}
+		if err := stream.SendMsg(message); err != nil {
+			closed = true
+			return fmt.Errorf("%w: %v", errStreamGone, err)
+		}
+		return nil
+	}
+
+	if err := send(encodeGrpcHello()); err != nil {
+		return err
+	}
+
+	logger.Info("gRPC stream connected, waiting for tasks")
+	setPushConnected(true)
+	defer setPushConnected(false)
+
+	// Pick up anything created while we were disconnected
+	checkForTasks()
+
+	for {
+		var message wireMessage
+		if err := stream.RecvMsg(&message); err != nil {
+			return err
+		}
+
+		task, found, err := decodeGrpcTask(message.data)
+		if err != nil {
+			logger.Warn("Ignoring gRPC message", "error", err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if task.Control != "" {
+			queueTask(task)
+			continue
+		}
+
+		taskLogger(task).Info("Task pushed", "transport", TRANSPORT_GRPC)
+
+		if err := send(encodeGrpcAck(task.Id)); err != nil {
+			return err
+		}
+
+		task.respond = func(response JsonResponse) error {
+			body, err := json.Marshal(response.Body)
+			if err != nil {
+				return err
+			}
+			for chunk := 0; ; chunk++ {
+				size := len(body)
+				if size > GRPC_RESULT_CHUNK_SIZE {
+					size = GRPC_RESULT_CHUNK_SIZE
+				}
+				last := size == len(body)
+				if err := send(encodeGrpcResult(response.TaskId, response.Type, body[:size], chunk, last)); err != nil {
+					return err
+				}
+				body = body[size:]
+				if last {
+					return nil
+				}
+			}
+		}
+		queueTask(task)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	LONG_POLL_DEFAULT_WAIT = 30
+	LONG_POLL_GRACE        = 15 * time.Second
+)
+
+/**
+How long the server may hold a long poll open, in seconds
+*/
+func longPollWait() int {
+	if wait := currentConfig().LongPollWait; wait > 0 {
+		return wait
+	}
+	return LONG_POLL_DEFAULT_WAIT
+}
+
+/**
+Fetch tasks back to back, letting the server hold each request open for up to `long_poll_wait` seconds
+until a task is ready. Falls back to waiting `interval` seconds between requests when a request fails,
+or when the server answers straight away without holding the request.
+*/
+func runLongPollTransport() {
+	for !isShuttingDown() {
+		start := time.Now()
+		logger.Debug("Waiting for tasks")
+
+		tasks, err := getPendingTasks()
+		recordPollResult(err == nil)
+		recordPollOutcome(err)
+		switch {
+		case err == nil:
+			for _, task := range tasks {
+				queueTask(task)
+			}
+		case err == errNoTasks && time.Since(start) > time.Second:
+			// The server held the request open and nothing came up - ask again straight away
+		default:
+			// Failed, or an instant empty response meaning the server isn't holding requests - don't hammer it
+			logger.Error("Checking for tasks failed", "error", err)
+			time.Sleep(nextPollDelay())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"os"
+	"time"
+)
+
+const (
+	MQTT_DEFAULT_QOS     = 1
+	MQTT_CONNECT_TIMEOUT = 30 * time.Second
+)
+
+/**
+Broker connection details for the MQTT transport
+e.g. `{"broker": "ssl://mqtt.example.com:8883", "task_topic": "digistorm/school-1/tasks", "username": "school-1", "password": "..."}`
+*/
+type MqttConfig struct {
+	Broker        string `json:"broker"`
+	TaskTopic     string `json:"task_topic"`
+	ResponseTopic string `json:"response_topic,omitempty"` // defaults to `task_topic` + "/responses"
+	ClientId      string `json:"client_id,omitempty"`      // defaults to "goproxy-" + hostname
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Qos           *byte  `json:"qos,omitempty"`
+}
+
+/**
+Fill in defaults for anything left out of the MQTT config
+*/
+func getMqttConfig() (MqttConfig, error) {
+	config := currentConfig()
+	if config.Mqtt == nil || config.Mqtt.Broker == "" || config.Mqtt.TaskTopic == "" {
+		return MqttConfig{}, errors.New("The MQTT transport needs a broker and task_topic in the mqtt config.")
+	}
+
+	mqttConfig := *config.Mqtt
+	if mqttConfig.ResponseTopic == "" {
+		mqttConfig.ResponseTopic = mqttConfig.TaskTopic + "/responses"
+	}
+	if mqttConfig.ClientId == "" {
+		hostname, _ := os.Hostname()
+		mqttConfig.ClientId = "goproxy-" + hostname
+	}
+	if mqttConfig.Qos == nil {
+		qos := byte(MQTT_DEFAULT_QOS)
+		mqttConfig.Qos = &qos
+	}
+
+	return mqttConfig, nil
+}
+
+/**
+Connect to the MQTT broker and process tasks published to the task topic, publishing results to the
+response topic, until the connection drops
+*/
+func listenMqtt() error {
+	mqttConfig, err := getMqttConfig()
+	if err != nil {
+		return err
+	}
+	qos := *mqttConfig.Qos
+
+	lost := make(chan error, 1)
+	options := mqtt.NewClientOptions().
+		AddBroker(mqttConfig.Broker).
+		SetClientID(mqttConfig.ClientId).
+		SetUsername(mqttConfig.Username).
+		SetPassword(mqttConfig.Password).
+		// Keep our subscription while we're offline so the broker queues tasks for us
+		SetCleanSession(false).
+		// Reconnects are handled by runPushTransport so polling can take over in between
+		SetAutoReconnect(false).
+		SetConnectTimeout(MQTT_CONNECT_TIMEOUT).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			lost <- err
+		})
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		return token.Error()
+	}
+	defer client.Disconnect(250)
+
+	respond := func(response JsonResponse) error {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		token := client.Publish(mqttConfig.ResponseTopic, qos, false, payload)
+		token.Wait()
+		return token.Error()
+	}
+
+	token = client.Subscribe(mqttConfig.TaskTopic, qos, func(client mqtt.Client, message mqtt.Message) {
+		var task Task
+		if err := json.Unmarshal(message.Payload(), &task); err != nil || (task.Id == "" && task.Control == "") {
+			logger.Warn("Ignoring MQTT message", "message", string(message.Payload()))
+			return
+		}
+
+		taskLogger(task).Info("Task received", "transport", TRANSPORT_MQTT)
+		task.respond = respond
+		queueTask(task)
+	})
+	token.Wait()
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	logger.Info("MQTT connected, waiting for tasks", "topic", mqttConfig.TaskTopic)
+	setPushConnected(true)
+	defer setPushConnected(false)
+
+	// Pick up anything created while we were disconnected
+	checkForTasks()
+
+	return <-lost
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"time"
+)
+
+const (
+	SQS_WAIT_SECONDS      = 20
+	SQS_MAX_MESSAGES      = 10
+	SQS_MAX_MESSAGE_SIZE  = 256 * 1024
+	SQS_REQUEST_TIMEOUT   = 60 * time.Second
+	SQS_RESULT_S3_POINTER = "s3_result"
+)
+
+/**
+Queue and credentials for the SQS transport. Credentials fall back to the usual AWS chain (environment,
+shared config, instance role) when no keys are given.
+e.g. `{"region": "ap-southeast-2", "queue_url": "https://sqs.ap-southeast-2.amazonaws.com/123456789012/school-1-tasks", "result_queue_url": "...", "result_bucket": "school-1-results"}`
+*/
+type SqsConfig struct {
+	Region          string `json:"region"`
+	QueueUrl        string `json:"queue_url"`
+	ResultQueueUrl  string `json:"result_queue_url,omitempty"`
+	ResultBucket    string `json:"result_bucket,omitempty"` // results go here when there's no result queue, or they're too big for one
+	ResultPrefix    string `json:"result_prefix,omitempty"`
+	AccessKeyId     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+}
+
+/**
+Load the AWS config for the SQS transport - static keys from our config, or the default credential chain
+*/
+func getSqsAwsConfig(sqsConfig SqsConfig) (aws.Config, error) {
+	options := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(sqsConfig.Region),
+	}
+	if sqsConfig.AccessKeyId != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(sqsConfig.AccessKeyId, sqsConfig.SecretAccessKey, ""),
+		))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SQS_REQUEST_TIMEOUT)
+	defer cancel()
+	return awsconfig.LoadDefaultConfig(ctx, options...)
+}
+
+/**
+Send a task result to the result queue, storing it in S3 instead when it's too big for a message
+(or there's no queue), with a pointer to the object sent to the queue
+*/
+func publishSqsResult(sqsClient *sqs.Client, s3Client *s3.Client, sqsConfig SqsConfig, response JsonResponse) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SQS_REQUEST_TIMEOUT)
+	defer cancel()
+
+	if sqsConfig.ResultBucket != "" && (sqsConfig.ResultQueueUrl == "" || len(payload) > SQS_MAX_MESSAGE_SIZE) {
+		key := sqsConfig.ResultPrefix + response.TaskId + ".json"
+		_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(sqsConfig.ResultBucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(payload),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info("Result stored in S3", "task_id", response.TaskId, "key", key)
+		if sqsConfig.ResultQueueUrl == "" {
+			return nil
+		}
+
+		payload, err = json.Marshal(JsonResponse{
+			TaskId: response.TaskId,
+			Type:   SQS_RESULT_S3_POINTER,
+			Body:   map[string]string{"bucket": sqsConfig.ResultBucket, "key": key, "type": response.Type},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(sqsConfig.ResultQueueUrl),
+		MessageBody: aws.String(string(payload)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"task_id": {DataType: aws.String("String"), StringValue: aws.String(response.TaskId)},
+		},
+	})
+	return err
+}
+
+/**
+Long-poll the SQS task queue and process each task, sending results to the result queue or S3,
+until a receive fails
+*/
+func listenSqs() error {
+	config := currentConfig()
+	if config.Sqs == nil || config.Sqs.QueueUrl == "" {
+		return errors.New("The SQS transport needs a queue_url in the sqs config.")
+	}
+	sqsConfig := *config.Sqs
+	if sqsConfig.ResultQueueUrl == "" && sqsConfig.ResultBucket == "" {
+		return errors.New("The SQS transport needs a result_queue_url or result_bucket in the sqs config.")
+	}
+
+	awsConfig, err := getSqsAwsConfig(sqsConfig)
+	if err != nil {
+		return err
+	}
+	sqsClient := sqs.NewFromConfig(awsConfig)
+	s3Client := s3.NewFromConfig(awsConfig)
+
+	respond := func(response JsonResponse) error {
+		return publishSqsResult(sqsClient, s3Client, sqsConfig, response)
+	}
+
+	connected := false
+	defer setPushConnected(false)
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), SQS_REQUEST_TIMEOUT)
+		output, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(sqsConfig.QueueUrl),
+			MaxNumberOfMessages: SQS_MAX_MESSAGES,
+			WaitTimeSeconds:     SQS_WAIT_SECONDS,
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if !connected {
+			logger.Info("SQS connected, receiving tasks", "queue_url", sqsConfig.QueueUrl)
+			setPushConnected(true)
+			connected = true
+		}
+
+		for _, message := range output.Messages {
+			// The task is ours once it's received - its result goes to the result queue either way
+			ctx, cancel := context.WithTimeout(context.Background(), SQS_REQUEST_TIMEOUT)
+			_, err := sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(sqsConfig.QueueUrl),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			cancel()
+			if err != nil {
+				return err
+			}
+
+			var task Task
+			if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &task); err != nil || (task.Id == "" && task.Control == "") {
+				logger.Warn("Ignoring SQS message", "message", aws.ToString(message.Body))
+				continue
+			}
+
+			taskLogger(task).Info("Task received", "transport", TRANSPORT_SQS)
+			task.respond = respond
+			queueTask(task)
+		}
+	}
+}
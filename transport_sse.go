@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SSE_IDLE_TIMEOUT = 90 * time.Second
+)
+
+// ID of the last event received, sent back on reconnect so the server can replay anything we missed
+var sseLastEventId string
+
+/**
+The SSE URL to connect to - `push_url` from the config, or `events` under the API URL
+*/
+func sseUrl() (string, error) {
+	config := currentConfig()
+	if config.PushUrl != "" {
+		return config.PushUrl, nil
+	}
+
+	u, err := url.Parse(apiUrl())
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/events"
+
+	return u.String(), nil
+}
+
+/**
+Subscribe to the task server's event stream and fetch a task whenever one is announced, until the stream drops
+*/
+func listenSse() error {
+	streamUrl, err := sseUrl()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", streamUrl, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if err := authenticateRequest(req, nil); err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if sseLastEventId != "" {
+		req.Header.Set("Last-Event-ID", sseLastEventId)
+	}
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+	// The stream stays open indefinitely - the idle timer below notices if it dies
+	client = withRequestTimeout(client, 0)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Event stream returned %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return fmt.Errorf("Event stream returned unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	logger.Info("Event stream connected, waiting for tasks")
+	setPushConnected(true)
+	defer setPushConnected(false)
+
+	// The server sends comments to keep the stream alive - give up on it if it goes quiet
+	idle := time.AfterFunc(SSE_IDLE_TIMEOUT, cancel)
+	defer idle.Stop()
+
+	// Pick up anything created while we were disconnected
+	checkForTasks()
+
+	var eventType, data string
+	var hasData bool
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(SSE_IDLE_TIMEOUT)
+		line := scanner.Text()
+
+		// A blank line dispatches the event, if it had any data
+		if line == "" {
+			switch {
+			case hasData && (eventType == "" || eventType == "task"):
+				logger.Info("Task announced")
+				checkForTasks()
+			case eventType == CONTROL_CANCEL:
+				// The data is the ID of the task to cancel
+				handleControlMessage(Task{Control: CONTROL_CANCEL, TargetId: data})
+			}
+			eventType, data, hasData = "", "", false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data, hasData = value, true
+		case "id":
+			sseLastEventId = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Event stream closed by the server")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	WEBSOCKET_PONG_WAIT   = 60 * time.Second
+	WEBSOCKET_PING_PERIOD = 50 * time.Second
+)
+
+/**
+The WebSocket URL to connect to - `push_url` from the config, or `ws` under the API URL
+*/
+func webSocketUrl() (string, error) {
+	config := currentConfig()
+	if config.PushUrl != "" {
+		return config.PushUrl, nil
+	}
+
+	u, err := url.Parse(apiUrl())
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+
+	return u.String(), nil
+}
+
+/**
+Connect to the task server's WebSocket and process tasks as they are pushed, until the connection drops
+*/
+func listenWebSocket() error {
+	config := currentConfig()
+	wsUrl, err := webSocketUrl()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(wsUrl)
+	if err != nil {
+		return err
+	}
+	header, err := apiAuthHeaders("GET", u.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := apiTlsConfig()
+	if err != nil {
+		return err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	if config.Proxy != nil && config.Proxy.Url != "" {
+		dialer.Proxy = nil
+		dialer.NetDialContext = dialProxy
+	}
+
+	conn, _, err := dialer.Dial(wsUrl, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	logger.Info("WebSocket connected, waiting for tasks")
+	setPushConnected(true)
+	defer setPushConnected(false)
+
+	// Ping the server regularly and expect a pong back, so a dead connection is noticed
+	conn.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_WAIT))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(WEBSOCKET_PING_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Pick up anything created while we were disconnected
+	checkForTasks()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var task Task
+		if err := json.Unmarshal(message, &task); err != nil || (task.Id == "" && task.Control == "") {
+			logger.Warn("Ignoring WebSocket message", "message", string(message))
+			continue
+		}
+
+		taskLogger(task).Info("Task pushed", "transport", TRANSPORT_WEBSOCKET)
+		queueTask(task)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	UPLOAD_DEFAULT_CHUNK_SIZE = 5 * 1024 * 1024
+	UPLOAD_MAX_RESUMES        = 5
+)
+
+/**
+Summary of a file uploaded to the API in chunks
+*/
+type UploadResult struct {
+	Bytes  int64  `json:"bytes"`
+	Chunks int    `json:"chunks"`
+	Sha256 string `json:"sha256"`
+}
+
+/**
+How much of a task's upload the API already has, so an interrupted upload can carry on from there
+*/
+type UploadStatus struct {
+	Offset   int64 `json:"offset"`
+	Chunks   int   `json:"chunks"`
+	Complete bool  `json:"complete"`
+}
+
+/**
+Ask the API how much of a task's upload it has received. A 404 means nothing has arrived yet.
+*/
+func getUploadStatus(task Task) (UploadStatus, error) {
+	var status UploadStatus
+
+	query := url.Values{}
+	query.Set("task", task.Id)
+	query.Set("status", "1")
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return status, err
+	}
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		statusUrl, err := apiEndpointWithQuery(ENDPOINT_UPLOAD, task, query)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("GET", statusUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return status, err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return status, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return status, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("Upload status check failed: %s", resp.Status)
+	}
+	if err := verifyResponse(req, resp, body); err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+/**
+POST a single chunk of a task's upload to the API
+*/
+func uploadChunk(task Task, index int, offset int64, chunk []byte, last bool) error {
+	checksum := sha256.Sum256(chunk)
+
+	query := url.Values{}
+	query.Set("task", task.Id)
+	query.Set("chunk", strconv.Itoa(index))
+
+	client, err := apiHttpClient()
+	if err != nil {
+		return err
+	}
+
+	req, resp, err := doWithRetry(client, func() (*http.Request, error) {
+		uploadUrl, err := apiEndpointWithQuery(ENDPOINT_UPLOAD, task, query)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", uploadUrl, bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticateRequest(req, chunk); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Digistorm-Chunk-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("X-Digistorm-Chunk-Sha256", hex.EncodeToString(checksum[:]))
+		if last {
+			req.Header.Set("X-Digistorm-Chunk-Last", "1")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Chunk %d upload failed: %s", index, resp.Status)
+	}
+	if err := verifyResponse(req, resp, body); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+Upload a file to the API in chunks of `chunkSize` bytes. If the connection drops part way through, the API is asked
+how much it has and the upload carries on from there, up to `UPLOAD_MAX_RESUMES` times.
+*/
+func uploadFile(task Task, filePath string, chunkSize int64) (UploadResult, error) {
+	if chunkSize <= 0 {
+		chunkSize = UPLOAD_DEFAULT_CHUNK_SIZE
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	progress := newProgressReporter(task, "uploading", info.Size())
+
+	// A fresh upload starts from zero without asking
+	var status UploadStatus
+	for resumes := 0; ; resumes++ {
+		result, err := uploadFrom(task, file, info.Size(), chunkSize, status, progress)
+		if err == nil {
+			return result, nil
+		}
+		// A cancelled or timed out task isn't resumed
+		if resumes >= UPLOAD_MAX_RESUMES || task.Context().Err() != nil {
+			return result, err
+		}
+
+		delay := retryDelay(getRetryConfig(), resumes)
+		taskLogger(task).Warn("Upload interrupted - resuming", "bytes", result.Bytes, "size", info.Size(), "error", err, "delay", delay.Round(time.Millisecond).String())
+		select {
+		case <-task.Context().Done():
+			return result, task.Context().Err()
+		case <-time.After(delay):
+		}
+
+		status, err = getUploadStatus(task)
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+/**
+Upload the rest of a file, starting from what the API already has
+*/
+func uploadFrom(task Task, file *os.File, size int64, chunkSize int64, status UploadStatus, progress *ProgressReporter) (UploadResult, error) {
+	var result UploadResult
+
+	// Only trust the API's offset if it fits the file - otherwise start again
+	if status.Offset < 0 || status.Offset > size || (status.Offset == size && !status.Complete) {
+		status = UploadStatus{}
+	}
+	if status.Offset > 0 {
+		taskLogger(task).Info("Resuming upload", "offset", status.Offset, "chunks", status.Chunks)
+	}
+
+	// The checksum covers the whole file, so the part already sent is read back through it
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	if _, err := io.CopyN(hash, file, status.Offset); err != nil {
+		return result, err
+	}
+	result.Bytes = status.Offset
+	result.Chunks = status.Chunks
+
+	chunk := make([]byte, chunkSize)
+
+	for !status.Complete {
+		if err := task.Context().Err(); err != nil {
+			return result, err
+		}
+		n, err := io.ReadFull(file, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return result, err
+		}
+		if n == 0 && result.Chunks > 0 {
+			break
+		}
+
+		last := result.Bytes+int64(n) >= size
+		if err := uploadChunk(task, result.Chunks, result.Bytes, chunk[:n], last); err != nil {
+			return result, err
+		}
+		hash.Write(chunk[:n])
+		result.Bytes += int64(n)
+		auditTaskUploaded(task, int64(n))
+		result.Chunks++
+		progress.Update(0, result.Bytes)
+
+		if last {
+			break
+		}
+	}
+
+	result.Sha256 = hex.EncodeToString(hash.Sum(nil))
+
+	return result, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	VALIDATE_MAX_INTERVAL    = 3600
+	VALIDATE_REQUEST_TIMEOUT = 15 * time.Second
+)
+
+/**
+The outcome of one check in a config report
+*/
+type validationCheck struct {
+	name   string
+	err    error
+	detail string
+}
+
+/**
+Check the config thoroughly and print a pass/fail line for each check, for `-validate` - so a site install can be
+checked up front rather than failing at runtime. Returns whether every check passed.
+*/
+func validateConfiguration() bool {
+	checks := []validationCheck{
+		{name: "Config file", detail: fmt.Sprintf("%s (%s)", configFilePath, configFormat(configFilePath))},
+		checkConfigDir(),
+		checkRegistryConfig(),
+		{name: "Config", err: validateConfig()},
+		checkApiKeyFormat(),
+		checkInterval(),
+		checkConfigPermissions(),
+		checkStateDirectory(),
+	}
+	checks = append(checks, checkApiUrls()...)
+	for _, dir := range allowedDirs() {
+		checks = append(checks, checkAllowedDir(dir))
+	}
+
+	passed := true
+	for _, check := range checks {
+		status := "PASS"
+		detail := check.detail
+		if check.err != nil {
+			status = "FAIL"
+			detail = check.err.Error()
+			passed = false
+		}
+		fmt.Printf("%s  %-22s %s\n", status, check.name, detail)
+	}
+	if passed {
+		fmt.Println("Config is valid.")
+	} else {
+		fmt.Println("Config has problems.")
+	}
+	return passed
+}
+
+/**
+The drop-in files merged over the config file, if there are any
+*/
+func checkConfigDir() validationCheck {
+	check := validationCheck{name: "Config drop-ins"}
+	files, err := configDirFiles()
+	switch {
+	case err != nil:
+		check.err = err
+	case len(files) == 0:
+		check.detail = "none in " + configDirPath()
+	default:
+		names := make([]string, len(files))
+		for i, file := range files {
+			names[i] = filepath.Base(file)
+		}
+		check.detail = fmt.Sprintf("%s merged from %s", strings.Join(names, ", "), configDirPath())
+	}
+	return check
+}
+
+/**
+Settings pushed to the registry, which win over the files
+*/
+func checkRegistryConfig() validationCheck {
+	check := validationCheck{name: "Registry config"}
+	values, err := readRegistryConfig()
+	switch {
+	case runtime.GOOS != "windows":
+		check.detail = "not used outside Windows"
+	case err != nil:
+		check.err = err
+	case values == nil:
+		check.detail = `none at HKLM\` + REGISTRY_CONFIG_KEY
+	default:
+		check.detail = fmt.Sprintf(`%d settings from HKLM\%s`, len(values), REGISTRY_CONFIG_KEY)
+	}
+	return check
+}
+
+/**
+The API key has to look like one the server issues, unless OAuth2 is used instead
+*/
+func checkApiKeyFormat() validationCheck {
+	config := currentConfig()
+	check := validationCheck{name: "API key"}
+	switch {
+	case config.OAuth2 != nil && config.ApiKey == "":
+		check.detail = "not used - OAuth2 is configured"
+	case config.ApiKey == "":
+		check.err = fmt.Errorf("no key - set one with -key or enroll with -enroll")
+	case !validApiKey.MatchString(config.ApiKey):
+		check.err = fmt.Errorf("not a valid key - expected 16 to 256 letters, digits, - or _")
+	default:
+		check.detail = "key " + apiKeyId()
+		if config.KeyProtected != "" {
+			check.detail += ", protected"
+		}
+	}
+	return check
+}
+
+/**
+The poll interval has to be sensible - too short hammers the API, too long leaves tasks waiting
+*/
+func checkInterval() validationCheck {
+	config := currentConfig()
+	check := validationCheck{name: "Interval"}
+	switch {
+	case config.Interval < 1 || config.Interval > VALIDATE_MAX_INTERVAL:
+		check.err = fmt.Errorf("%d seconds is outside 1 to %d", config.Interval, VALIDATE_MAX_INTERVAL)
+	case config.MinInterval > config.Interval:
+		check.err = fmt.Errorf("min_interval %d is longer than interval %d", config.MinInterval, config.Interval)
+	default:
+		check.detail = fmt.Sprintf("%d seconds", config.Interval)
+	}
+	return check
+}
+
+/**
+The config file holds the key, so only its owner should be able to read it unless it's encrypted. Windows
+permissions aren't file modes, so this is only checked elsewhere.
+*/
+func checkConfigPermissions() validationCheck {
+	config := currentConfig()
+	check := validationCheck{name: "Config permissions"}
+	info, err := os.Stat(configFilePath)
+	data, _ := ioutil.ReadFile(configFilePath)
+	switch {
+	case os.IsNotExist(err):
+		check.detail = "no config file - configured from the environment"
+	case err != nil:
+		check.err = err
+	case isEncryptedConfig(data):
+		check.detail = "encrypted with a passphrase"
+	case runtime.GOOS == "windows":
+		check.detail = "not checked on Windows"
+	case info.Mode().Perm()&0077 != 0 && config.ApiKey != "" && config.KeyProtected == "":
+		check.err = fmt.Errorf("%s holds the API key but can be read by others - chmod 600 it", info.Mode().Perm())
+	default:
+		check.detail = info.Mode().Perm().String()
+	}
+	return check
+}
+
+/**
+The task store, schedules and pause marker are written to the state directory
+*/
+func checkStateDirectory() validationCheck {
+	check := validationCheck{name: "State directory"}
+	dir := stateDir()
+	file, err := ioutil.TempFile(dir, ".validate-*")
+	if err != nil {
+		check.err = fmt.Errorf("%s is not writable: %v", dir, err)
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+	check.detail = dir + " is writable"
+	return check
+}
+
+/**
+Each API URL has to be a valid http(s) URL the connector can reach - any response will do, as this isn't a
+signed request
+*/
+func checkApiUrls() []validationCheck {
+	config := currentConfig()
+	if len(config.Url) == 0 {
+		return []validationCheck{{name: "API URL", err: fmt.Errorf("no url configured")}}
+	}
+
+	client, clientErr := apiHttpClient()
+	var checks []validationCheck
+	for _, apiUrl := range config.Url {
+		check := validationCheck{name: "API URL"}
+		u, err := url.Parse(apiUrl)
+		switch {
+		case err != nil:
+			check.err = fmt.Errorf("%s is not a valid URL: %v", apiUrl, err)
+		case u.Scheme != "https" && u.Scheme != "http":
+			check.err = fmt.Errorf("%s must start with https:// or http://", apiUrl)
+		case clientErr != nil:
+			check.err = fmt.Errorf("%s: %v", apiUrl, clientErr)
+		default:
+			check.detail, check.err = probeUrl(client, apiUrl)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+/**
+See whether a URL answers at all
+*/
+func probeUrl(client *http.Client, probeUrl string) (string, error) {
+	client = withRequestTimeout(client, VALIDATE_REQUEST_TIMEOUT)
+	resp, err := client.Get(probeUrl)
+	if err != nil {
+		return "", fmt.Errorf("%s is not reachable: %v", probeUrl, err)
+	}
+	closeResponse(resp)
+	if u, _ := url.Parse(probeUrl); u.Scheme == "http" {
+		return fmt.Sprintf("%s answered %s - plain http sends the key unencrypted", probeUrl, resp.Status), nil
+	}
+	return fmt.Sprintf("%s answered %s", probeUrl, resp.Status), nil
+}
+
+/**
+Directories file tasks may read from have to exist
+*/
+func checkAllowedDir(dir string) validationCheck {
+	check := validationCheck{name: "Allowed dir"}
+	info, err := os.Stat(dir)
+	switch {
+	case err != nil:
+		check.err = fmt.Errorf("%s: %v", dir, err)
+	case !info.IsDir():
+		check.err = fmt.Errorf("%s is not a directory", dir)
+	default:
+		check.detail = dir
+	}
+	return check
+}
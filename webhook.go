@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WEBHOOK_MAX_BODY  = 10 * 1024 * 1024
+	WEBHOOK_MAX_SKEW  = 5 * time.Minute
+	WEBHOOK_TASK_PATH = "/tasks"
+)
+
+/**
+A local HTTPS listener a server on the school network can push tasks to, instead of waiting for the next poll
+e.g. `{"listen": "10.0.0.5:8443", "cert_file": "C:\\goproxy\\webhook.crt", "key_file": "C:\\goproxy\\webhook.key", "secret": "..."}`
+*/
+type WebhookConfig struct {
+	Listen   string `json:"listen"`    // address and port to listen on - give an interface address rather than 0.0.0.0
+	CertFile string `json:"cert_file"` // PEM certificate for the listener
+	KeyFile  string `json:"key_file"`  // PEM private key for `cert_file`
+	Secret   string `json:"secret"`    // shared secret pushes are signed with
+}
+
+/**
+Check the webhook config has everything the listener needs
+*/
+func (w *WebhookConfig) Validate() error {
+	if w.Listen == "" || w.CertFile == "" || w.KeyFile == "" {
+		return errors.New("The webhook listener needs listen, cert_file and key_file.")
+	}
+	if len(w.Secret) < 16 {
+		return errors.New("The webhook secret must be at least 16 characters.")
+	}
+	return nil
+}
+
+/**
+Check a push was signed with the webhook secret: `X-Digistorm-Signature` must be the hex
+HMAC-SHA256(secret, timestamp \n sha256(body)), with `X-Digistorm-Timestamp` within a few minutes of now
+*/
+func checkWebhookSignature(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get("X-Digistorm-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Missing or invalid timestamp.")
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > WEBHOOK_MAX_SKEW || skew < -WEBHOOK_MAX_SKEW {
+		return errors.New("Timestamp is too far from our clock.")
+	}
+
+	mac := hmac.New(sha256.New, []byte(currentConfig().Webhook.Secret))
+	mac.Write([]byte(timestamp + "\n" + bodyHash(body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Digistorm-Signature"))) {
+		return errors.New("Signature does not match.")
+	}
+	return nil
+}
+
+/**
+Take a pushed task, or batch of tasks, and run it. An empty body just means "check for tasks now".
+Results go back to the API the same way as polled tasks.
+*/
+func handleWebhookTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, WEBHOOK_MAX_BODY))
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	}
+	if err := checkWebhookSignature(r, body); err != nil {
+		logger.Warn("Webhook rejected push", "event_id", EVENT_WEBHOOK_AUTH_REJECTED, "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if len(body) == 0 {
+		checkForTasks()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	tasks, err := parseTasks(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, task := range tasks {
+		taskLogger(task).Info("Task pushed", "transport", "webhook")
+		queueTask(task)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/**
+Run the webhook listener until it fails. Polling (or the configured transport) carries on alongside it.
+*/
+func runWebhookListener() {
+	config := currentConfig()
+	certificate, err := tls.LoadX509KeyPair(config.Webhook.CertFile, config.Webhook.KeyFile)
+	if err != nil {
+		logger.Error("Webhook listener not started", "error", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(WEBHOOK_TASK_PATH, handleWebhookTask)
+
+	server := &http.Server{
+		Addr:    config.Webhook.Listen,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+
+	logger.Info("Webhook listening", "url", "https://"+config.Webhook.Listen+WEBHOOK_TASK_PATH)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		logger.Error("Webhook listener stopped", "error", err)
+	}
+}
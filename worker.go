@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_CONCURRENCY  = 1
+	DEFAULT_QUEUE_SIZE   = 100
+	DEFAULT_TASK_TIMEOUT = 600
+	TASK_ABANDON_GRACE   = 30 * time.Second
+)
+
+// Tasks waiting for a worker, started on first use with `concurrency` workers pulling from it
+var (
+	taskQueue     *TaskQueue
+	taskQueueOnce sync.Once
+)
+
+// Tasks being run right now, and when the last one started (Unix nanoseconds) - reported in heartbeats
+var (
+	tasksRunning  int32
+	lastTaskStart int64
+)
+
+/**
+How many tasks can run at once
+*/
+func getConcurrency() int {
+	config := currentConfig()
+	if config.Concurrency <= 0 {
+		return DEFAULT_CONCURRENCY
+	}
+	return config.Concurrency
+}
+
+/**
+The task queue, with its workers started the first time it's needed
+*/
+func getTaskQueue() *TaskQueue {
+	taskQueueOnce.Do(func() {
+		queueSize := currentConfig().QueueSize
+		if queueSize <= 0 {
+			queueSize = DEFAULT_QUEUE_SIZE
+		}
+		taskQueue = newTaskQueue(queueSize)
+
+		for i := 0; i < getConcurrency(); i++ {
+			go runWorker(taskQueue)
+		}
+	})
+	return taskQueue
+}
+
+/**
+Accept a task delivered by the server and queue it - see `dispatchTask`. Control messages are handled straight away
+instead, and duplicate deliveries of a task aren't run again.
+*/
+func queueTask(task Task) {
+	// Control messages arrive the same way as tasks, but are acted on straight away
+	if task.Control != "" {
+		handleControlMessage(task)
+		return
+	}
+
+	if isDuplicateTask(task) {
+		return
+	}
+	auditTaskReceived(task)
+	traceTaskReceived(task)
+	storeTask(task)
+	dispatchTask(task)
+}
+
+/**
+Add an accepted task to the queue for the next free worker, ahead of any with a lower `priority` - blocks while the
+queue is full. Tasks with a `run_at` time or a prerequisite are held until they're due.
+*/
+func dispatchTask(task Task) {
+	if isShuttingDown() {
+		postStoppedResult(task, "interrupted", "The connector is shutting down", nil)
+		return
+	}
+	if task.RunAt != "" && deferTask(task) {
+		return
+	}
+	if task.DependsOn != "" {
+		var ready bool
+		if task, ready = resolveDependency(task); !ready {
+			return
+		}
+	}
+
+	registerQueuedTask(task.Id)
+	getTaskQueue().Push(task, taskSerialKey(task), func() {
+		taskLogger(task).Warn("Task queue is full - waiting for a free worker")
+	})
+}
+
+/**
+Is there no room for more work? Polling carries on while workers are busy, so urgent tasks can get into the queue
+ahead of the backlog.
+*/
+func tasksBusy() bool {
+	return getTaskQueue().Full()
+}
+
+/**
+Run tasks from the queue one at a time, for as long as the connector runs, holding off while processing is paused
+*/
+func runWorker(queue *TaskQueue) {
+	defer capturePanic()
+	for {
+		waitWhilePaused()
+		task, key := queue.Pop()
+		// Paused while this worker was waiting for a task
+		waitWhilePaused()
+		func() {
+			// A crash outside the task itself loses this task, but not the worker
+			defer recoverPanic("worker")
+			runTask(task)
+		}()
+		queue.Done(key)
+	}
+}
+
+/**
+What a task must not run alongside - tasks against the same database run one after another to avoid fighting over
+locks, while tasks against different databases run in parallel. Empty for tasks that can run alongside anything.
+*/
+func taskSerialKey(task Task) string {
+	var dbConfig DBTaskConfig
+	if json.Unmarshal(task.RawConfig, &dbConfig) != nil || dbConfig.resolveAlias() != nil || dbConfig.Dsn == "" {
+		return ""
+	}
+	return "dsn:" + dbConfig.Dsn
+}
+
+/**
+How long a task may run for - its own `timeout` if it has one, then the `timeout` for its database, otherwise
+`task_timeout`. 0 means no limit.
+*/
+func getTaskTimeout(task Task) time.Duration {
+	seconds := task.Timeout
+	if section := taskDbSection(task); seconds == 0 && section != nil {
+		seconds = section.Timeout
+	}
+	if seconds == 0 {
+		seconds = currentConfig().TaskTimeout
+	}
+	if seconds == 0 {
+		seconds = DEFAULT_TASK_TIMEOUT
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/**
+Run a function in a goroutine of its own and wait for it, so an `errCheck` inside only ends that goroutine
+*/
+func runAndWait(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverPanic("result")
+		f()
+	}()
+	<-done
+}
+
+/**
+Send the result for a task that was stopped before it finished
+*/
+func postStoppedResult(task Task, responseType string, message string, extra map[string]interface{}) {
+	body := map[string]interface{}{"message": message}
+	for name, value := range extra {
+		body[name] = value
+	}
+	runAndWait(func() {
+		postJsonResponse(task, JsonResponse{Type: responseType, Body: body})
+	})
+}
+
+/**
+Run a task and wait for it to finish. Tasks that fail bail out of their goroutine with `runtime.Goexit`, so each one
+gets a goroutine of its own and the worker carries on to the next.
+If the task runs out of time, the server cancels it or the connector shuts down, its context is cancelled, a
+timeout, cancelled or interrupted result is sent in its place, and after a grace period the worker moves on without it.
+*/
+func runTask(task Task) {
+	atomic.AddInt32(&tasksRunning, 1)
+	defer atomic.AddInt32(&tasksRunning, -1)
+
+	task.responded = new(int32)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if isShuttingDown() {
+		postStoppedResult(task, "interrupted", "The connector shut down before the task started", nil)
+		return
+	}
+	if !registerRunningTask(task.Id, cancel) {
+		taskLogger(task).Info("Task was cancelled before it started")
+		postStoppedResult(task, "cancelled", "Task was cancelled by the server before it started", nil)
+		return
+	}
+	defer unregisterRunningTask(task.Id)
+	markTaskStarted(task)
+
+	// Wait for the task's type to be under its rate limit - the timeout starts once it's allowed to run
+	release, err := acquireTypeLimit(ctx, task)
+	if err != nil {
+		if isShuttingDown() {
+			postStoppedResult(task, "interrupted", "The connector shut down before the task started", nil)
+		} else {
+			postStoppedResult(task, "cancelled", "Task was cancelled by the server before it started", nil)
+		}
+		return
+	}
+	defer release()
+	recordLastTask(task)
+	auditTaskStarted(task)
+	task.startedAt = time.Now()
+
+	timeout := getTaskTimeout(task)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	task.ctx = ctx
+
+	taskLogger(task).Info("Task started")
+	dumpTask(task)
+	start := time.Now()
+	execute := startTaskSpan(task, "execute", SPAN_KIND_INTERNAL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverTaskPanic(task)
+		processTask(task)
+	}()
+
+	select {
+	case <-done:
+		taskLogger(task).Info("Task finished", durationField(start))
+	case <-ctx.Done():
+	}
+	recordTaskDuration(task, time.Since(start))
+	execute.finish(ctx.Err())
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		taskLogger(task).Warn("Task timed out", "event_id", EVENT_TASK_TIMED_OUT, durationField(start))
+		postStoppedResult(task, "timeout", fmt.Sprintf("Task did not finish within %s", timeout), map[string]interface{}{
+			"timeout": int(timeout.Seconds()),
+		})
+	case context.Canceled:
+		if isShuttingDown() {
+			// The connector is about to exit - no point waiting for the task to wind down
+			taskLogger(task).Warn("Task was interrupted", durationField(start))
+			postStoppedResult(task, "interrupted", "The connector shut down while the task was running", nil)
+			return
+		}
+		taskLogger(task).Info("Task was cancelled", durationField(start))
+		postStoppedResult(task, "cancelled", "Task was cancelled by the server", nil)
+	default:
+		return
+	}
+
+	// Give the task a chance to notice it was cancelled and clean up
+	select {
+	case <-done:
+	case <-time.After(TASK_ABANDON_GRACE):
+		taskLogger(task).Warn("Task is still running - leaving it behind")
+	}
+}